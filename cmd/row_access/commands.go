@@ -0,0 +1,1097 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charlie-gallagher/go-row-access-policies/rowaccess"
+	"github.com/spf13/pflag"
+)
+
+// A rowctrl subcommand
+//
+// The command definitions are the single source of the CLI: they drive
+// argument parsing, the help for each command and the man page.
+type command struct {
+	// The words that run the command, e.g. "list roles"
+	name string
+	// The positional arguments, with optional ones in brackets
+	args []string
+	// A one-line summary
+	summary string
+	// Paragraphs separated by blank lines, wrapped when printed
+	description string
+	// The flag that ran the command before rowctrl had subcommands, which
+	// still works
+	alias string
+	// Takes --db
+	db bool
+	// Opens the store given by --db before running
+	store bool
+	// Prints with a formatter, and takes --format and --output
+	output bool
+	// The default --format, if not json
+	default_format string
+	// Adds the command's own flags
+	flags func(fs *pflag.FlagSet, opts *options)
+	run   func(ctx context.Context, inv *invocation) error
+}
+
+// The values of every flag a command can take
+type options struct {
+	help      bool
+	db        string
+	verbose   bool
+	sync      bool
+	yes       bool
+	dry_run   bool
+	effective bool
+	user      string
+	combine   string
+	match     string
+	color     string
+	format    string
+	output    string
+	sort      string
+	split     string
+}
+
+// A command being run, with its arguments and where to write
+type invocation struct {
+	args   []string
+	opts   options
+	store  rowaccess.PolicyStore
+	out    *formatter
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// Every command, in the order they are documented
+//
+// It is filled in by init, as the help command refers back to it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "load",
+			args:    []string{"CONFIG..."},
+			summary: "load configs and users into the store",
+			description: `Load policy configurations from JSON configuration files into the
+store, replacing the policy of every role in each file. The files must
+conform to the JSON schema built into rowctrl (see print-schema), or be
+written in the policy language (see fmt).
+
+A config may also list users and the roles they are members of, and a file
+ending in .csv is read as users alone, with a user,role header and a row
+for each membership. Loading a user replaces their memberships; users not
+in the files are left alone, even with --sync, though a sync removes every
+membership in a role it deletes or that the files do not define.
+
+Each file is streamed into the database one role at a time, in a single
+transaction: if any role fails to load, nothing from that file is changed.
+Files are loaded in order, and loading stops at the first that fails.
+Every policy is also checked for problems the schema cannot express (a role
+listed twice, a column repeated within a role or with an empty name, a
+column with no values, and __all__ mixed with other values). Each problem
+is reported with its JSON pointer, e.g. /policies/3/policy/1/values.
+
+Loading is additive: roles already in the store that are not in the files
+are left alone. With --sync (or --prune) the store is made to match the
+files exactly, in one transaction: every role they do not define is
+deleted. The files are read whole rather than streamed, and a role defined
+in more than one of them is an error. The roles to be deleted are listed
+first, and rowctrl asks before deleting them; without a terminal to ask
+on, --yes must be given to confirm.
+
+With --dry-run nothing is changed. Instead the difference the load would
+make is printed: the roles it would add and remove (only with --sync),
+for each changed role the columns and values it would gain or lose, and
+the users it would add or whose roles it would change. Lines start with +
+for what would be added, - for what would be removed and ~ for what would
+change. --format json prints the same diff for programs. rowctrl exits
+with status 2 if there would be changes, 0 if there would be none and 1 on
+error, so CI can gate changes to configs on it.`,
+			alias: "--load CONFIG",
+			db:    true,
+			store: true,
+			flags: func(fs *pflag.FlagSet, opts *options) {
+				fs.BoolVarP(&opts.verbose, "verbose", "v", false, "report what was written and the load throughput on standard error")
+				fs.BoolVar(&opts.sync, "sync", false, "delete every role the files do not define")
+				fs.BoolVar(&opts.sync, "prune", false, "same as --sync")
+				fs.BoolVarP(&opts.yes, "yes", "y", false, "delete roles with --sync without asking")
+				fs.BoolVarP(&opts.dry_run, "dry-run", "n", false, "print what would change instead of loading")
+				diffFlags(fs, opts)
+			},
+			run: runLoad,
+		},
+		{
+			name:    "get",
+			args:    []string{"[ROLE...]"},
+			summary: "print the policy of roles or a user",
+			description: `Retrieve and print the access policy for the role. In the sql format
+this is the condition a query's WHERE clause needs to show the role only the
+rows it may see.
+
+A role may extend others, and by default only its own columns are printed.
+With --effective the roles it extends are resolved: its own columns replace
+the same columns of the roles it extends, every other column is inherited,
+and a column more than one of them has comes from the first listed. The
+roles it extends are resolved the same way first. It is an error if a role
+in the chain does not exist.
+
+Given more than one role, the policy they have together is printed, with
+the roles each value came from. With --user USER instead of roles, the
+roles are those the user is a member of, and a user with no roles sees
+nothing. Each role is resolved as with --effective, and the roles are
+combined in the database's mode (see combine-mode) or the mode --combine
+gives.
+
+In an intersection a row is visible only if every role would show it: a
+column is restricted by every role that lists it, and a value survives only
+if each of those roles grants it by name or with __all__. In a union a row
+is visible if any role would show it: roles that differ in one column are
+merged, and that column allows every value any of them allows, or is
+__all__ if some role leaves it out or grants __all__. Other roles are kept
+as separate sets of columns, which are ORed. Roles that see nothing add
+nothing to a union.
+
+The dsl format cannot show where values came from, and is not supported
+for combined policies.`,
+			alias:  "--get ROLE",
+			db:     true,
+			store:  true,
+			output: true,
+			flags: func(fs *pflag.FlagSet, opts *options) {
+				fs.BoolVar(&opts.effective, "effective", false, "resolve the roles the role extends")
+				fs.StringVar(&opts.user, "user", "", "print the combined policy of the roles of `USER`")
+				fs.StringVar(&opts.combine, "combine", "", "combine roles in `MODE`, intersection or union, instead of the database's mode")
+			},
+			run: runGet,
+		},
+		{
+			name:        "list roles",
+			summary:     "list every role",
+			description: `Print the name of every role in the store, in order.`,
+			db:          true,
+			store:       true,
+			output:      true,
+			run:         runListRoles,
+		},
+		{
+			name:        "list users",
+			summary:     "list every user",
+			description: `Print the name of every user in the store, in order.`,
+			db:          true,
+			store:       true,
+			output:      true,
+			run:         runListUsers,
+		},
+		{
+			name:    "list columns",
+			summary: "list every control column",
+			description: `Print the name of every control column that some role has a grant on,
+in order.`,
+			db:     true,
+			store:  true,
+			output: true,
+			run:    runListColumns,
+		},
+		{
+			name:    "delete role",
+			args:    []string{"ROLE"},
+			summary: "delete a role and its policy",
+			description: `Delete the role and its whole policy, and remove it from the roles of
+every user who is a member of it. It is an error if the role does not
+exist, or if other roles extend it: change or delete them first.`,
+			db:    true,
+			store: true,
+			run:   runDeleteRole,
+		},
+		{
+			name:    "rename role",
+			args:    []string{"ROLE", "NEW_ROLE"},
+			summary: "give a role a new name",
+			description: `Rename the role, keeping its policy, in one transaction. It is an error
+if the role does not exist, if NEW_ROLE is already a role, if NEW_ROLE is
+not a valid role name, or if roles would then extend each other in a
+cycle.`,
+			db:    true,
+			store: true,
+			run:   runRenameRole,
+		},
+		{
+			name:    "clone role",
+			args:    []string{"ROLE", "NEW_ROLE"},
+			summary: "copy a role's policy to a new role",
+			description: `Create NEW_ROLE with a copy of the role's policy, in one transaction.
+The two roles share nothing afterwards. It is an error if the role does
+not exist, if NEW_ROLE is already a role, if NEW_ROLE is not a valid role
+name, or if roles would then extend each other in a cycle.`,
+			db:    true,
+			store: true,
+			run:   runCloneRole,
+		},
+		{
+			name:    "combine-mode",
+			args:    []string{"[MODE]"},
+			summary: "print or set how roles are combined",
+			description: `Print how get combines the policies of several roles or of a user's
+roles, or set it to MODE, either intersection or union (see get). A
+database that has never had it set uses intersection. The mode belongs to
+the database, and is not part of configs or exports.`,
+			db:    true,
+			store: true,
+			run:   runCombineMode,
+		},
+		{
+			name:    "grant",
+			args:    []string{"ROLE", "COLUMN", "VALUE..."},
+			summary: "grant a role values of a column",
+			description: `Add the values to the role's grant on the column, without reloading the
+rest of its policy. The role and the column are created if needed. Granting
+__all__ replaces the column's values with __all__, and granting single
+values on a column already granted __all__ takes them out of its except
+list, if they are in it, and otherwise changes nothing.
+
+With --match the values are prefixes, globs or regular expressions rather
+than exact values (see help). A column is matched one way, so values
+can only be added to a column with the same match; revoke __all__ to match
+it another way.
+
+The result is checked as load checks a config, and the change is made in
+one transaction. The difference it made is printed as by load --dry-run,
+and each value granted is recorded in the database's change log. With
+--dry-run nothing is changed, and rowctrl exits with status 2 if the grant
+would change anything.`,
+			db:    true,
+			store: true,
+			flags: matchFlags,
+			run:   runGrant,
+		},
+		{
+			name:    "revoke",
+			args:    []string{"ROLE", "COLUMN", "VALUE..."},
+			summary: "revoke values of a column from a role",
+			description: `Remove the values from the role's grant on the column. Revoking __all__
+removes the whole grant, and a grant left with no values is removed, but
+the role is kept. Revoking single values of a column granted __all__ adds
+them to its except list instead, so the column still allows every other
+value. Patterns are revoked with the --match they were granted with. It is
+an error if the role does not exist.
+
+The change is checked, made, printed and recorded as by grant, and
+--dry-run works the same way.`,
+			db:    true,
+			store: true,
+			flags: matchFlags,
+			run:   runRevoke,
+		},
+		{
+			name:    "patch",
+			args:    []string{"PATCH"},
+			summary: "apply a file of grants and revokes",
+			description: `Apply every grant and revoke in PATCH, in order, in one transaction: if
+any fails, nothing is changed. PATCH is a JSON array of changes, each an
+object such as {"op": "grant", "role": "pa_sales_manager", "column":
+"State", "values": ["Ohio", "Delaware"]}, where op is grant or revoke and
+"match" may give the match as grant's --match does. A
+change with op create or drop and only a role creates or drops the role.
+
+Every problem with the file is reported with
+its JSON pointer, e.g. /1/values. Use - to read the patch from standard
+input. The changes are made, printed and recorded as by grant, and
+--dry-run works the same way.`,
+			alias: "--patch PATCH",
+			db:    true,
+			store: true,
+			flags: changeFlags,
+			run:   runPatch,
+		},
+		{
+			name:    "exec",
+			args:    []string{"[FILE]"},
+			summary: "run GRANT, REVOKE, CREATE and DROP statements",
+			description: `Run admin statements from FILE, or from standard input if FILE is
+omitted or is -. There are four statements, each ending in a semicolon:
+
+GRANT column IN ('value', ...) TO ROLE role;
+
+REVOKE column IN ('value', ...) FROM ROLE role;
+
+CREATE ROLE role;
+
+DROP ROLE role;
+
+Keywords are case insensitive. A column is a bare word or is double
+quoted, e.g. "Sales Region". Values are single quoted, with a quote within
+one doubled, and ALL stands for __all__, e.g. GRANT State IN (ALL) TO ROLE
+admin. Comments start with -- and run to the end of the line. GRANT and
+REVOKE work as the grant and revoke commands do. CREATE ROLE gives a new
+role an empty policy, and DROP ROLE deletes a role with its policy and
+removes it from the roles of its members, as delete role does.
+
+Every statement is parsed before any is run, and a syntax error is
+reported with its line and column. The statements are then run in order in
+one transaction: if any fails, nothing is changed. The changes are printed
+and recorded as by grant, and --dry-run works the same way.`,
+			db:    true,
+			store: true,
+			flags: changeFlags,
+			run:   runExec,
+		},
+		{
+			name:    "validate",
+			args:    []string{"CONFIG"},
+			summary: "check a JSON config without loading it",
+			description: `Check a configuration file against the JSON schema and for the
+problems load refuses, without opening a store. Every problem is reported
+with its JSON pointer.`,
+			run: runValidate,
+		},
+		{
+			name:    "export",
+			summary: "print every policy and user as a JSON config",
+			description: `Print the policy of every role, in role order. In the json, pretty and
+dsl formats the policies are followed by every user and the roles they
+are members of, in user order, and this is a configuration that load
+accepts, and that loads into an identical database.
+
+By default each role's columns and values, and each user's roles, are in
+the order they were loaded. --sort name sorts them by name instead, with
+__all__ first, so that exports of the same policies are identical however
+they were loaded and can be committed and diffed.
+
+--split DIR writes each role to its own file in DIR, named after the role,
+e.g. DIR/admin.json (.csv, .txt, .sql or .policy in the other formats). In
+the json and pretty formats each file is a config of its own. Users are not
+written. Files of that extension left in DIR by an earlier export, for
+roles that no longer exist, are removed, so DIR should be kept for the
+export alone.`,
+			db:     true,
+			store:  true,
+			output: true,
+			flags: func(fs *pflag.FlagSet, opts *options) {
+				fs.StringVar(&opts.sort, "sort", string(rowaccess.SortLoaded), "order each role's columns and values by `ORDER`: loaded or name")
+				fs.StringVar(&opts.split, "split", "", "write one file per role to `DIR`")
+			},
+			run: runExport,
+		},
+		{
+			name:    "fmt",
+			args:    []string{"CONFIG..."},
+			summary: "convert configs between JSON and the policy language",
+			description: `Print the policies of the configs, which may be JSON or in the policy
+language, in one of the output formats: by default the policy language,
+and with --format json or pretty as a JSON config. Nothing is checked
+beyond what is needed to read the configs, so fmt can tidy a config that
+validate rejects.
+
+The policy language is a compact alternative to JSON that load, validate,
+diff and the other commands accept wherever they take a config. A config
+that does not start with { is read as the policy language. Each role lists
+its columns, separated by semicolons, and each column its values,
+separated by commas:
+
+role pa_sales_manager { Region: Eastern; State: Pennsylvania }
+
+role admin { Region: __all__; State: __all__; }
+
+Names and values are bare words, or are double quoted if they hold space
+or any of {}:;,"#, as in State: "New York". A quote within a quoted word is
+doubled. Comments run from # to the end of the line, and are not kept by
+fmt.`,
+			output:         true,
+			default_format: "dsl",
+			run:            runFmt,
+		},
+		{
+			name:    "diff",
+			args:    []string{"OLD", "NEW"},
+			summary: "compare two databases or configs",
+			description: `Print the difference between two sets of policies, going from OLD to
+NEW: the roles only in NEW (+) or only in OLD (-), for each role in both
+the columns and values it gains or loses (~), and the users whose roles
+differ in the same way. Values and a user's roles are compared as sets,
+and a column granted with __all__ is compared as such, so that going
+from __all__ to a list of values shows __all__ removed and the values
+added.
+
+Each side is a JSON config or a store: sqlite:FILE, mem:, or a file name.
+A file is read as a SQLite database if it is one and as a config
+otherwise. A database file that does not exist is an error rather than an
+empty store.
+
+The diff is printed as by load --dry-run, and rowctrl exits with status 2
+if the sides differ, 0 if they do not and 1 on error.`,
+			flags: diffFlags,
+			run:   runDiff,
+		},
+		{
+			name:    "migrate",
+			summary: "upgrade the database to the latest schema",
+			description: `Upgrade the database to the latest schema version and print the
+versions before and after. Existing databases are also upgraded
+automatically by the other commands. Needs a SQLite database.`,
+			alias: "--migrate",
+			db:    true,
+			run:   runMigrate,
+		},
+		{
+			name:    "schema-version",
+			summary: "print the schema version of the database",
+			description: `Print the schema version of the database without changing it. A
+database with no recorded version reports 0. Needs a SQLite database.`,
+			alias: "--schema-version",
+			db:    true,
+			run:   runSchemaVersion,
+		},
+		{
+			name:    "print-schema",
+			summary: "print the JSON schema for configs",
+			description: `Print the JSON schema that configuration files are validated against,
+exactly as built into this binary.`,
+			alias: "--print-schema",
+			run:   runPrintSchema,
+		},
+		{
+			name:        "help",
+			args:        []string{"[COMMAND...]"},
+			summary:     "show help for rowctrl or a command",
+			description: `Print the manual, or the help for one command.`,
+			alias:       "--help",
+			run:         runHelp,
+		},
+	}
+}
+
+// Return the command named at the start of args, and the arguments after
+// its name
+//
+// Multi-word names are matched whole, so "list" alone matches nothing.
+func findCommand(args []string) (*command, []string) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):]
+		}
+	}
+	return nil, args
+}
+
+// Return the commands whose names start with the word, e.g. the list
+// commands for "list"
+func commandsStartingWith(word string) []string {
+	var names []string
+	for _, cmd := range commands {
+		if first, _, _ := strings.Cut(cmd.name, " "); first == word && cmd.name != word {
+			names = append(names, cmd.name)
+		}
+	}
+	return names
+}
+
+// Return the flags the command takes, writing their values to opts
+func (cmd *command) flagSet(opts *options) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.SortFlags = false
+	if cmd.db {
+		fs.StringVarP(&opts.db, "db", "d", "", "the `STORE` to use: sqlite:FILE, mem: or a database file")
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs, opts)
+	}
+	if cmd.output {
+		default_format := cmp.Or(cmd.default_format, "json")
+		fs.StringVarP(&opts.format, "format", "f", default_format, "print as `FORMAT`: "+strings.Join(output_formats, ", "))
+		fs.StringVarP(&opts.output, "output", "o", "", "write to `FILE` instead of standard output")
+	}
+	fs.BoolVarP(&opts.help, "help", "h", false, "show help for the command")
+	return fs
+}
+
+// Return true if the command takes the flag
+func (cmd *command) takesFlag(name string) bool {
+	return cmd.flagSet(&options{}).Lookup(name) != nil
+}
+
+// Return how the command is run, e.g. "get [--db STORE] ROLE"
+func (cmd *command) usage() string {
+	parts := []string{cmd.name}
+	if cmd.db {
+		parts = append(parts, "[--db STORE]")
+	}
+	if cmd.flags != nil || cmd.output {
+		parts = append(parts, "[OPTIONS]")
+	}
+	parts = append(parts, cmd.args...)
+	return strings.Join(parts, " ")
+}
+
+// Return the number of positional arguments the command needs, and the
+// number it can take, which is -1 if there is no limit
+func (cmd *command) argRange() (int, int) {
+	required := 0
+	for _, arg := range cmd.args {
+		if !strings.HasPrefix(arg, "[") {
+			required++
+		}
+		if strings.HasSuffix(arg, "...") || strings.HasSuffix(arg, "...]") {
+			return required, -1
+		}
+	}
+	return required, len(cmd.args)
+}
+
+// Add the flags of the commands that grant and revoke values
+func changeFlags(fs *pflag.FlagSet, opts *options) {
+	fs.BoolVarP(&opts.dry_run, "dry-run", "n", false, "print what would change instead of changing it")
+	diffFlags(fs, opts)
+}
+
+// Add the flags of the grant and revoke commands
+func matchFlags(fs *pflag.FlagSet, opts *options) {
+	fs.StringVar(&opts.match, "match", "", "match the values as `KIND`: exact, prefix, glob or regex")
+	changeFlags(fs, opts)
+}
+
+// Load policies into the store. A SQLite config is streamed into the
+// database in one transaction, which also initializes a new database, so a
+// failed load never leaves behind an empty or half-loaded database.
+func runLoad(ctx context.Context, inv *invocation) error {
+	if inv.opts.dry_run {
+		return runDryRun(ctx, inv)
+	}
+	if inv.opts.format != "text" || inv.opts.color != "auto" {
+		return fmt.Errorf("--format and --color are only used with --dry-run")
+	}
+	if inv.opts.sync {
+		return runSync(ctx, inv)
+	}
+	if inv.opts.yes {
+		return fmt.Errorf("--yes is only used with --sync")
+	}
+	for _, config_file := range inv.args {
+		stats, err := rowaccess.LoadStoreFromFile(ctx, inv.store, config_file)
+		if err != nil {
+			if len(inv.args) > 1 {
+				return fmt.Errorf("loading %s into db: %w", config_file, err)
+			}
+			return fmt.Errorf("loading policies into db: %w", err)
+		}
+		if inv.opts.verbose {
+			printLoadStats(inv.stderr, stats)
+		}
+	}
+	return nil
+}
+
+// Print what loading the config files would change
+func runDryRun(ctx context.Context, inv *invocation) error {
+	var policy_sets []*rowaccess.PolicySet
+	if inv.opts.sync {
+		policy_set, err := rowaccess.LoadPolicySetFiles(inv.args)
+		if err != nil {
+			return err
+		}
+		policy_sets = append(policy_sets, policy_set)
+	} else {
+		// Each file is loaded on its own, so a later file may redefine a role
+		for _, config_file := range inv.args {
+			policy_set, err := rowaccess.LoadPolicySetFiles([]string{config_file})
+			if err != nil {
+				return err
+			}
+			policy_sets = append(policy_sets, policy_set)
+		}
+	}
+	diff, err := rowaccess.PlanLoad(ctx, inv.store, policy_sets, inv.opts.sync)
+	if err != nil {
+		return fmt.Errorf("planning load: %w", err)
+	}
+	return writeDiff(inv, diff)
+}
+
+// Make the store match the config files, after confirming the roles that
+// will be deleted
+func runSync(ctx context.Context, inv *invocation) error {
+	policy_set, err := rowaccess.LoadPolicySetFiles(inv.args)
+	if err != nil {
+		return fmt.Errorf("loading policies into db: %w", err)
+	}
+	to_prune, err := rowaccess.RolesToPrune(ctx, inv.store, policy_set)
+	if err != nil {
+		return fmt.Errorf("finding roles to delete: %w", err)
+	}
+	if len(to_prune) > 0 {
+		fmt.Fprintf(inv.stderr, "--sync will delete %d role(s) not in the config:\n", len(to_prune))
+		for _, role := range to_prune {
+			fmt.Fprintf(inv.stderr, "  %s\n", role)
+		}
+		if err := confirm(inv, "Delete them?"); err != nil {
+			return err
+		}
+	}
+	stats, err := inv.store.SyncPolicies(ctx, policy_set)
+	if err != nil {
+		return fmt.Errorf("syncing policies into db: %w", err)
+	}
+	if inv.opts.verbose {
+		printLoadStats(inv.stderr, stats.LoadStats)
+		fmt.Fprintf(inv.stderr, "deleted %d roles\n", len(stats.Deleted))
+	}
+	return nil
+}
+
+func printLoadStats(w io.Writer, stats rowaccess.LoadStats) {
+	fmt.Fprintf(w, "loaded %d roles, %d columns and %d values (%d rows) in %s: %.0f rows/s\n",
+		stats.Roles, stats.Grants, stats.Values, stats.Rows(), stats.Duration.Round(time.Millisecond), stats.RowsPerSecond())
+	if stats.Users > 0 {
+		fmt.Fprintf(w, "loaded %d users\n", stats.Users)
+	}
+}
+
+// Return nil if --yes was given or the user answers yes to the question,
+// which is only asked when standard input is a terminal
+func confirm(inv *invocation, question string) error {
+	if inv.opts.yes {
+		return nil
+	}
+	if !isTerminal(inv.stdin) {
+		return fmt.Errorf("not deleting roles without confirmation, rerun with --yes")
+	}
+	fmt.Fprintf(inv.stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(inv.stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("cancelled, nothing was changed")
+}
+
+// Return true if the reader or writer is a terminal. A variable, so that
+// tests can answer prompts.
+var isTerminal = func(r any) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func runGet(ctx context.Context, inv *invocation) error {
+	mode, err := combineMode(inv)
+	if err != nil {
+		return err
+	}
+	if inv.opts.user != "" {
+		return runGetUser(ctx, inv, mode)
+	}
+	if len(inv.args) == 0 {
+		return fmt.Errorf("get needs a ROLE or --user")
+	}
+	if len(inv.args) > 1 {
+		return runGetRoles(ctx, inv, mode)
+	}
+	if mode != "" {
+		return fmt.Errorf("--combine is only used with several roles or --user")
+	}
+	role := inv.args[0]
+	get_policy := inv.store.GetPolicy
+	if inv.opts.effective {
+		get_policy = func(ctx context.Context, role string) (rowaccess.Policy, error) {
+			return rowaccess.EffectivePolicy(ctx, inv.store, role)
+		}
+	}
+	policy, err := get_policy(ctx, role)
+	if err != nil {
+		return fmt.Errorf("getting policy for role %s: %w", role, err)
+	}
+	return inv.out.writePolicy(policy)
+}
+
+// Return the mode --combine gives, or "" for the database's mode
+func combineMode(inv *invocation) (rowaccess.CombineMode, error) {
+	if inv.opts.combine == "" {
+		return "", nil
+	}
+	return rowaccess.ParseCombineMode(inv.opts.combine)
+}
+
+func runGetUser(ctx context.Context, inv *invocation, mode rowaccess.CombineMode) error {
+	if len(inv.args) > 0 {
+		return fmt.Errorf("get takes either roles or --user, not both")
+	}
+	if inv.opts.effective {
+		return fmt.Errorf("--effective is implied by --user")
+	}
+	user_policy, err := rowaccess.GetUserPolicy(ctx, inv.store, inv.opts.user, mode)
+	if err != nil {
+		return fmt.Errorf("getting policy for user %s: %w", inv.opts.user, err)
+	}
+	return inv.out.writeCombinedPolicy(user_policy)
+}
+
+func runGetRoles(ctx context.Context, inv *invocation, mode rowaccess.CombineMode) error {
+	if inv.opts.effective {
+		return fmt.Errorf("--effective is implied by several roles")
+	}
+	combined, err := rowaccess.CombineRoles(ctx, inv.store, inv.args, mode)
+	if err != nil {
+		return fmt.Errorf("getting policy for roles %s: %w", strings.Join(inv.args, ", "), err)
+	}
+	return inv.out.writeCombinedPolicy(combined)
+}
+
+func runListRoles(ctx context.Context, inv *invocation) error {
+	roles, err := inv.store.ListRoles(ctx)
+	if err != nil {
+		return fmt.Errorf("listing roles: %w", err)
+	}
+	return inv.out.writeNames("role", roles)
+}
+
+func runListUsers(ctx context.Context, inv *invocation) error {
+	users, err := inv.store.ListUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("listing users: %w", err)
+	}
+	return inv.out.writeNames("user", users)
+}
+
+func runListColumns(ctx context.Context, inv *invocation) error {
+	columns, err := inv.store.ListColumns(ctx)
+	if err != nil {
+		return fmt.Errorf("listing columns: %w", err)
+	}
+	return inv.out.writeNames("column", columns)
+}
+
+func runDeleteRole(ctx context.Context, inv *invocation) error {
+	role := inv.args[0]
+	if err := inv.store.DeleteRole(ctx, role); err != nil {
+		return fmt.Errorf("deleting role %s: %w", role, err)
+	}
+	return nil
+}
+
+func runRenameRole(ctx context.Context, inv *invocation) error {
+	role, new_role := inv.args[0], inv.args[1]
+	if err := inv.store.RenameRole(ctx, role, new_role); err != nil {
+		return fmt.Errorf("renaming role %s: %w", role, err)
+	}
+	return nil
+}
+
+func runCloneRole(ctx context.Context, inv *invocation) error {
+	role, new_role := inv.args[0], inv.args[1]
+	if err := inv.store.CloneRole(ctx, role, new_role); err != nil {
+		return fmt.Errorf("cloning role %s: %w", role, err)
+	}
+	return nil
+}
+
+func runGrant(ctx context.Context, inv *invocation) error {
+	return applyChanges(ctx, inv, []rowaccess.PolicyChange{changeFromArgs(rowaccess.OpGrant, inv.args, inv.opts.match)})
+}
+
+func runRevoke(ctx context.Context, inv *invocation) error {
+	return applyChanges(ctx, inv, []rowaccess.PolicyChange{changeFromArgs(rowaccess.OpRevoke, inv.args, inv.opts.match)})
+}
+
+func runPatch(ctx context.Context, inv *invocation) error {
+	patch_file := inv.args[0]
+	var changes []rowaccess.PolicyChange
+	var err error
+	if patch_file == "-" {
+		changes, err = rowaccess.ReadPatch(inv.stdin)
+	} else {
+		changes, err = rowaccess.ReadPatchFile(patch_file)
+	}
+	if err != nil {
+		return fmt.Errorf("reading patch %s: %w", patch_file, err)
+	}
+	return applyChanges(ctx, inv, changes)
+}
+
+func runExec(ctx context.Context, inv *invocation) error {
+	if len(inv.args) == 0 || inv.args[0] == "-" {
+		changes, err := rowaccess.ParseStatements(inv.stdin)
+		if err != nil {
+			return fmt.Errorf("parsing statements: %w", err)
+		}
+		return applyChanges(ctx, inv, changes)
+	}
+	changes, err := rowaccess.ParseStatementsFile(inv.args[0])
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", inv.args[0], err)
+	}
+	return applyChanges(ctx, inv, changes)
+}
+
+// Return the change given by the arguments ROLE COLUMN VALUE... and the
+// --match of their values
+func changeFromArgs(op rowaccess.GrantOp, args []string, match string) rowaccess.PolicyChange {
+	return rowaccess.PolicyChange{Op: op, Role: args[0], Column: args[1], Match: rowaccess.MatchKind(match), Values: args[2:]}
+}
+
+// Apply the changes to the store, or only plan them with --dry-run, and
+// print the difference they make
+func applyChanges(ctx context.Context, inv *invocation, changes []rowaccess.PolicyChange) error {
+	if inv.opts.dry_run {
+		diff, err := rowaccess.PlanChanges(ctx, inv.store, changes)
+		if err != nil {
+			return fmt.Errorf("planning changes: %w", err)
+		}
+		return writeDiff(inv, diff)
+	}
+	diff, err := inv.store.ApplyChanges(ctx, changes)
+	if err != nil {
+		return fmt.Errorf("applying changes: %w", err)
+	}
+	// Changes that were made are not a failure, as they are with --dry-run
+	if err := writeDiff(inv, diff); !errors.Is(err, errDiffFound) {
+		return err
+	}
+	return nil
+}
+
+func runFmt(ctx context.Context, inv *invocation) error {
+	config := &rowaccess.PolicySet{Policies: []rowaccess.Policy{}}
+	for _, config_file := range inv.args {
+		policy_set, err := rowaccess.LoadRolePolicies(config_file)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", config_file, err)
+		}
+		config.Policies = append(config.Policies, policy_set.Policies...)
+		config.Users = append(config.Users, policy_set.Users...)
+	}
+	return inv.out.writeConfig(config)
+}
+
+func runValidate(ctx context.Context, inv *invocation) error {
+	config_file := inv.args[0]
+	if err := rowaccess.CheckConfigFile(config_file); err != nil {
+		return fmt.Errorf("validating %s: %w", config_file, err)
+	}
+	fmt.Fprintf(inv.stdout, "%s: ok\n", config_file)
+	return nil
+}
+
+func runExport(ctx context.Context, inv *invocation) error {
+	order, err := rowaccess.ParseSortOrder(inv.opts.sort)
+	if err != nil {
+		return err
+	}
+	if inv.opts.split != "" {
+		if inv.opts.output != "" {
+			return fmt.Errorf("--split and --output cannot be used together")
+		}
+		return exportSplit(ctx, inv, order)
+	}
+	users, err := rowaccess.ExportUsers(ctx, inv.store, order)
+	if err != nil {
+		return fmt.Errorf("exporting users: %w", err)
+	}
+	err = inv.out.writePoliciesAndUsers(func(fn func(rowaccess.Policy) error) error {
+		return rowaccess.ExportPolicies(ctx, inv.store, order, fn)
+	}, users)
+	if err != nil {
+		return fmt.Errorf("exporting policies: %w", err)
+	}
+	return nil
+}
+
+// Write each role to its own file in the --split directory, then remove the
+// files of roles that were exported before but no longer exist
+func exportSplit(ctx context.Context, inv *invocation, order rowaccess.SortOrder) error {
+	dir := inv.opts.split
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("exporting policies: %w", err)
+	}
+	ext := inv.out.extension()
+	written := map[string]bool{}
+	err := rowaccess.ExportPolicies(ctx, inv.store, order, func(policy rowaccess.Policy) error {
+		fname := policy.Role + ext
+		if err := writePolicyFile(filepath.Join(dir, fname), inv.out.format, policy); err != nil {
+			return fmt.Errorf("writing %s: %w", fname, err)
+		}
+		written[fname] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("exporting policies: %w", err)
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		return err
+	}
+	for _, fname := range stale {
+		if !written[filepath.Base(fname)] && rowaccess.IsValidRoleName(strings.TrimSuffix(filepath.Base(fname), ext)) {
+			if err := os.Remove(fname); err != nil {
+				return fmt.Errorf("removing stale export: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Write one policy to a file, as a whole export of that one role
+func writePolicyFile(fname, format string, policy rowaccess.Policy) error {
+	output, err := createOutputFile(fname)
+	if err != nil {
+		return err
+	}
+	defer output.abort()
+	out, err := newFormatter(format, output)
+	if err != nil {
+		return err
+	}
+	err = out.writePolicies(func(fn func(rowaccess.Policy) error) error {
+		return fn(policy)
+	})
+	if err != nil {
+		return err
+	}
+	return output.commit()
+}
+
+func runDiff(ctx context.Context, inv *invocation) error {
+	old_set, err := readPolicySet(ctx, inv.args[0])
+	if err != nil {
+		return err
+	}
+	new_set, err := readPolicySet(ctx, inv.args[1])
+	if err != nil {
+		return err
+	}
+	return writeDiff(inv, rowaccess.DiffPolicySets(old_set, new_set))
+}
+
+// Return every policy and user in the store or config named by spec, for
+// diff
+func readPolicySet(ctx context.Context, spec string) (*rowaccess.PolicySet, error) {
+	backend, location := rowaccess.ParseStoreSpec(spec)
+	if backend == "sqlite" && !strings.HasPrefix(spec, "sqlite:") {
+		is_db, err := isSQLiteFile(location)
+		if err != nil {
+			return nil, err
+		}
+		if !is_db {
+			return rowaccess.LoadPolicySetFiles([]string{location})
+		}
+	}
+	if backend == "sqlite" {
+		// Opening a missing file would create an empty database
+		if _, err := os.Stat(location); err != nil {
+			return nil, err
+		}
+	}
+	store, err := rowaccess.OpenStore(ctx, spec)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", spec, err)
+	}
+	defer store.Close()
+	policy_set, err := rowaccess.ExportPolicySet(ctx, store, rowaccess.SortLoaded)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", spec, err)
+	}
+	return policy_set, nil
+}
+
+// Return true if the file starts with the SQLite database header
+func isSQLiteFile(fname string) (bool, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(sqlite_header))
+	if _, err := io.ReadFull(f, header); err != nil {
+		// Too short to be a database
+		return false, nil
+	}
+	return string(header) == sqlite_header, nil
+}
+
+const sqlite_header = "SQLite format 3\x00"
+
+// Print the store's combination mode, or set it to the one given
+func runCombineMode(ctx context.Context, inv *invocation) error {
+	if len(inv.args) == 0 {
+		mode, err := rowaccess.StoreCombineMode(ctx, inv.store)
+		if err != nil {
+			return fmt.Errorf("reading combination mode: %w", err)
+		}
+		fmt.Fprintln(inv.stdout, mode)
+		return nil
+	}
+	mode, err := rowaccess.ParseCombineMode(inv.args[0])
+	if err != nil {
+		return err
+	}
+	if err := inv.store.SetCombineMode(ctx, mode); err != nil {
+		return fmt.Errorf("setting combination mode: %w", err)
+	}
+	return nil
+}
+
+// Report the version as found, before opening the database normally (which
+// migrates it automatically)
+func runSchemaVersion(ctx context.Context, inv *invocation) error {
+	db, err := getFileDbHandle(ctx, inv.opts.db, "schema-version")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, err := rowaccess.SchemaVersion(ctx, db)
+	if err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+	fmt.Fprintln(inv.stdout, version)
+	return nil
+}
+
+func runMigrate(ctx context.Context, inv *invocation) error {
+	db, err := getFileDbHandle(ctx, inv.opts.db, "migrate")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	from, to, err := rowaccess.MigrateDb(ctx, db)
+	if err != nil {
+		return fmt.Errorf("migrating db: %w", err)
+	}
+	fmt.Fprintf(inv.stdout, "schema version %d -> %d\n", from, to)
+	return nil
+}
+
+// The schema is built into the binary, so no store is needed
+func runPrintSchema(ctx context.Context, inv *invocation) error {
+	_, err := inv.stdout.Write(rowaccess.ConfigSchema())
+	return err
+}
+
+func runHelp(ctx context.Context, inv *invocation) error {
+	if len(inv.args) == 0 {
+		fmt.Fprintln(inv.stdout, manPage())
+		return nil
+	}
+	cmd, rest := findCommand(strings.Fields(strings.Join(inv.args, " ")))
+	if cmd == nil || len(rest) > 0 {
+		return unknownCommand(inv.args)
+	}
+	fmt.Fprint(inv.stdout, commandHelp(cmd))
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/charlie-gallagher/go-row-access-policies/rowaccess"
+	"github.com/spf13/pflag"
+)
+
+// Returned by commands that found differences, which rowctrl exits with
+// diff_exit_code for rather than reporting as an error
+var errDiffFound = errors.New("differences found")
+
+// The exit code when differences are found, so that CI can tell them from
+// errors
+const diff_exit_code = 2
+
+// The formats a diff can be printed in, in the order they are documented
+var diff_formats = []string{"text", "json", "pretty"}
+
+const (
+	ansi_green  = "\x1b[32m"
+	ansi_red    = "\x1b[31m"
+	ansi_yellow = "\x1b[33m"
+	ansi_reset  = "\x1b[0m"
+)
+
+// Add the flags of the commands that print a diff
+func diffFlags(fs *pflag.FlagSet, opts *options) {
+	fs.StringVarP(&opts.format, "format", "f", "text", "print the diff as `FORMAT`: "+strings.Join(diff_formats, ", "))
+	fs.StringVar(&opts.color, "color", "auto", "color the text diff: `WHEN` is auto, always or never")
+}
+
+// Write the diff in the format given by the options, returning errDiffFound
+// if there are differences
+func writeDiff(inv *invocation, diff *rowaccess.Diff) error {
+	var err error
+	switch inv.opts.format {
+	case "text":
+		color, color_err := useColor(inv.opts.color, inv.stdout)
+		if color_err != nil {
+			return color_err
+		}
+		err = writeTextDiff(inv.stdout, diff, color)
+	case "json":
+		err = writeJson(inv.stdout, diff, "")
+	case "pretty":
+		err = writeJson(inv.stdout, diff, "  ")
+	default:
+		return fmt.Errorf("unknown diff format %q, use one of %s", inv.opts.format, strings.Join(diff_formats, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	if !diff.Empty() {
+		return errDiffFound
+	}
+	return nil
+}
+
+// Return whether to color output to w, given the --color option
+//
+// auto colors a terminal, unless NO_COLOR is set.
+func useColor(when string, w io.Writer) (bool, error) {
+	switch when {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return os.Getenv("NO_COLOR") == "" && isTerminal(w), nil
+	}
+	return false, fmt.Errorf("unknown --color %q, use auto, always or never", when)
+}
+
+// Write the diff for reading: + for what is added, - for what is removed and
+// ~ for what is changed, then a summary line
+func writeTextDiff(w io.Writer, diff *rowaccess.Diff, color bool) error {
+	paint := func(change rowaccess.Change, text string) string {
+		if !color {
+			return text
+		}
+		switch change {
+		case rowaccess.Added:
+			return ansi_green + text + ansi_reset
+		case rowaccess.Removed:
+			return ansi_red + text + ansi_reset
+		}
+		return ansi_yellow + text + ansi_reset
+	}
+	for _, role_diff := range diff.Roles {
+		fmt.Fprintln(w, paint(role_diff.Change, changeMark(role_diff.Change)+" role "+role_diff.Role))
+		if extends := role_diff.Extends; extends != nil {
+			fmt.Fprintf(w, "    %s: %s\n", paint(role_diff.Change, changeMark(role_diff.Change)+" extends"), extendsChange(role_diff.Change, extends))
+		}
+		for _, column_diff := range role_diff.Columns {
+			fmt.Fprintf(w, "    %s: %s\n", paint(column_diff.Change, changeMark(column_diff.Change)+" "+column_diff.Column), columnChange(column_diff, paint))
+		}
+		for _, column_diff := range role_diff.Deny {
+			fmt.Fprintf(w, "    %s: %s\n", paint(column_diff.Change, changeMark(column_diff.Change)+" deny "+column_diff.Column), columnChange(column_diff, paint))
+		}
+	}
+	for _, user_diff := range diff.Users {
+		var roles []string
+		for _, role := range user_diff.Added {
+			roles = append(roles, paint(rowaccess.Added, "+"+role))
+		}
+		for _, role := range user_diff.Removed {
+			roles = append(roles, paint(rowaccess.Removed, "-"+role))
+		}
+		fmt.Fprintf(w, "%s: %s\n", paint(user_diff.Change, changeMark(user_diff.Change)+" user "+user_diff.User), strings.Join(roles, " "))
+	}
+	if diff.Empty() {
+		_, err := fmt.Fprintln(w, "no changes")
+		return err
+	}
+	added, removed, changed := diff.Counts()
+	_, err := fmt.Fprintf(w, "%d role(s) added, %d removed, %d changed\n", added, removed, changed)
+	if err != nil || len(diff.Users) == 0 {
+		return err
+	}
+	added, removed, changed = diff.UserCounts()
+	_, err = fmt.Fprintf(w, "%d user(s) added, %d removed, %d changed\n", added, removed, changed)
+	return err
+}
+
+// Describe the values added to and removed from a column, with except: in
+// front of the values an __all__ grant leaves out, after the column's match
+// if it changed
+func columnChange(column_diff rowaccess.ColumnDiff, paint func(rowaccess.Change, string) string) string {
+	var values []string
+	if match := column_diff.Match; match != nil {
+		values = append(values, matchChange(column_diff.Change, match))
+	}
+	for _, value := range column_diff.Added {
+		values = append(values, paint(rowaccess.Added, "+"+value))
+	}
+	for _, value := range column_diff.Removed {
+		values = append(values, paint(rowaccess.Removed, "-"+value))
+	}
+	for _, value := range column_diff.ExceptAdded {
+		values = append(values, paint(rowaccess.Added, "+except:"+value))
+	}
+	for _, value := range column_diff.ExceptRemoved {
+		values = append(values, paint(rowaccess.Removed, "-except:"+value))
+	}
+	return strings.Join(values, " ")
+}
+
+// Describe a change to a column's match: the match of an added column, that
+// of a removed one, and otherwise the old match and the new one
+func matchChange(change rowaccess.Change, match *rowaccess.MatchDiff) string {
+	switch change {
+	case rowaccess.Added:
+		return matchName(match.New)
+	case rowaccess.Removed:
+		return matchName(match.Old)
+	}
+	return matchName(match.Old) + " -> " + matchName(match.New)
+}
+
+func changeMark(change rowaccess.Change) string {
+	switch change {
+	case rowaccess.Added:
+		return "+"
+	case rowaccess.Removed:
+		return "-"
+	}
+	return "~"
+}
+
+// Describe a change to the roles a role extends: the roles an added role
+// extends, those a removed role extended, and otherwise the old list and the
+// new one
+func extendsChange(change rowaccess.Change, extends *rowaccess.ExtendsDiff) string {
+	list := func(roles []string) string {
+		if len(roles) == 0 {
+			return "(none)"
+		}
+		return strings.Join(roles, ", ")
+	}
+	switch change {
+	case rowaccess.Added:
+		return list(extends.New)
+	case rowaccess.Removed:
+		return list(extends.Old)
+	}
+	return list(extends.Old) + " -> " + list(extends.New)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/charlie-gallagher/go-row-access-policies/rowaccess"
+)
+
+func getTestDiff() *rowaccess.Diff {
+	return &rowaccess.Diff{Roles: []rowaccess.RoleDiff{
+		{Role: "admin", Change: rowaccess.Changed, Columns: []rowaccess.ColumnDiff{
+			{Column: "Region", Change: rowaccess.Changed, Added: []string{"Eastern"}, Removed: []string{"__all__"}},
+		}},
+		{Role: "west_mgr", Change: rowaccess.Removed, Columns: []rowaccess.ColumnDiff{
+			{Column: "Region", Change: rowaccess.Removed, Added: []string{}, Removed: []string{"Western"}},
+		}},
+	}}
+}
+
+func TestTextDiff(t *testing.T) {
+	tests := map[string]struct {
+		diff     *rowaccess.Diff
+		color    bool
+		expected string
+	}{
+		"Plain": {getTestDiff(), false, `~ role admin
+    ~ Region: +Eastern -__all__
+- role west_mgr
+    - Region: -Western
+0 role(s) added, 1 removed, 1 changed
+`},
+		"Color": {getTestDiff(), true, "\x1b[33m~ role admin\x1b[0m\n" +
+			"    \x1b[33m~ Region\x1b[0m: \x1b[32m+Eastern\x1b[0m \x1b[31m-__all__\x1b[0m\n" +
+			"\x1b[31m- role west_mgr\x1b[0m\n" +
+			"    \x1b[31m- Region\x1b[0m: \x1b[31m-Western\x1b[0m\n" +
+			"0 role(s) added, 1 removed, 1 changed\n"},
+		"No changes": {&rowaccess.Diff{}, true, "no changes\n"},
+		"Except and deny": {&rowaccess.Diff{Roles: []rowaccess.RoleDiff{
+			{Role: "not_ca", Change: rowaccess.Changed, Columns: []rowaccess.ColumnDiff{
+				{Column: "State", Change: rowaccess.Changed, Added: []string{}, Removed: []string{}, ExceptAdded: []string{"Texas"}, ExceptRemoved: []string{"Ohio"}},
+			}, Deny: []rowaccess.ColumnDiff{
+				{Column: "Store", Change: rowaccess.Added, Added: []string{"12"}, Removed: []string{}},
+			}},
+		}}, false, `~ role not_ca
+    ~ State: +except:Texas -except:Ohio
+    + deny Store: +12
+0 role(s) added, 0 removed, 1 changed
+`},
+		"Matches": {&rowaccess.Diff{Roles: []rowaccess.RoleDiff{
+			{Role: "sku_reader", Change: rowaccess.Changed, Columns: []rowaccess.ColumnDiff{
+				{Column: "Sku", Change: rowaccess.Changed, Match: &rowaccess.MatchDiff{Old: "", New: rowaccess.MatchPrefix}, Added: []string{"SKU-12"}, Removed: []string{"SKU-12"}},
+				{Column: "Store", Change: rowaccess.Added, Match: &rowaccess.MatchDiff{Old: "", New: rowaccess.MatchGlob}, Added: []string{"1?"}, Removed: []string{}},
+			}},
+		}}, false, `~ role sku_reader
+    ~ Sku: exact -> prefix +SKU-12 -SKU-12
+    + Store: glob +1?
+0 role(s) added, 0 removed, 1 changed
+`},
+		"Extends": {&rowaccess.Diff{Roles: []rowaccess.RoleDiff{
+			{Role: "ne_mgr", Change: rowaccess.Added, Extends: &rowaccess.ExtendsDiff{Old: []string{}, New: []string{"east_mgr", "auditor"}}, Columns: []rowaccess.ColumnDiff{}},
+			{Role: "pa_mgr", Change: rowaccess.Changed, Extends: &rowaccess.ExtendsDiff{Old: []string{}, New: []string{"east_mgr"}}, Columns: []rowaccess.ColumnDiff{}},
+		}}, false, `+ role ne_mgr
+    + extends: east_mgr, auditor
+~ role pa_mgr
+    ~ extends: (none) -> east_mgr
+1 role(s) added, 0 removed, 1 changed
+`},
+		"Users": {&rowaccess.Diff{Roles: []rowaccess.RoleDiff{}, Users: []rowaccess.UserDiff{
+			{User: "alice", Change: rowaccess.Changed, Added: []string{"maine"}, Removed: []string{"ohio"}},
+			{User: "bob", Change: rowaccess.Added, Added: []string{"admin", "ohio"}, Removed: []string{}},
+		}}, false, `~ user alice: +maine -ohio
++ user bob: +admin +ohio
+0 role(s) added, 0 removed, 0 changed
+1 user(s) added, 0 removed, 1 changed
+`},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeTextDiff(&b, test.diff, test.color); err != nil {
+				t.Fatalf("Error writing diff: %v\n", err)
+			}
+			if b.String() != test.expected {
+				t.Errorf("Diff mismatch: got %q, want %q\n", b.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestDryRunExitCodes(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	config := filepath.Join("..", "..", "config.json")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	changed := filepath.Join(t.TempDir(), "changed.json")
+	err := os.WriteFile(changed, []byte(`{"policies":[{"role":"admin","policy":[{"column":"Region","values":["Eastern"]}]}]}`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	_, before, _ := runRowctrl(t, "export", "--db", db)
+
+	if code, stdout, stderr := runRowctrl(t, "load", "--db", db, "--dry-run", config); code != 0 || stdout != "no changes\n" {
+		t.Errorf("Expected no changes reloading config, got %d: %s%s\n", code, stdout, stderr)
+	}
+	code, stdout, stderr := runRowctrl(t, "--db", db, "--load", changed, "--dry-run", "--format", "json")
+	if code != diff_exit_code {
+		t.Fatalf("Exit code mismatch: got %d, want %d\n%s", code, diff_exit_code, stderr)
+	}
+	var diff rowaccess.Diff
+	if err := json.Unmarshal([]byte(stdout), &diff); err != nil {
+		t.Fatalf("Error decoding json diff: %v\n%s", err, stdout)
+	}
+	want := []rowaccess.ColumnDiff{
+		{Column: "Region", Change: rowaccess.Changed, Added: []string{"Eastern"}, Removed: []string{"__all__"}},
+		{Column: "State", Change: rowaccess.Removed, Added: []string{}, Removed: []string{"__all__"}},
+	}
+	if len(diff.Roles) != 1 || diff.Roles[0].Role != "admin" || !reflect.DeepEqual(diff.Roles[0].Columns, want) {
+		t.Errorf("Diff mismatch: got %+v\n", diff)
+	}
+
+	code, stdout, _ = runRowctrl(t, "load", "--db", db, "--dry-run", "--sync", "--color", "never", changed)
+	if code != diff_exit_code || !bytes.Contains([]byte(stdout), []byte("0 role(s) added, 3 removed, 1 changed")) {
+		t.Errorf("Sync dry run mismatch: got %d: %s\n", code, stdout)
+	}
+	users := filepath.Join(t.TempDir(), "users.csv")
+	if err := os.WriteFile(users, []byte("user,role\nalice,admin\n"), 0o644); err != nil {
+		t.Fatalf("Error writing users: %v\n", err)
+	}
+	code, stdout, _ = runRowctrl(t, "load", "--db", db, "--dry-run", "--color", "never", users)
+	if code != diff_exit_code || stdout != "+ user alice: +admin\n0 role(s) added, 0 removed, 0 changed\n1 user(s) added, 0 removed, 0 changed\n" {
+		t.Errorf("Users dry run mismatch: got %d: %s\n", code, stdout)
+	}
+	if _, after, _ := runRowctrl(t, "export", "--db", db); after != before {
+		t.Errorf("Dry run changed the database:\ngot  %s\nwant %s\n", after, before)
+	}
+}
+
+func TestDiffComparesDatabasesAndConfigs(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join("..", "..", "config.json")
+	changed := filepath.Join(dir, "changed.json")
+	err := os.WriteFile(changed, []byte(`{"policies":[{"role":"admin","policy":[{"column":"Region","values":["__all__"]},{"column":"State","values":["Maine"]}]}]}`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	users := filepath.Join(dir, "users.csv")
+	if err := os.WriteFile(users, []byte("user,role\nalice,admin\n"), 0o644); err != nil {
+		t.Fatalf("Error writing users: %v\n", err)
+	}
+	dev_db := filepath.Join(dir, "dev.db")
+	prod_db := filepath.Join(dir, "prod.db")
+	members_db := filepath.Join(dir, "members.db")
+	for _, args := range [][]string{
+		{"load", "--db", dev_db, config, changed},
+		{"load", "--db", prod_db, config},
+		{"load", "--db", members_db, config, users},
+	} {
+		if code, _, stderr := runRowctrl(t, args...); code != 0 {
+			t.Fatalf("Error loading config: %s\n", stderr)
+		}
+	}
+
+	tests := map[string]struct {
+		args   []string
+		code   int
+		stdout string
+	}{
+		"Database against itself": {[]string{prod_db, "sqlite:" + prod_db}, 0, "no changes\n"},
+		"Database against config": {[]string{prod_db, config}, 0, "no changes\n"},
+		"Two databases": {[]string{prod_db, dev_db}, diff_exit_code, `~ role admin
+    ~ State: +Maine -__all__
+0 role(s) added, 0 removed, 1 changed
+`},
+		"Databases differing in users": {[]string{members_db, prod_db}, diff_exit_code, `- user alice: -admin
+0 role(s) added, 0 removed, 0 changed
+0 user(s) added, 1 removed, 0 changed
+`},
+		"Config against empty store": {[]string{changed, "mem:"}, diff_exit_code, `- role admin
+    - Region: -__all__
+    - State: -Maine
+0 role(s) added, 1 removed, 0 changed
+`},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			code, stdout, stderr := runRowctrl(t, append([]string{"diff"}, test.args...)...)
+			if code != test.code {
+				t.Fatalf("Exit code mismatch: got %d, want %d\n%s", code, test.code, stderr)
+			}
+			if stdout != test.stdout {
+				t.Errorf("Diff mismatch: got %s, want %s\n", stdout, test.stdout)
+			}
+		})
+	}
+
+	t.Run("Missing database", func(t *testing.T) {
+		missing := filepath.Join(dir, "missing.db")
+		if code, _, _ := runRowctrl(t, "diff", prod_db, missing); code != 1 {
+			t.Errorf("Exit code mismatch: got %d, want 1\n", code)
+		}
+		if _, err := os.Stat(missing); err == nil {
+			t.Errorf("diff created the missing database")
+		}
+	})
+}
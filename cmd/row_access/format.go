@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/charlie-gallagher/go-row-access-policies/rowaccess"
+)
+
+// The formats read commands can print, in the order they are documented
+var output_formats = []string{"json", "pretty", "csv", "table", "sql", "dsl"}
+
+// Writes the output of a read command in one format
+//
+// Every read command goes through a formatter, so each format looks the
+// same whichever command printed it.
+type formatter struct {
+	format string
+	w      io.Writer
+}
+
+// Return a formatter for the format, or an error if there is no such format
+func newFormatter(format string, w io.Writer) (*formatter, error) {
+	for _, f := range output_formats {
+		if f == format {
+			return &formatter{format: format, w: w}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown format %q, use one of %s", format, strings.Join(output_formats, ", "))
+}
+
+// Return the file extension for output in the format
+func (f *formatter) extension() string {
+	switch f.format {
+	case "json", "pretty":
+		return ".json"
+	case "table":
+		return ".txt"
+	case "dsl":
+		return ".policy"
+	}
+	return "." + f.format
+}
+
+// Write a list of names, e.g. roles, under a heading for the formats that
+// have one
+func (f *formatter) writeNames(heading string, names []string) error {
+	switch f.format {
+	case "json":
+		return writeJson(f.w, names, "")
+	case "pretty":
+		return writeJson(f.w, names, "  ")
+	case "csv":
+		cw := csv.NewWriter(f.w)
+		cw.Write([]string{heading})
+		for _, name := range names {
+			cw.Write([]string{name})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := newTabWriter(f.w)
+		fmt.Fprintln(tw, strings.ToUpper(heading))
+		for _, name := range names {
+			fmt.Fprintln(tw, name)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("the %s format is only for policies", f.format)
+}
+
+// Write one policy
+func (f *formatter) writePolicy(policy rowaccess.Policy) error {
+	switch f.format {
+	case "json":
+		_, err := fmt.Fprintln(f.w, policy.ToJson())
+		return err
+	case "pretty":
+		return writeJson(f.w, jsonPolicy(policy), "  ")
+	case "sql":
+		_, err := fmt.Fprintln(f.w, policy.ToSql())
+		return err
+	case "dsl":
+		_, err := fmt.Fprint(f.w, policy.ToDsl())
+		return err
+	}
+	return f.writePolicies(func(fn func(rowaccess.Policy) error) error {
+		return fn(policy)
+	})
+}
+
+// Write every policy given by each, which calls its argument with the
+// policies in order
+//
+// The json, csv and sql formats are written as the policies are read.
+func (f *formatter) writePolicies(each func(fn func(rowaccess.Policy) error) error) error {
+	switch f.format {
+	case "json":
+		return f.writeJsonConfig(each, nil)
+	case "pretty":
+		policy_set := rowaccess.PolicySet{Policies: []rowaccess.Policy{}}
+		err := each(func(policy rowaccess.Policy) error {
+			policy_set.Policies = append(policy_set.Policies, jsonPolicy(policy))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return writeJson(f.w, policy_set, "  ")
+	case "csv":
+		cw := csv.NewWriter(f.w)
+		cw.Write([]string{"role", "column", "value", "effect", "match"})
+		err := each(func(policy rowaccess.Policy) error {
+			for _, row := range policyRows(policy) {
+				cw.Write(row)
+			}
+			return cw.Error()
+		})
+		cw.Flush()
+		if err != nil {
+			return err
+		}
+		return cw.Error()
+	case "table":
+		tw := newTabWriter(f.w)
+		fmt.Fprintln(tw, "ROLE\tCOLUMN\tVALUES")
+		err := each(func(policy rowaccess.Policy) error {
+			if len(policy.Policy) == 0 {
+				fmt.Fprintf(tw, "%s\t\t\n", policy.Role)
+			}
+			for _, policy_item := range policy.Policy {
+				values := tableValues(policy_item.Match, policy_item.Values)
+				if len(policy_item.Except) > 0 {
+					values += " except " + strings.Join(policy_item.Except, ", ")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", policy.Role, policy_item.Column, values)
+			}
+			for _, deny_item := range policy.Deny {
+				fmt.Fprintf(tw, "%s\t%s\tdeny %s\n", policy.Role, deny_item.Column, tableValues(deny_item.Match, deny_item.Values))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tw.Flush()
+	case "sql":
+		sep := ""
+		return each(func(policy rowaccess.Policy) error {
+			_, err := fmt.Fprintf(f.w, "%s-- %s\n%s;\n", sep, policy.Role, policy.ToSql())
+			sep = "\n"
+			return err
+		})
+	case "dsl":
+		sep := ""
+		return each(func(policy rowaccess.Policy) error {
+			_, err := fmt.Fprintf(f.w, "%s%s", sep, policy.ToDsl())
+			sep = "\n"
+			return err
+		})
+	}
+	return fmt.Errorf("unknown format %q", f.format)
+}
+
+// Write a whole config, its policies followed by its users
+//
+// Only the json, pretty and dsl formats, which are configs, have users.
+func (f *formatter) writeConfig(policy_set *rowaccess.PolicySet) error {
+	return f.writePoliciesAndUsers(func(fn func(rowaccess.Policy) error) error {
+		for _, policy := range policy_set.Policies {
+			if err := fn(policy); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, policy_set.Users)
+}
+
+// Write every policy given by each, as writePolicies does, followed by the
+// users in the formats that are configs
+func (f *formatter) writePoliciesAndUsers(each func(fn func(rowaccess.Policy) error) error, users []rowaccess.User) error {
+	switch f.format {
+	case "json":
+		return f.writeJsonConfig(each, users)
+	case "pretty":
+		config := rowaccess.PolicySet{Policies: []rowaccess.Policy{}, Users: users}
+		err := each(func(policy rowaccess.Policy) error {
+			config.Policies = append(config.Policies, jsonPolicy(policy))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return writeJson(f.w, config, "  ")
+	case "dsl":
+		any_policies := false
+		err := f.writePolicies(func(fn func(rowaccess.Policy) error) error {
+			return each(func(policy rowaccess.Policy) error {
+				any_policies = true
+				return fn(policy)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for i, user := range users {
+			sep := ""
+			if i == 0 && any_policies {
+				sep = "\n"
+			}
+			if _, err := fmt.Fprint(f.w, sep+user.ToDsl()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return f.writePolicies(each)
+}
+
+// Write a JSON config with one policy and one user per line, so that large
+// exports stay readable
+func (f *formatter) writeJsonConfig(each func(fn func(rowaccess.Policy) error) error, users []rowaccess.User) error {
+	fmt.Fprint(f.w, `{"policies":[`)
+	sep := "\n"
+	err := each(func(policy rowaccess.Policy) error {
+		_, err := fmt.Fprintf(f.w, "%s  %s", sep, policy.ToJson())
+		sep = ",\n"
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		fmt.Fprint(f.w, "\n],\n\"users\":[")
+		sep = "\n"
+		for _, user := range users {
+			data, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(f.w, "%s  %s", sep, data)
+			sep = ",\n"
+		}
+	}
+	_, err = fmt.Fprintln(f.w, "\n]}")
+	return err
+}
+
+// Write the combined policy of several roles or a user, with the roles each
+// value came from
+//
+// The sql format prints the condition for the combined policy, and the dsl
+// format, which has no way to name the roles, is an error.
+func (f *formatter) writeCombinedPolicy(combined rowaccess.CombinedPolicy) error {
+	heading := []string{"column", "value", "effect", "match", "roles"}
+	if len(combined.Or) > 0 {
+		heading = append([]string{"set"}, heading...)
+	}
+	if combined.User != "" {
+		heading = append([]string{"user"}, heading...)
+	}
+	switch f.format {
+	case "json":
+		return writeJson(f.w, combined, "")
+	case "pretty":
+		return writeJson(f.w, combined, "  ")
+	case "csv":
+		cw := csv.NewWriter(f.w)
+		cw.Write(heading)
+		for _, row := range combinedRows(combined) {
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := newTabWriter(f.w)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(heading, "\t")))
+		for _, row := range combinedRows(combined) {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	case "sql":
+		_, err := fmt.Fprintln(f.w, combined.ToSql())
+		return err
+	}
+	return fmt.Errorf("the %s format is only for single roles", f.format)
+}
+
+// Return one row of column, value, effect, match and the roles that grant,
+// except or deny it for each value in the combined policy, led by the user
+// if there is one, with rows for empty columns and policies as policyRows
+// has
+//
+// A union with several sets of columns leads each row with the number of
+// its set, from 1, and each deny row, which applies to every set, with
+// nothing.
+func combinedRows(combined rowaccess.CombinedPolicy) [][]string {
+	var rows [][]string
+	set := ""
+	add := func(column string, sourced_values []rowaccess.SourcedValue, effect string, match rowaccess.MatchKind) {
+		for _, sourced_value := range sourced_values {
+			rows = append(rows, []string{set, column, sourced_value.Value, effect, matchName(match), strings.Join(sourced_value.Roles, " ")})
+		}
+	}
+	for i, items := range append([][]rowaccess.SourcedItem{combined.Policy}, combined.Or...) {
+		set = strconv.Itoa(i + 1)
+		if len(items) == 0 {
+			rows = append(rows, []string{set, "", "", "", "", ""})
+		}
+		for _, sourced_item := range items {
+			if len(sourced_item.Values) == 0 {
+				rows = append(rows, []string{set, sourced_item.Column, "", "", "", ""})
+			}
+			add(sourced_item.Column, sourced_item.Values, effect_allow, sourced_item.Match)
+			add(sourced_item.Column, sourced_item.Except, effect_except, "")
+		}
+	}
+	set = ""
+	for _, sourced_item := range combined.Deny {
+		add(sourced_item.Column, sourced_item.Values, effect_deny, sourced_item.Match)
+	}
+	for i, row := range rows {
+		if len(combined.Or) == 0 {
+			row = row[1:]
+		}
+		if combined.User != "" {
+			row = append([]string{combined.User}, row...)
+		}
+		rows[i] = row
+	}
+	return rows
+}
+
+// The effect of a value in csv and table rows: granted, left out of an
+// __all__ grant, or denied
+const (
+	effect_allow  = "allow"
+	effect_except = "except"
+	effect_deny   = "deny"
+)
+
+// Return one row of role, column, value, effect and match for each value
+// the policy grants, excepts or denies
+//
+// A column with no values, or a role with no columns, still has a row, with
+// the missing fields empty.
+func policyRows(policy rowaccess.Policy) [][]string {
+	var rows [][]string
+	if len(policy.Policy) == 0 {
+		rows = append(rows, []string{policy.Role, "", "", "", ""})
+	}
+	add := func(column string, values []string, effect string, match rowaccess.MatchKind) {
+		for _, value := range values {
+			rows = append(rows, []string{policy.Role, column, value, effect, matchName(match)})
+		}
+	}
+	for _, policy_item := range policy.Policy {
+		if len(policy_item.Values) == 0 {
+			rows = append(rows, []string{policy.Role, policy_item.Column, "", "", ""})
+		}
+		add(policy_item.Column, policy_item.Values, effect_allow, policy_item.Match)
+		add(policy_item.Column, policy_item.Except, effect_except, "")
+	}
+	for _, deny_item := range policy.Deny {
+		add(deny_item.Column, deny_item.Values, effect_deny, deny_item.Match)
+	}
+	return rows
+}
+
+// Return the name of the match, which is exact if it is empty
+func matchName(match rowaccess.MatchKind) string {
+	if match == "" {
+		return string(rowaccess.MatchExact)
+	}
+	return string(match)
+}
+
+// Return the values for a table, after their match unless they are exact
+func tableValues(match rowaccess.MatchKind, values []string) string {
+	if matchName(match) == string(rowaccess.MatchExact) {
+		return strings.Join(values, ", ")
+	}
+	return string(match) + " " + strings.Join(values, ", ")
+}
+
+// Return the policy with empty lists in place of nil ones, as ToJson prints
+// it
+func jsonPolicy(policy rowaccess.Policy) rowaccess.Policy {
+	if policy.Policy == nil {
+		policy.Policy = []rowaccess.PolicyItem{}
+	}
+	return policy
+}
+
+func writeJson(w io.Writer, v any, indent string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", indent)
+	return enc.Encode(v)
+}
+
+func newTabWriter(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+}
+
+// A file output is written to, which only replaces the named file once the
+// command has succeeded
+type outputFile struct {
+	*os.File
+	fname string
+	done  bool
+}
+
+func createOutputFile(fname string) (*outputFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(fname), "."+filepath.Base(fname)+".*")
+	if err != nil {
+		return nil, err
+	}
+	// Temporary files are private; keep the mode of the file being replaced
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(fname); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &outputFile{File: f, fname: fname}, nil
+}
+
+// Move the output into place
+func (o *outputFile) commit() error {
+	o.done = true
+	if err := o.Close(); err != nil {
+		os.Remove(o.Name())
+		return err
+	}
+	if err := os.Rename(o.Name(), o.fname); err != nil {
+		os.Remove(o.Name())
+		return err
+	}
+	return nil
+}
+
+// Throw the output away, unless it has been committed
+func (o *outputFile) abort() {
+	if o.done {
+		return
+	}
+	o.Close()
+	os.Remove(o.Name())
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charlie-gallagher/go-row-access-policies/rowaccess"
+)
+
+func getTestPolicies() []rowaccess.Policy {
+	return []rowaccess.Policy{
+		{Role: "admin", Policy: []rowaccess.PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "east_mgr", Policy: []rowaccess.PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"New York", "Rhode Island"}},
+		}},
+	}
+}
+
+func writeTestPolicies(f *formatter) error {
+	return f.writePolicies(func(fn func(rowaccess.Policy) error) error {
+		for _, policy := range getTestPolicies() {
+			if err := fn(policy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestFormatsWritePolicies(t *testing.T) {
+	tests := map[string]string{
+		"json": `{"policies":[
+  {"role":"admin","policy":[{"column":"Region","values":["__all__"]}]},
+  {"role":"east_mgr","policy":[{"column":"Region","values":["Eastern"]},{"column":"State","values":["New York","Rhode Island"]}]}
+]}
+`,
+		"csv": `role,column,value,effect,match
+admin,Region,__all__,allow,exact
+east_mgr,Region,Eastern,allow,exact
+east_mgr,State,New York,allow,exact
+east_mgr,State,Rhode Island,allow,exact
+`,
+		"table": `ROLE      COLUMN  VALUES
+admin     Region  __all__
+east_mgr  Region  Eastern
+east_mgr  State   New York, Rhode Island
+`,
+		"sql": `-- admin
+TRUE;
+
+-- east_mgr
+"Region" IN ('Eastern') AND "State" IN ('New York', 'Rhode Island');
+`,
+		"dsl": `role admin {
+    Region: __all__;
+}
+
+role east_mgr {
+    Region: Eastern;
+    State: "New York", "Rhode Island";
+}
+`,
+	}
+	for format, expected := range tests {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			f, err := newFormatter(format, &b)
+			if err != nil {
+				t.Fatalf("Error creating formatter: %v\n", err)
+			}
+			if err := writeTestPolicies(f); err != nil {
+				t.Fatalf("Error writing policies: %v\n", err)
+			}
+			if b.String() != expected {
+				t.Errorf("Output mismatch: got %s, want %s\n", b.String(), expected)
+			}
+		})
+	}
+}
+
+func TestFormatsShowExceptAndDeny(t *testing.T) {
+	policy := rowaccess.Policy{Role: "not_west", Policy: []rowaccess.PolicyItem{
+		{Column: "State", Values: []string{"__all__"}, Except: []string{"California", "Texas"}},
+	}, Deny: []rowaccess.PolicyItem{{Column: "Store", Values: []string{"12"}}}}
+	tests := map[string]string{
+		"csv": `role,column,value,effect,match
+not_west,State,__all__,allow,exact
+not_west,State,California,except,exact
+not_west,State,Texas,except,exact
+not_west,Store,12,deny,exact
+`,
+		"table": `ROLE      COLUMN  VALUES
+not_west  State   __all__ except California, Texas
+not_west  Store   deny 12
+`,
+	}
+	for format, expected := range tests {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			f, _ := newFormatter(format, &b)
+			if err := f.writePolicy(policy); err != nil {
+				t.Fatalf("Error writing policy: %v\n", err)
+			}
+			if b.String() != expected {
+				t.Errorf("Output mismatch: got %s, want %s\n", b.String(), expected)
+			}
+		})
+	}
+}
+
+func TestFormatsShowMatches(t *testing.T) {
+	policy := rowaccess.Policy{Role: "sku_reader", Policy: []rowaccess.PolicyItem{
+		{Column: "Sku", Match: rowaccess.MatchPrefix, Values: []string{"SKU-12", "SKU-34"}},
+		{Column: "State", Values: []string{"Ohio"}},
+	}, Deny: []rowaccess.PolicyItem{{Column: "Store", Match: rowaccess.MatchGlob, Values: []string{"9*"}}}}
+	tests := map[string]string{
+		"csv": `role,column,value,effect,match
+sku_reader,Sku,SKU-12,allow,prefix
+sku_reader,Sku,SKU-34,allow,prefix
+sku_reader,State,Ohio,allow,exact
+sku_reader,Store,9*,deny,glob
+`,
+		"table": `ROLE        COLUMN  VALUES
+sku_reader  Sku     prefix SKU-12, SKU-34
+sku_reader  State   Ohio
+sku_reader  Store   deny glob 9*
+`,
+		"sql": `substr("Sku", 1, 6) IN ('SKU-12', 'SKU-34') AND "State" IN ('Ohio') AND ("Store" IS NULL OR NOT "Store" GLOB '9*')
+`,
+		"dsl": `role sku_reader {
+    Sku: prefix SKU-12, SKU-34;
+    State: Ohio;
+    deny Store: glob 9*;
+}
+`,
+	}
+	for format, expected := range tests {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			f, _ := newFormatter(format, &b)
+			if err := f.writePolicy(policy); err != nil {
+				t.Fatalf("Error writing policy: %v\n", err)
+			}
+			if b.String() != expected {
+				t.Errorf("Output mismatch: got %s, want %s\n", b.String(), expected)
+			}
+		})
+	}
+}
+
+func TestJsonFormatsCanBeLoaded(t *testing.T) {
+	for _, format := range []string{"json", "pretty"} {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			f, _ := newFormatter(format, &b)
+			if err := writeTestPolicies(f); err != nil {
+				t.Fatalf("Error writing policies: %v\n", err)
+			}
+			var policy_set rowaccess.PolicySet
+			if err := json.Unmarshal(b.Bytes(), &policy_set); err != nil {
+				t.Fatalf("Error decoding output: %v\n", err)
+			}
+			store := rowaccess.NewMemStore()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading output: %v\n", err)
+			}
+			policy, err := store.GetPolicy(t.Context(), "east_mgr")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			expected := getTestPolicies()[1]
+			if policy.ToJson() != expected.ToJson() {
+				t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected.ToJson())
+			}
+		})
+	}
+}
+
+func TestCsvValuesAreQuoted(t *testing.T) {
+	var b bytes.Buffer
+	f, _ := newFormatter("csv", &b)
+	policy := rowaccess.Policy{Role: "odd", Policy: []rowaccess.PolicyItem{{Column: "Name", Values: []string{`Smith, "Jr"`}}}}
+	if err := f.writePolicy(policy); err != nil {
+		t.Fatalf("Error writing policy: %v\n", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("Error reading csv: %v\n", err)
+	}
+	if len(records) != 2 || records[1][2] != `Smith, "Jr"` {
+		t.Errorf("Records mismatch: got %v\n", records)
+	}
+}
+
+func TestFormatsWriteNames(t *testing.T) {
+	tests := map[string]string{
+		"json":   `["Region","State"]` + "\n",
+		"pretty": "[\n  \"Region\",\n  \"State\"\n]\n",
+		"csv":    "column\nRegion\nState\n",
+		"table":  "COLUMN\nRegion\nState\n",
+	}
+	for format, expected := range tests {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			f, _ := newFormatter(format, &b)
+			if err := f.writeNames("column", []string{"Region", "State"}); err != nil {
+				t.Fatalf("Error writing names: %v\n", err)
+			}
+			if b.String() != expected {
+				t.Errorf("Output mismatch: got %s, want %s\n", b.String(), expected)
+			}
+		})
+	}
+	f, _ := newFormatter("sql", &bytes.Buffer{})
+	if err := f.writeNames("column", []string{"Region"}); err == nil {
+		t.Errorf("Expected error writing names as sql, but got none")
+	}
+}
+
+func TestFmtConvertsConfigs(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join("..", "..", "config.json")
+	dsl_file := filepath.Join(dir, "config.policy")
+	if code, _, stderr := runRowctrl(t, "fmt", config, "--output", dsl_file); code != 0 {
+		t.Fatalf("Error formatting config: %s\n", stderr)
+	}
+	data, err := os.ReadFile(dsl_file)
+	if err != nil {
+		t.Fatalf("Error reading formatted config: %v\n", err)
+	}
+	if !strings.HasPrefix(string(data), "role admin {\n    Region: __all__;\n") {
+		t.Errorf("Formatted config mismatch: got %s\n", data)
+	}
+
+	// Back to JSON, which is the config as export prints it
+	code, stdout, stderr := runRowctrl(t, "fmt", "--format", "json", dsl_file)
+	if code != 0 {
+		t.Fatalf("Error formatting config: %s\n", stderr)
+	}
+	db := filepath.Join(dir, "ex.db")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, dsl_file); code != 0 {
+		t.Fatalf("Error loading formatted config: %s\n", stderr)
+	}
+	if _, exported, _ := runRowctrl(t, "export", "--db", db); exported != stdout {
+		t.Errorf("Round trip mismatch:\ngot  %s\nwant %s\n", stdout, exported)
+	}
+	if code, stdout, _ := runRowctrl(t, "diff", config, dsl_file); code != 0 {
+		t.Errorf("Expected no difference between config and its formatted form, got %s\n", stdout)
+	}
+}
+
+func TestFmtKeepsUsers(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.policy")
+	if err := os.WriteFile(config, []byte("role admin { Region: __all__ }\nuser alice { admin }\nuser bob {}\n"), 0o644); err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	want := "{\"policies\":[\n" +
+		"  {\"role\":\"admin\",\"policy\":[{\"column\":\"Region\",\"values\":[\"__all__\"]}]}\n" +
+		"],\n\"users\":[\n" +
+		"  {\"user\":\"alice\",\"roles\":[\"admin\"]},\n" +
+		"  {\"user\":\"bob\",\"roles\":[]}\n" +
+		"]}\n"
+	code, stdout, stderr := runRowctrl(t, "fmt", "--format", "json", config)
+	if code != 0 {
+		t.Fatalf("Error formatting config: %s\n", stderr)
+	}
+	if stdout != want {
+		t.Errorf("Formatted config mismatch: got %s, want %s\n", stdout, want)
+	}
+	if code, stdout, _ := runRowctrl(t, "fmt", config); !strings.HasSuffix(stdout, "}\n\nuser alice { admin }\nuser bob {}\n") || code != 0 {
+		t.Errorf("Formatted config mismatch: got %s\n", stdout)
+	}
+}
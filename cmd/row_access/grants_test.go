@@ -0,0 +1,335 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGrantAndRevokeChangeValues(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	config := filepath.Join("..", "..", "config.json")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+
+	code, stdout, stderr := runRowctrl(t, "grant", "--db", db, "--dry-run", "pa_sales_manager", "State", "Ohio", "Delaware")
+	if code != diff_exit_code || stdout != "~ role pa_sales_manager\n    ~ State: +Ohio +Delaware\n0 role(s) added, 0 removed, 1 changed\n" {
+		t.Errorf("Dry run mismatch: got %d: %s%s\n", code, stdout, stderr)
+	}
+	if _, stdout, _ := runRowctrl(t, "get", "--db", db, "pa_sales_manager"); strings.Contains(stdout, "Ohio") {
+		t.Errorf("Dry run changed the database: %s\n", stdout)
+	}
+
+	steps := []struct {
+		args   []string
+		stdout string
+	}{
+		{[]string{"grant", "--db", db, "pa_sales_manager", "State", "Ohio", "Delaware"}, "~ role pa_sales_manager\n    ~ State: +Ohio +Delaware\n0 role(s) added, 0 removed, 1 changed\n"},
+		{[]string{"grant", "--db", db, "pa_sales_manager", "State", "Ohio"}, "no changes\n"},
+		{[]string{"revoke", "--db", db, "pa_sales_manager", "State", "Pennsylvania"}, "~ role pa_sales_manager\n    ~ State: -Pennsylvania\n0 role(s) added, 0 removed, 1 changed\n"},
+		{[]string{"grant", "--db", db, "pa_sales_manager", "Sku", "--match", "prefix", "SKU-12"}, "~ role pa_sales_manager\n    + Sku: prefix +SKU-12\n0 role(s) added, 0 removed, 1 changed\n"},
+		{[]string{"revoke", "--db", db, "pa_sales_manager", "Sku", "__all__"}, "~ role pa_sales_manager\n    - Sku: prefix -SKU-12\n0 role(s) added, 0 removed, 1 changed\n"},
+		{[]string{"revoke", "--db", db, "admin", "State", "Ohio"}, "~ role admin\n    ~ State: +except:Ohio\n0 role(s) added, 0 removed, 1 changed\n"},
+		{[]string{"grant", "--db", db, "admin", "State", "Ohio"}, "~ role admin\n    ~ State: -except:Ohio\n0 role(s) added, 0 removed, 1 changed\n"},
+	}
+	for _, step := range steps {
+		code, stdout, stderr := runRowctrl(t, step.args...)
+		if code != 0 {
+			t.Fatalf("Error running %v: %s\n", step.args, stderr)
+		}
+		if stdout != step.stdout {
+			t.Errorf("Output mismatch for %v: got %s, want %s\n", step.args, stdout, step.stdout)
+		}
+	}
+	_, stdout, _ = runRowctrl(t, "get", "--db", db, "pa_sales_manager")
+	if want := `{"role":"pa_sales_manager","policy":[{"column":"Region","values":["Eastern"]},{"column":"State","values":["Ohio","Delaware"]}]}`; strings.TrimSpace(stdout) != want {
+		t.Errorf("Policy mismatch: got %s, want %s\n", stdout, want)
+	}
+
+	failures := [][]string{
+		{"revoke", "--db", db, "west_mgr", "State", "Ohio"},
+		{"revoke", "--db", db, "admin", "State", "--match", "prefix", "O"},
+		{"grant", "--db", db, "admin", "State", "Ohio", "__all__"},
+		{"grant", "--db", db, "admin", "State"},
+		{"grant", "--db", db, "pa_sales_manager", "State", "--match", "glob", "O*"},
+		{"grant", "--db", db, "pa_sales_manager", "Sku", "--match", "regex", ".*"},
+		{"grant", "--db", db, "pa_sales_manager", "Sku", "--match", "suffix", "12"},
+	}
+	for _, args := range failures {
+		if code, _, _ := runRowctrl(t, args...); code != 1 {
+			t.Errorf("Exit code mismatch for %v: got %d, want 1\n", args, code)
+		}
+	}
+}
+
+func TestPatchAppliesChangesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	db := "sqlite:" + filepath.Join(dir, "ex.db")
+	config := filepath.Join("..", "..", "config.json")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	_, before, _ := runRowctrl(t, "export", "--db", db)
+
+	failing := filepath.Join(dir, "failing.json")
+	err := os.WriteFile(failing, []byte(`[
+		{"op": "grant", "role": "pa_sales_manager", "column": "State", "values": ["Ohio"]},
+		{"op": "revoke", "role": "admin", "column": "State", "match": "prefix", "values": ["O"]}
+	]`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing patch: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "patch", "--db", db, failing); code != 1 || !strings.Contains(stderr, "has exact values on State") {
+		t.Errorf("Expected failing patch to fail, got %d: %s\n", code, stderr)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`[{"op": "add", "role": "admin", "column": "State", "values": ["Ohio"]}]`), 0o644); err != nil {
+		t.Fatalf("Error writing patch: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "--db", db, "--patch", invalid); code != 1 || !strings.Contains(stderr, "/0/op") {
+		t.Errorf("Expected invalid patch to fail with its pointer, got %d: %s\n", code, stderr)
+	}
+	if _, after, _ := runRowctrl(t, "export", "--db", db); after != before {
+		t.Errorf("Failed patch changed the database:\ngot  %s\nwant %s\n", after, before)
+	}
+
+	patch := `[
+		{"op": "grant", "role": "pa_sales_manager", "column": "State", "values": ["Ohio"]},
+		{"op": "revoke", "role": "admin", "column": "State", "values": ["__all__"]},
+		{"op": "grant", "role": "auditor", "column": "Region", "values": ["__all__"]}
+	]`
+	code, stdout, stderr := runRowctrlWithInput(t, patch, "patch", "--db", db, "--color", "never", "-")
+	if code != 0 {
+		t.Fatalf("Error applying patch: %s\n", stderr)
+	}
+	if !strings.HasSuffix(stdout, "1 role(s) added, 0 removed, 2 changed\n") {
+		t.Errorf("Patch output mismatch: got %s\n", stdout)
+	}
+	_, stdout, _ = runRowctrl(t, "list", "roles", "--db", db)
+	if !strings.Contains(stdout, `"auditor"`) {
+		t.Errorf("Patch did not add role: %s\n", stdout)
+	}
+}
+
+func TestExecRunsStatements(t *testing.T) {
+	dir := t.TempDir()
+	db := "sqlite:" + filepath.Join(dir, "ex.db")
+	config := filepath.Join("..", "..", "config.json")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+
+	statements := filepath.Join(dir, "changes.sql")
+	err := os.WriteFile(statements, []byte(`-- Set up the north east manager
+CREATE ROLE ne_manager;
+GRANT Region IN ('Eastern', 'Northern') TO ROLE ne_manager;
+DROP ROLE eastern_region_sales_manager;
+`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing statements: %v\n", err)
+	}
+	code, stdout, stderr := runRowctrl(t, "exec", "--db", db, "--color", "never", statements)
+	if code != 0 {
+		t.Fatalf("Error running statements: %s\n", stderr)
+	}
+	expected := `- role eastern_region_sales_manager
+    - Region: -Eastern
+    - State: -__all__
++ role ne_manager
+    + Region: +Eastern +Northern
+1 role(s) added, 1 removed, 0 changed
+`
+	if stdout != expected {
+		t.Errorf("Output mismatch: got %s, want %s\n", stdout, expected)
+	}
+
+	_, before, _ := runRowctrl(t, "export", "--db", db)
+	failures := map[string]struct {
+		input  string
+		stderr string
+	}{
+		"Syntax error":  {"REVOKE Region IN ('Northern') FROM ROLE ne_manager;\nGRANT Region IN ('Western')\n  FROM ROLE ne_manager;", "line 3, column 3: expected TO, found FROM"},
+		"Missing role":  {"REVOKE Region IN ('Northern') FROM ROLE ne_manager;\nDROP ROLE eastern_region_sales_manager;", "role does not exist"},
+		"Existing role": {"DROP ROLE ne_manager;\nCREATE ROLE admin;", "role already exists"},
+	}
+	for name, test := range failures {
+		code, _, stderr := runRowctrlWithInput(t, test.input, "exec", "--db", db)
+		if code != 1 || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%s: expected failure with %q, got %d: %s\n", name, test.stderr, code, stderr)
+		}
+	}
+	if _, after, _ := runRowctrl(t, "export", "--db", db); after != before {
+		t.Errorf("Failed statements changed the database:\ngot  %s\nwant %s\n", after, before)
+	}
+}
+
+func TestGetResolvesExtends(t *testing.T) {
+	dir := t.TempDir()
+	db := "sqlite:" + filepath.Join(dir, "ex.db")
+	config := filepath.Join(dir, "config.policy")
+	err := os.WriteFile(config, []byte(`role eastern_region_sales_manager { Region: Eastern; State: __all__ }
+role ne_sales_manager extends eastern_region_sales_manager {
+    State: "New York", Vermont;
+}
+role orphan extends retired_manager {}
+`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+
+	tests := map[string]struct {
+		args   []string
+		stdout string
+	}{
+		"Own policy": {[]string{"get", "--db", db, "ne_sales_manager"},
+			`{"role":"ne_sales_manager","extends":["eastern_region_sales_manager"],"policy":[{"column":"State","values":["New York","Vermont"]}]}`},
+		"Effective policy": {[]string{"get", "--db", db, "--effective", "ne_sales_manager"},
+			`{"role":"ne_sales_manager","policy":[{"column":"State","values":["New York","Vermont"]},{"column":"Region","values":["Eastern"]}]}`},
+		"Legacy flags": {[]string{"--db", db, "--get", "ne_sales_manager", "--effective", "-f", "dsl"},
+			"role ne_sales_manager {\n    State: \"New York\", Vermont;\n    Region: Eastern;\n}"},
+	}
+	for name, test := range tests {
+		code, stdout, stderr := runRowctrl(t, test.args...)
+		if code != 0 {
+			t.Fatalf("%s: error getting policy: %s\n", name, stderr)
+		}
+		if strings.TrimSpace(stdout) != test.stdout {
+			t.Errorf("%s: output mismatch: got %s, want %s\n", name, stdout, test.stdout)
+		}
+	}
+
+	if code, _, stderr := runRowctrl(t, "get", "--db", db, "--effective", "orphan"); code != 1 || !strings.Contains(stderr, "role orphan extends retired_manager: role does not exist") {
+		t.Errorf("Expected missing parent to fail, got %d: %s\n", code, stderr)
+	}
+	cycle := filepath.Join(dir, "cycle.policy")
+	if err := os.WriteFile(cycle, []byte("role eastern_region_sales_manager extends ne_sales_manager { Region: Eastern }"), 0o644); err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, cycle); code != 1 || !strings.Contains(stderr, "cycle: eastern_region_sales_manager -> ne_sales_manager") {
+		t.Errorf("Expected cycle to fail, got %d: %s\n", code, stderr)
+	}
+}
+
+func TestGetCombinesUserRoles(t *testing.T) {
+	dir := t.TempDir()
+	db := "sqlite:" + filepath.Join(dir, "users.db")
+	config := filepath.Join(dir, "config.policy")
+	err := os.WriteFile(config, []byte(`role eastern_region_sales_manager { Region: Eastern; State: __all__ }
+role ohio_reader { State: Ohio, Maine; Store: __all__ }
+`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	users := filepath.Join(dir, "users.csv")
+	if err := os.WriteFile(users, []byte("user,role\nalice,eastern_region_sales_manager\nalice,ohio_reader\nbob,\n"), 0o644); err != nil {
+		t.Fatalf("Error writing users: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config, users); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+
+	tests := map[string]struct {
+		args   []string
+		stdout string
+	}{
+		"List users": {[]string{"list", "users", "--db", db}, `["alice","bob"]`},
+		"Table": {[]string{"get", "--db", db, "--user", "alice", "-f", "table"}, strings.Join([]string{
+			"USER   COLUMN  VALUE    EFFECT  MATCH  ROLES",
+			"alice  Region  Eastern  allow   exact  eastern_region_sales_manager",
+			"alice  State   Ohio     allow   exact  ohio_reader",
+			"alice  State   Maine    allow   exact  ohio_reader",
+			"alice  Store   __all__  allow   exact  ohio_reader",
+		}, "\n")},
+		"SQL":      {[]string{"get", "--db", db, "--user", "alice", "-f", "sql"}, `"Region" IN ('Eastern') AND "State" IN ('Ohio', 'Maine')`},
+		"No roles": {[]string{"get", "--db", db, "--user", "bob"}, `{"user":"bob","roles":[],"mode":"intersection","policy":[]}`},
+	}
+	for name, test := range tests {
+		code, stdout, stderr := runRowctrl(t, test.args...)
+		if code != 0 {
+			t.Fatalf("%s: error getting policy: %s\n", name, stderr)
+		}
+		if strings.TrimSpace(stdout) != test.stdout {
+			t.Errorf("%s: output mismatch: got %s, want %s\n", name, stdout, test.stdout)
+		}
+	}
+
+	failures := map[string][]string{
+		"Role and user": {"get", "--db", db, "--user", "alice", "ohio_reader"},
+		"Missing user":  {"get", "--db", db, "--user", "carol"},
+		"DSL":           {"get", "--db", db, "--user", "alice", "-f", "dsl"},
+	}
+	for name, args := range failures {
+		if code, _, _ := runRowctrl(t, args...); code != 1 {
+			t.Errorf("%s: expected status 1, got %d\n", name, code)
+		}
+	}
+
+	// Deleting a role removes its members
+	if code, _, stderr := runRowctrl(t, "delete", "role", "--db", db, "ohio_reader"); code != 0 {
+		t.Fatalf("Error deleting role: %s\n", stderr)
+	}
+	code, stdout, stderr := runRowctrl(t, "get", "--db", db, "--user", "alice", "-f", "sql")
+	if code != 0 || strings.TrimSpace(stdout) != `"Region" IN ('Eastern')` {
+		t.Errorf("Policy mismatch after delete: got %d: %s%s\n", code, stdout, stderr)
+	}
+}
+
+func TestGetCombinesRolesInMode(t *testing.T) {
+	dir := t.TempDir()
+	db := "sqlite:" + filepath.Join(dir, "combine.db")
+	config := filepath.Join(dir, "config.policy")
+	err := os.WriteFile(config, []byte(`role ohio_reader { State: Ohio; Store: __all__ }
+role maine_reader { State: Maine }
+role eastern { Region: Eastern }
+user alice { ohio_reader, maine_reader }
+`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, config); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+
+	steps := []struct {
+		args   []string
+		stdout string
+	}{
+		{[]string{"combine-mode", "--db", db}, "intersection"},
+		{[]string{"get", "--db", db, "-f", "sql", "ohio_reader", "maine_reader"}, "FALSE"},
+		{[]string{"get", "--db", db, "-f", "csv", "--combine", "union", "ohio_reader", "maine_reader"},
+			"column,value,effect,match,roles\nState,Ohio,allow,exact,ohio_reader\nState,Maine,allow,exact,maine_reader\nStore,__all__,allow,exact,ohio_reader maine_reader"},
+		{[]string{"get", "--db", db, "-f", "sql", "--combine", "union", "ohio_reader", "eastern"},
+			`(("State" IN ('Ohio')) OR ("Region" IN ('Eastern')))`},
+		{[]string{"get", "--db", db, "-f", "csv", "--combine", "union", "ohio_reader", "eastern"},
+			"set,column,value,effect,match,roles\n1,State,Ohio,allow,exact,ohio_reader\n1,Store,__all__,allow,exact,ohio_reader\n2,Region,Eastern,allow,exact,eastern"},
+		{[]string{"combine-mode", "--db", db, "union"}, ""},
+		{[]string{"combine-mode", "--db", db}, "union"},
+		{[]string{"get", "--db", db, "-f", "sql", "--user", "alice"}, `"State" IN ('Ohio', 'Maine')`},
+		{[]string{"get", "--db", db, "-f", "sql", "--user", "alice", "--combine", "intersection"}, "FALSE"},
+	}
+	for _, step := range steps {
+		code, stdout, stderr := runRowctrl(t, step.args...)
+		if code != 0 {
+			t.Fatalf("%v: error: %s\n", step.args, stderr)
+		}
+		if strings.TrimSpace(stdout) != step.stdout {
+			t.Errorf("%v: output mismatch: got %s, want %s\n", step.args, stdout, step.stdout)
+		}
+	}
+
+	failures := map[string][]string{
+		"Unknown mode":          {"combine-mode", "--db", db, "both"},
+		"Unknown --combine":     {"get", "--db", db, "--combine", "both", "ohio_reader", "maine_reader"},
+		"--combine on one role": {"get", "--db", db, "--combine", "union", "ohio_reader"},
+	}
+	for name, args := range failures {
+		if code, _, _ := runRowctrl(t, args...); code != 1 {
+			t.Errorf("%s: expected status 1, got %d\n", name, code)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The width help text is wrapped to
+const help_width = 78
+
+// I confess I wrote a weak version of this help text and then had Cursor
+// make it better. It used man-page formatting instead of help-text formatting,
+// but that's ok. The sections about commands are generated from the command
+// definitions; these are the rest.
+const man_header = `ROWCTRL(1)                    User Commands                   ROWCTRL(1)
+
+NAME
+       rowctrl - row access control policy management tool
+`
+
+const man_description = `DESCRIPTION
+       rowctrl is a command-line tool for managing row-level access control
+       policies in business intelligence applications. It provides functionality
+       to load policy configurations into a SQLite database and retrieve
+       policies for specific roles.
+
+       The tool implements a separation of policy and enforcement, where this
+       module controls the policy definitions and another module handles
+       enforcement when necessary.
+`
+
+const man_options = `OPTIONS
+       --help is taken by every command, and --db by every command that
+       uses a store. Both may also be given before the command.
+
+       -h, --help
+              Display help for rowctrl, or for the command, and exit.
+
+       -d, --db STORE
+              Specify the policy store to use for policy storage and
+              retrieval. STORE is one of:
+
+              sqlite:FILE
+                     A SQLite database file. Databases written by a newer
+                     version of rowctrl are refused.
+
+              mem:   An in-memory store that lasts only as long as the
+                     command. Useful for checking that a config loads.
+
+              A STORE with no backend prefix is taken to be a SQLite
+              database file. migrate and schema-version need a SQLite
+              database.
+
+       get, list, export and fmt take --format and --output.
+
+       -f, --format FORMAT
+              Print the output as FORMAT, one of:
+
+              json   Compact JSON, the default. Exported policies are one
+                     role per line.
+
+              pretty Indented JSON.
+
+              csv    Comma-separated values with a header row, one row for
+                     each value a role may see.
+
+              table  Aligned columns with a heading, for reading in a
+                     terminal.
+
+              sql    The SQL condition each policy stands for. Only for get
+                     and export.
+
+              dsl    The policy language (see fmt), which fmt prints by
+                     default. Only for get, export and fmt, and not for
+                     combined policies.
+
+       -o, --output FILE
+              Write the output to FILE instead of standard output. FILE is
+              only replaced once the command has succeeded.
+`
+
+const man_trailer = `CONFIGURATION FILE FORMAT
+       The configuration file is a JSON document containing an array of policy
+       definitions. Each policy consists of a role name and an array of policy
+       items that define column access rules.
+
+       Example configuration structure:
+              {
+                "policies": [
+                  {
+                    "role": "admin",
+                    "policy": [
+                      {"column": "Region", "values": ["__all__"]},
+                      {"column": "State", "values": ["__all__"]}
+                    ]
+                  },
+                  {
+                    "role": "eastern_region_sales_manager",
+                    "policy": [
+                      {"column": "Region", "values": ["Eastern"]},
+                      {"column": "State", "values": ["__all__"]}
+                    ]
+                  }
+                ]
+              }
+
+       A role may list the roles it extends, in order of precedence, as
+       "extends": ["eastern_region_sales_manager"]. get --effective merges
+       them into its policy. Roles may not extend each other in a cycle.
+
+       A column granted __all__ may leave values out with
+       "except": ["California"], and a role may list values it can never see
+       as "deny": [{"column": "Store", "values": ["12"]}]. Denied values stay
+       hidden whatever the role or the other roles of a user grant.
+
+       A column's values match exactly unless it has "match": "prefix",
+       "glob" (SQLite GLOB, e.g. SKU-[0-9]*) or "regex" (RE2, matched against
+       the whole value). Deny items take a match too. Patterns that are
+       invalid, can never match, or match every value are rejected, where a
+       pattern matches every value if it matches every one that is not empty
+       and has no line break, as .* and (?s).+ do. Filters with regex need a
+       REGEXP function registered with SQLite.
+
+       A config may list users after its policies, as
+       "users": [{"user": "alice", "roles": ["pa_sales_manager"]}]. Users can
+       also be loaded from a CSV file with a user,role header.
+
+       Special Values:
+              "__all__"  Grants access to all values for the specified column
+
+EXAMPLES
+       Load policies from a configuration file:
+              rowctrl load --db policies.db config.json
+
+       Make a database match a directory of configs, deleting roles
+       that are no longer in them:
+              rowctrl load --db policies.db --sync --yes policies/*.json
+
+       Check what loading a config would change, failing CI if it would:
+              rowctrl load --db prod.db --dry-run config.json
+
+       Confirm that promoting dev.db to production changes what you expect:
+              rowctrl diff prod.db dev.db
+
+       Grant a role two more states without reloading its config:
+              rowctrl grant --db policies.db pa_sales_manager State Ohio Delaware
+
+       Grant a role every SKU that starts with SKU-12:
+              rowctrl grant --db policies.db sku_reader Sku --match prefix SKU-12
+
+       Apply a reviewed file of grants and revokes:
+              rowctrl patch --db policies.db changes.json
+
+       Run admin statements from a file:
+              rowctrl exec --db policies.db changes.sql
+
+       Retrieve policy for a specific role:
+              rowctrl get --db policies.db admin
+
+       Retrieve the policy of a role with the roles it extends merged in:
+              rowctrl get --db policies.db --effective north_eastern_sales_manager
+
+       Retrieve what a user can see through all of their roles:
+              rowctrl get --db policies.db --user alice --format table
+
+       Retrieve what two roles can see between them, as a union:
+              rowctrl get --db policies.db --combine union ohio_reader maine_reader
+
+       Save the policy of a role to a file:
+              rowctrl get --db policies.db pa_sales_manager --output policy.json
+
+       Export every policy to a spreadsheet:
+              rowctrl export --db policies.db --format csv --output policies.csv
+
+       List the roles in a database:
+              rowctrl --db policies.db list roles
+
+       Fix a misspelled role name:
+              rowctrl rename role --db policies.db pa_sales_manger pa_sales_manager
+
+       Convert a JSON config to the policy language, and back:
+              rowctrl fmt config.json --output config.policy
+              rowctrl fmt --format pretty config.policy
+
+       Check a configuration file before loading it:
+              rowctrl validate config.json
+
+AUTHOR
+       Charlie Gallagher, October 2025
+
+SEE ALSO
+       sqlite3(1), json(1)
+
+BUGS
+       Report bugs and feature requests to the project repository.
+
+COPYRIGHT
+       This is free software; see the source for copying conditions.`
+
+// Return the manual, with the synopsis, commands and legacy flags generated
+// from the command definitions
+func manPage() string {
+	var b strings.Builder
+	b.WriteString(man_header)
+
+	b.WriteString("\nSYNOPSIS\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "       rowctrl %s\n", cmd.usage())
+	}
+
+	b.WriteString("\n" + man_description)
+
+	b.WriteString("\nCOMMANDS\n")
+	for i, cmd := range commands {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "       %s\n", cmd.usage())
+		b.WriteString(wrap(cmd.description, 14))
+		// --db and the output flags are described once, under OPTIONS
+		hidden := []string{"db"}
+		if cmd.output {
+			hidden = append(hidden, "format", "output")
+		}
+		if usages := commandFlagUsages(cmd, hidden...); usages != "" {
+			b.WriteString("\n" + indent(usages, 12))
+		}
+	}
+
+	b.WriteString("\n" + man_options)
+
+	b.WriteString("\nLEGACY FLAGS\n")
+	b.WriteString(wrap(`The flags rowctrl took before it had commands still work, and run the
+command they stand for. Options given with them are passed on to the
+command.`, 7))
+	b.WriteString("\n")
+	for _, cmd := range commands {
+		if cmd.alias != "" {
+			fmt.Fprintf(&b, "       %-22s rowctrl %s\n", cmd.alias, strings.Join(append([]string{cmd.name}, cmd.args...), " "))
+		}
+	}
+
+	b.WriteString("\n" + man_trailer)
+	return b.String()
+}
+
+// Return the help for one command
+func commandHelp(cmd *command) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "usage: rowctrl %s\n\n", cmd.usage())
+	b.WriteString(wrap(cmd.description, 0))
+	if usages := commandFlagUsages(cmd); usages != "" {
+		b.WriteString("\noptions:\n" + usages)
+	}
+	if cmd.alias != "" {
+		fmt.Fprintf(&b, "\nalso run by the legacy flag %s\n", cmd.alias)
+	}
+	return b.String()
+}
+
+// Return the usage of every flag the command takes, other than --help and
+// the hidden ones
+func commandFlagUsages(cmd *command, hidden ...string) string {
+	var opts options
+	fs := cmd.flagSet(&opts)
+	for _, name := range append(hidden, "help") {
+		if fs.Lookup(name) != nil {
+			fs.MarkHidden(name)
+		}
+	}
+	return fs.FlagUsages()
+}
+
+// Wrap each paragraph of the text to help_width, indenting every line
+func wrap(text string, margin int) string {
+	var b strings.Builder
+	for i, paragraph := range strings.Split(text, "\n\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line != "" && margin+len(line)+1+len(word) > help_width {
+				fmt.Fprintf(&b, "%*s%s\n", margin, "", line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		fmt.Fprintf(&b, "%*s%s\n", margin, "", line)
+	}
+	return b.String()
+}
+
+// Indent every line of the text
+func indent(text string, margin int) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = strings.Repeat(" ", margin) + line
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/charlie-gallagher/go-row-access-policies/rowaccess"
+	"github.com/spf13/pflag"
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Run rowctrl with the arguments, returning the exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	args, err := translateLegacyArgs(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "error: no command given, see rowctrl help")
+		return 1
+	}
+	cmd, rest := findCommand(args)
+	if cmd == nil {
+		fmt.Fprintln(stderr, "error:", unknownCommand(args))
+		return 1
+	}
+
+	inv := &invocation{stdin: stdin, stdout: stdout, stderr: stderr}
+	fs := cmd.flagSet(&inv.opts)
+	if err := fs.Parse(rest); err != nil {
+		fmt.Fprintf(stderr, "error: %v\nusage: rowctrl %s\n", err, cmd.usage())
+		return 1
+	}
+	if inv.opts.help {
+		fmt.Fprint(stdout, commandHelp(cmd))
+		return 0
+	}
+	inv.args = fs.Args()
+	min_args, max_args := cmd.argRange()
+	if len(inv.args) < min_args || (max_args >= 0 && len(inv.args) > max_args) {
+		fmt.Fprintf(stderr, "error: wrong number of arguments\nusage: rowctrl %s\n", cmd.usage())
+		return 1
+	}
+	if cmd.db && inv.opts.db == "" {
+		fmt.Fprintln(stderr, "error: --db option is required")
+		return 1
+	}
+
+	var output *outputFile
+	if cmd.output {
+		if inv.opts.output != "" {
+			if output, err = createOutputFile(inv.opts.output); err != nil {
+				fmt.Fprintln(stderr, "error: creating output file:", err)
+				return 1
+			}
+			// Discards the file unless the command succeeds
+			defer output.abort()
+			inv.stdout = output
+		}
+		if inv.out, err = newFormatter(inv.opts.format, inv.stdout); err != nil {
+			fmt.Fprintln(stderr, "error:", err)
+			return 1
+		}
+	}
+
+	if cmd.store {
+		store, err := rowaccess.OpenStore(ctx, inv.opts.db)
+		if err != nil {
+			fmt.Fprintln(stderr, "error: opening store:", err)
+			return 1
+		}
+		defer store.Close()
+		inv.store = store
+	}
+
+	if err := cmd.run(ctx, inv); err != nil {
+		if errors.Is(err, errDiffFound) {
+			return diff_exit_code
+		}
+		printError(stderr, err)
+		return 1
+	}
+	if output != nil {
+		if err := output.commit(); err != nil {
+			fmt.Fprintln(stderr, "error: writing output file:", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// Print an error, listing each problem in a config on its own line
+func printError(w io.Writer, err error) {
+	var config_errors rowaccess.ConfigErrors
+	if !errors.As(err, &config_errors) {
+		fmt.Fprintln(w, "error:", err)
+		return
+	}
+	fmt.Fprintf(w, "error: config has %d problem(s):\n", len(config_errors))
+	for _, config_error := range config_errors {
+		fmt.Fprintf(w, "  %s\n", config_error)
+	}
+}
+
+// Return the error for arguments that name no command
+func unknownCommand(args []string) error {
+	if names := commandsStartingWith(args[0]); len(names) > 0 {
+		return fmt.Errorf("%s needs a subcommand: %s", args[0], strings.Join(names, ", "))
+	}
+	return fmt.Errorf("unknown command %q, see rowctrl help", strings.Join(args, " "))
+}
+
+// Rewrite the flags rowctrl took before it had commands as the command they
+// stand for, e.g. --db ex.db --get admin as get --db ex.db -- admin
+//
+// Arguments that start with a command are returned as they are. Options
+// given before a command are passed on to it.
+func translateLegacyArgs(args []string) ([]string, error) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "-") {
+		return args, nil
+	}
+	var help bool
+	var db_file string
+	var config_file string
+	var role string
+	var patch_file string
+	var verbose bool
+	var sync bool
+	var prune bool
+	var yes bool
+	var dry_run bool
+	var effective bool
+	var migrate bool
+	var schema_version bool
+	var print_schema bool
+	var format string
+	var output string
+
+	fs := pflag.NewFlagSet("rowctrl", pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.SetInterspersed(false)
+	fs.BoolVarP(&help, "help", "h", false, "display help message")
+	fs.StringVarP(&db_file, "db", "d", "", "policy store, as sqlite:FILE, mem: or a database file")
+	fs.StringVarP(&config_file, "load", "l", "", "config file to load into database")
+	fs.StringVarP(&role, "get", "g", "", "role to get policy for from database")
+	fs.StringVar(&patch_file, "patch", "", "patch of grants and revokes to apply to the database")
+	fs.BoolVarP(&verbose, "verbose", "v", false, "report what --load wrote and its throughput")
+	fs.BoolVar(&sync, "sync", false, "make the database match --load exactly")
+	fs.BoolVar(&prune, "prune", false, "same as --sync")
+	fs.BoolVarP(&yes, "yes", "y", false, "delete roles with --sync without asking")
+	fs.BoolVarP(&dry_run, "dry-run", "n", false, "print what --load would change")
+	fs.BoolVar(&effective, "effective", false, "resolve the roles --get's role extends")
+	fs.BoolVar(&migrate, "migrate", false, "upgrade the database to the latest schema version")
+	fs.BoolVar(&schema_version, "schema-version", false, "print the schema version of the database")
+	fs.BoolVar(&print_schema, "print-schema", false, "print the JSON schema configs are validated against")
+	fs.StringVarP(&format, "format", "f", "", "output format")
+	fs.StringVarP(&output, "output", "o", "", "file to write output to")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if help {
+		return append([]string{"help"}, fs.Args()...), nil
+	}
+
+	var cmd *command
+	var rest []string
+	if fs.NArg() > 0 {
+		if config_file != "" || role != "" || patch_file != "" || migrate || schema_version || print_schema {
+			return nil, fmt.Errorf("--load, --get, --patch, --migrate, --schema-version and --print-schema cannot be used with a command")
+		}
+		if cmd, rest = findCommand(fs.Args()); cmd == nil {
+			return fs.Args(), nil
+		}
+	} else {
+		mode, err := getModeFromFlags(config_file, role, patch_file, migrate, schema_version, print_schema)
+		if err != nil {
+			return nil, err
+		}
+		cmd, _ = findCommand([]string{mode})
+		switch mode {
+		case "load":
+			rest = []string{"--", config_file}
+		case "get":
+			rest = []string{"--", role}
+		case "patch":
+			rest = []string{"--", patch_file}
+		}
+	}
+
+	translated := strings.Fields(cmd.name)
+	if cmd.db && fs.Changed("db") {
+		translated = append(translated, "--db", db_file)
+	}
+	if verbose && cmd.name == "load" {
+		translated = append(translated, "--verbose")
+	}
+	if (sync || prune) && cmd.name == "load" {
+		translated = append(translated, "--sync")
+	}
+	if yes && cmd.name == "load" {
+		translated = append(translated, "--yes")
+	}
+	if dry_run && cmd.takesFlag("dry-run") {
+		translated = append(translated, "--dry-run")
+	}
+	if effective && cmd.takesFlag("effective") {
+		translated = append(translated, "--effective")
+	}
+	if cmd.takesFlag("format") && fs.Changed("format") {
+		translated = append(translated, "--format", format)
+	}
+	if cmd.takesFlag("output") && fs.Changed("output") {
+		translated = append(translated, "--output", output)
+	}
+	return append(translated, rest...), nil
+}
+
+// Return the mode chosen by the legacy flags, of which only one may be given
+func getModeFromFlags(config_file, role, patch_file string, migrate, schema_version, print_schema bool) (string, error) {
+	var modes []string
+	if config_file != "" {
+		modes = append(modes, "load")
+	}
+	if role != "" {
+		modes = append(modes, "get")
+	}
+	if patch_file != "" {
+		modes = append(modes, "patch")
+	}
+	if migrate {
+		modes = append(modes, "migrate")
+	}
+	if schema_version {
+		modes = append(modes, "schema-version")
+	}
+	if print_schema {
+		modes = append(modes, "print-schema")
+	}
+	if len(modes) == 0 {
+		return "", fmt.Errorf("no command given, see rowctrl help")
+	}
+	if len(modes) > 1 {
+		return "", fmt.Errorf("--%s and --%s cannot be used together", modes[0], modes[1])
+	}
+	return modes[0], nil
+}
+
+// Open the SQLite database given by the store specification without
+// migrating it, for the commands that inspect or change its schema
+func getFileDbHandle(ctx context.Context, spec, command_name string) (*sql.DB, error) {
+	backend, location := rowaccess.ParseStoreSpec(spec)
+	if backend != "sqlite" {
+		return nil, fmt.Errorf("%s needs a sqlite database", command_name)
+	}
+	db, err := sql.Open("sqlite", rowaccess.DbDsn(location))
+	if err != nil {
+		return nil, fmt.Errorf("getting db handle: %w", err)
+	}
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("getting db handle: %w", err)
+	}
+	return db, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Run rowctrl, returning its exit code, standard output and standard error
+func runRowctrl(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	return runRowctrlWithInput(t, "", args...)
+}
+
+// Run rowctrl with the text as standard input
+func runRowctrlWithInput(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(t.Context(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestLegacyFlagsAreTranslated(t *testing.T) {
+	tests := map[string]struct {
+		input  []string
+		output []string
+	}{
+		"Load":                     {[]string{"--db", "ex.db", "--load", "config.json"}, []string{"load", "--db", "ex.db", "--", "config.json"}},
+		"Sync load":                {[]string{"--db", "ex.db", "--load", "config.json", "--prune", "-y"}, []string{"load", "--db", "ex.db", "--sync", "--yes", "--", "config.json"}},
+		"Verbose load":             {[]string{"-d", "ex.db", "-v", "-l", "config.json"}, []string{"load", "--db", "ex.db", "--verbose", "--", "config.json"}},
+		"Get":                      {[]string{"--get", "admin", "--db", "ex.db"}, []string{"get", "--db", "ex.db", "--", "admin"}},
+		"Get with output":          {[]string{"-d", "ex.db", "-g", "admin", "--output", "policy.json", "-f", "pretty"}, []string{"get", "--db", "ex.db", "--format", "pretty", "--output", "policy.json", "--", "admin"}},
+		"Effective get":            {[]string{"--get", "admin", "--effective"}, []string{"get", "--effective", "--", "admin"}},
+		"Patch":                    {[]string{"--db", "ex.db", "--patch", "patch.json", "-n"}, []string{"patch", "--db", "ex.db", "--dry-run", "--", "patch.json"}},
+		"Migrate":                  {[]string{"--db", "ex.db", "--migrate"}, []string{"migrate", "--db", "ex.db"}},
+		"Print schema":             {[]string{"--print-schema"}, []string{"print-schema"}},
+		"Help":                     {[]string{"--help"}, []string{"help"}},
+		"Options before a command": {[]string{"--db", "ex.db", "list", "roles"}, []string{"list", "roles", "--db", "ex.db"}},
+		"A command":                {[]string{"get", "--db", "ex.db", "admin"}, []string{"get", "--db", "ex.db", "admin"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := translateLegacyArgs(test.input)
+			if err != nil {
+				t.Fatalf("Error translating arguments: %v\n", err)
+			}
+			if !reflect.DeepEqual(got, test.output) {
+				t.Errorf("Arguments mismatch: got %v, want %v\n", got, test.output)
+			}
+		})
+	}
+}
+
+func TestLegacyFlagsCannotBeCombined(t *testing.T) {
+	invalid_args := map[string][]string{
+		"Load and get":     {"--db", "ex.db", "--load", "config.json", "--get", "admin"},
+		"No mode":          {"--db", "ex.db"},
+		"Mode and command": {"--db", "ex.db", "--get", "admin", "list", "roles"},
+	}
+	for name, args := range invalid_args {
+		t.Run(name, func(t *testing.T) {
+			if code, _, _ := runRowctrl(t, args...); code == 0 {
+				t.Errorf("Expected error for %v, but got none", args)
+			}
+		})
+	}
+}
+
+func TestCommandsWork(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	config := filepath.Join("..", "..", "config.json")
+	steps := []struct {
+		args   []string
+		stdout string
+	}{
+		{[]string{"--db", db, "--load", config}, ""},
+		{[]string{"get", "--db", db, "pa_sales_manager"}, `{"role":"pa_sales_manager","policy":[{"column":"Region","values":["Eastern"]},{"column":"State","values":["Pennsylvania"]}]}` + "\n"},
+		{[]string{"--db", db, "list", "columns"}, `["Region","State"]` + "\n"},
+		{[]string{"delete", "role", "--db", db, "admin"}, ""},
+		{[]string{"clone", "role", "--db", db, "pa_sales_manager", "ny_sales_manager"}, ""},
+		{[]string{"rename", "role", "--db", db, "eastern_region_sales_manager", "east_sales_manager"}, ""},
+		{[]string{"list", "roles", "--db", db, "--format", "table"}, "ROLE\neast_sales_manager\nnorth_eastern_sales_manager\nny_sales_manager\npa_sales_manager\n"},
+		{[]string{"get", "--db", db, "ny_sales_manager"}, `{"role":"ny_sales_manager","policy":[{"column":"Region","values":["Eastern"]},{"column":"State","values":["Pennsylvania"]}]}` + "\n"},
+		{[]string{"validate", config}, config + ": ok\n"},
+	}
+	for _, step := range steps {
+		code, stdout, stderr := runRowctrl(t, step.args...)
+		if code != 0 {
+			t.Fatalf("Error running %v: %s\n", step.args, stderr)
+		}
+		if stdout != step.stdout {
+			t.Errorf("Output mismatch for %v: got %s, want %s\n", step.args, stdout, step.stdout)
+		}
+	}
+
+	t.Run("Export can be loaded", func(t *testing.T) {
+		code, exported, stderr := runRowctrl(t, "export", "--db", db)
+		if code != 0 {
+			t.Fatalf("Error exporting: %s\n", stderr)
+		}
+		fname := filepath.Join(t.TempDir(), "export.json")
+		if err := os.WriteFile(fname, []byte(exported), 0o644); err != nil {
+			t.Fatalf("Error writing export: %v\n", err)
+		}
+		copy_db := "sqlite:" + filepath.Join(t.TempDir(), "copy.db")
+		if code, _, stderr := runRowctrl(t, "load", "--db", copy_db, fname); code != 0 {
+			t.Fatalf("Error loading export: %s\n", stderr)
+		}
+		if _, reexported, _ := runRowctrl(t, "export", "--db", copy_db); reexported != exported {
+			t.Errorf("Export mismatch after round trip:\ngot  %s\nwant %s\n", reexported, exported)
+		}
+	})
+}
+
+func TestHelpCoversEveryCommand(t *testing.T) {
+	code, man_page, _ := runRowctrl(t, "help")
+	if code != 0 {
+		t.Fatalf("Error printing help")
+	}
+	for _, cmd := range commands {
+		if !strings.Contains(man_page, "rowctrl "+cmd.usage()+"\n") {
+			t.Errorf("Man page synopsis is missing %s\n", cmd.name)
+		}
+		if cmd.alias != "" && !strings.Contains(man_page, cmd.alias) {
+			t.Errorf("Man page is missing legacy flag %s\n", cmd.alias)
+		}
+		args := append(strings.Fields(cmd.name), "--help")
+		code, help, _ := runRowctrl(t, args...)
+		if code != 0 || !strings.HasPrefix(help, "usage: rowctrl "+cmd.usage()) {
+			t.Errorf("Help mismatch for %s: got %s\n", cmd.name, help)
+		}
+	}
+}
+
+func TestOutputIsWrittenToFile(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, filepath.Join("..", "..", "config.json")); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "policy.sql")
+
+	code, stdout, stderr := runRowctrl(t, "--db", db, "--get", "pa_sales_manager", "--output", fname, "--format", "sql")
+	if code != 0 {
+		t.Fatalf("Error getting policy: %s\n", stderr)
+	}
+	if stdout != "" {
+		t.Errorf("Expected no standard output, got %s\n", stdout)
+	}
+	expected := `"Region" IN ('Eastern') AND "State" IN ('Pennsylvania')` + "\n"
+	if data, err := os.ReadFile(fname); err != nil || string(data) != expected {
+		t.Errorf("Output file mismatch: got %s (%v), want %s\n", data, err, expected)
+	}
+
+	t.Run("Failed command leaves the file alone", func(t *testing.T) {
+		if code, _, _ := runRowctrl(t, "get", "--db", db, "--output", fname, "nobody"); code == 0 {
+			t.Fatalf("Expected error getting missing role, but got none")
+		}
+		if data, _ := os.ReadFile(fname); string(data) != expected {
+			t.Errorf("Output file changed after failed command: got %s\n", data)
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("Temporary file left behind: found %d files, want 1\n", len(entries))
+		}
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		code, _, stderr := runRowctrl(t, "export", "--db", db, "--format", "xml")
+		if code == 0 || !strings.Contains(stderr, `unknown format "xml"`) {
+			t.Errorf("Expected unknown format error, got %d: %s\n", code, stderr)
+		}
+	})
+}
+
+func TestExportKeepsUsers(t *testing.T) {
+	dir := t.TempDir()
+	db := "sqlite:" + filepath.Join(dir, "ex.db")
+	users := filepath.Join(dir, "users.csv")
+	if err := os.WriteFile(users, []byte("user,role\nbob,admin\nalice,pa_sales_manager\nalice,admin\n"), 0o644); err != nil {
+		t.Fatalf("Error writing users: %v\n", err)
+	}
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, filepath.Join("..", "..", "config.json"), users); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	for _, format := range []string{"json", "pretty", "dsl"} {
+		t.Run(format, func(t *testing.T) {
+			code, exported, stderr := runRowctrl(t, "export", "--db", db, "--format", format)
+			if code != 0 {
+				t.Fatalf("Error exporting: %s\n", stderr)
+			}
+			fname := filepath.Join(t.TempDir(), "export.config")
+			if err := os.WriteFile(fname, []byte(exported), 0o644); err != nil {
+				t.Fatalf("Error writing export: %v\n", err)
+			}
+			copy_db := "sqlite:" + filepath.Join(t.TempDir(), "copy.db")
+			if code, _, stderr := runRowctrl(t, "load", "--db", copy_db, fname); code != 0 {
+				t.Fatalf("Error loading export: %s\n", stderr)
+			}
+			if _, reexported, _ := runRowctrl(t, "export", "--db", copy_db, "--format", format); reexported != exported {
+				t.Errorf("Export mismatch after round trip:\ngot  %s\nwant %s\n", reexported, exported)
+			}
+			if _, got, _ := runRowctrl(t, "list", "users", "--db", copy_db); got != `["alice","bob"]`+"\n" {
+				t.Errorf("Users mismatch after round trip: got %s\n", got)
+			}
+			if _, got, _ := runRowctrl(t, "get", "--db", copy_db, "--user", "alice", "--format", "sql"); got != `"Region" IN ('Eastern') AND "State" IN ('Pennsylvania')`+"\n" {
+				t.Errorf("User policy mismatch after round trip: got %s\n", got)
+			}
+		})
+	}
+}
+
+func TestSplitExportRoundTrip(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, filepath.Join("..", "..", "config.json")); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	dir := filepath.Join(t.TempDir(), "policies")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("Error creating directory: %v\n", err)
+	}
+	for _, fname := range []string{"old_role.json", "README.md"} {
+		if err := os.WriteFile(filepath.Join(dir, fname), []byte("{}"), 0o644); err != nil {
+			t.Fatalf("Error writing file: %v\n", err)
+		}
+	}
+	if code, _, stderr := runRowctrl(t, "export", "--db", db, "--split", dir, "--sort", "name"); code != 0 {
+		t.Fatalf("Error exporting: %s\n", stderr)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v\n", err)
+	}
+	var fnames []string
+	for _, entry := range entries {
+		fnames = append(fnames, entry.Name())
+	}
+	expected := []string{"README.md", "admin.json", "eastern_region_sales_manager.json", "north_eastern_sales_manager.json", "pa_sales_manager.json"}
+	if !reflect.DeepEqual(fnames, expected) {
+		t.Errorf("Files mismatch: got %v, want %v\n", fnames, expected)
+	}
+
+	copy_db := "sqlite:" + filepath.Join(t.TempDir(), "copy.db")
+	args := []string{"load", "--db", copy_db}
+	for _, fname := range expected[1:] {
+		args = append(args, filepath.Join(dir, fname))
+	}
+	if code, _, stderr := runRowctrl(t, args...); code != 0 {
+		t.Fatalf("Error loading split export: %s\n", stderr)
+	}
+	_, want, _ := runRowctrl(t, "export", "--db", db, "--sort", "name")
+	if _, got, _ := runRowctrl(t, "export", "--db", copy_db, "--sort", "name"); got != want {
+		t.Errorf("Export mismatch after round trip:\ngot  %s\nwant %s\n", got, want)
+	}
+}
+
+func TestRoleCommandsReportErrors(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, filepath.Join("..", "..", "config.json")); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	tests := map[string]struct {
+		args   []string
+		stderr string
+	}{
+		"Rename missing role":     {[]string{"rename", "role", "--db", db, "nobody", "somebody"}, "role does not exist: nobody"},
+		"Rename to existing role": {[]string{"rename", "role", "--db", db, "admin", "pa_sales_manager"}, "role already exists: pa_sales_manager"},
+		"Clone to invalid name":   {[]string{"clone", "role", "--db", db, "admin", "new admin"}, `invalid role name: "new admin"`},
+		"Delete missing role":     {[]string{"delete", "role", "--db", db, "nobody"}, "role does not exist: nobody"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			code, _, stderr := runRowctrl(t, test.args...)
+			if code == 0 || !strings.Contains(stderr, test.stderr) {
+				t.Errorf("Error mismatch: got %d: %s, want %s\n", code, stderr, test.stderr)
+			}
+		})
+	}
+}
+
+func TestSyncDeletesRolesMissingFromConfig(t *testing.T) {
+	db := "sqlite:" + filepath.Join(t.TempDir(), "ex.db")
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, filepath.Join("..", "..", "config.json")); code != 0 {
+		t.Fatalf("Error loading config: %s\n", stderr)
+	}
+	config := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(config, []byte(`{"policies":[{"role":"admin","policy":[{"column":"Region","values":["__all__"]}]}]}`), 0o644)
+	if err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	roles := func() string {
+		t.Helper()
+		_, stdout, _ := runRowctrl(t, "list", "roles", "--db", db)
+		return stdout
+	}
+	all_roles := roles()
+
+	code, _, stderr := runRowctrl(t, "load", "--db", db, "--sync", config)
+	if code == 0 || !strings.Contains(stderr, "  pa_sales_manager\n") || !strings.Contains(stderr, "--yes") {
+		t.Errorf("Expected sync to list roles and ask for --yes, got %d: %s\n", code, stderr)
+	}
+	if got := roles(); got != all_roles {
+		t.Errorf("Roles changed without confirmation: got %s, want %s\n", got, all_roles)
+	}
+
+	t.Run("Prompt", func(t *testing.T) {
+		defer func(f func(any) bool) { isTerminal = f }(isTerminal)
+		isTerminal = func(any) bool { return true }
+		if code, _, _ := runRowctrlWithInput(t, "n\n", "load", "--db", db, "--prune", config); code == 0 {
+			t.Errorf("Expected error when sync is declined, but got none")
+		}
+		if got := roles(); got != all_roles {
+			t.Errorf("Roles changed after sync was declined: got %s, want %s\n", got, all_roles)
+		}
+		if code, _, stderr := runRowctrlWithInput(t, "y\n", "load", "--db", db, "--prune", config); code != 0 {
+			t.Errorf("Error syncing after confirming: %s\n", stderr)
+		}
+	})
+
+	if code, _, stderr := runRowctrl(t, "load", "--db", db, "--sync", "--yes", config); code != 0 {
+		t.Fatalf("Error syncing: %s\n", stderr)
+	}
+	if got, want := roles(), `["admin"]`+"\n"; got != want {
+		t.Errorf("Roles mismatch after sync: got %s, want %s\n", got, want)
+	}
+}
@@ -0,0 +1,264 @@
+package rowaccess
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// A problem with a config, at the JSON pointer of the value at fault
+type ConfigError struct {
+	Pointer string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pointer, e.Message)
+}
+
+// Every problem found in a config, in the order they appear
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, config_error := range e {
+		messages[i] = config_error.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Check a policy set for the problems the config schema cannot express
+//
+// Every problem is reported, as ConfigErrors; nil means the set can be
+// loaded. The checks are:
+//   - Roles that are invalid or listed more than once.
+//   - Roles that extend an invalid role, themselves or one role twice, and
+//     roles in the set that extend each other in a cycle.
+//   - Column names that are empty or repeated within a role.
+//   - Columns with no values, and __all__ mixed with other values.
+//   - Except lists on columns not granted __all__, or that list __all__.
+//   - Unknown matches, __all__ as a pattern, and patterns that are invalid,
+//     can never match or match every value, as checkPattern finds them.
+//   - Deny items with the same problems as columns, or that deny __all__.
+//   - Users that are invalid, listed more than once, or members of an
+//     invalid role or of one role twice.
+func CheckPolicySet(policy_set *PolicySet) error {
+	var c policyChecker
+	for _, role_policy := range policy_set.Policies {
+		c.check(role_policy)
+	}
+	for _, user := range policy_set.Users {
+		c.checkUser(user)
+	}
+	c.checkCycles()
+	return c.err()
+}
+
+// Check a JSON config against the config schema and with CheckPolicySet,
+// without loading it
+//
+// The config is read as a stream. A schema error stops the check, but every
+// problem CheckPolicySet finds is reported.
+func CheckConfig(r io.Reader) error {
+	var c policyChecker
+	err := DecodeConfig(r, func(role_policy Policy) error {
+		c.check(role_policy)
+		return nil
+	}, func(user User) error {
+		c.checkUser(user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.checkCycles()
+	return c.err()
+}
+
+// Check a JSON config file with CheckConfig
+func CheckConfigFile(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return CheckConfig(f)
+}
+
+// Checks the policies of a set one at a time, in order, so that a streamed
+// config can be checked as it is read
+type policyChecker struct {
+	roles    map[string]int
+	extends  map[string][]string
+	policies int
+	users    map[string]int
+	n_users  int
+	errors   ConfigErrors
+}
+
+// Check the next policy in the set, returning true if it has no problems
+func (c *policyChecker) check(role_policy Policy) bool {
+	if c.roles == nil {
+		c.roles = map[string]int{}
+		c.extends = map[string][]string{}
+	}
+	found := len(c.errors)
+	i := c.policies
+	c.policies++
+	pointer := fmt.Sprintf("/policies/%d", i)
+
+	if !IsValidRoleName(role_policy.Role) {
+		c.add(pointer+"/role", "invalid role name %q", role_policy.Role)
+	} else if first, ok := c.roles[role_policy.Role]; ok {
+		c.add(pointer+"/role", "role %q is already defined at /policies/%d", role_policy.Role, first)
+	} else {
+		c.roles[role_policy.Role] = i
+	}
+
+	parents := map[string]int{}
+	var valid_parents []string
+	for j, parent := range role_policy.Extends {
+		parent_pointer := fmt.Sprintf("%s/extends/%d", pointer, j)
+		if !IsValidRoleName(parent) {
+			c.add(parent_pointer, "invalid role name %q", parent)
+		} else if parent == role_policy.Role {
+			c.add(parent_pointer, "role %q extends itself", parent)
+		} else if first, ok := parents[parent]; ok {
+			c.add(parent_pointer, "role %q is already extended at %s/extends/%d", parent, pointer, first)
+		} else {
+			parents[parent] = j
+			valid_parents = append(valid_parents, parent)
+		}
+	}
+	if _, ok := c.extends[role_policy.Role]; !ok && len(valid_parents) > 0 {
+		c.extends[role_policy.Role] = valid_parents
+	}
+
+	columns := map[string]int{}
+	for j, policy_item := range role_policy.Policy {
+		item_pointer := fmt.Sprintf("%s/policy/%d", pointer, j)
+		if policy_item.Column == "" {
+			c.add(item_pointer+"/column", "column name is empty")
+		} else if first, ok := columns[policy_item.Column]; ok {
+			c.add(item_pointer+"/column", "column %q is already listed at %s/policy/%d", policy_item.Column, pointer, first)
+		} else {
+			columns[policy_item.Column] = j
+		}
+		if len(policy_item.Values) == 0 {
+			c.add(item_pointer+"/values", "no values; list the values the role may see, or %s", AllValues)
+		} else if slices.Contains(policy_item.Values, AllValues) && slices.ContainsFunc(policy_item.Values, isNotAllValues) {
+			c.add(item_pointer+"/values", "%s is mixed with other values", AllValues)
+		}
+		c.checkPatterns(item_pointer, policy_item)
+		if len(policy_item.Except) > 0 {
+			if !slices.Contains(policy_item.Values, AllValues) {
+				c.add(item_pointer+"/except", "except needs the column to be granted %s", AllValues)
+			} else if slices.Contains(policy_item.Except, AllValues) {
+				c.add(item_pointer+"/except", "%s cannot be excepted; leave the column out instead", AllValues)
+			}
+		}
+	}
+
+	denied := map[string]int{}
+	for j, deny_item := range role_policy.Deny {
+		item_pointer := fmt.Sprintf("%s/deny/%d", pointer, j)
+		if deny_item.Column == "" {
+			c.add(item_pointer+"/column", "column name is empty")
+		} else if first, ok := denied[deny_item.Column]; ok {
+			c.add(item_pointer+"/column", "column %q is already denied at %s/deny/%d", deny_item.Column, pointer, first)
+		} else {
+			denied[deny_item.Column] = j
+		}
+		if len(deny_item.Values) == 0 {
+			c.add(item_pointer+"/values", "no values; list the values the role may never see")
+		} else if slices.Contains(deny_item.Values, AllValues) {
+			c.add(item_pointer+"/values", "%s cannot be denied; a role that sees nothing needs no columns", AllValues)
+		}
+		if len(deny_item.Except) > 0 {
+			c.add(item_pointer+"/except", "deny items take no except list")
+		}
+		c.checkPatterns(item_pointer, deny_item)
+	}
+	return len(c.errors) == found
+}
+
+// Check the match of the item at the pointer and, if its values are
+// patterns, each pattern
+func (c *policyChecker) checkPatterns(item_pointer string, policy_item PolicyItem) {
+	if policy_item.Match == "" {
+		return
+	}
+	if _, err := ParseMatchKind(string(policy_item.Match)); err != nil {
+		c.add(item_pointer+"/match", "%v", err)
+		return
+	}
+	if !policy_item.isPattern() {
+		return
+	}
+	for k, pattern := range policy_item.Values {
+		if pattern == AllValues {
+			c.add(fmt.Sprintf("%s/values/%d", item_pointer, k), "%s is not a pattern; grant it without a match", AllValues)
+		} else if err := checkPattern(policy_item.Match, pattern); err != nil {
+			c.add(fmt.Sprintf("%s/values/%d", item_pointer, k), "%v", err)
+		}
+	}
+}
+
+// Check the next user in the set, returning true if it has no problems
+func (c *policyChecker) checkUser(user User) bool {
+	if c.users == nil {
+		c.users = map[string]int{}
+	}
+	found := len(c.errors)
+	i := c.n_users
+	c.n_users++
+	pointer := fmt.Sprintf("/users/%d", i)
+
+	if !IsValidUserName(user.Name) {
+		c.add(pointer+"/user", "invalid user name %q", user.Name)
+	} else if first, ok := c.users[user.Name]; ok {
+		c.add(pointer+"/user", "user %q is already defined at /users/%d", user.Name, first)
+	} else {
+		c.users[user.Name] = i
+	}
+	roles := map[string]int{}
+	for j, role := range user.Roles {
+		role_pointer := fmt.Sprintf("%s/roles/%d", pointer, j)
+		if !IsValidRoleName(role) {
+			c.add(role_pointer, "invalid role name %q", role)
+		} else if first, ok := roles[role]; ok {
+			c.add(role_pointer, "role %q is already listed at %s/roles/%d", role, pointer, first)
+		} else {
+			roles[role] = j
+		}
+	}
+	return len(c.errors) == found
+}
+
+// Check the roles checked so far for cycles in what they extend, which
+// can only be found once every role has been seen
+func (c *policyChecker) checkCycles() {
+	cycle := findExtendsCycle(c.extends)
+	if cycle == nil {
+		return
+	}
+	c.add(fmt.Sprintf("/policies/%d/extends", c.roles[cycle[0]]), "roles extend each other in a cycle: %s", strings.Join(cycle, " -> "))
+}
+
+func isNotAllValues(value string) bool {
+	return value != AllValues
+}
+
+func (c *policyChecker) add(pointer, format string, args ...any) {
+	c.errors = append(c.errors, &ConfigError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// Return the problems found so far, or nil if there are none
+func (c *policyChecker) err() error {
+	if len(c.errors) == 0 {
+		return nil
+	}
+	return c.errors
+}
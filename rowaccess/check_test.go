@@ -0,0 +1,253 @@
+package rowaccess
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckPolicySetAcceptsValidSets(t *testing.T) {
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	policy_sets := map[string]*PolicySet{
+		"Valid config file": policy_set,
+		"Empty set":         {},
+		"Role with no items": {Policies: []Policy{
+			{Role: "nobody", Policy: []PolicyItem{}},
+		}},
+		"Same column in different roles": {Policies: []Policy{
+			{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+			{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+		}},
+		"Repeated values": {Policies: []Policy{
+			{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__", "__all__"}}}},
+		}},
+	}
+	for name, policy_set := range policy_sets {
+		t.Run(name, func(t *testing.T) {
+			if err := CheckPolicySet(policy_set); err != nil {
+				t.Errorf("Error checking valid policy set: %v\n", err)
+			}
+		})
+	}
+}
+
+func TestCheckPolicySetFindsProblems(t *testing.T) {
+	policy_sets := map[string]struct {
+		input    PolicySet
+		pointers []string
+	}{
+		"Repeated role": {
+			PolicySet{Policies: []Policy{
+				{Role: "admin", Policy: []PolicyItem{}},
+				{Role: "east_mgr", Policy: []PolicyItem{}},
+				{Role: "admin", Policy: []PolicyItem{}},
+			}},
+			[]string{"/policies/2/role"},
+		},
+		"Invalid role name": {
+			PolicySet{Policies: []Policy{{Role: getInvalidRoleName(), Policy: []PolicyItem{}}}},
+			[]string{"/policies/0/role"},
+		},
+		"Repeated column": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{
+				{Column: "Region", Values: []string{"one"}},
+				{Column: "State", Values: []string{"two"}},
+				{Column: "Region", Values: []string{"three"}},
+			}}}},
+			[]string{"/policies/0/policy/2/column"},
+		},
+		"Empty column name": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "", Values: []string{"one"}}}}}},
+			[]string{"/policies/0/policy/0/column"},
+		},
+		"Empty values": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{}}}}}},
+			[]string{"/policies/0/policy/0/values"},
+		},
+		"__all__ mixed with other values": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "__all__"}}}}}},
+			[]string{"/policies/0/policy/0/values"},
+		},
+		"Bad except": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{
+				{Column: "Region", Values: []string{"Eastern"}, Except: []string{"Western"}},
+				{Column: "State", Values: []string{"__all__"}, Except: []string{"__all__"}},
+				{Column: "Store", Values: []string{"__all__"}, Except: []string{"12"}},
+			}}}},
+			[]string{"/policies/0/policy/0/except", "/policies/0/policy/1/except"},
+		},
+		"Bad deny": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{}, Deny: []PolicyItem{
+				{Column: "", Values: []string{"one"}},
+				{Column: "State", Values: []string{}},
+				{Column: "State", Values: []string{"__all__"}},
+				{Column: "Region", Values: []string{"Western"}, Except: []string{"Eastern"}},
+			}}}},
+			[]string{
+				"/policies/0/deny/0/column",
+				"/policies/0/deny/1/values",
+				"/policies/0/deny/2/column",
+				"/policies/0/deny/2/values",
+				"/policies/0/deny/3/except",
+			},
+		},
+		"Bad match": {
+			PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{
+				{Column: "Region", Match: "suffix", Values: []string{"ern"}},
+				{Column: "State", Match: MatchPrefix, Values: []string{"New", "__all__", ""}},
+				{Column: "Store", Match: MatchRegex, Values: []string{`1(`, `a^b`, `\d+`}},
+				{Column: "City", Match: MatchExact, Values: []string{"Boston"}},
+			}, Deny: []PolicyItem{
+				{Column: "Sku", Match: MatchGlob, Values: []string{"SKU-[9", "*"}},
+			}}}},
+			[]string{
+				"/policies/0/policy/0/match",
+				"/policies/0/policy/1/values",
+				"/policies/0/policy/1/values/1",
+				"/policies/0/policy/1/values/2",
+				"/policies/0/policy/2/values/0",
+				"/policies/0/policy/2/values/1",
+				"/policies/0/deny/0/values/0",
+				"/policies/0/deny/0/values/1",
+			},
+		},
+		"Bad extends": {
+			PolicySet{Policies: []Policy{{Role: "admin", Extends: []string{"east_mgr", "admin", getInvalidRoleName(), "east_mgr"}, Policy: []PolicyItem{}}}},
+			[]string{"/policies/0/extends/1", "/policies/0/extends/2", "/policies/0/extends/3"},
+		},
+		"Extends cycle": {
+			PolicySet{Policies: []Policy{
+				{Role: "admin", Policy: []PolicyItem{}},
+				{Role: "east_mgr", Extends: []string{"admin", "north_mgr"}, Policy: []PolicyItem{}},
+				{Role: "north_mgr", Extends: []string{"east_mgr"}, Policy: []PolicyItem{}},
+			}},
+			[]string{"/policies/1/extends"},
+		},
+		"Bad users": {
+			PolicySet{Policies: []Policy{}, Users: []User{
+				{Name: "alice", Roles: []string{"admin", getInvalidRoleName(), "admin"}},
+				{Name: " bob", Roles: []string{}},
+				{Name: "alice", Roles: []string{}},
+			}},
+			[]string{"/users/0/roles/1", "/users/0/roles/2", "/users/1/user", "/users/2/user"},
+		},
+		"Every problem is reported": {
+			PolicySet{Policies: []Policy{
+				{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}},
+				{Role: "east_mgr", Policy: []PolicyItem{
+					{Column: "Region", Values: []string{}},
+					{Column: "Region", Values: []string{"__all__", "two"}},
+				}},
+				{Role: "admin", Policy: []PolicyItem{{Column: "", Values: []string{"three"}}}},
+				{Role: getInvalidRoleName(), Policy: []PolicyItem{}},
+			}},
+			[]string{
+				"/policies/1/policy/0/values",
+				"/policies/1/policy/1/column",
+				"/policies/1/policy/1/values",
+				"/policies/2/role",
+				"/policies/2/policy/0/column",
+				"/policies/3/role",
+			},
+		},
+	}
+	for name, test := range policy_sets {
+		t.Run(name, func(t *testing.T) {
+			err := CheckPolicySet(&test.input)
+			var config_errors ConfigErrors
+			if !errors.As(err, &config_errors) {
+				t.Fatalf("Expected ConfigErrors, got %v\n", err)
+			}
+			var pointers []string
+			for _, config_error := range config_errors {
+				pointers = append(pointers, config_error.Pointer)
+			}
+			if !reflect.DeepEqual(pointers, test.pointers) {
+				t.Errorf("Pointers mismatch: got %v, want %v\n", pointers, test.pointers)
+			}
+		})
+	}
+}
+
+func TestConfigErrorsPrintEveryProblem(t *testing.T) {
+	err := CheckPolicySet(&PolicySet{Policies: []Policy{
+		{Role: "admin", Policy: []PolicyItem{}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{}}}},
+	}})
+	expected := "/policies/1/role: role \"admin\" is already defined at /policies/0\n" +
+		"/policies/1/policy/0/values: no values; list the values the role may see, or __all__"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Error mismatch: got %v, want %s\n", err, expected)
+	}
+}
+
+func TestStreamingLoadReportsEveryProblem(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	initial_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}}}}
+	if err := LoadDbWithPolicies(t.Context(), db, &initial_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+	before := dumpDb(t, db)
+
+	failing_set := PolicySet{Policies: []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"two"}}}},
+		{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{}}}},
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"three"}}}},
+	}}
+	data, err := json.Marshal(failing_set)
+	if err != nil {
+		t.Fatalf("Error marshalling policy set: %v\n", err)
+	}
+	_, err = LoadDbFromReader(t.Context(), db, strings.NewReader(string(data)))
+	var config_errors ConfigErrors
+	if !errors.As(err, &config_errors) {
+		t.Fatalf("Expected ConfigErrors, got %v\n", err)
+	}
+	if len(config_errors) != 2 {
+		t.Errorf("Problem count mismatch: got %d, want %d\n%v", len(config_errors), 2, err)
+	}
+	if after := dumpDb(t, db); after != before {
+		t.Errorf("Database changed after failed load:\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+}
+
+func TestCheckConfigWorks(t *testing.T) {
+	configs := map[string]struct {
+		config   string
+		problems int
+	}{
+		"Valid config":      {`{"policies":[{"role":"admin","policy":[{"column":"Region","values":["__all__"]}]}]}`, 0},
+		"Semantic problems": {`{"policies":[{"role":"admin","policy":[]},{"role":"admin","policy":[{"column":"Region","values":[]}]}]}`, 2},
+		"Schema error":      {`{"policies":[{"role":"admin"}]}`, -1},
+	}
+	for name, test := range configs {
+		t.Run(name, func(t *testing.T) {
+			err := CheckConfig(strings.NewReader(test.config))
+			var config_errors ConfigErrors
+			switch {
+			case test.problems == 0 && err != nil:
+				t.Errorf("Error checking valid config: %v\n", err)
+			case test.problems < 0 && (err == nil || errors.As(err, &config_errors)):
+				t.Errorf("Expected schema error, got %v\n", err)
+			case test.problems > 0 && (!errors.As(err, &config_errors) || len(config_errors) != test.problems):
+				t.Errorf("Problem count mismatch: got %v, want %d problems\n", err, test.problems)
+			}
+		})
+	}
+
+	t.Run("Config file", func(t *testing.T) {
+		if err := CheckConfigFile("testdata/valid_policy_set.json"); err != nil {
+			t.Errorf("Error checking valid config file: %v\n", err)
+		}
+		if err := CheckConfigFile("testdata/invalid_policy_set.json"); err == nil {
+			t.Errorf("Expected error checking invalid config file, but got none")
+		}
+	})
+}
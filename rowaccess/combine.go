@@ -0,0 +1,600 @@
+package rowaccess
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// How the policies of several roles combine into one
+type CombineMode string
+
+const (
+	// A row is visible if every role would show it, the model the README
+	// describes
+	CombineIntersection CombineMode = "intersection"
+	// A row is visible if any role would show it
+	CombineUnion CombineMode = "union"
+)
+
+// Every combination mode, in the order they are documented. The first is
+// the default for a store that has none set.
+var CombineModes = []CombineMode{CombineIntersection, CombineUnion}
+
+// Return the combination mode with the name, or an error if there is none
+func ParseCombineMode(name string) (CombineMode, error) {
+	for _, mode := range CombineModes {
+		if string(mode) == name {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown combination mode %q, use %s or %s", name, CombineIntersection, CombineUnion)
+}
+
+// The policy several roles have together, with the roles each value came
+// from
+type CombinedPolicy struct {
+	// The user whose roles these are, if any
+	User   string        `json:"user,omitempty"`
+	Roles  []string      `json:"roles"`
+	Mode   CombineMode   `json:"mode"`
+	Policy []SourcedItem `json:"policy"`
+	// Further sets of columns, in a union of roles that cannot be combined
+	// column by column. A row is visible if Policy or any of these shows it.
+	Or [][]SourcedItem `json:"or,omitempty"`
+	// The values any of the roles may never see
+	Deny []SourcedItem `json:"deny,omitempty"`
+}
+
+// A column of a combined policy
+type SourcedItem struct {
+	Column string `json:"column"`
+	// How the values match, as for PolicyItem
+	Match  MatchKind      `json:"match,omitempty"`
+	Values []SourcedValue `json:"values"`
+	// The values a column combined to __all__ leaves out
+	Except []SourcedValue `json:"except,omitempty"`
+}
+
+// A value of a combined policy and the roles that grant it
+type SourcedValue struct {
+	Value string   `json:"value"`
+	Roles []string `json:"roles"`
+}
+
+// Return the combined policy as plain policies, one for each set of
+// columns, each with the deny items and named for the user if there is
+// one. A row is visible if any of them shows it.
+func (p *CombinedPolicy) ToPolicies() []Policy {
+	var policies []Policy
+	for _, items := range append([][]SourcedItem{p.Policy}, p.Or...) {
+		policy := Policy{Role: p.User, Policy: unsourceItems(items)}
+		if len(p.Deny) > 0 {
+			policy.Deny = unsourceItems(p.Deny)
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// Return a SQL condition for the combined policy, as Policy.ToSql does for
+// one role. The conditions of several sets of columns are ORed, and the deny
+// items are applied to them all.
+func (p *CombinedPolicy) ToSql() string {
+	policies := p.ToPolicies()
+	if len(policies) == 1 {
+		return policies[0].ToSql()
+	}
+	var alternatives []string
+	for _, policy := range policies {
+		policy.Deny = nil
+		condition := policy.ToSql()
+		if condition == "TRUE" {
+			alternatives = nil
+			break
+		}
+		alternatives = append(alternatives, "("+condition+")")
+	}
+	var conditions []string
+	if len(alternatives) > 0 {
+		conditions = append(conditions, "("+strings.Join(alternatives, " OR ")+")")
+	}
+	conditions = append(conditions, denySql(policies[0].Deny)...)
+	if len(conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// Return the sourced items as plain policy items
+func unsourceItems(sourced_items []SourcedItem) []PolicyItem {
+	items := make([]PolicyItem, len(sourced_items))
+	for i, sourced_item := range sourced_items {
+		items[i] = PolicyItem{Column: sourced_item.Column, Match: sourced_item.Match, Values: unsourceValues(sourced_item.Values)}
+		if len(sourced_item.Except) > 0 {
+			items[i].Except = unsourceValues(sourced_item.Except)
+		}
+	}
+	return items
+}
+
+// Return the sourced values without their roles
+func unsourceValues(sourced_values []SourcedValue) []string {
+	values := make([]string, len(sourced_values))
+	for i, sourced_value := range sourced_values {
+		values[i] = sourced_value.Value
+	}
+	return values
+}
+
+// Return the policy the roles have together
+//
+// Each role is resolved with EffectivePolicy. An empty mode uses the store's
+// mode, as StoreCombineMode gives it. It is an error if a role does not
+// exist.
+func CombineRoles(ctx context.Context, store PolicyStore, roles []string, mode CombineMode) (CombinedPolicy, error) {
+	return combineRoles(ctx, store, roles, mode, func(role string, err error) error {
+		return err
+	})
+}
+
+// Return the combined policy of the roles, wrapping errors resolving a role
+// with wrap
+func combineRoles(ctx context.Context, store PolicyStore, roles []string, mode CombineMode, wrap func(role string, err error) error) (CombinedPolicy, error) {
+	if mode == "" {
+		var err error
+		if mode, err = StoreCombineMode(ctx, store); err != nil {
+			return CombinedPolicy{}, err
+		}
+	}
+	r := resolver{ctx: ctx, store: store, resolved: map[string]Policy{}}
+	var policies []Policy
+	for _, role := range roles {
+		policy, err := r.resolve(role, nil)
+		if err != nil {
+			return CombinedPolicy{}, wrap(role, err)
+		}
+		policies = append(policies, policy)
+	}
+	sets := CombinePolicies(mode, policies)
+	combined := CombinedPolicy{Roles: roles, Mode: mode, Policy: sets[0], Deny: CombineDenials(policies)}
+	if len(sets) > 1 {
+		combined.Or = sets[1:]
+	}
+	return combined, nil
+}
+
+// Return the store's combination mode, or CombineIntersection if it has
+// none set
+func StoreCombineMode(ctx context.Context, store PolicyStore) (CombineMode, error) {
+	mode, err := store.GetCombineMode(ctx)
+	if err != nil || mode != "" {
+		return mode, err
+	}
+	return CombineModes[0], nil
+}
+
+// Return the policies combined in the mode, with the roles each value came
+// from, as one or more sets of columns. A row is visible if any set shows
+// it, and an intersection is always one set.
+//
+// Policies are combined as ToSql reads them: a missing column is
+// unrestricted, and a role with no columns, or with a column with no
+// values, sees nothing.
+//
+// With CombineIntersection a row is visible if every role would show it:
+//   - A column only some roles list is restricted by just those roles.
+//   - A value survives if every role that lists the column grants it, either
+//     by name, with a pattern that matches it, or with an __all__ that does
+//     not except it, and is attributed to the roles that name or match it.
+//     __all__ survives only if every such role grants it, and is attributed
+//     to all of them; it excepts every value any of them excepts.
+//   - If no role names values but some match them with patterns, prefixes
+//     survive if every role's patterns match them. Other patterns are kept
+//     as they are, one item for each distinct grant, so the column is listed
+//     once for each and each restricts it further. Values the __all__
+//     grants except are kept as a last __all__ item.
+//   - A column whose values do not overlap is kept with no values, and a
+//     role with no columns leaves no columns; both see nothing.
+//
+// With CombineUnion a row is visible if any role would show it:
+//   - Roles that see nothing are left out.
+//   - Roles that restrict every column the same way but one are combined
+//     into one set, which restricts that column as any of them do.
+//     Leaving a column out restricts it the same way as granting __all__
+//     with no exceptions. Every other role is a set of its own.
+//
+// Within a set of a union:
+//   - A column is the union of the values of the roles that list it, each
+//     attributed to the roles that name it. If the roles match the column
+//     differently its values are converted to globs, or to regular
+//     expressions if any role matches it with one.
+//   - A column some role does not restrict, by leaving it out or granting
+//     __all__, is __all__, attributed to those roles. If every role lists
+//     it, it excepts the values every __all__ grant excepts and no role
+//     names or matches.
+//
+// A union expects each role to list a column once, as roles do; an
+// intersection may not.
+//
+// Both modes are associative, and the result lists columns in the order the
+// roles first list them. No policies combine to one set of no columns,
+// which sees nothing in either mode. Deny items are combined apart, by
+// CombineDenials.
+func CombinePolicies(mode CombineMode, policies []Policy) [][]SourcedItem {
+	if mode == CombineUnion {
+		return unionPolicies(policies)
+	}
+	return [][]SourcedItem{intersectPolicies(policies)}
+}
+
+// Return the values any of the policies deny, column by column, with the
+// roles that deny each, or nil if none do
+//
+// Deny items take precedence over grants in every mode, so they are
+// combined from every role, even one that sees nothing. Items that match a
+// column differently are kept apart.
+func CombineDenials(policies []Policy) []SourcedItem {
+	var items []SourcedItem
+	for _, policy := range policies {
+		for _, deny_item := range policy.Deny {
+			match := storedMatch(deny_item)
+			i := slices.IndexFunc(items, func(item SourcedItem) bool {
+				return item.Column == deny_item.Column && item.Match == MatchKind(match)
+			})
+			if i < 0 {
+				i = len(items)
+				items = append(items, SourcedItem{Column: deny_item.Column, Match: MatchKind(match), Values: []SourcedValue{}})
+			}
+			items[i].Values = addSource(items[i].Values, deny_item.Values, policy.Role)
+		}
+	}
+	return items
+}
+
+// Return the sourced values with each value attributed to the role, adding
+// the values that are not there yet
+func addSource(sourced_values []SourcedValue, values []string, role string) []SourcedValue {
+	for _, value := range values {
+		i := slices.IndexFunc(sourced_values, func(sourced_value SourcedValue) bool {
+			return sourced_value.Value == value
+		})
+		if i < 0 {
+			i = len(sourced_values)
+			sourced_values = append(sourced_values, SourcedValue{Value: value, Roles: []string{}})
+		}
+		if !slices.Contains(sourced_values[i].Roles, role) {
+			sourced_values[i].Roles = append(sourced_values[i].Roles, role)
+		}
+	}
+	return sourced_values
+}
+
+// Return the columns the policies list, in the order they first list them
+func combinedColumns(policies []Policy) []string {
+	var columns []string
+	for _, policy := range policies {
+		for _, policy_item := range policy.Policy {
+			if !slices.Contains(columns, policy_item.Column) {
+				columns = append(columns, policy_item.Column)
+			}
+		}
+	}
+	return columns
+}
+
+// Return the policy's item for the column, and whether it lists the column
+// at all
+func columnItem(policy Policy, column string) (PolicyItem, bool) {
+	for _, policy_item := range policy.Policy {
+		if policy_item.Column == column {
+			return policy_item, true
+		}
+	}
+	return PolicyItem{}, false
+}
+
+// Return true if the item grants the value through __all__
+func allowsThroughAll(policy_item PolicyItem, value string) bool {
+	return !policy_item.isPattern() && slices.Contains(policy_item.Values, AllValues) && !slices.Contains(policy_item.Except, value)
+}
+
+// Return true if the item names the value or matches it with a pattern.
+// __all__ is only ever named.
+func namesValue(policy_item PolicyItem, value string) bool {
+	if policy_item.isPattern() {
+		return value != AllValues && policy_item.allows(value)
+	}
+	return slices.Contains(policy_item.Values, value)
+}
+
+// Return true if the policy sees no rows at all
+func seesNothing(policy Policy) bool {
+	if len(policy.Policy) == 0 {
+		return true
+	}
+	for _, policy_item := range policy.Policy {
+		if len(policy_item.Values) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the intersection of the policies, as CombinePolicies describes
+func intersectPolicies(policies []Policy) []SourcedItem {
+	items := []SourcedItem{}
+	for _, policy := range policies {
+		if len(policy.Policy) == 0 {
+			return items
+		}
+	}
+
+	for _, column := range combinedColumns(policies) {
+		// The roles that list the column, and what each grants, once for
+		// each item a role has for it
+		var roles []string
+		var grants []PolicyItem
+		for _, policy := range policies {
+			for _, policy_item := range policy.Policy {
+				if policy_item.Column == column {
+					roles = append(roles, policy.Role)
+					grants = append(grants, policy_item)
+				}
+			}
+		}
+		names := slices.ContainsFunc(grants, func(grant PolicyItem) bool {
+			return !grant.isPattern() && !slices.Contains(grant.Values, AllValues)
+		})
+		if !names && slices.ContainsFunc(grants, func(grant PolicyItem) bool { return grant.isPattern() }) {
+			items = append(items, intersectPatterns(column, roles, grants)...)
+			continue
+		}
+
+		item := SourcedItem{Column: column, Values: []SourcedValue{}}
+		seen := map[string]bool{}
+		for _, grant := range grants {
+			if grant.isPattern() {
+				continue
+			}
+			for _, value := range grant.Values {
+				if seen[value] {
+					continue
+				}
+				seen[value] = true
+				sourced := SourcedValue{Value: value, Roles: []string{}}
+				survives := true
+				for i, other := range grants {
+					if namesValue(other, value) {
+						sourced.Roles = append(sourced.Roles, roles[i])
+					} else if value == AllValues || !allowsThroughAll(other, value) {
+						survives = false
+						break
+					}
+				}
+				if survives {
+					item.Values = append(item.Values, sourced)
+				}
+			}
+		}
+		if slices.ContainsFunc(item.Values, func(sourced SourcedValue) bool { return sourced.Value == AllValues }) {
+			for i, grant := range grants {
+				item.Except = addSource(item.Except, grant.Except, roles[i])
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Return the intersection of a column that the roles grant __all__ or
+// match with patterns, and do not name values of, as CombinePolicies
+// describes
+func intersectPatterns(column string, roles []string, grants []PolicyItem) []SourcedItem {
+	var items []SourcedItem
+	prefixes := !slices.ContainsFunc(grants, func(grant PolicyItem) bool {
+		return grant.isPattern() && grant.Match != MatchPrefix
+	})
+	for i, grant := range grants {
+		switch {
+		case !grant.isPattern():
+			continue
+		case prefixes:
+			// A prefix every role's patterns match is a prefix of values
+			// they all match
+			if len(items) == 0 {
+				items = append(items, SourcedItem{Column: column, Match: MatchPrefix, Values: []SourcedValue{}})
+			}
+			for _, prefix := range grant.Values {
+				if !slices.ContainsFunc(grants, func(other PolicyItem) bool { return other.isPattern() && !other.allows(prefix) }) {
+					items[0].Values = addSource(items[0].Values, []string{prefix}, roles[i])
+				}
+			}
+		default:
+			j := slices.IndexFunc(items, func(item SourcedItem) bool {
+				return item.Match == grant.Match && slices.Equal(unsourceValues(item.Values), grant.Values)
+			})
+			if j < 0 {
+				j = len(items)
+				items = append(items, SourcedItem{Column: column, Match: grant.Match, Values: []SourcedValue{}})
+			}
+			items[j].Values = addSource(items[j].Values, grant.Values, roles[i])
+		}
+	}
+
+	all := SourcedItem{Column: column, Values: []SourcedValue{{Value: AllValues, Roles: []string{}}}}
+	for i, grant := range grants {
+		if grant.isPattern() {
+			continue
+		}
+		all.Values[0].Roles = append(all.Values[0].Roles, roles[i])
+		for _, value := range grant.Except {
+			if !slices.ContainsFunc(grants, func(other PolicyItem) bool { return other.isPattern() && !other.allows(value) }) {
+				all.Except = addSource(all.Except, []string{value}, roles[i])
+			}
+		}
+	}
+	if len(all.Except) > 0 {
+		items = append(items, all)
+	}
+	return items
+}
+
+// Return the union of the policies, as CombinePolicies describes
+func unionPolicies(policies []Policy) [][]SourcedItem {
+	var groups [][]Policy
+	for _, policy := range policies {
+		if !seesNothing(policy) {
+			groups = append(groups, []Policy{policy})
+		}
+	}
+	if len(groups) == 0 {
+		return [][]SourcedItem{{}}
+	}
+
+	// Merge groups until no two can be combined column by column
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(groups) && !merged; i++ {
+			for j := i + 1; j < len(groups); j++ {
+				group := append(slices.Clone(groups[i]), groups[j]...)
+				if differentColumns(group) <= 1 {
+					groups[i] = group
+					groups = slices.Delete(groups, j, j+1)
+					merged = true
+					break
+				}
+			}
+		}
+	}
+	sets := make([][]SourcedItem, len(groups))
+	for i, group := range groups {
+		sets[i] = unionColumns(group)
+	}
+	return sets
+}
+
+// Return the number of columns that some of the policies restrict
+// differently from the first
+func differentColumns(policies []Policy) int {
+	var columns []string
+	for _, policy := range policies[1:] {
+		for _, column := range combinedColumns([]Policy{policies[0], policy}) {
+			if !sameRestriction(policies[0], policy, column) && !slices.Contains(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return len(columns)
+}
+
+// Return true if the policies restrict the column in the same way
+func sameRestriction(a, b Policy, column string) bool {
+	if leavesOpen(a, column) || leavesOpen(b, column) {
+		return leavesOpen(a, column) == leavesOpen(b, column)
+	}
+	a_item, _ := columnItem(a, column)
+	b_item, _ := columnItem(b, column)
+	return a_item.matchKind() == b_item.matchKind() && sameValues(a_item.Values, b_item.Values) && sameValues(a_item.Except, b_item.Except)
+}
+
+// Return true if the policy does not restrict the column, by leaving it out
+// or granting __all__ with no exceptions
+func leavesOpen(policy Policy, column string) bool {
+	policy_item, ok := columnItem(policy, column)
+	return !ok || (!policy_item.isPattern() && slices.Contains(policy_item.Values, AllValues) && len(policy_item.Except) == 0)
+}
+
+// Return true if the lists have the same values, in any order
+func sameValues(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// Return the union of policies that restrict every column in the same way
+// but one, column by column
+func unionColumns(live []Policy) []SourcedItem {
+	items := []SourcedItem{}
+	for _, column := range combinedColumns(live) {
+		item := SourcedItem{Column: column, Values: []SourcedValue{}}
+		var unrestricted []string
+		for _, policy := range live {
+			if policy_item, ok := columnItem(policy, column); !ok || slices.Contains(policy_item.Values, AllValues) {
+				unrestricted = append(unrestricted, policy.Role)
+			}
+		}
+		if len(unrestricted) > 0 {
+			item.Values = append(item.Values, SourcedValue{Value: AllValues, Roles: unrestricted})
+			item.Except = unionExcept(live, column)
+			items = append(items, item)
+			continue
+		}
+
+		// Roles that match the column differently share a glob or, if one
+		// matches it with regular expressions, a regular expression
+		var kinds []MatchKind
+		for _, policy := range live {
+			policy_item, _ := columnItem(policy, column)
+			if !slices.Contains(kinds, policy_item.matchKind()) {
+				kinds = append(kinds, policy_item.matchKind())
+			}
+		}
+		target := kinds[0]
+		if len(kinds) > 1 {
+			target = MatchGlob
+			if slices.Contains(kinds, MatchRegex) {
+				target = MatchRegex
+			}
+		}
+		if target != MatchExact {
+			item.Match = target
+		}
+		for _, policy := range live {
+			policy_item, _ := columnItem(policy, column)
+			values := make([]string, len(policy_item.Values))
+			for i, value := range policy_item.Values {
+				values[i] = convertPattern(policy_item.matchKind(), target, value)
+			}
+			item.Values = addSource(item.Values, values, policy.Role)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Return the values the union of the policies leaves out of a column that
+// some of them grant __all__: those every __all__ grant excepts and no
+// policy names or matches, attributed to the roles that except them. It is
+// nil if a policy leaves the column out.
+func unionExcept(policies []Policy, column string) []SourcedValue {
+	var grants []PolicyItem
+	var roles []string
+	var others []PolicyItem
+	for _, policy := range policies {
+		policy_item, ok := columnItem(policy, column)
+		if !ok {
+			return nil
+		}
+		if !policy_item.isPattern() && slices.Contains(policy_item.Values, AllValues) {
+			grants = append(grants, policy_item)
+			roles = append(roles, policy.Role)
+		} else {
+			others = append(others, policy_item)
+		}
+	}
+	var except []SourcedValue
+	for _, value := range grants[0].Except {
+		if slices.ContainsFunc(others, func(other PolicyItem) bool {
+			return namesValue(other, value)
+		}) || slices.ContainsFunc(grants, func(grant PolicyItem) bool {
+			return !slices.Contains(grant.Except, value)
+		}) {
+			continue
+		}
+		except = append(except, SourcedValue{Value: value, Roles: slices.Clone(roles)})
+	}
+	return except
+}
@@ -0,0 +1,486 @@
+package rowaccess
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCombinePolicies(t *testing.T) {
+	east := Policy{Role: "east", Policy: []PolicyItem{
+		{Column: "Region", Values: []string{"Eastern"}},
+		{Column: "State", Values: []string{"__all__"}},
+	}}
+	ohio := Policy{Role: "ohio", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"Ohio", "Maine"}},
+		{Column: "Store", Values: []string{"__all__"}},
+	}}
+	maine := Policy{Role: "maine", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"Maine", "Vermont"}},
+	}}
+	admin := Policy{Role: "admin", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"__all__"}},
+	}}
+	stores := Policy{Role: "stores", Policy: []PolicyItem{
+		{Column: "Store", Values: []string{"__all__"}},
+	}}
+	nobody := Policy{Role: "nobody", Policy: []PolicyItem{}}
+	closed := Policy{Role: "closed", Policy: []PolicyItem{{Column: "State", Values: []string{}}}}
+	not_ohio := Policy{Role: "not_ohio", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"__all__"}, Except: []string{"Ohio", "Texas"}},
+	}}
+	not_texas := Policy{Role: "not_texas", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"__all__"}, Except: []string{"Texas"}},
+	}}
+	m_or_o := Policy{Role: "m_or_o", Policy: []PolicyItem{
+		{Column: "State", Match: MatchPrefix, Values: []string{"M", "O"}},
+	}}
+	ma_or_n := Policy{Role: "ma_or_n", Policy: []PolicyItem{
+		{Column: "State", Match: MatchPrefix, Values: []string{"Ma", "N"}},
+	}}
+	t_states := Policy{Role: "t_states", Policy: []PolicyItem{
+		{Column: "State", Match: MatchGlob, Values: []string{"T*"}},
+	}}
+	long_states := Policy{Role: "long_states", Policy: []PolicyItem{
+		{Column: "State", Match: MatchRegex, Values: []string{`.{5,}`}},
+	}}
+
+	tests := map[string]struct {
+		mode     CombineMode
+		policies []Policy
+		want     [][]SourcedItem
+	}{
+		"Intersection of no roles": {CombineIntersection, nil, [][]SourcedItem{{}}},
+		"Intersection of one role": {CombineIntersection, []Policy{maine}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"Maine", []string{"maine"}}, {"Vermont", []string{"maine"}}}},
+		}}},
+		"Intersection keeps the values __all__ meets": {CombineIntersection, []Policy{east, ohio}, [][]SourcedItem{{
+			{Column: "Region", Values: []SourcedValue{{"Eastern", []string{"east"}}}},
+			{Column: "State", Values: []SourcedValue{{"Ohio", []string{"ohio"}}, {"Maine", []string{"ohio"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"ohio"}}}},
+		}}},
+		"Intersection keeps __all__ only if every role grants it": {CombineIntersection, []Policy{admin, east}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"admin", "east"}}}},
+			{Column: "Region", Values: []SourcedValue{{"Eastern", []string{"east"}}}},
+		}}},
+		"Intersection attributes overlap to every role": {CombineIntersection, []Policy{ohio, maine}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"Maine", []string{"ohio", "maine"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"ohio"}}}},
+		}}},
+		"Intersection with no overlap": {CombineIntersection, []Policy{{Role: "a", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio"}}}}, maine}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{}},
+		}}},
+		"Intersection with a role with no columns": {CombineIntersection, []Policy{east, nobody}, [][]SourcedItem{{}}},
+		"Intersection drops excepted values": {CombineIntersection, []Policy{not_ohio, maine, ohio}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"Maine", []string{"maine", "ohio"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"ohio"}}}},
+		}}},
+		"Intersection excepts what any role excepts": {CombineIntersection, []Policy{not_texas, not_ohio}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_texas", "not_ohio"}}}, Except: []SourcedValue{
+				{"Texas", []string{"not_texas", "not_ohio"}}, {"Ohio", []string{"not_ohio"}},
+			}},
+		}}},
+		"Intersection filters named values by patterns": {CombineIntersection, []Policy{ohio, m_or_o, maine}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"Maine", []string{"ohio", "m_or_o", "maine"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"ohio"}}}},
+		}}},
+		"Intersection narrows prefixes": {CombineIntersection, []Policy{m_or_o, admin, ma_or_n}, [][]SourcedItem{{
+			{Column: "State", Match: MatchPrefix, Values: []SourcedValue{{"Ma", []string{"ma_or_n"}}}},
+		}}},
+		"Intersection keeps other patterns apart": {CombineIntersection, []Policy{t_states, not_ohio, long_states, t_states}, [][]SourcedItem{{
+			{Column: "State", Match: MatchGlob, Values: []SourcedValue{{"T*", []string{"t_states"}}}},
+			{Column: "State", Match: MatchRegex, Values: []SourcedValue{{`.{5,}`, []string{"long_states"}}}},
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_ohio"}}}, Except: []SourcedValue{{"Texas", []string{"not_ohio"}}}},
+		}}},
+		"Union of no roles": {CombineUnion, nil, [][]SourcedItem{{}}},
+		"Union adds values": {CombineUnion, []Policy{ohio, maine}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"Ohio", []string{"ohio"}}, {"Maine", []string{"ohio", "maine"}}, {"Vermont", []string{"maine"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"ohio", "maine"}}}},
+		}}},
+		"Union with __all__ and missing columns": {CombineUnion, []Policy{admin, ohio}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"admin"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"admin", "ohio"}}}},
+		}}},
+		"Union keeps roles that restrict different columns apart": {CombineUnion, []Policy{east, ohio}, [][]SourcedItem{
+			{
+				{Column: "Region", Values: []SourcedValue{{"Eastern", []string{"east"}}}},
+				{Column: "State", Values: []SourcedValue{{"__all__", []string{"east"}}}},
+			},
+			{
+				{Column: "State", Values: []SourcedValue{{"Ohio", []string{"ohio"}}, {"Maine", []string{"ohio"}}}},
+				{Column: "Store", Values: []SourcedValue{{"__all__", []string{"ohio"}}}},
+			},
+		}},
+		"Union leaves out roles that see nothing": {CombineUnion, []Policy{nobody, maine, closed}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"Maine", []string{"maine"}}, {"Vermont", []string{"maine"}}}},
+		}}},
+		"Union of roles that see nothing": {CombineUnion, []Policy{nobody, closed}, [][]SourcedItem{{}}},
+		"Union excepts what every role leaves out": {CombineUnion, []Policy{not_ohio, not_texas}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_ohio", "not_texas"}}}, Except: []SourcedValue{
+				{"Texas", []string{"not_ohio", "not_texas"}},
+			}},
+		}}},
+		"Union with a named value drops its exception": {CombineUnion, []Policy{not_ohio, ohio}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_ohio"}}}, Except: []SourcedValue{
+				{"Texas", []string{"not_ohio"}},
+			}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"not_ohio", "ohio"}}}},
+		}}},
+		"Union of one match keeps it": {CombineUnion, []Policy{m_or_o, ma_or_n}, [][]SourcedItem{{
+			{Column: "State", Match: MatchPrefix, Values: []SourcedValue{
+				{"M", []string{"m_or_o"}}, {"O", []string{"m_or_o"}}, {"Ma", []string{"ma_or_n"}}, {"N", []string{"ma_or_n"}},
+			}},
+		}}},
+		"Union of different matches converts them to globs": {CombineUnion, []Policy{maine, m_or_o, t_states}, [][]SourcedItem{{
+			{Column: "State", Match: MatchGlob, Values: []SourcedValue{
+				{"Maine", []string{"maine"}}, {"Vermont", []string{"maine"}}, {"M*", []string{"m_or_o"}}, {"O*", []string{"m_or_o"}}, {"T*", []string{"t_states"}},
+			}},
+		}}},
+		"Union with a regular expression converts to them": {CombineUnion, []Policy{maine, m_or_o, long_states}, [][]SourcedItem{{
+			{Column: "State", Match: MatchRegex, Values: []SourcedValue{
+				{"Maine", []string{"maine"}}, {"Vermont", []string{"maine"}}, {"M(?s:.*)", []string{"m_or_o"}}, {"O(?s:.*)", []string{"m_or_o"}}, {".{5,}", []string{"long_states"}},
+			}},
+		}}},
+		"Union with a pattern drops the exceptions it matches": {CombineUnion, []Policy{not_ohio, m_or_o}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_ohio"}}}, Except: []SourcedValue{
+				{"Texas", []string{"not_ohio"}},
+			}},
+		}}},
+		"Union with a missing column drops exceptions": {CombineUnion, []Policy{not_ohio, stores}, [][]SourcedItem{{
+			{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_ohio", "stores"}}}},
+			{Column: "Store", Values: []SourcedValue{{"__all__", []string{"not_ohio", "stores"}}}},
+		}}},
+		"Union merges the roles it can": {CombineUnion, []Policy{east, maine, ohio, not_ohio}, [][]SourcedItem{
+			{
+				{Column: "Region", Values: []SourcedValue{{"Eastern", []string{"east"}}}},
+				{Column: "State", Values: []SourcedValue{{"__all__", []string{"east"}}}},
+			},
+			{
+				{Column: "State", Values: []SourcedValue{{"__all__", []string{"not_ohio"}}}, Except: []SourcedValue{{"Texas", []string{"not_ohio"}}}},
+				{Column: "Store", Values: []SourcedValue{{"__all__", []string{"maine", "ohio", "not_ohio"}}}},
+			},
+		}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := CombinePolicies(test.mode, test.policies); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Combination mismatch:\ngot  %+v\nwant %+v\n", got, test.want)
+			}
+		})
+	}
+}
+
+// The columns, values and patterns random policies are drawn from. "other"
+// is never granted, so rows with it are only seen through __all__ or a
+// missing column.
+var (
+	property_columns  = []string{"Region", "State"}
+	property_values   = []string{"a", "b", "c", "ab", "other"}
+	property_patterns = map[MatchKind][]string{
+		MatchPrefix: {"a", "ab", "b"},
+		MatchGlob:   {"[bc]*", "?b"},
+		MatchRegex:  {"a|c", "b+"},
+	}
+)
+
+// Return a random policy of up to two columns, which may be empty or have
+// no values, whose __all__ grants may except values and whose values may
+// be patterns
+func randomPolicy(r *rand.Rand, role string) Policy {
+	policy := Policy{Role: role, Policy: []PolicyItem{}}
+	for _, column := range property_columns {
+		switch r.IntN(4) {
+		case 0:
+			continue
+		case 1:
+			policy_item := PolicyItem{Column: column, Values: []string{AllValues}}
+			for _, value := range property_values[:4] {
+				if r.IntN(3) == 0 {
+					policy_item.Except = append(policy_item.Except, value)
+				}
+			}
+			policy.Policy = append(policy.Policy, policy_item)
+		case 2:
+			values := []string{}
+			for _, value := range property_values[:4] {
+				if r.IntN(2) == 0 {
+					values = append(values, value)
+				}
+			}
+			policy.Policy = append(policy.Policy, PolicyItem{Column: column, Values: values})
+		case 3:
+			kind := MatchKinds[1+r.IntN(3)]
+			patterns := property_patterns[kind]
+			values := []string{patterns[r.IntN(len(patterns))]}
+			if other := patterns[r.IntN(len(patterns))]; other != values[0] && r.IntN(2) == 0 {
+				values = append(values, other)
+			}
+			policy.Policy = append(policy.Policy, PolicyItem{Column: column, Match: kind, Values: values})
+		}
+	}
+	return policy
+}
+
+// Return the policies combined as plain policies, any of which shows a row,
+// so that they can be combined again
+func combine(mode CombineMode, policies ...Policy) []Policy {
+	sets := CombinePolicies(mode, policies)
+	combined := CombinedPolicy{Policy: sets[0], Or: sets[1:]}
+	return combined.ToPolicies()
+}
+
+// Return the SQL conditions of the policies, ORed
+func anySql(policies []Policy) string {
+	var conditions []string
+	for _, policy := range policies {
+		conditions = append(conditions, "("+policy.ToSql()+")")
+	}
+	return strings.Join(conditions, " OR ")
+}
+
+// Return true if the policy shows the row, as its ToSql condition would
+func shows(policy Policy, row map[string]string) bool {
+	if len(policy.Policy) == 0 {
+		return false
+	}
+	for _, policy_item := range policy.Policy {
+		if !policy_item.allows(row[policy_item.Column]) {
+			return false
+		}
+	}
+	for _, deny_item := range policy.Deny {
+		if deny_item.allows(row[deny_item.Column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the rows any of the policies shows, out of every row of the
+// property columns and values
+func shownRows(policies ...Policy) []string {
+	var rows []string
+	for _, region := range property_values {
+		for _, state := range property_values {
+			row := map[string]string{"Region": region, "State": state}
+			if slices.ContainsFunc(policies, func(policy Policy) bool { return shows(policy, row) }) {
+				rows = append(rows, region+"/"+state)
+			}
+		}
+	}
+	return rows
+}
+
+func TestCombinationProperties(t *testing.T) {
+	r := rand.New(rand.NewPCG(22, 23))
+	// The identity of each mode, and the policy that absorbs every other
+	identities := map[CombineMode]Policy{
+		CombineIntersection: {Role: "everything", Policy: []PolicyItem{{Column: "Region", Values: []string{AllValues}}}},
+		CombineUnion:        {Role: "nothing", Policy: []PolicyItem{}},
+	}
+	absorbing := map[CombineMode]Policy{
+		CombineIntersection: identities[CombineUnion],
+		CombineUnion:        identities[CombineIntersection],
+	}
+
+	for _, mode := range CombineModes {
+		t.Run(string(mode), func(t *testing.T) {
+			for i := range 500 {
+				a, b, c := randomPolicy(r, "a"), randomPolicy(r, "b"), randomPolicy(r, "c")
+				message := fmt.Sprintf("%s, %s and %s", a.ToSql(), b.ToSql(), c.ToSql())
+
+				// Associativity: grouping does not change what is shown
+				left := combine(mode, append(combine(mode, a, b), c)...)
+				right := combine(mode, append([]Policy{a}, combine(mode, b, c)...)...)
+				all := combine(mode, a, b, c)
+				if !reflect.DeepEqual(shownRows(left...), shownRows(right...)) || !reflect.DeepEqual(shownRows(left...), shownRows(all...)) {
+					t.Fatalf("Case %d: %s is not associative:\n%s\n(ab)c %s\na(bc) %s\nabc   %s\n", i, mode, message, anySql(left), anySql(right), anySql(all))
+				}
+				if ab, ba := combine(mode, a, b), combine(mode, b, a); !reflect.DeepEqual(shownRows(ab...), shownRows(ba...)) {
+					t.Fatalf("Case %d: %s is not commutative: %s\n", i, mode, message)
+				}
+				// A role on its own, or with itself, is shown as it is
+				if got := shownRows(combine(mode, a)...); !reflect.DeepEqual(got, shownRows(a)) {
+					t.Fatalf("Case %d: %s of %s alone shows %v, want %v\n", i, mode, a.ToSql(), got, shownRows(a))
+				}
+				if got := shownRows(combine(mode, a, a)...); !reflect.DeepEqual(got, shownRows(a)) {
+					t.Fatalf("Case %d: %s of %s with itself shows %v, want %v\n", i, mode, a.ToSql(), got, shownRows(a))
+				}
+				// A union shows what any of its roles shows, and an
+				// intersection what all of them do
+				want := shownRows(a, b)
+				if mode == CombineIntersection {
+					want = nil
+					for _, row := range shownRows(a) {
+						if slices.Contains(shownRows(b), row) {
+							want = append(want, row)
+						}
+					}
+				}
+				if got := shownRows(combine(mode, a, b)...); !reflect.DeepEqual(got, want) {
+					t.Fatalf("Case %d: %s of %s and %s shows %v, want %v\n", i, mode, a.ToSql(), b.ToSql(), got, want)
+				}
+
+				identity := identities[mode]
+				for _, got := range [][]Policy{combine(mode, identity, a), combine(mode, a, identity)} {
+					if !reflect.DeepEqual(shownRows(got...), shownRows(a)) {
+						t.Fatalf("Case %d: %s of %s with the identity %s shows %v, want %v\n", i, mode, a.ToSql(), identity.ToSql(), shownRows(got...), shownRows(a))
+					}
+				}
+				absorber := absorbing[mode]
+				if got := combine(mode, absorber, a); !reflect.DeepEqual(shownRows(got...), shownRows(absorber)) {
+					t.Fatalf("Case %d: %s of %s with %s shows %v\n", i, mode, a.ToSql(), absorber.ToSql(), shownRows(got...))
+				}
+			}
+
+			// No roles at all show nothing, whatever the mode's identity
+			if got := shownRows(combine(mode)...); got != nil {
+				t.Errorf("No roles show %v, want nothing\n", got)
+			}
+		})
+	}
+}
+
+func TestCombineDenials(t *testing.T) {
+	policies := []Policy{
+		{Role: "east", Policy: []PolicyItem{{Column: "State", Values: []string{"__all__"}}}, Deny: []PolicyItem{
+			{Column: "State", Values: []string{"Texas"}},
+		}},
+		{Role: "nobody", Policy: []PolicyItem{}, Deny: []PolicyItem{
+			{Column: "Region", Values: []string{"Western"}},
+			{Column: "State", Values: []string{"Texas", "Ohio"}},
+		}},
+		{Role: "ohio", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio", "Maine"}}}},
+		{Role: "no_m", Policy: []PolicyItem{}, Deny: []PolicyItem{
+			{Column: "State", Match: MatchPrefix, Values: []string{"M"}},
+		}},
+	}
+	want := []SourcedItem{
+		{Column: "State", Values: []SourcedValue{{"Texas", []string{"east", "nobody"}}, {"Ohio", []string{"nobody"}}}},
+		{Column: "Region", Values: []SourcedValue{{"Western", []string{"nobody"}}}},
+		{Column: "State", Match: MatchPrefix, Values: []SourcedValue{{"M", []string{"no_m"}}}},
+	}
+	if got := CombineDenials(policies); !reflect.DeepEqual(got, want) {
+		t.Errorf("Denials mismatch:\ngot  %+v\nwant %+v\n", got, want)
+	}
+	if got := CombineDenials(policies[2:3]); got != nil {
+		t.Errorf("Denials mismatch: got %+v, want nil\n", got)
+	}
+
+	// A denial takes precedence over every grant, even in a union that
+	// leaves out the role that sees nothing
+	combined := CombinedPolicy{Policy: CombinePolicies(CombineUnion, policies[:3])[0], Deny: CombineDenials(policies[:3])}
+	if got := shownStates(combined.ToPolicies()[0]); !reflect.DeepEqual(got, []string{"Maine"}) {
+		t.Errorf("Union shows %v, want [Maine]\n", got)
+	}
+	combined = CombinedPolicy{Policy: CombinePolicies(CombineUnion, policies)[0], Deny: CombineDenials(policies)}
+	if got := shownStates(combined.ToPolicies()[0]); got != nil {
+		t.Errorf("Union shows %v, want nothing\n", got)
+	}
+}
+
+// Return the states the policy shows in the Eastern region
+func shownStates(policy Policy) []string {
+	var states []string
+	for _, state := range []string{"Maine", "Ohio", "Texas"} {
+		if shows(policy, map[string]string{"Region": "Eastern", "State": state}) {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func TestParseCombineMode(t *testing.T) {
+	for _, mode := range CombineModes {
+		if got, err := ParseCombineMode(string(mode)); err != nil || got != mode {
+			t.Errorf("Parse mismatch: got %s, %v, want %s\n", got, err, mode)
+		}
+	}
+	if _, err := ParseCombineMode("both"); err == nil {
+		t.Errorf("Expected an error parsing an unknown mode\n")
+	}
+}
+
+func TestStoresKeepCombineMode(t *testing.T) {
+	policy_set := PolicySet{
+		Policies: []Policy{
+			{Role: "ohio", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio"}}}},
+			{Role: "maine", Policy: []PolicyItem{{Column: "State", Values: []string{"Maine"}}}},
+		},
+		Users: []User{{Name: "alice", Roles: []string{"ohio", "maine"}}},
+	}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if mode, err := StoreCombineMode(t.Context(), store); err != nil || mode != CombineIntersection {
+				t.Errorf("Default mode mismatch: got %s, %v, want %s\n", mode, err, CombineIntersection)
+			}
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			if err := store.SetCombineMode(t.Context(), "both"); err == nil {
+				t.Errorf("Expected an error setting an unknown mode\n")
+			}
+			if err := store.SetCombineMode(t.Context(), CombineUnion); err != nil {
+				t.Fatalf("Error setting mode: %v\n", err)
+			}
+			// Loading and syncing leave the mode alone
+			if _, err := store.SyncPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error syncing policies: %v\n", err)
+			}
+			if mode, err := store.GetCombineMode(t.Context()); err != nil || mode != CombineUnion {
+				t.Errorf("Mode mismatch: got %s, %v, want %s\n", mode, err, CombineUnion)
+			}
+
+			// The store's mode applies unless the request gives one
+			user_policy, err := GetUserPolicy(t.Context(), store, "alice", "")
+			if err != nil {
+				t.Fatalf("Error getting user policy: %v\n", err)
+			}
+			if got := user_policy.ToSql(); user_policy.Mode != CombineUnion || got != `"State" IN ('Ohio', 'Maine')` {
+				t.Errorf("Union mismatch: got %s in %s\n", got, user_policy.Mode)
+			}
+			combined, err := CombineRoles(t.Context(), store, []string{"ohio", "maine"}, CombineIntersection)
+			if err != nil {
+				t.Fatalf("Error combining roles: %v\n", err)
+			}
+			if got := combined.ToSql(); got != "FALSE" {
+				t.Errorf("Intersection mismatch: got %s, want FALSE\n", got)
+			}
+		})
+	}
+}
+
+func TestCombinedPolicyConvertsToSql(t *testing.T) {
+	east := []SourcedItem{
+		{Column: "Region", Values: []SourcedValue{{"Eastern", []string{"east"}}}},
+		{Column: "State", Values: []SourcedValue{{"__all__", []string{"east"}}}},
+	}
+	ohio := []SourcedItem{{Column: "State", Values: []SourcedValue{{"Ohio", []string{"ohio"}}}}}
+	admin := []SourcedItem{{Column: "State", Values: []SourcedValue{{"__all__", []string{"admin"}}}}}
+	no_texas := []SourcedItem{{Column: "State", Values: []SourcedValue{{"Texas", []string{"no_texas"}}}}}
+
+	tests := map[string]struct {
+		input  CombinedPolicy
+		output string
+	}{
+		"One set":              {CombinedPolicy{Policy: east}, `"Region" IN ('Eastern')`},
+		"No columns":           {CombinedPolicy{Policy: []SourcedItem{}}, "FALSE"},
+		"Sets are ORed":        {CombinedPolicy{Policy: east, Or: [][]SourcedItem{ohio}}, `(("Region" IN ('Eastern')) OR ("State" IN ('Ohio')))`},
+		"Denials apply to all": {CombinedPolicy{Policy: east, Or: [][]SourcedItem{ohio}, Deny: no_texas}, `(("Region" IN ('Eastern')) OR ("State" IN ('Ohio'))) AND ("State" IS NULL OR "State" NOT IN ('Texas'))`},
+		"A set that sees all":  {CombinedPolicy{Policy: east, Or: [][]SourcedItem{admin}}, "TRUE"},
+		"Denials of all":       {CombinedPolicy{Policy: admin, Or: [][]SourcedItem{ohio}, Deny: no_texas}, `("State" IS NULL OR "State" NOT IN ('Texas'))`},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.input.ToSql(); got != test.output {
+				t.Errorf("SQL mismatch: got %s, want %s\n", got, test.output)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package rowaccess
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// How a role or column differs between two sets of policies
+type Change string
+
+const (
+	Added   Change = "added"
+	Removed Change = "removed"
+	Changed Change = "changed"
+)
+
+// The differences between two sets of policies, role by role, and between
+// their users
+type Diff struct {
+	// Every role that differs, in order of name
+	Roles []RoleDiff `json:"roles"`
+	// Every user whose roles differ, in order of name
+	Users []UserDiff `json:"users,omitempty"`
+}
+
+// How one role differs
+//
+// An added role lists every column it is granted, and a removed role every
+// column it was granted.
+type RoleDiff struct {
+	Role   string `json:"role"`
+	Change Change `json:"change"`
+	// Set if the roles the role extends differ, which includes being added
+	// or removed with some
+	Extends *ExtendsDiff `json:"extends,omitempty"`
+	Columns []ColumnDiff `json:"columns"`
+	// How the role's deny items differ, compared as Columns are
+	Deny []ColumnDiff `json:"deny,omitempty"`
+}
+
+// How the roles a role extends differ
+//
+// Order matters, as it decides which role a column is inherited from, so
+// the lists are given in full.
+type ExtendsDiff struct {
+	Old []string `json:"old"`
+	New []string `json:"new"`
+}
+
+// How one column of a role's policy differs
+//
+// Values are compared as sets, so a change in their order is not a
+// difference. A column granted in full has the value __all__, so a column
+// that goes from __all__ to a list of values removes __all__ and adds the
+// list. Values a grant of __all__ leaves out are compared the same way.
+//
+// A value means something else under another match, so a column whose
+// match changes removes every old value and adds every new one.
+type ColumnDiff struct {
+	Column string `json:"column"`
+	Change Change `json:"change"`
+	// Set if the column's match differs, which includes being added or
+	// removed with a pattern match
+	Match         *MatchDiff `json:"match,omitempty"`
+	Added         []string   `json:"added"`
+	Removed       []string   `json:"removed"`
+	ExceptAdded   []string   `json:"except_added,omitempty"`
+	ExceptRemoved []string   `json:"except_removed,omitempty"`
+}
+
+// How the roles a user is a member of differ
+//
+// Roles are compared as sets, as values are. An added user lists every role
+// it is a member of, and a removed user every role it was a member of.
+type UserDiff struct {
+	User    string   `json:"user"`
+	Change  Change   `json:"change"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// How the match of a column differs. An exact match is empty.
+type MatchDiff struct {
+	Old MatchKind `json:"old"`
+	New MatchKind `json:"new"`
+}
+
+// Return true if there are no differences
+func (d *Diff) Empty() bool {
+	return len(d.Roles) == 0 && len(d.Users) == 0
+}
+
+// Return the number of roles added, removed and changed
+func (d *Diff) Counts() (int, int, int) {
+	var changes []Change
+	for _, role_diff := range d.Roles {
+		changes = append(changes, role_diff.Change)
+	}
+	return countChanges(changes)
+}
+
+// Return the number of users added, removed and changed
+func (d *Diff) UserCounts() (int, int, int) {
+	var changes []Change
+	for _, user_diff := range d.Users {
+		changes = append(changes, user_diff.Change)
+	}
+	return countChanges(changes)
+}
+
+// Return the number of changes that add, remove and change
+func countChanges(changes []Change) (int, int, int) {
+	var added, removed, changed int
+	for _, change := range changes {
+		switch change {
+		case Added:
+			added++
+		case Removed:
+			removed++
+		default:
+			changed++
+		}
+	}
+	return added, removed, changed
+}
+
+// Return the differences going from the old policy set to the new one,
+// users included, as DiffPolicies and DiffUsers give them
+func DiffPolicySets(old_set, new_set *PolicySet) *Diff {
+	diff := DiffPolicies(old_set.Policies, new_set.Policies)
+	diff.Users = DiffUsers(old_set.Users, new_set.Users)
+	return diff
+}
+
+// Return the differences going from the old policies to the new ones
+//
+// Each list holds at most one policy per role. Columns are reported in the
+// order the new policy lists them, followed by those only the old one has.
+func DiffPolicies(old_policies, new_policies []Policy) *Diff {
+	old_by_role := map[string]Policy{}
+	for _, policy := range old_policies {
+		old_by_role[policy.Role] = normalizePolicy(policy)
+	}
+	new_by_role := map[string]Policy{}
+	for _, policy := range new_policies {
+		new_by_role[policy.Role] = normalizePolicy(policy)
+	}
+
+	diff := &Diff{Roles: []RoleDiff{}}
+	for role, new_policy := range new_by_role {
+		old_policy, ok := old_by_role[role]
+		if !ok {
+			diff.Roles = append(diff.Roles, RoleDiff{Role: role, Change: Added, Extends: diffExtends(nil, new_policy.Extends), Columns: diffItems(nil, new_policy.Policy), Deny: denyDiff(nil, new_policy.Deny)})
+			continue
+		}
+		extends := diffExtends(old_policy.Extends, new_policy.Extends)
+		columns := diffItems(old_policy.Policy, new_policy.Policy)
+		deny := denyDiff(old_policy.Deny, new_policy.Deny)
+		if len(columns) > 0 || extends != nil || deny != nil {
+			diff.Roles = append(diff.Roles, RoleDiff{Role: role, Change: Changed, Extends: extends, Columns: columns, Deny: deny})
+		}
+	}
+	for role, old_policy := range old_by_role {
+		if _, ok := new_by_role[role]; !ok {
+			diff.Roles = append(diff.Roles, RoleDiff{Role: role, Change: Removed, Extends: diffExtends(old_policy.Extends, nil), Columns: diffItems(old_policy.Policy, nil), Deny: denyDiff(old_policy.Deny, nil)})
+		}
+	}
+	slices.SortFunc(diff.Roles, func(a, b RoleDiff) int {
+		return strings.Compare(a.Role, b.Role)
+	})
+	return diff
+}
+
+// Return the users whose roles differ going from the old users to the new
+// ones, in order of name, or nil if none do
+//
+// Each list holds each user at most once.
+func DiffUsers(old_users, new_users []User) []UserDiff {
+	old_by_name := map[string][]string{}
+	for _, user := range old_users {
+		old_by_name[user.Name] = user.Roles
+	}
+	new_by_name := map[string][]string{}
+	for _, user := range new_users {
+		new_by_name[user.Name] = user.Roles
+	}
+
+	var users []UserDiff
+	for name, new_roles := range new_by_name {
+		old_roles, ok := old_by_name[name]
+		if !ok {
+			users = append(users, UserDiff{User: name, Change: Added, Added: valuesNotIn(new_roles, nil), Removed: []string{}})
+			continue
+		}
+		added, removed := diffValues(old_roles, new_roles)
+		if len(added) > 0 || len(removed) > 0 {
+			users = append(users, UserDiff{User: name, Change: Changed, Added: added, Removed: removed})
+		}
+	}
+	for name, old_roles := range old_by_name {
+		if _, ok := new_by_name[name]; !ok {
+			users = append(users, UserDiff{User: name, Change: Removed, Added: []string{}, Removed: valuesNotIn(old_roles, nil)})
+		}
+	}
+	slices.SortFunc(users, func(a, b UserDiff) int {
+		return strings.Compare(a.User, b.User)
+	})
+	return users
+}
+
+// Return the roles the diff removes, in order of name
+func removedRoles(diff *Diff) []string {
+	var roles []string
+	for _, role_diff := range diff.Roles {
+		if role_diff.Change == Removed {
+			roles = append(roles, role_diff.Role)
+		}
+	}
+	return roles
+}
+
+// Return how users lose the roles the diff removes, given the roles each
+// user is a member of, in order of name
+func removedMemberships(diff *Diff, members map[string][]string) []UserDiff {
+	removed := removedRoles(diff)
+	var users []UserDiff
+	for user, roles := range members {
+		lost := []string{}
+		for _, role := range removed {
+			if slices.Contains(roles, role) {
+				lost = append(lost, role)
+			}
+		}
+		if len(lost) > 0 {
+			users = append(users, UserDiff{User: user, Change: Changed, Added: []string{}, Removed: lost})
+		}
+	}
+	slices.SortFunc(users, func(a, b UserDiff) int {
+		return strings.Compare(a.User, b.User)
+	})
+	return users
+}
+
+// Return how the roles extended differ, or nil if they are the same
+func diffExtends(old_extends, new_extends []string) *ExtendsDiff {
+	if slices.Equal(old_extends, new_extends) {
+		return nil
+	}
+	if old_extends == nil {
+		old_extends = []string{}
+	}
+	if new_extends == nil {
+		new_extends = []string{}
+	}
+	return &ExtendsDiff{Old: old_extends, New: new_extends}
+}
+
+// Return the differences between two lists of deny items, or nil if there
+// are none
+func denyDiff(old_items, new_items []PolicyItem) []ColumnDiff {
+	if deny := diffItems(old_items, new_items); len(deny) > 0 {
+		return deny
+	}
+	return nil
+}
+
+// Return how the match of a column differs, or nil if it is the same
+func diffMatch(old_match, new_match MatchKind) *MatchDiff {
+	if old_match == new_match {
+		return nil
+	}
+	return &MatchDiff{Old: old_match, New: new_match}
+}
+
+// Return the differences between two normalized lists of policy items
+func diffItems(old_items, new_items []PolicyItem) []ColumnDiff {
+	old_by_column := map[string]PolicyItem{}
+	for _, policy_item := range old_items {
+		old_by_column[policy_item.Column] = policy_item
+	}
+	columns := []ColumnDiff{}
+	for _, policy_item := range new_items {
+		old_item, ok := old_by_column[policy_item.Column]
+		if !ok {
+			columns = append(columns, ColumnDiff{Column: policy_item.Column, Change: Added, Match: diffMatch("", policy_item.Match), Added: policy_item.Values, Removed: []string{}, ExceptAdded: policy_item.Except})
+			continue
+		}
+		if match := diffMatch(old_item.Match, policy_item.Match); match != nil {
+			columns = append(columns, ColumnDiff{Column: policy_item.Column, Change: Changed, Match: match, Added: policy_item.Values, Removed: old_item.Values, ExceptAdded: policy_item.Except, ExceptRemoved: old_item.Except})
+			continue
+		}
+		added, removed := diffValues(old_item.Values, policy_item.Values)
+		except_added, except_removed := diffValues(old_item.Except, policy_item.Except)
+		if len(added) > 0 || len(removed) > 0 || len(except_added) > 0 || len(except_removed) > 0 {
+			column_diff := ColumnDiff{Column: policy_item.Column, Change: Changed, Added: added, Removed: removed}
+			if len(except_added) > 0 {
+				column_diff.ExceptAdded = except_added
+			}
+			if len(except_removed) > 0 {
+				column_diff.ExceptRemoved = except_removed
+			}
+			columns = append(columns, column_diff)
+		}
+	}
+	new_columns := map[string]bool{}
+	for _, policy_item := range new_items {
+		new_columns[policy_item.Column] = true
+	}
+	for _, policy_item := range old_items {
+		if !new_columns[policy_item.Column] {
+			columns = append(columns, ColumnDiff{Column: policy_item.Column, Change: Removed, Match: diffMatch(policy_item.Match, ""), Added: []string{}, Removed: policy_item.Values, ExceptRemoved: policy_item.Except})
+		}
+	}
+	return columns
+}
+
+// Return the values only in new_values and those only in old_values, each
+// in the order of their list
+func diffValues(old_values, new_values []string) ([]string, []string) {
+	return valuesNotIn(new_values, old_values), valuesNotIn(old_values, new_values)
+}
+
+// Return the values that are not in other, keeping their order
+func valuesNotIn(values, other []string) []string {
+	in_other := make(map[string]bool, len(other))
+	for _, value := range other {
+		in_other[value] = true
+	}
+	missing := []string{}
+	for _, value := range values {
+		if !in_other[value] {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+// Return what loading the policy sets into the store, in order, would
+// change, without changing anything
+//
+// With sync, as for SyncPolicies, every role the sets do not define would be
+// deleted; otherwise roles not in the sets are left as they are. A role in
+// more than one set takes the policy of the last. Users are never deleted,
+// and a user in the sets takes the roles of the last set to list them. With
+// sync, users are no longer members of the roles that would be deleted.
+func PlanLoad(ctx context.Context, store PolicyStore, policy_sets []*PolicySet, sync bool) (*Diff, error) {
+	var current []Policy
+	err := store.GetAllPolicies(ctx, func(policy Policy) error {
+		current = append(current, policy)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := map[string]Policy{}
+	if !sync {
+		for _, policy := range current {
+			loaded[policy.Role] = policy
+		}
+	}
+	for _, policy_set := range policy_sets {
+		for _, policy := range policy_set.Policies {
+			loaded[policy.Role] = policy
+		}
+	}
+	after := make([]Policy, 0, len(loaded))
+	for _, policy := range loaded {
+		after = append(after, policy)
+	}
+
+	current_users, err := ExportUsers(ctx, store, SortLoaded)
+	if err != nil {
+		return nil, err
+	}
+	members := map[string][]string{}
+	for _, user := range current_users {
+		members[user.Name] = user.Roles
+	}
+	for _, policy_set := range policy_sets {
+		for _, user := range policy_set.Users {
+			members[user.Name] = user.Roles
+		}
+	}
+	after_users := make([]User, 0, len(members))
+	for name, roles := range members {
+		if sync {
+			roles = slices.DeleteFunc(slices.Clone(roles), func(role string) bool {
+				_, ok := loaded[role]
+				return !ok
+			})
+		}
+		after_users = append(after_users, User{Name: name, Roles: roles})
+	}
+	return DiffPolicySets(&PolicySet{Policies: current, Users: current_users}, &PolicySet{Policies: after, Users: after_users}), nil
+}
@@ -0,0 +1,145 @@
+package rowaccess
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffPolicies(t *testing.T) {
+	old_policies := []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"Maine", "Ohio"}},
+			{Column: "City", Values: []string{"Boston"}},
+		}},
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+		{Role: "auditor", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern", "Western"}}}},
+		{Role: "pa_mgr", Extends: []string{"east_mgr", "auditor"}, Policy: []PolicyItem{}},
+		{Role: "not_ca", Policy: []PolicyItem{{Column: "State", Values: []string{"__all__"}, Except: []string{"California"}}}, Deny: []PolicyItem{
+			{Column: "Store", Values: []string{"12"}},
+		}},
+		{Role: "sku_mgr", Policy: []PolicyItem{
+			{Column: "Sku", Match: MatchPrefix, Values: []string{"SKU-1"}},
+			{Column: "Store", Match: MatchExact, Values: []string{"12"}},
+		}},
+	}
+	new_policies := []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+		{Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"Ohio", "Vermont"}},
+			{Column: "Store", Values: []string{"__all__"}},
+		}},
+		{Role: "north_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Northern"}}}},
+		// Reordered values are not a difference
+		{Role: "auditor", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western", "Eastern", "Western"}}}},
+		// Reordered roles to extend are a difference
+		{Role: "pa_mgr", Extends: []string{"auditor", "east_mgr"}, Policy: []PolicyItem{}},
+		{Role: "ne_mgr", Extends: []string{"north_mgr"}, Policy: []PolicyItem{}},
+		{Role: "not_ca", Policy: []PolicyItem{{Column: "State", Values: []string{"__all__"}, Except: []string{"Texas", "California"}}}},
+		// An exact match is the same as none
+		{Role: "sku_mgr", Policy: []PolicyItem{
+			{Column: "Sku", Match: MatchGlob, Values: []string{"SKU-1*"}},
+			{Column: "Store", Values: []string{"12"}},
+		}},
+	}
+	expected := &Diff{Roles: []RoleDiff{
+		{Role: "admin", Change: Changed, Columns: []ColumnDiff{
+			{Column: "Region", Change: Changed, Added: []string{"Eastern"}, Removed: []string{"__all__"}},
+		}},
+		{Role: "east_mgr", Change: Changed, Columns: []ColumnDiff{
+			{Column: "State", Change: Changed, Added: []string{"Vermont"}, Removed: []string{"Maine"}},
+			{Column: "Store", Change: Added, Added: []string{"__all__"}, Removed: []string{}},
+			{Column: "City", Change: Removed, Added: []string{}, Removed: []string{"Boston"}},
+		}},
+		{Role: "ne_mgr", Change: Added, Extends: &ExtendsDiff{Old: []string{}, New: []string{"north_mgr"}}, Columns: []ColumnDiff{}},
+		{Role: "north_mgr", Change: Added, Columns: []ColumnDiff{
+			{Column: "Region", Change: Added, Added: []string{"Northern"}, Removed: []string{}},
+		}},
+		{Role: "not_ca", Change: Changed, Columns: []ColumnDiff{
+			{Column: "State", Change: Changed, Added: []string{}, Removed: []string{}, ExceptAdded: []string{"Texas"}},
+		}, Deny: []ColumnDiff{
+			{Column: "Store", Change: Removed, Added: []string{}, Removed: []string{"12"}},
+		}},
+		{Role: "pa_mgr", Change: Changed, Extends: &ExtendsDiff{Old: []string{"east_mgr", "auditor"}, New: []string{"auditor", "east_mgr"}}, Columns: []ColumnDiff{}},
+		{Role: "sku_mgr", Change: Changed, Columns: []ColumnDiff{
+			{Column: "Sku", Change: Changed, Match: &MatchDiff{Old: MatchPrefix, New: MatchGlob}, Added: []string{"SKU-1*"}, Removed: []string{"SKU-1"}},
+		}},
+		{Role: "west_mgr", Change: Removed, Columns: []ColumnDiff{
+			{Column: "Region", Change: Removed, Added: []string{}, Removed: []string{"Western"}},
+		}},
+	}}
+	diff := DiffPolicies(old_policies, new_policies)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Diff mismatch:\ngot  %+v\nwant %+v\n", diff, expected)
+	}
+	if added, removed, changed := diff.Counts(); added != 2 || removed != 1 || changed != 5 {
+		t.Errorf("Counts mismatch: got %d, %d, %d, want 2, 1, 5\n", added, removed, changed)
+	}
+	if diff := DiffPolicies(old_policies, old_policies); !diff.Empty() {
+		t.Errorf("Expected no differences between the same policies, got %+v\n", diff)
+	}
+}
+
+func TestPlanLoadMatchesLoad(t *testing.T) {
+	initial_set := PolicySet{Policies: []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+	}, Users: []User{
+		{Name: "alice", Roles: []string{"east_mgr"}},
+		{Name: "bob", Roles: []string{"admin"}},
+	}}
+	load_set := PolicySet{Policies: []Policy{
+		{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern", "Northern"}}}},
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+	}, Users: []User{
+		{Name: "alice", Roles: []string{"west_mgr", "east_mgr"}},
+		{Name: "carol", Roles: []string{"west_mgr"}},
+	}}
+	for _, sync := range []bool{false, true} {
+		for name, open := range getStoreFactories() {
+			t.Run(name, func(t *testing.T) {
+				store := open(t)
+				defer store.Close()
+				if _, err := store.LoadPolicies(t.Context(), &initial_set); err != nil {
+					t.Fatalf("Error loading policies: %v\n", err)
+				}
+				before, err := ExportPolicySet(t.Context(), store, SortLoaded)
+				if err != nil {
+					t.Fatalf("Error exporting policies: %v\n", err)
+				}
+				plan, err := PlanLoad(t.Context(), store, []*PolicySet{&load_set}, sync)
+				if err != nil {
+					t.Fatalf("Error planning load: %v\n", err)
+				}
+				if unchanged, err := ExportPolicySet(t.Context(), store, SortLoaded); err != nil || !reflect.DeepEqual(unchanged, before) {
+					t.Fatalf("Planning a load changed the store: %v\n", err)
+				}
+				if sync {
+					_, err = store.SyncPolicies(t.Context(), &load_set)
+				} else {
+					_, err = store.LoadPolicies(t.Context(), &load_set)
+				}
+				if err != nil {
+					t.Fatalf("Error loading policies: %v\n", err)
+				}
+				after, err := ExportPolicySet(t.Context(), store, SortLoaded)
+				if err != nil {
+					t.Fatalf("Error exporting policies: %v\n", err)
+				}
+				if diff := DiffPolicySets(before, after); !reflect.DeepEqual(plan, diff) {
+					t.Errorf("Plan mismatch (sync %t):\ngot  %+v\nwant %+v\n", sync, plan, diff)
+				}
+				_, removed, _ := plan.Counts()
+				if want := map[bool]int{false: 0, true: 1}[sync]; removed != want {
+					t.Errorf("Removed roles mismatch (sync %t): got %d, want %d\n", sync, removed, want)
+				}
+				// With sync, bob is no longer a member of the pruned admin
+				if added, removed, changed := plan.UserCounts(); added != 1 || removed != 0 || changed != map[bool]int{false: 1, true: 2}[sync] {
+					t.Errorf("User counts mismatch (sync %t): got %d, %d, %d\n", sync, added, removed, changed)
+				}
+			})
+		}
+	}
+}
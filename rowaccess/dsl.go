@@ -0,0 +1,444 @@
+package rowaccess
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Return the policy in the policy language, which DecodePolicyDsl reads
+//
+// Each column is on its own line, and values are quoted only if they need
+// to be.
+func (p *Policy) ToDsl() string {
+	header := "role " + quoteDslWord(p.Role)
+	if len(p.Extends) > 0 {
+		parents := make([]string, len(p.Extends))
+		for i, parent := range p.Extends {
+			parents[i] = quoteDslWord(parent)
+		}
+		header += " extends " + strings.Join(parents, ", ")
+	}
+	if len(p.Policy) == 0 && len(p.Deny) == 0 {
+		return header + " {}\n"
+	}
+	var b strings.Builder
+	b.WriteString(header + " {\n")
+	for _, policy_item := range p.Policy {
+		values := dslValues(policy_item)
+		if len(policy_item.Except) > 0 {
+			values += " except " + dslList(policy_item.Except)
+		}
+		fmt.Fprintf(&b, "    %s: %s;\n", quoteDslWord(policy_item.Column), values)
+	}
+	for _, deny_item := range p.Deny {
+		fmt.Fprintf(&b, "    deny %s: %s;\n", quoteDslWord(deny_item.Column), dslValues(deny_item))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Return the item's values as a list, after its match if they are patterns.
+// An exact value named for a match is quoted, so that it is not read as
+// one.
+func dslValues(policy_item PolicyItem) string {
+	if policy_item.isPattern() {
+		return string(policy_item.Match) + " " + dslList(policy_item.Values)
+	}
+	if len(policy_item.Values) > 0 {
+		if _, err := ParseMatchKind(policy_item.Values[0]); err == nil {
+			return `"` + policy_item.Values[0] + `"` + strings.TrimPrefix(dslList(policy_item.Values), policy_item.Values[0])
+		}
+	}
+	return dslList(policy_item.Values)
+}
+
+// Return the words quoted as needed and separated by commas
+func dslList(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = quoteDslWord(word)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Return the user in the policy language, which DecodeConfig reads
+func (u *User) ToDsl() string {
+	roles := make([]string, len(u.Roles))
+	for i, role := range u.Roles {
+		roles[i] = quoteDslWord(role)
+	}
+	if len(roles) == 0 {
+		return fmt.Sprintf("user %s {}\n", quoteDslWord(u.Name))
+	}
+	return fmt.Sprintf("user %s { %s }\n", quoteDslWord(u.Name), strings.Join(roles, ", "))
+}
+
+// Return the word as is if it can be written bare, and double quoted
+// otherwise, with any quotes within it doubled
+func quoteDslWord(word string) string {
+	if word != "" && !strings.ContainsFunc(word, isDslSpecial) {
+		return word
+	}
+	return `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+}
+
+// Return true if the character cannot be part of a bare word
+func isDslSpecial(c rune) bool {
+	return unicode.IsSpace(c) || strings.ContainsRune(`{}:;,"#`, c)
+}
+
+// Decode a policy set written in the policy language, calling fn with each
+// policy in order
+//
+// A config is a list of roles, each with its columns and their values:
+//
+//	# Comments run from # to the end of the line
+//	role pa_sales_manager { Region: Eastern; State: Pennsylvania }
+//	role ne_manager {
+//	    Region: Eastern, Northern;
+//	    State: "New York", Vermont;
+//	}
+//	role admin { Region: __all__; }
+//	role nobody {}
+//	role pa_auditor extends pa_sales_manager, nobody { Region: __all__ }
+//	role not_california { State: __all__ except California; deny Region: Western }
+//	role sku_reader { Sku: prefix SKU-12, SKU-34; deny Store: regex "9\d+" }
+//	user alice { pa_sales_manager, ne_manager }
+//
+// Columns are separated by semicolons, and the last may end with one. A
+// column granted __all__ may leave values out after except, and a column
+// after deny lists values the role may never see. Values after prefix,
+// glob or regex are patterns matched that way. A column named deny, or a
+// value named except or for a match, in their place must be quoted.
+// Names and values are bare words or double quoted, with a quote within one
+// doubled. A bare word runs until space or one of {}:;,"#. The roles a role
+// extends follow its name, separated by commas, and a user lists the roles
+// it is a member of the same way.
+//
+// Decoding stops at the first error, which is a *SyntaxError with its line
+// and column if the config cannot be parsed. Users are skipped; DecodeConfig
+// returns them too.
+func DecodePolicyDsl(r io.Reader, fn func(Policy) error) error {
+	return decodeDslConfig(r, fn, func(User) error { return nil })
+}
+
+// Decode a config in the policy language, calling policy_fn with each role
+// and user_fn with each user
+func decodeDslConfig(r io.Reader, policy_fn func(Policy) error, user_fn func(User) error) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	l := &dslLexer{input: []rune(string(data)), line: 1, column: 1}
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return err
+		}
+		if tok.kind == tokenEOF {
+			return nil
+		}
+		if tok.kind == tokenWord && tok.text == "user" {
+			user, err := l.user()
+			if err != nil {
+				return err
+			}
+			if err := user_fn(user); err != nil {
+				return fmt.Errorf("line %d (user %s): %w", tok.line, user.Name, err)
+			}
+			continue
+		}
+		policy, err := l.role(tok)
+		if err != nil {
+			return err
+		}
+		if err := policy_fn(policy); err != nil {
+			return fmt.Errorf("line %d (role %s): %w", tok.line, policy.Role, err)
+		}
+	}
+}
+
+// Return true if the config is not JSON, and so is in the policy language,
+// judging by its first character that is not space
+func isDslConfig(br *bufio.Reader) bool {
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return false
+		}
+		if !unicode.IsSpace(c) {
+			br.UnreadRune()
+			return c != '{'
+		}
+	}
+}
+
+// Return true if the config data is in the policy language, as isDslConfig
+func isDslData(data []byte) bool {
+	return isDslConfig(bufio.NewReader(bytes.NewReader(data)))
+}
+
+type dslLexer struct {
+	input  []rune
+	pos    int
+	line   int
+	column int
+}
+
+func (l *dslLexer) advance() rune {
+	c := l.input[l.pos]
+	l.pos++
+	if c == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return c
+}
+
+// Return the next token, skipping space and comments
+//
+// Punctuation is a tokenPunct, bare words are tokenWord and quoted words
+// are tokenName.
+func (l *dslLexer) next() (token, error) {
+	for l.pos < len(l.input) {
+		if c := l.input[l.pos]; unicode.IsSpace(c) {
+			l.advance()
+		} else if c == '#' {
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.advance()
+			}
+		} else {
+			break
+		}
+	}
+	tok := token{line: l.line, column: l.column}
+	if l.pos >= len(l.input) {
+		return tok, nil
+	}
+
+	switch c := l.input[l.pos]; {
+	case strings.ContainsRune("{}:;,", c):
+		tok.kind = tokenPunct
+		tok.text = string(l.advance())
+	case c == '"':
+		l.advance()
+		var b strings.Builder
+		for {
+			if l.pos >= len(l.input) {
+				return tok, &SyntaxError{tok.line, tok.column, `unterminated "`}
+			}
+			c := l.advance()
+			if c == '"' {
+				if l.pos >= len(l.input) || l.input[l.pos] != '"' {
+					break
+				}
+				l.advance()
+			}
+			b.WriteRune(c)
+		}
+		tok.kind = tokenName
+		tok.text = b.String()
+	default:
+		var b strings.Builder
+		for l.pos < len(l.input) && !isDslSpecial(l.input[l.pos]) {
+			b.WriteRune(l.advance())
+		}
+		tok.kind = tokenWord
+		tok.text = b.String()
+	}
+	return tok, nil
+}
+
+// Return a syntax error at the token
+func unexpected(tok token, expected string) error {
+	return &SyntaxError{tok.line, tok.column, fmt.Sprintf("expected %s, found %s", expected, tok)}
+}
+
+func isPunct(tok token, text string) bool {
+	return tok.kind == tokenPunct && tok.text == text
+}
+
+func isWord(tok token) bool {
+	return tok.kind == tokenWord || tok.kind == tokenName
+}
+
+// Parse the role that starts with the token
+func (l *dslLexer) role(tok token) (Policy, error) {
+	if tok.kind != tokenWord || tok.text != "role" {
+		return Policy{}, unexpected(tok, "role or user")
+	}
+	tok, err := l.next()
+	if err != nil {
+		return Policy{}, err
+	}
+	if !isWord(tok) {
+		return Policy{}, unexpected(tok, "role name")
+	}
+	policy := Policy{Role: tok.text, Policy: []PolicyItem{}}
+	if tok, err = l.next(); err != nil {
+		return Policy{}, err
+	}
+	if tok.kind == tokenWord && tok.text == "extends" {
+		for {
+			if tok, err = l.next(); err != nil {
+				return Policy{}, err
+			}
+			if !isWord(tok) {
+				return Policy{}, unexpected(tok, "role name")
+			}
+			policy.Extends = append(policy.Extends, tok.text)
+			if tok, err = l.next(); err != nil {
+				return Policy{}, err
+			}
+			if !isPunct(tok, ",") {
+				break
+			}
+		}
+	}
+	if !isPunct(tok, "{") {
+		return Policy{}, unexpected(tok, "{")
+	}
+
+	for {
+		if tok, err = l.next(); err != nil {
+			return Policy{}, err
+		}
+		if isPunct(tok, "}") {
+			return policy, nil
+		}
+		if !isWord(tok) {
+			return Policy{}, unexpected(tok, "column name or }")
+		}
+		deny := tok.kind == tokenWord && tok.text == "deny"
+		column := tok
+		if tok, err = l.next(); err != nil {
+			return Policy{}, err
+		}
+		if deny && isWord(tok) {
+			column = tok
+			if tok, err = l.next(); err != nil {
+				return Policy{}, err
+			}
+		} else {
+			deny = false
+		}
+		if !isPunct(tok, ":") {
+			return Policy{}, unexpected(tok, ":")
+		}
+		policy_item := PolicyItem{Column: column.text}
+		if policy_item.Match, err = l.match(); err != nil {
+			return Policy{}, err
+		}
+		if policy_item.Values, tok, err = l.list("value"); err != nil {
+			return Policy{}, err
+		}
+		if !deny && tok.kind == tokenWord && tok.text == "except" {
+			if policy_item.Except, tok, err = l.list("value"); err != nil {
+				return Policy{}, err
+			}
+		}
+		if deny {
+			policy.Deny = append(policy.Deny, policy_item)
+		} else {
+			policy.Policy = append(policy.Policy, policy_item)
+		}
+		if isPunct(tok, "}") {
+			return policy, nil
+		}
+		if !isPunct(tok, ";") {
+			return Policy{}, unexpected(tok, "; or }")
+		}
+	}
+}
+
+// Parse the match that starts a column's values, if there is one: a bare
+// match name followed by a value. The lexer is left at the first value.
+func (l *dslLexer) match() (MatchKind, error) {
+	before := *l
+	tok, err := l.next()
+	if err != nil {
+		return "", err
+	}
+	if kind, kind_err := ParseMatchKind(tok.text); tok.kind == tokenWord && kind_err == nil {
+		after := *l
+		if tok, err = l.next(); err != nil {
+			return "", err
+		}
+		if isWord(tok) {
+			*l = after
+			return kind, nil
+		}
+	}
+	*l = before
+	return "", nil
+}
+
+// Parse a list of words separated by commas, returning them and the token
+// after the last
+func (l *dslLexer) list(what string) ([]string, token, error) {
+	words := []string{}
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, tok, err
+		}
+		if !isWord(tok) {
+			return nil, tok, unexpected(tok, what)
+		}
+		words = append(words, tok.text)
+		if tok, err = l.next(); err != nil {
+			return nil, tok, err
+		}
+		if !isPunct(tok, ",") {
+			return words, tok, nil
+		}
+	}
+}
+
+// Parse the user whose user keyword has just been read
+func (l *dslLexer) user() (User, error) {
+	tok, err := l.next()
+	if err != nil {
+		return User{}, err
+	}
+	if !isWord(tok) {
+		return User{}, unexpected(tok, "user name")
+	}
+	user := User{Name: tok.text, Roles: []string{}}
+	if tok, err = l.next(); err != nil {
+		return User{}, err
+	}
+	if !isPunct(tok, "{") {
+		return User{}, unexpected(tok, "{")
+	}
+	if tok, err = l.next(); err != nil {
+		return User{}, err
+	}
+	if isPunct(tok, "}") {
+		return user, nil
+	}
+	for {
+		if !isWord(tok) {
+			return User{}, unexpected(tok, "role name")
+		}
+		user.Roles = append(user.Roles, tok.text)
+		if tok, err = l.next(); err != nil {
+			return User{}, err
+		}
+		if isPunct(tok, "}") {
+			return user, nil
+		}
+		if !isPunct(tok, ",") {
+			return User{}, unexpected(tok, ", or }")
+		}
+		if tok, err = l.next(); err != nil {
+			return User{}, err
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package rowaccess
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Return every policy in the config
+func decodeDsl(t *testing.T, config string) ([]Policy, error) {
+	t.Helper()
+	policies := []Policy{}
+	err := DecodePolicyDsl(strings.NewReader(config), func(policy Policy) error {
+		policies = append(policies, policy)
+		return nil
+	})
+	return policies, err
+}
+
+func TestDecodePolicyDsl(t *testing.T) {
+	config := `# Sales managers
+role pa_sales_manager { Region: Eastern; State: Pennsylvania }
+role ne_manager {
+    Region: Eastern, Northern;  # two regions
+    "Sales State": "New York", "Say ""hi""", 10-B;
+}
+role admin{Region:__all__;}
+role nobody {}
+role pa_auditor extends pa_sales_manager, "no body" { Region: __all__ }
+role not_west {
+    State: __all__ except California, "New Mexico";
+    deny Region: Western;
+    deny: except, "deny";
+}
+role sku_reader {
+    Sku: prefix SKU-12, "SKU 34";
+    Store: glob 1?;
+    Size: "regex", regex;
+    Kind: prefix;
+    deny Code: regex "X\d{2,}", Y;
+}
+`
+	expected := []Policy{
+		{Role: "pa_sales_manager", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"Pennsylvania"}},
+		}},
+		{Role: "ne_manager", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern", "Northern"}},
+			{Column: "Sales State", Values: []string{"New York", `Say "hi"`, "10-B"}},
+		}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "nobody", Policy: []PolicyItem{}},
+		{Role: "pa_auditor", Extends: []string{"pa_sales_manager", "no body"}, Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"__all__"}},
+		}},
+		{Role: "not_west", Policy: []PolicyItem{
+			{Column: "State", Values: []string{"__all__"}, Except: []string{"California", "New Mexico"}},
+			{Column: "deny", Values: []string{"except", "deny"}},
+		}, Deny: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+		{Role: "sku_reader", Policy: []PolicyItem{
+			{Column: "Sku", Match: MatchPrefix, Values: []string{"SKU-12", "SKU 34"}},
+			{Column: "Store", Match: MatchGlob, Values: []string{"1?"}},
+			{Column: "Size", Values: []string{"regex", "regex"}},
+			{Column: "Kind", Values: []string{"prefix"}},
+		}, Deny: []PolicyItem{{Column: "Code", Match: MatchRegex, Values: []string{`X\d{2,}`, "Y"}}}},
+	}
+	policies, err := decodeDsl(t, config)
+	if err != nil {
+		t.Fatalf("Error decoding config: %v\n", err)
+	}
+	if !reflect.DeepEqual(policies, expected) {
+		t.Errorf("Policies mismatch:\ngot  %+v\nwant %+v\n", policies, expected)
+	}
+
+	// Formatting the policies gives a config that decodes to the same
+	// policies
+	var b strings.Builder
+	for _, policy := range policies {
+		b.WriteString(policy.ToDsl())
+	}
+	if formatted, err := decodeDsl(t, b.String()); err != nil || !reflect.DeepEqual(formatted, expected) {
+		t.Errorf("Formatted policies mismatch: got %+v, %v\n%s", formatted, err, b.String())
+	}
+}
+
+func TestPolicyConvertsToDsl(t *testing.T) {
+	policy := Policy{Role: "ne_manager", Policy: []PolicyItem{
+		{Column: "Region", Values: []string{"__all__"}},
+		{Column: "Sales State", Values: []string{"New York", "Maine", `a"b`, "x#y"}},
+	}}
+	expected := `role ne_manager {
+    Region: __all__;
+    "Sales State": "New York", Maine, "a""b", "x#y";
+}
+`
+	if got := policy.ToDsl(); got != expected {
+		t.Errorf("DSL mismatch: got %s, want %s\n", got, expected)
+	}
+	empty := Policy{Role: "nobody"}
+	if got := empty.ToDsl(); got != "role nobody {}\n" {
+		t.Errorf("DSL mismatch: got %s, want role nobody {}\n", got)
+	}
+}
+
+func TestDecodePolicyDslReportsPositions(t *testing.T) {
+	tests := map[string]string{
+		"role a_b {\n  Region: Eastern\n  State: Ohio }": "line 3, column 3: expected ; or }, found State",
+		"role a_b { Region Eastern }":                    "line 1, column 19: expected :, found Eastern",
+		"role a_b { Region: ; }":                         "line 1, column 20: expected value, found ;",
+		"# nothing\npolicy a_b {}":                       "line 2, column 1: expected role or user, found policy",
+		"role a_b {\n  Region: \"Eastern;\n}":            "line 2, column 11: unterminated \"",
+		"role a_b { Region: Eastern;":                    "line 1, column 28: expected column name or }, found end of input",
+		"role { Region: Eastern }":                       "line 1, column 6: expected role name, found {",
+	}
+	for config, expected := range tests {
+		_, err := decodeDsl(t, config)
+		var syntax_error *SyntaxError
+		if !errors.As(err, &syntax_error) || err.Error() != expected {
+			t.Errorf("Error mismatch for %q: got %v, want %s\n", config, err, expected)
+		}
+	}
+}
+
+func TestDslConfigsLoadLikeJson(t *testing.T) {
+	json_set, err := LoadRolePolicies(filepath.Join("..", "config.json"))
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
+	var b bytes.Buffer
+	b.WriteString("  # the example config\n")
+	for _, policy := range json_set.Policies {
+		b.WriteString(policy.ToDsl())
+	}
+	dsl_file := filepath.Join(t.TempDir(), "config.policy")
+	if err := os.WriteFile(dsl_file, b.Bytes(), 0o644); err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+
+	dsl_set, err := LoadRolePolicies(dsl_file)
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
+	if !reflect.DeepEqual(dsl_set, json_set) {
+		t.Errorf("Policy set mismatch:\ngot  %+v\nwant %+v\n", dsl_set, json_set)
+	}
+	if err := CheckConfigFile(dsl_file); err != nil {
+		t.Errorf("Error checking config: %v\n", err)
+	}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := LoadStoreFromFile(t.Context(), store, dsl_file); err != nil {
+				t.Fatalf("Error loading config: %v\n", err)
+			}
+			exported, err := ExportPolicySet(t.Context(), store, SortLoaded)
+			if err != nil {
+				t.Fatalf("Error exporting policies: %v\n", err)
+			}
+			if len(exported.Policies) != len(json_set.Policies) {
+				t.Errorf("Policies mismatch: got %d, want %d\n", len(exported.Policies), len(json_set.Policies))
+			}
+		})
+	}
+
+	// Problems beyond the syntax are found as they are in JSON
+	if err := CheckConfig(strings.NewReader("role a_b { Region: Eastern }\nrole a_b {}")); err == nil {
+		t.Errorf("Expected error checking config with a repeated role\n")
+	}
+}
@@ -0,0 +1,125 @@
+package rowaccess
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// The order an export puts each policy's columns and values in. Roles are
+// always in order of name.
+type SortOrder string
+
+const (
+	// Columns and values in the order they were loaded, so that the export
+	// reloads to an identical store
+	SortLoaded SortOrder = "loaded"
+	// Columns and values in order of name, with __all__ first, so that
+	// exports of the same policies compare equal however they were loaded
+	SortByName SortOrder = "name"
+)
+
+// Every sort order, in the order they are documented
+var SortOrders = []SortOrder{SortLoaded, SortByName}
+
+// Return the sort order with the name, or an error if there is none
+func ParseSortOrder(name string) (SortOrder, error) {
+	for _, order := range SortOrders {
+		if string(order) == name {
+			return order, nil
+		}
+	}
+	return "", fmt.Errorf("unknown sort order %q, use %s or %s", name, SortLoaded, SortByName)
+}
+
+// Return a copy of the policy with its columns and values in the order
+//
+// The roles it extends keep their order, which decides what it inherits.
+// Deny items and except lists are sorted like columns and values.
+func (order SortOrder) Apply(policy Policy) Policy {
+	sorted := copyPolicy(policy)
+	if sorted.Policy == nil {
+		sorted.Policy = []PolicyItem{}
+	}
+	if order != SortByName {
+		return sorted
+	}
+	for _, items := range [][]PolicyItem{sorted.Policy, sorted.Deny} {
+		slices.SortStableFunc(items, func(a, b PolicyItem) int {
+			return compareNames(a.Column, b.Column)
+		})
+		for _, policy_item := range items {
+			slices.SortStableFunc(policy_item.Values, compareNames)
+			slices.SortStableFunc(policy_item.Except, compareNames)
+		}
+	}
+	return sorted
+}
+
+// Compare names, putting __all__ before every other name
+func compareNames(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == AllValues:
+		return -1
+	case b == AllValues:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 1
+}
+
+// Call fn with the policy of every role in the store, in role order, with
+// columns and values in the sort order
+//
+// The policies make up a config that LoadRolePolicies accepts and that loads
+// back into the same policies.
+func ExportPolicies(ctx context.Context, store PolicyStore, order SortOrder, fn func(Policy) error) error {
+	return store.GetAllPolicies(ctx, func(policy Policy) error {
+		return fn(order.Apply(policy))
+	})
+}
+
+// Return every user in the store, in order of name, or nil if there are
+// none
+//
+// Each user's roles keep the order they were loaded in, or with SortByName
+// are sorted by name.
+func ExportUsers(ctx context.Context, store PolicyStore, order SortOrder) ([]User, error) {
+	names, err := store.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for _, name := range names {
+		user, err := store.GetUser(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if order == SortByName {
+			user.Roles = slices.Clone(user.Roles)
+			slices.Sort(user.Roles)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Return every policy and user in the store as a policy set, as
+// ExportPolicies and ExportUsers give them
+func ExportPolicySet(ctx context.Context, store PolicyStore, order SortOrder) (*PolicySet, error) {
+	policy_set := &PolicySet{Policies: []Policy{}}
+	err := ExportPolicies(ctx, store, order, func(policy Policy) error {
+		policy_set.Policies = append(policy_set.Policies, policy)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if policy_set.Users, err = ExportUsers(ctx, store, order); err != nil {
+		return nil, err
+	}
+	return policy_set, nil
+}
@@ -0,0 +1,132 @@
+package rowaccess
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExportReloadsToIdenticalDb(t *testing.T) {
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	users := []User{
+		{Name: "alice", Roles: []string{"pa_sales_manager", "admin"}},
+		{Name: "bob", Roles: []string{"eastern_region_sales_manager"}},
+	}
+	policy_set.Users = users
+	open := func(fname string) *SQLiteStore {
+		db, err := OpenDb(t.Context(), filepath.Join(t.TempDir(), fname))
+		if err != nil {
+			t.Fatalf("Error opening db: %v\n", err)
+		}
+		return NewSQLiteStore(db)
+	}
+	original := open("original.db")
+	defer original.Close()
+	if _, err := original.LoadPolicies(t.Context(), policy_set); err != nil {
+		t.Fatalf("Error loading policies: %v\n", err)
+	}
+
+	exported, err := ExportPolicySet(t.Context(), original, SortLoaded)
+	if err != nil {
+		t.Fatalf("Error exporting policies: %v\n", err)
+	}
+	if !reflect.DeepEqual(exported.Users, users) {
+		t.Errorf("Users mismatch: got %+v, want %+v\n", exported.Users, users)
+	}
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatalf("Error marshalling export: %v\n", err)
+	}
+	if err := ValidateConfig(data); err != nil {
+		t.Fatalf("Export is not a valid config: %v\n", err)
+	}
+
+	copy_store := open("copy.db")
+	defer copy_store.Close()
+	if _, err := copy_store.LoadPolicies(t.Context(), exported); err != nil {
+		t.Fatalf("Error loading export: %v\n", err)
+	}
+	if got, want := dumpDb(t, copy_store.db), dumpDb(t, original.db); got != want {
+		t.Errorf("Database mismatch after round trip:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	reexported, err := ExportPolicySet(t.Context(), copy_store, SortLoaded)
+	if err != nil {
+		t.Fatalf("Error exporting policies: %v\n", err)
+	}
+	if !reflect.DeepEqual(reexported, exported) {
+		t.Errorf("Export mismatch after round trip")
+	}
+}
+
+func TestSortOrdersWork(t *testing.T) {
+	policy := Policy{Role: "east_mgr", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"Vermont", "Maine", "Ohio"}},
+		{Column: "Region", Values: []string{"__all__"}},
+		{Column: "City", Values: []string{"__all__", "Boston"}},
+	}}
+	tests := map[SortOrder]Policy{
+		SortLoaded: policy,
+		SortByName: {Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "City", Values: []string{"__all__", "Boston"}},
+			{Column: "Region", Values: []string{"__all__"}},
+			{Column: "State", Values: []string{"Maine", "Ohio", "Vermont"}},
+		}},
+	}
+	for order, expected := range tests {
+		t.Run(string(order), func(t *testing.T) {
+			before := policy.ToJson()
+			if got := order.Apply(policy); !reflect.DeepEqual(got, expected) {
+				t.Errorf("Policy mismatch: got %s, want %s\n", got.ToJson(), expected.ToJson())
+			}
+			if policy.ToJson() != before {
+				t.Errorf("Sorting changed the original policy: got %s, want %s\n", policy.ToJson(), before)
+			}
+		})
+	}
+}
+
+func TestSortedExportsMatchHoweverLoaded(t *testing.T) {
+	loads := []PolicySet{
+		{Policies: []Policy{
+			{Role: "west_mgr", Policy: []PolicyItem{{Column: "State", Values: []string{"Utah", "Idaho"}}, {Column: "Region", Values: []string{"Western"}}}},
+			{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		}, Users: []User{{Name: "alice", Roles: []string{"west_mgr", "admin"}}}},
+		{Policies: []Policy{
+			{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+			{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}, {Column: "State", Values: []string{"Idaho", "Utah"}}}},
+		}, Users: []User{{Name: "alice", Roles: []string{"admin", "west_mgr"}}}},
+	}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			var exports []*PolicySet
+			for _, policy_set := range loads {
+				store := open(t)
+				defer store.Close()
+				if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+					t.Fatalf("Error loading policies: %v\n", err)
+				}
+				exported, err := ExportPolicySet(t.Context(), store, SortByName)
+				if err != nil {
+					t.Fatalf("Error exporting policies: %v\n", err)
+				}
+				exports = append(exports, exported)
+			}
+			if !reflect.DeepEqual(exports[0], exports[1]) {
+				t.Errorf("Sorted exports differ:\n%+v\n%+v\n", exports[0], exports[1])
+			}
+		})
+	}
+}
+
+func TestParseSortOrder(t *testing.T) {
+	if order, err := ParseSortOrder("name"); err != nil || order != SortByName {
+		t.Errorf("Sort order mismatch: got %s (%v), want %s\n", order, err, SortByName)
+	}
+	if _, err := ParseSortOrder("size"); err == nil {
+		t.Errorf("Expected error parsing unknown sort order, but got none")
+	}
+}
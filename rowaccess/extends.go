@@ -0,0 +1,173 @@
+package rowaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Returned when roles extend each other in a cycle, so that none of them
+// can be resolved
+var ErrExtendsCycle = errors.New("roles extend each other in a cycle")
+
+// Returned when deleting a role that other roles extend
+var ErrRoleExtended = errors.New("role is extended by other roles")
+
+// Return the policy the role has once its inheritance is resolved
+//
+// The merge rules are:
+//   - The role's own columns come first, and replace the same column in every
+//     role it extends: a child can narrow or widen a column, not add to it.
+//   - Every other column is inherited from the roles it extends, each
+//     resolved first by these same rules. When more than one has the column,
+//     the first listed wins.
+//   - Inherited columns follow the role's own, in the order of the roles
+//     they come from.
+//   - Deny items are never replaced: the role denies what it and every role
+//     it extends deny.
+//
+// The result extends nothing. A role that extends a missing role is an error
+// that wraps ErrRoleNotFound, and roles that extend each other in a cycle
+// return ErrExtendsCycle.
+func EffectivePolicy(ctx context.Context, store PolicyStore, role string) (Policy, error) {
+	r := resolver{ctx: ctx, store: store, resolved: map[string]Policy{}}
+	return r.resolve(role, nil)
+}
+
+// Resolves roles in a store, remembering each one so that a role extended
+// by several others is read once
+type resolver struct {
+	ctx      context.Context
+	store    PolicyStore
+	resolved map[string]Policy
+}
+
+// Return the effective policy of the role, where path is the chain of roles
+// that led to it
+func (r *resolver) resolve(role string, path []string) (Policy, error) {
+	if policy, ok := r.resolved[role]; ok {
+		return policy, nil
+	}
+	if i := slices.Index(path, role); i >= 0 {
+		return Policy{}, extendsCycle(append(path[i:], role))
+	}
+	policy, err := r.store.GetPolicy(r.ctx, role)
+	if err != nil {
+		if len(path) > 0 {
+			return Policy{}, fmt.Errorf("role %s extends %s: %w", path[len(path)-1], role, err)
+		}
+		return Policy{}, err
+	}
+
+	effective := Policy{Role: role, Policy: policy.Policy}
+	denied := policy.Deny
+	columns := map[string]bool{}
+	for _, policy_item := range policy.Policy {
+		columns[policy_item.Column] = true
+	}
+	for _, parent := range policy.Extends {
+		parent_policy, err := r.resolve(parent, append(path, role))
+		if err != nil {
+			return Policy{}, err
+		}
+		for _, policy_item := range parent_policy.Policy {
+			if !columns[policy_item.Column] {
+				columns[policy_item.Column] = true
+				effective.Policy = append(effective.Policy, copyItems([]PolicyItem{policy_item})...)
+			}
+		}
+		denied = append(slices.Clip(denied), parent_policy.Deny...)
+	}
+	if len(denied) > 0 {
+		effective.Deny = normalizeItems(denied)
+	}
+	r.resolved[role] = effective
+	return effective, nil
+}
+
+func extendsCycle(cycle []string) error {
+	return fmt.Errorf("%w: %s", ErrExtendsCycle, strings.Join(cycle, " -> "))
+}
+
+// Return ErrRoleExtended if a role in extends that is not deleted extends
+// one that is
+//
+// The deleted roles are checked in order, and the first one that is still
+// extended is reported with every role that extends it.
+func checkNotExtended(extends map[string][]string, deleted []string) error {
+	for _, role := range deleted {
+		var children []string
+		for child, parents := range extends {
+			if slices.Contains(parents, role) && !slices.Contains(deleted, child) {
+				children = append(children, child)
+			}
+		}
+		if len(children) > 0 {
+			slices.Sort(children)
+			return fmt.Errorf("%w: %s is extended by %s", ErrRoleExtended, role, strings.Join(children, ", "))
+		}
+	}
+	return nil
+}
+
+// Return a cycle in the roles each role extends, starting and ending with
+// the same role, or nil if there is none
+//
+// Roles are searched in order of name, so the same cycle is always reported
+// the same way. Parents that are not in the map extend nothing.
+func findExtendsCycle(extends map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(role string) []string
+	visit = func(role string) []string {
+		switch state[role] {
+		case visiting:
+			return append(slices.Clone(path[slices.Index(path, role):]), role)
+		case done:
+			return nil
+		}
+		state[role] = visiting
+		path = append(path, role)
+		for _, parent := range extends[role] {
+			if cycle := visit(parent); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[role] = done
+		return nil
+	}
+
+	roles := make([]string, 0, len(extends))
+	for role := range extends {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	for _, role := range roles {
+		if cycle := visit(role); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Return ErrExtendsCycle if the roles in the database extend each other in
+// a cycle
+func checkExtendsTx(ctx context.Context, tx *sql.Tx) error {
+	extends, err := getExtends(ctx, tx, "")
+	if err != nil {
+		return err
+	}
+	if cycle := findExtendsCycle(extends); cycle != nil {
+		return extendsCycle(cycle)
+	}
+	return nil
+}
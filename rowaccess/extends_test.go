@@ -0,0 +1,267 @@
+package rowaccess
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Managers that build on one another, and a role that extends a role that
+// was never loaded
+func getExtendsPolicySet() PolicySet {
+	return PolicySet{Policies: []Policy{
+		{Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"__all__"}},
+		}},
+		{Role: "store_reader", Policy: []PolicyItem{
+			{Column: "Store", Values: []string{"__all__"}},
+			{Column: "State", Values: []string{"Ohio"}},
+		}},
+		{Role: "ne_mgr", Extends: []string{"east_mgr", "store_reader"}, Policy: []PolicyItem{
+			{Column: "State", Values: []string{"Maine", "Vermont"}},
+		}},
+		{Role: "maine_mgr", Extends: []string{"ne_mgr"}, Policy: []PolicyItem{
+			{Column: "State", Values: []string{"Maine"}},
+		}},
+		{Role: "orphan", Extends: []string{"retired_mgr"}, Policy: []PolicyItem{}},
+	}}
+}
+
+func TestEffectivePolicy(t *testing.T) {
+	expected := map[string]Policy{
+		"east_mgr": {Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"__all__"}},
+		}},
+		// State is its own, Region comes from east_mgr and Store from
+		// store_reader, whose State is hidden by east_mgr's
+		"ne_mgr": {Role: "ne_mgr", Policy: []PolicyItem{
+			{Column: "State", Values: []string{"Maine", "Vermont"}},
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "Store", Values: []string{"__all__"}},
+		}},
+		"maine_mgr": {Role: "maine_mgr", Policy: []PolicyItem{
+			{Column: "State", Values: []string{"Maine"}},
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "Store", Values: []string{"__all__"}},
+		}},
+	}
+	policy_set := getExtendsPolicySet()
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			for role, want := range expected {
+				got, err := EffectivePolicy(t.Context(), store, role)
+				if err != nil {
+					t.Fatalf("Error resolving %s: %v\n", role, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Effective policy mismatch for %s:\ngot  %+v\nwant %+v\n", role, got, want)
+				}
+			}
+			// The role's own policy still lists what it extends
+			if got, _ := store.GetPolicy(t.Context(), "ne_mgr"); !reflect.DeepEqual(got.Extends, []string{"east_mgr", "store_reader"}) {
+				t.Errorf("Extends mismatch: got %v\n", got.Extends)
+			}
+			if _, err := EffectivePolicy(t.Context(), store, "orphan"); !errors.Is(err, ErrRoleNotFound) {
+				t.Errorf("Expected ErrRoleNotFound for a missing parent, got %v\n", err)
+			}
+		})
+	}
+}
+
+func TestStoresRejectExtendsCycles(t *testing.T) {
+	policy_set := getExtendsPolicySet()
+	cycle := PolicySet{Policies: []Policy{
+		{Role: "east_mgr", Extends: []string{"maine_mgr"}, Policy: []PolicyItem{}},
+	}}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			before := getAllPolicies(t, store)
+
+			// The cycle runs through roles loaded earlier, so only the store
+			// can find it
+			_, err := store.LoadPolicies(t.Context(), &cycle)
+			if !errors.Is(err, ErrExtendsCycle) {
+				t.Fatalf("Expected ErrExtendsCycle, got %v\n", err)
+			}
+			if want := "roles extend each other in a cycle: east_mgr -> maine_mgr -> ne_mgr -> east_mgr"; err.Error() != want {
+				t.Errorf("Error mismatch: got %s, want %s\n", err, want)
+			}
+			// A cycle within one set is a problem with the set
+			var config_errors ConfigErrors
+			if _, err := store.SyncPolicies(t.Context(), &PolicySet{Policies: append(cycle.Policies, policy_set.Policies[1:]...)}); !errors.As(err, &config_errors) {
+				t.Errorf("Expected ConfigErrors from sync, got %v\n", err)
+			}
+			if after := getAllPolicies(t, store); !reflect.DeepEqual(after, before) {
+				t.Errorf("Failed load changed the store:\ngot  %+v\nwant %+v\n", after, before)
+			}
+
+			// Without ne_mgr there is no cycle once the roles missing from
+			// the set are deleted
+			if _, err := store.SyncPolicies(t.Context(), &PolicySet{Policies: append(cycle.Policies, policy_set.Policies[3])}); err != nil {
+				t.Errorf("Error syncing policies: %v\n", err)
+			}
+		})
+	}
+}
+
+func TestStoresKeepExtendsOnRenameAndClone(t *testing.T) {
+	policy_set := getExtendsPolicySet()
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			if err := store.RenameRole(t.Context(), "east_mgr", "eastern_mgr"); err != nil {
+				t.Fatalf("Error renaming role: %v\n", err)
+			}
+			if err := store.CloneRole(t.Context(), "ne_mgr", "vt_mgr"); err != nil {
+				t.Fatalf("Error cloning role: %v\n", err)
+			}
+			for _, role := range []string{"ne_mgr", "vt_mgr"} {
+				policy, err := store.GetPolicy(t.Context(), role)
+				if err != nil {
+					t.Fatalf("Error getting policy: %v\n", err)
+				}
+				if want := []string{"eastern_mgr", "store_reader"}; !reflect.DeepEqual(policy.Extends, want) {
+					t.Errorf("Extends mismatch for %s: got %v, want %v\n", role, policy.Extends, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoresRefuseDanglingExtendsAndCycles(t *testing.T) {
+	// p extends q, which was never loaded, so renaming r, which extends p,
+	// to q would close the cycle role_p -> role_q -> role_p
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "role_p", Extends: []string{"role_q"}, Policy: []PolicyItem{}},
+		{Role: "role_r", Extends: []string{"role_p"}, Policy: []PolicyItem{}},
+		{Role: "role_s", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+	}}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			before := getAllPolicies(t, store)
+
+			failures := map[string]struct {
+				fn  func() error
+				err error
+				msg string
+			}{
+				"Delete extended role": {func() error {
+					return store.DeleteRole(t.Context(), "role_p")
+				}, ErrRoleExtended, "role is extended by other roles: role_p is extended by role_r"},
+				"Drop extended role": {func() error {
+					_, err := store.ApplyChanges(t.Context(), []PolicyChange{{Op: OpDrop, Role: "role_p"}})
+					return err
+				}, ErrRoleExtended, "role is extended by other roles: role_p is extended by role_r"},
+				"Plan dropping extended role": {func() error {
+					_, err := PlanChanges(t.Context(), store, []PolicyChange{{Op: OpDrop, Role: "role_p"}})
+					return err
+				}, ErrRoleExtended, "role is extended by other roles: role_p is extended by role_r"},
+				"Rename into cycle": {func() error {
+					return store.RenameRole(t.Context(), "role_r", "role_q")
+				}, ErrExtendsCycle, "roles extend each other in a cycle: role_p -> role_q -> role_p"},
+				"Clone into cycle": {func() error {
+					return store.CloneRole(t.Context(), "role_r", "role_q")
+				}, ErrExtendsCycle, "roles extend each other in a cycle: role_p -> role_q -> role_p"},
+			}
+			for name, test := range failures {
+				err := test.fn()
+				if !errors.Is(err, test.err) {
+					t.Errorf("%s: expected %v, got %v\n", name, test.err, err)
+				} else if err.Error() != test.msg {
+					t.Errorf("%s: error mismatch: got %s, want %s\n", name, err, test.msg)
+				}
+			}
+			if after := getAllPolicies(t, store); !reflect.DeepEqual(after, before) {
+				t.Errorf("Refused changes changed the store:\ngot  %+v\nwant %+v\n", after, before)
+			}
+
+			// Roles that are deleted together may extend each other, and the
+			// store still loads afterwards
+			if _, err := store.ApplyChanges(t.Context(), []PolicyChange{{Op: OpDrop, Role: "role_r"}, {Op: OpDrop, Role: "role_p"}}); err != nil {
+				t.Errorf("Error dropping roles: %v\n", err)
+			}
+			if _, err := store.LoadPolicies(t.Context(), &PolicySet{Policies: []Policy{{Role: "role_t", Policy: []PolicyItem{}}}}); err != nil {
+				t.Errorf("Error loading policies: %v\n", err)
+			}
+		})
+	}
+}
+
+func TestExportKeepsExtends(t *testing.T) {
+	policy_set := getExtendsPolicySet()
+	store := NewMemStore()
+	if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+		t.Fatalf("Error loading policies: %v\n", err)
+	}
+	for _, order := range SortOrders {
+		exported, err := ExportPolicySet(t.Context(), store, order)
+		if err != nil {
+			t.Fatalf("Error exporting policies: %v\n", err)
+		}
+		for _, policy := range exported.Policies {
+			if policy.Role == "ne_mgr" && !reflect.DeepEqual(policy.Extends, []string{"east_mgr", "store_reader"}) {
+				t.Errorf("Extends mismatch sorted %s: got %v\n", order, policy.Extends)
+			}
+		}
+	}
+}
+
+func TestFindExtendsCycle(t *testing.T) {
+	tests := map[string]struct {
+		extends map[string][]string
+		cycle   []string
+	}{
+		"No roles":      {map[string][]string{}, nil},
+		"Chain":         {map[string][]string{"a": {"b"}, "b": {"c"}}, nil},
+		"Diamond":       {map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}}, nil},
+		"Self":          {map[string][]string{"a": {"a"}}, []string{"a", "a"}},
+		"Cycle":         {map[string][]string{"c": {"a"}, "a": {"b"}, "b": {"c"}}, []string{"a", "b", "c", "a"}},
+		"Cycle in tail": {map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}}, []string{"b", "c", "b"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if cycle := findExtendsCycle(test.extends); !reflect.DeepEqual(cycle, test.cycle) {
+				t.Errorf("Cycle mismatch: got %v, want %v\n", cycle, test.cycle)
+			}
+		})
+	}
+}
+
+// Return every policy in the store, in role order
+func getAllPolicies(t *testing.T, store PolicyStore) []Policy {
+	t.Helper()
+	var policies []Policy
+	err := store.GetAllPolicies(t.Context(), func(policy Policy) error {
+		policies = append(policies, policy)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error getting all policies: %v\n", err)
+	}
+	return policies
+}
@@ -0,0 +1,316 @@
+package rowaccess
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// Whether a change grants values, revokes them, or creates or drops a role
+type GrantOp string
+
+const (
+	OpGrant  GrantOp = "grant"
+	OpRevoke GrantOp = "revoke"
+	OpCreate GrantOp = "create"
+	OpDrop   GrantOp = "drop"
+)
+
+// A targeted change to one column of a role's policy, or to a whole role
+//
+// Granting values adds them to the column, creating the role and the column
+// if needed; granting __all__ replaces the column's values with __all__, and
+// granting values to a column granted __all__ takes them out of its except
+// list.
+// Revoking values removes them, and revoking __all__ removes the whole
+// column. A column left with no values is removed, but the role is kept.
+// Revoking values from a column granted __all__ adds them to its except
+// list.
+//
+// Values are matched as Match says, exactly if it is empty. A column is
+// matched one way, so values can only be granted to or revoked from a
+// column with the same match, except that revoking __all__ removes any
+// column.
+//
+// Creating a role gives it an empty policy, and dropping one deletes it
+// with its policy; neither takes a column or values.
+type PolicyChange struct {
+	Op     GrantOp   `json:"op"`
+	Role   string    `json:"role"`
+	Column string    `json:"column,omitempty"`
+	Match  MatchKind `json:"match,omitempty"`
+	Values []string  `json:"values,omitempty"`
+}
+
+// Return true if the change is to a column rather than a whole role
+func (c PolicyChange) onColumn() bool {
+	return c.Op == OpGrant || c.Op == OpRevoke
+}
+
+// Return the change's match as a policy item stores it, empty if exact
+func (c PolicyChange) match() MatchKind {
+	if c.Match == MatchExact {
+		return ""
+	}
+	return c.Match
+}
+
+// Return ConfigErrors listing every problem with the changes, with JSON
+// pointers into the patch they were read from
+func CheckChanges(changes []PolicyChange) error {
+	var config_errors ConfigErrors
+	add := func(pointer, format string, args ...any) {
+		config_errors = append(config_errors, &ConfigError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, change := range changes {
+		pointer := fmt.Sprintf("/%d", i)
+		if !change.onColumn() && change.Op != OpCreate && change.Op != OpDrop {
+			add(pointer+"/op", "unknown op %q, use grant, revoke, create or drop", change.Op)
+		}
+		if !IsValidRoleName(change.Role) {
+			add(pointer+"/role", "invalid role name %q", change.Role)
+		}
+		if change.Op == OpCreate || change.Op == OpDrop {
+			if change.Column != "" {
+				add(pointer+"/column", "%s takes no column", change.Op)
+			}
+			if len(change.Values) > 0 {
+				add(pointer+"/values", "%s takes no values", change.Op)
+			}
+			if change.Match != "" {
+				add(pointer+"/match", "%s takes no match", change.Op)
+			}
+			continue
+		}
+		if change.Column == "" {
+			add(pointer+"/column", "empty column name")
+		}
+		if len(change.Values) == 0 {
+			add(pointer+"/values", "no values")
+		} else if slices.Contains(change.Values, AllValues) && slices.ContainsFunc(change.Values, isNotAllValues) {
+			add(pointer+"/values", "__all__ cannot be mixed with other values")
+		}
+		if change.Match == "" {
+			continue
+		}
+		if _, err := ParseMatchKind(string(change.Match)); err != nil {
+			add(pointer+"/match", "%v", err)
+			continue
+		}
+		for k, value := range change.Values {
+			if change.match() != "" && value == AllValues {
+				add(fmt.Sprintf("%s/values/%d", pointer, k), "%s is not a pattern; grant it without a match", AllValues)
+			} else if err := checkPattern(change.Match, value); err != nil {
+				add(fmt.Sprintf("%s/values/%d", pointer, k), "%v", err)
+			}
+		}
+	}
+	if len(config_errors) > 0 {
+		return config_errors
+	}
+	return nil
+}
+
+// Read a patch, a JSON array of changes applied in order, e.g.
+//
+//	[{"op": "grant", "role": "pa_sales_manager", "column": "State", "values": ["Ohio"]}]
+//
+// The changes are checked with CheckChanges.
+func ReadPatch(r io.Reader) ([]PolicyChange, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var changes []PolicyChange
+	if err := decoder.Decode(&changes); err != nil {
+		return nil, fmt.Errorf("decoding patch: %w", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("decoding patch: unexpected data after the array of changes")
+	}
+	if err := CheckChanges(changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Read a patch from a file with ReadPatch
+func ReadPatchFile(fname string) ([]PolicyChange, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPatch(f)
+}
+
+// Return what applying the changes to the store would do, without changing
+// anything
+func PlanChanges(ctx context.Context, store PolicyStore, changes []PolicyChange) (*Diff, error) {
+	before, after, err := planChanges(changes, func(role string) (Policy, error) {
+		return store.GetPolicy(ctx, role)
+	})
+	if err != nil {
+		return nil, err
+	}
+	diff := DiffPolicies(before, after)
+	removed := removedRoles(diff)
+	if len(removed) == 0 {
+		return diff, nil
+	}
+	extends := map[string][]string{}
+	err = store.GetAllPolicies(ctx, func(policy Policy) error {
+		extends[policy.Role] = policy.Extends
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range after {
+		extends[policy.Role] = policy.Extends
+	}
+	if err := checkNotExtended(extends, removed); err != nil {
+		return nil, err
+	}
+	users, err := ExportUsers(ctx, store, SortLoaded)
+	if err != nil {
+		return nil, err
+	}
+	members := map[string][]string{}
+	for _, user := range users {
+		members[user.Name] = user.Roles
+	}
+	diff.Users = removedMemberships(diff, members)
+	return diff, nil
+}
+
+// Apply the changes in order to the policies read with get, returning the
+// policy of every role they touch before and after
+//
+// A role that does not exist yet has no policy before, and a dropped role
+// none after. The policies after are checked with CheckPolicySet, as a load
+// would check them.
+func planChanges(changes []PolicyChange, get func(role string) (Policy, error)) ([]Policy, []Policy, error) {
+	if err := CheckChanges(changes); err != nil {
+		return nil, nil, err
+	}
+	var before []Policy
+	// A nil policy is a role that does not exist
+	after := map[string]*Policy{}
+	var roles []string
+	for _, change := range changes {
+		current, ok := after[change.Role]
+		if !ok {
+			policy, err := get(change.Role)
+			switch {
+			case err == nil:
+				before = append(before, policy)
+				current = &policy
+			case !errors.Is(err, ErrRoleNotFound):
+				return nil, nil, err
+			}
+			roles = append(roles, change.Role)
+		}
+
+		switch {
+		case change.Op == OpCreate && current != nil:
+			return nil, nil, roleExists(change.Role)
+		case change.Op == OpCreate:
+			current = &Policy{Role: change.Role, Policy: []PolicyItem{}}
+		case current == nil && change.Op != OpGrant:
+			return nil, nil, roleNotFound(change.Role)
+		case change.Op == OpDrop:
+			current = nil
+		default:
+			if current == nil {
+				current = &Policy{Role: change.Role, Policy: []PolicyItem{}}
+			}
+			policy, err := applyChange(*current, change)
+			if err != nil {
+				return nil, nil, err
+			}
+			current = &policy
+		}
+		after[change.Role] = current
+	}
+	policy_set := &PolicySet{Policies: []Policy{}}
+	for _, role := range roles {
+		if after[role] != nil {
+			policy_set.Policies = append(policy_set.Policies, *after[role])
+		}
+	}
+	if err := CheckPolicySet(policy_set); err != nil {
+		return nil, nil, err
+	}
+	return before, policy_set.Policies, nil
+}
+
+// Return a copy of the policy with the change applied
+func applyChange(policy Policy, change PolicyChange) (Policy, error) {
+	policy = copyPolicy(policy)
+	i := slices.IndexFunc(policy.Policy, func(policy_item PolicyItem) bool {
+		return policy_item.Column == change.Column
+	})
+	grants_all := slices.Contains(change.Values, AllValues)
+	if i >= 0 && !grants_all && policy.Policy[i].Match != change.match() {
+		change_item := PolicyItem{Match: change.match()}
+		return Policy{}, fmt.Errorf("role %s has %s values on %s, not %s; revoke __all__ and grant the values instead",
+			change.Role, policy.Policy[i].matchKind(), change.Column, change_item.matchKind())
+	}
+
+	if change.Op == OpGrant {
+		switch {
+		case i < 0:
+			policy.Policy = append(policy.Policy, PolicyItem{Column: change.Column, Match: change.match(), Values: dedupe(change.Values)})
+		case grants_all:
+			policy.Policy[i].Values = []string{AllValues}
+			policy.Policy[i].Match = ""
+			policy.Policy[i].Except = nil
+		case slices.Contains(policy.Policy[i].Values, AllValues):
+			policy.Policy[i].Except = slices.DeleteFunc(policy.Policy[i].Except, func(value string) bool {
+				return slices.Contains(change.Values, value)
+			})
+		default:
+			policy.Policy[i].Values = dedupe(append(policy.Policy[i].Values, change.Values...))
+		}
+		return policy, nil
+	}
+
+	if i < 0 {
+		return policy, nil
+	}
+	values := policy.Policy[i].Values
+	if !grants_all && slices.Contains(values, AllValues) {
+		policy.Policy[i].Except = dedupe(append(policy.Policy[i].Except, change.Values...))
+		return policy, nil
+	}
+	values = slices.DeleteFunc(values, func(value string) bool {
+		return grants_all || slices.Contains(change.Values, value)
+	})
+	if len(values) == 0 {
+		policy.Policy = slices.Delete(policy.Policy, i, i+1)
+	} else {
+		policy.Policy[i].Values = values
+	}
+	return policy, nil
+}
+
+// Return the values with repeats dropped, keeping the first of each
+func dedupe(values []string) []string {
+	seen := map[string]bool{}
+	deduped := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			deduped = append(deduped, value)
+		}
+	}
+	return deduped
+}
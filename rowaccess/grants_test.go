@@ -0,0 +1,397 @@
+package rowaccess
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyChange(t *testing.T) {
+	policy := Policy{Role: "east_mgr", Policy: []PolicyItem{
+		{Column: "Region", Values: []string{"__all__"}},
+		{Column: "State", Values: []string{"Maine", "Ohio"}},
+	}}
+	tests := map[string]struct {
+		change   PolicyChange
+		expected []PolicyItem
+		err      string
+	}{
+		"Grant new values": {
+			change: PolicyChange{Op: OpGrant, Column: "State", Values: []string{"Ohio", "Delaware", "Delaware"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}},
+				{Column: "State", Values: []string{"Maine", "Ohio", "Delaware"}},
+			},
+		},
+		"Grant new column": {
+			change: PolicyChange{Op: OpGrant, Column: "City", Values: []string{"Boston"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}},
+				{Column: "State", Values: []string{"Maine", "Ohio"}},
+				{Column: "City", Values: []string{"Boston"}},
+			},
+		},
+		"Grant new column of prefixes": {
+			change: PolicyChange{Op: OpGrant, Column: "City", Match: MatchPrefix, Values: []string{"Bos"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}},
+				{Column: "State", Values: []string{"Maine", "Ohio"}},
+				{Column: "City", Match: MatchPrefix, Values: []string{"Bos"}},
+			},
+		},
+		"Grant prefixes to column of exact values": {
+			change: PolicyChange{Op: OpGrant, Column: "State", Match: MatchPrefix, Values: []string{"M"}},
+			err:    "role east_mgr has exact values on State, not prefix",
+		},
+		"Grant exact values by name": {
+			change: PolicyChange{Op: OpGrant, Column: "State", Match: MatchExact, Values: []string{"Delaware"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}},
+				{Column: "State", Values: []string{"Maine", "Ohio", "Delaware"}},
+			},
+		},
+		"Grant all values": {
+			change: PolicyChange{Op: OpGrant, Column: "State", Values: []string{"__all__"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}},
+				{Column: "State", Values: []string{"__all__"}},
+			},
+		},
+		"Grant values of column granted all values": {
+			change:   PolicyChange{Op: OpGrant, Column: "Region", Values: []string{"Eastern"}},
+			expected: policy.Policy,
+		},
+		"Revoke values": {
+			change: PolicyChange{Op: OpRevoke, Column: "State", Values: []string{"Ohio", "Delaware"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}},
+				{Column: "State", Values: []string{"Maine"}},
+			},
+		},
+		"Revoke last values": {
+			change:   PolicyChange{Op: OpRevoke, Column: "State", Values: []string{"Ohio", "Maine"}},
+			expected: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}},
+		},
+		"Revoke all values": {
+			change:   PolicyChange{Op: OpRevoke, Column: "Region", Values: []string{"__all__"}},
+			expected: []PolicyItem{{Column: "State", Values: []string{"Maine", "Ohio"}}},
+		},
+		"Revoke missing column": {
+			change:   PolicyChange{Op: OpRevoke, Column: "City", Values: []string{"Boston"}},
+			expected: policy.Policy,
+		},
+		"Revoke values of column granted all values": {
+			change: PolicyChange{Op: OpRevoke, Column: "Region", Values: []string{"Eastern", "Western", "Eastern"}},
+			expected: []PolicyItem{
+				{Column: "Region", Values: []string{"__all__"}, Except: []string{"Eastern", "Western"}},
+				{Column: "State", Values: []string{"Maine", "Ohio"}},
+			},
+		},
+		"Revoke prefixes from column granted all values": {
+			change: PolicyChange{Op: OpRevoke, Column: "Region", Match: MatchPrefix, Values: []string{"East"}},
+			err:    "role east_mgr has exact values on Region, not prefix",
+		},
+	}
+	for name, test := range tests {
+		test.change.Role = policy.Role
+		got, err := applyChange(policy, test.change)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error mismatch: got %v, want %s\n", name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v\n", name, err)
+			continue
+		}
+		want := Policy{Role: policy.Role, Policy: test.expected}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: policy mismatch: got %s, want %s\n", name, got.ToJson(), want.ToJson())
+		}
+	}
+	if policy.Policy[1].Values[1] != "Ohio" || len(policy.Policy) != 2 {
+		t.Errorf("Applying changes modified the original policy: %s\n", policy.ToJson())
+	}
+}
+
+func TestReadPatchFindsProblems(t *testing.T) {
+	tests := map[string]struct {
+		patch    string
+		pointers []string
+	}{
+		"Valid patch": {
+			patch: `[{"op": "grant", "role": "east_mgr", "column": "State", "values": ["Ohio"]},
+				{"op": "revoke", "role": "east_mgr", "column": "Region", "values": ["__all__"]}]`,
+		},
+		"Every problem": {
+			patch: `[{"op": "add", "role": "east mgr", "column": "", "values": []},
+				{"op": "grant", "role": "east_mgr", "column": "State", "values": ["Ohio", "__all__"]}]`,
+			pointers: []string{"/0/op", "/0/role", "/0/column", "/0/values", "/1/values"},
+		},
+		"Bad matches": {
+			patch: `[{"op": "grant", "role": "east_mgr", "column": "State", "match": "suffix", "values": ["io"]},
+				{"op": "grant", "role": "east_mgr", "column": "Sku", "match": "glob", "values": ["SKU-*", "*", "__all__"]},
+				{"op": "create", "role": "west_mgr", "match": "prefix"}]`,
+			pointers: []string{"/0/match", "/1/values", "/1/values/1", "/1/values/2", "/2/match"},
+		},
+	}
+	for name, test := range tests {
+		_, err := ReadPatch(strings.NewReader(test.patch))
+		var config_errors ConfigErrors
+		if test.pointers == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v\n", name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &config_errors) {
+			t.Errorf("%s: expected ConfigErrors, got %v\n", name, err)
+			continue
+		}
+		var pointers []string
+		for _, config_error := range config_errors {
+			pointers = append(pointers, config_error.Pointer)
+		}
+		if !reflect.DeepEqual(pointers, test.pointers) {
+			t.Errorf("%s: pointers mismatch: got %v, want %v\n", name, pointers, test.pointers)
+		}
+	}
+
+	for _, patch := range []string{`{"op": "grant"}`, `[{"op": "grant", "roles": []}]`, `[] []`} {
+		if _, err := ReadPatch(strings.NewReader(patch)); err == nil {
+			t.Errorf("Expected an error reading patch %s\n", patch)
+		}
+	}
+}
+
+func TestStoresApplyChanges(t *testing.T) {
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "pa_sales_manager", Policy: []PolicyItem{{Column: "State", Values: []string{"Pennsylvania"}}}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+	}}
+	changes := []PolicyChange{
+		{Op: OpGrant, Role: "pa_sales_manager", Column: "State", Values: []string{"Ohio", "Delaware"}},
+		{Op: OpRevoke, Role: "pa_sales_manager", Column: "State", Values: []string{"Pennsylvania"}},
+		{Op: OpGrant, Role: "auditor", Column: "Region", Values: []string{"__all__"}},
+		{Op: OpRevoke, Role: "admin", Column: "Region", Values: []string{"__all__"}},
+	}
+	expected_diff := &Diff{Roles: []RoleDiff{
+		{Role: "admin", Change: Changed, Columns: []ColumnDiff{
+			{Column: "Region", Change: Removed, Added: []string{}, Removed: []string{"__all__"}},
+		}},
+		{Role: "auditor", Change: Added, Columns: []ColumnDiff{
+			{Column: "Region", Change: Added, Added: []string{"__all__"}, Removed: []string{}},
+		}},
+		{Role: "pa_sales_manager", Change: Changed, Columns: []ColumnDiff{
+			{Column: "State", Change: Changed, Added: []string{"Ohio", "Delaware"}, Removed: []string{"Pennsylvania"}},
+		}},
+	}}
+	expected := map[string]Policy{
+		"pa_sales_manager": {Role: "pa_sales_manager", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio", "Delaware"}}}},
+		"admin":            {Role: "admin", Policy: []PolicyItem{}},
+		"auditor":          {Role: "auditor", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+	}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+
+			planned, err := PlanChanges(t.Context(), store, changes)
+			if err != nil {
+				t.Fatalf("Error planning changes: %v\n", err)
+			}
+			diff, err := store.ApplyChanges(t.Context(), changes)
+			if err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			if !reflect.DeepEqual(diff, expected_diff) {
+				t.Errorf("Diff mismatch:\ngot  %+v\nwant %+v\n", diff, expected_diff)
+			}
+			if !reflect.DeepEqual(planned, diff) {
+				t.Errorf("Planned diff mismatch:\ngot  %+v\nwant %+v\n", planned, diff)
+			}
+			for role, want := range expected {
+				got, err := store.GetPolicy(t.Context(), role)
+				if err != nil {
+					t.Fatalf("Error getting policy: %v\n", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Policy mismatch: got %s, want %s\n", got.ToJson(), want.ToJson())
+				}
+			}
+
+			// Values added later come after those already granted
+			grant := []PolicyChange{{Op: OpGrant, Role: "pa_sales_manager", Column: "State", Values: []string{"Pennsylvania"}}}
+			if _, err := store.ApplyChanges(t.Context(), grant); err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			got, err := store.GetPolicy(t.Context(), "pa_sales_manager")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			if want := []string{"Ohio", "Delaware", "Pennsylvania"}; !reflect.DeepEqual(got.Policy[0].Values, want) {
+				t.Errorf("Values mismatch: got %v, want %v\n", got.Policy[0].Values, want)
+			}
+			diff, err = store.ApplyChanges(t.Context(), grant)
+			if err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			if !diff.Empty() {
+				t.Errorf("Expected granting values twice to change nothing, got %+v\n", diff)
+			}
+
+			// A failing change leaves every role as it was
+			failures := map[string]struct {
+				changes []PolicyChange
+				err     error
+			}{
+				"Revoke from missing role": {[]PolicyChange{
+					{Op: OpGrant, Role: "admin", Column: "Region", Values: []string{"Eastern"}},
+					{Op: OpRevoke, Role: "west_mgr", Column: "Region", Values: []string{"Western"}},
+				}, ErrRoleNotFound},
+				"Revoke prefix from column granted all values": {[]PolicyChange{
+					{Op: OpGrant, Role: "admin", Column: "Region", Values: []string{"Eastern"}},
+					{Op: OpRevoke, Role: "auditor", Column: "Region", Match: MatchPrefix, Values: []string{"West"}},
+				}, nil},
+				"Invalid change": {[]PolicyChange{
+					{Op: OpGrant, Role: "admin", Column: "Region", Values: []string{"Eastern"}},
+					{Op: OpGrant, Role: "admin", Column: "", Values: []string{"Eastern"}},
+				}, nil},
+			}
+			for name, test := range failures {
+				_, err := store.ApplyChanges(t.Context(), test.changes)
+				if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+					t.Errorf("%s: expected error %v, got %v\n", name, test.err, err)
+				}
+			}
+			got, err = store.GetPolicy(t.Context(), "admin")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			if len(got.Policy) != 0 {
+				t.Errorf("Failed changes modified policy: %s\n", got.ToJson())
+			}
+		})
+	}
+}
+
+func TestChangeLogRecordsChanges(t *testing.T) {
+	db, err := OpenDb(t.Context(), filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatalf("Error opening db: %v\n", err)
+	}
+	store := NewSQLiteStore(db)
+	defer store.Close()
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "pa_sales_manager", Policy: []PolicyItem{{Column: "State", Values: []string{"Pennsylvania"}}}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}, Except: []string{"Northern"}}}},
+	}}
+	if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+		t.Fatalf("Error loading policies: %v\n", err)
+	}
+	_, err = store.ApplyChanges(t.Context(), []PolicyChange{
+		{Op: OpGrant, Role: "pa_sales_manager", Column: "State", Values: []string{"Ohio", "Pennsylvania"}},
+		{Op: OpRevoke, Role: "pa_sales_manager", Column: "State", Values: []string{"Pennsylvania"}},
+		{Op: OpCreate, Role: "auditor"},
+		{Op: OpRevoke, Role: "admin", Column: "Region", Values: []string{"Western"}},
+		{Op: OpGrant, Role: "admin", Column: "Region", Values: []string{"Northern"}},
+	})
+	if err != nil {
+		t.Fatalf("Error applying changes: %v\n", err)
+	}
+
+	rows, err := db.QueryContext(t.Context(), "select role, coalesce(control_column, ''), op, coalesce(value, '') from change_log order by id")
+	if err != nil {
+		t.Fatalf("Error reading change log: %v\n", err)
+	}
+	defer rows.Close()
+	var logged []string
+	for rows.Next() {
+		var role, column, op, value string
+		if err := rows.Scan(&role, &column, &op, &value); err != nil {
+			t.Fatalf("Error reading change log: %v\n", err)
+		}
+		logged = append(logged, strings.TrimSpace(strings.Join([]string{role, column, op, value}, " ")))
+	}
+	// Only the net change is logged, and values excepted from __all__ are
+	// logged as revoked
+	expected := []string{
+		"admin Region revoke Western",
+		"admin Region grant Northern",
+		"auditor  create",
+		"pa_sales_manager State revoke Pennsylvania",
+		"pa_sales_manager State grant Ohio",
+	}
+	if !reflect.DeepEqual(logged, expected) {
+		t.Errorf("Change log mismatch: got %v, want %v\n", logged, expected)
+	}
+}
+
+func TestStoresCreateAndDropRoles(t *testing.T) {
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+	}}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			diff, err := store.ApplyChanges(t.Context(), []PolicyChange{
+				{Op: OpCreate, Role: "auditor"},
+				{Op: OpDrop, Role: "admin"},
+				{Op: OpGrant, Role: "admin", Column: "State", Values: []string{"Ohio"}},
+				{Op: OpCreate, Role: "temp"},
+				{Op: OpDrop, Role: "temp"},
+			})
+			if err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			expected_diff := &Diff{Roles: []RoleDiff{
+				{Role: "admin", Change: Changed, Columns: []ColumnDiff{
+					{Column: "State", Change: Added, Added: []string{"Ohio"}, Removed: []string{}},
+					{Column: "Region", Change: Removed, Added: []string{}, Removed: []string{"__all__"}},
+				}},
+				{Role: "auditor", Change: Added, Columns: []ColumnDiff{}},
+			}}
+			if !reflect.DeepEqual(diff, expected_diff) {
+				t.Errorf("Diff mismatch:\ngot  %+v\nwant %+v\n", diff, expected_diff)
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if want := []string{"admin", "auditor"}; !reflect.DeepEqual(roles, want) {
+				t.Errorf("Roles mismatch: got %v, want %v\n", roles, want)
+			}
+
+			failures := map[string]struct {
+				changes []PolicyChange
+				err     error
+			}{
+				"Create existing role": {[]PolicyChange{{Op: OpDrop, Role: "auditor"}, {Op: OpCreate, Role: "admin"}}, ErrRoleExists},
+				"Drop missing role":    {[]PolicyChange{{Op: OpDrop, Role: "auditor"}, {Op: OpDrop, Role: "auditor"}}, ErrRoleNotFound},
+				"Revoke dropped role": {[]PolicyChange{
+					{Op: OpDrop, Role: "auditor"},
+					{Op: OpRevoke, Role: "auditor", Column: "State", Values: []string{"Ohio"}},
+				}, ErrRoleNotFound},
+			}
+			for name, test := range failures {
+				if _, err := store.ApplyChanges(t.Context(), test.changes); !errors.Is(err, test.err) {
+					t.Errorf("%s: expected %v, got %v\n", name, test.err, err)
+				}
+			}
+			if roles, _ := store.ListRoles(t.Context()); !reflect.DeepEqual(roles, []string{"admin", "auditor"}) {
+				t.Errorf("Failed changes modified roles: %v\n", roles)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package rowaccess
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"io"
+	"os"
+	"time"
+)
+
+// Rows of grant_values inserted per statement
+const insert_batch_size = 2000
+
+// Counts of what a load wrote to the database, and how long it took
+type LoadStats struct {
+	Roles  int
+	Grants int
+	Values int
+	// Users whose roles were replaced, which Rows does not count
+	Users    int
+	Duration time.Duration
+}
+
+// Return the number of rows written to the roles, grants and grant_values
+// tables
+func (s LoadStats) Rows() int {
+	return s.Roles + s.Grants + s.Values
+}
+
+// Return the load throughput in rows written per second
+func (s LoadStats) RowsPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Rows()) / s.Duration.Seconds()
+}
+
+// Writes policies into the database inside one transaction
+//
+// Every statement is prepared once per load. Values are buffered and written
+// with multi-row inserts of up to insert_batch_size rows, and control column
+// ids are cached, so a load costs a handful of statements per role rather
+// than one per value.
+type loader struct {
+	ctx            context.Context
+	tx             *sql.Tx
+	upsert_role    *sql.Stmt
+	delete_grants  *sql.Stmt
+	delete_denials *sql.Stmt
+	insert_denial  *sql.Stmt
+	insert_except  *sql.Stmt
+	delete_parents *sql.Stmt
+	insert_parent  *sql.Stmt
+	upsert_user    *sql.Stmt
+	delete_members *sql.Stmt
+	insert_member  *sql.Stmt
+	upsert_column  *sql.Stmt
+	upsert_grant   *sql.Stmt
+	insert_values  *sql.Stmt
+	column_ids     map[string]int64
+	positions      map[int64]int
+	pending        [][3]any
+	stats          LoadStats
+}
+
+func newLoader(ctx context.Context, tx *sql.Tx) (*loader, error) {
+	l := &loader{
+		ctx:        ctx,
+		tx:         tx,
+		column_ids: map[string]int64{},
+		positions:  map[int64]int{},
+		pending:    make([][3]any, 0, insert_batch_size),
+	}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&l.upsert_role, `
+			insert into roles (role) values (?)
+			on conflict (role) do update set role = excluded.role
+			returning id`},
+		{&l.delete_grants, "delete from grants where role_id = ?"},
+		{&l.delete_denials, "delete from role_denials where role_id = ?"},
+		{&l.insert_denial, "insert into role_denials (role_id, column_id, value, position, match_kind) values (?, ?, ?, ?, ?) on conflict do nothing"},
+		{&l.insert_except, `
+			insert into grant_exceptions (grant_id, value, position)
+			select ?, ?, coalesce(max(position), 0) + 1 from grant_exceptions where grant_id = ?
+			on conflict do nothing`},
+		{&l.delete_parents, "delete from role_extends where role_id = ?"},
+		{&l.insert_parent, "insert into role_extends (role_id, parent, position) values (?, ?, ?) on conflict do nothing"},
+		{&l.upsert_user, `
+			insert into users (name) values (?)
+			on conflict (name) do update set name = excluded.name
+			returning id`},
+		{&l.delete_members, "delete from user_roles where user_id = ?"},
+		{&l.insert_member, "insert into user_roles (user_id, role, position) values (?, ?, ?) on conflict do nothing"},
+		{&l.upsert_column, `
+			insert into control_columns (name) values (?)
+			on conflict (name) do update set name = excluded.name
+			returning id`},
+		{&l.upsert_grant, `
+			insert into grants (role_id, column_id, all_values, match_kind) values (?, ?, ?, ?)
+			on conflict (role_id, column_id) do update set all_values = all_values or excluded.all_values
+			returning id`},
+		// Values are passed as one JSON array of [grant_id, value, position]
+		// rows, so a batch binds a single parameter however large it is
+		{&l.insert_values, `
+			insert into grant_values (grant_id, value, position)
+			select j.value ->> 0, j.value ->> 1, j.value ->> 2 from json_each(?) j where true
+			on conflict (grant_id, value) do nothing`},
+	}
+	for _, s := range statements {
+		stmt, err := tx.PrepareContext(ctx, s.query)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		*s.stmt = stmt
+	}
+	return l, nil
+}
+
+func (l *loader) close() {
+	for _, stmt := range []*sql.Stmt{l.upsert_role, l.delete_grants, l.delete_denials, l.insert_denial, l.insert_except, l.delete_parents, l.insert_parent, l.upsert_user, l.delete_members, l.insert_member, l.upsert_column, l.upsert_grant, l.insert_values} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+// Replace the role's policy with this one
+func (l *loader) loadPolicy(role_policy Policy) error {
+	// First, add role to `roles` table, if not already there
+	if !IsValidRoleName(role_policy.Role) {
+		return fmt.Errorf("invalid role name: %s", role_policy.Role)
+	}
+	var role_id int64
+	if err := l.upsert_role.QueryRowContext(l.ctx, role_policy.Role).Scan(&role_id); err != nil {
+		return err
+	}
+	l.stats.Roles++
+
+	// Truncate all of the role's existing grants (values cascade). Roles are
+	// checked before they are loaded, so none appears twice in one load.
+	if _, err := l.delete_grants.ExecContext(l.ctx, role_id); err != nil {
+		return err
+	}
+	clear(l.positions)
+
+	if _, err := l.delete_parents.ExecContext(l.ctx, role_id); err != nil {
+		return err
+	}
+	for i, parent := range role_policy.Extends {
+		if _, err := l.insert_parent.ExecContext(l.ctx, role_id, parent, i+1); err != nil {
+			return err
+		}
+	}
+
+	for _, policy_item := range role_policy.Policy {
+		if err := l.loadPolicyItem(role_id, policy_item); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.delete_denials.ExecContext(l.ctx, role_id); err != nil {
+		return err
+	}
+	position := 0
+	for _, deny_item := range role_policy.Deny {
+		column_id, err := l.controlColumnId(deny_item.Column)
+		if err != nil {
+			return err
+		}
+		for _, value := range deny_item.Values {
+			position++
+			if _, err := l.insert_denial.ExecContext(l.ctx, role_id, column_id, value, position, storedMatch(deny_item)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Replace the roles the user is a member of with these ones
+func (l *loader) loadUser(user User) error {
+	var user_id int64
+	if err := l.upsert_user.QueryRowContext(l.ctx, user.Name).Scan(&user_id); err != nil {
+		return err
+	}
+	l.stats.Users++
+	if _, err := l.delete_members.ExecContext(l.ctx, user_id); err != nil {
+		return err
+	}
+	for i, role := range user.Roles {
+		if _, err := l.insert_member.ExecContext(l.ctx, user_id, role, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert the grant for one policy item, merging it with any earlier item for
+// the same column
+//
+// __all__ is recorded on the grant itself, so that "all values" is an
+// explicit grant rather than a missing row. The grant keeps the match of the
+// first item for the column.
+func (l *loader) loadPolicyItem(role_id int64, policy_item PolicyItem) error {
+	column_id, err := l.controlColumnId(policy_item.Column)
+	if err != nil {
+		return err
+	}
+	all_values := false
+	for _, value := range policy_item.Values {
+		if value == AllValues {
+			all_values = true
+		}
+	}
+	var grant_id int64
+	if err := l.upsert_grant.QueryRowContext(l.ctx, role_id, column_id, all_values, storedMatch(policy_item)).Scan(&grant_id); err != nil {
+		return err
+	}
+	l.stats.Grants++
+	for _, value := range policy_item.Values {
+		if value == AllValues {
+			continue
+		}
+		l.positions[grant_id]++
+		l.pending = append(l.pending, [3]any{grant_id, value, l.positions[grant_id]})
+		l.stats.Values++
+		if len(l.pending) == cap(l.pending) {
+			if err := l.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	// Exceptions are rare and short, so they are not batched
+	for _, value := range policy_item.Except {
+		if _, err := l.insert_except.ExecContext(l.ctx, grant_id, value, grant_id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the id of the control column, adding it to the `control_columns`
+// table if needed
+func (l *loader) controlColumnId(column string) (int64, error) {
+	if id, ok := l.column_ids[column]; ok {
+		return id, nil
+	}
+	var id int64
+	if err := l.upsert_column.QueryRowContext(l.ctx, column).Scan(&id); err != nil {
+		return 0, err
+	}
+	l.column_ids[column] = id
+	return id, nil
+}
+
+// Write any buffered values
+func (l *loader) flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	rows, err := json.Marshal(l.pending)
+	if err != nil {
+		return err
+	}
+	l.pending = l.pending[:0]
+	_, err = l.insert_values.ExecContext(l.ctx, string(rows))
+	return err
+}
+
+// Write any buffered values and return the load's counts
+//
+// Roles are only checked for cycles in what they extend once every role is
+// loaded, as a cycle can run through roles loaded before.
+func (l *loader) finish() (LoadStats, error) {
+	if err := l.flush(); err != nil {
+		return LoadStats{}, err
+	}
+	if err := checkExtendsTx(l.ctx, l.tx); err != nil {
+		return LoadStats{}, err
+	}
+	return l.stats, nil
+}
+
+// Load the database with policies read from a JSON config, one policy at a
+// time
+//
+// The config is decoded as a stream, so only one policy is held in memory at
+// once, and each policy is checked against the config schema and by
+// CheckPolicySet before it is written. Every problem CheckPolicySet finds is
+// reported. The database is migrated to the latest schema version first, and
+// everything happens in one transaction: if any policy fails, nothing is
+// applied.
+func LoadDbFromReader(ctx context.Context, db *sql.DB, r io.Reader) (LoadStats, error) {
+	start := time.Now()
+	var stats LoadStats
+	err := withTx(ctx, db, func(tx *sql.Tx) error {
+		if _, _, err := migrateTx(ctx, tx); err != nil {
+			return err
+		}
+		l, err := newLoader(ctx, tx)
+		if err != nil {
+			return err
+		}
+		defer l.close()
+		// Every policy is checked, but once one has a problem nothing more is
+		// written, and the transaction is rolled back
+		var checker policyChecker
+		err = DecodeConfig(r, func(role_policy Policy) error {
+			if checker.check(role_policy); checker.err() != nil {
+				return nil
+			}
+			return l.loadPolicy(role_policy)
+		}, func(user User) error {
+			if checker.checkUser(user); checker.err() != nil {
+				return nil
+			}
+			return l.loadUser(user)
+		})
+		if err != nil {
+			return err
+		}
+		if err := checker.err(); err != nil {
+			return err
+		}
+		stats, err = l.finish()
+		return err
+	})
+	if err != nil {
+		return LoadStats{}, err
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// Load the database with policies from a JSON config file
+func LoadDbFromFile(ctx context.Context, db *sql.DB, fname string) (LoadStats, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return LoadStats{}, err
+	}
+	defer f.Close()
+	return LoadDbFromReader(ctx, db, f)
+}
+
+// Decode a JSON policy set one policy at a time, calling fn with each policy
+// in order
+//
+// Each policy is validated against the config schema before fn is called.
+// Decoding stops at the first error, from the config or from fn. A config
+// that does not start with { is decoded with DecodePolicyDsl instead. Users
+// in the config are checked against the schema but skipped; DecodeConfig
+// returns them too.
+func DecodePolicySet(r io.Reader, fn func(Policy) error) error {
+	return DecodeConfig(r, fn, func(User) error { return nil })
+}
+
+// Decode a config one policy and one user at a time, calling policy_fn with
+// each policy and user_fn with each user, in order
+//
+// Otherwise it is DecodePolicySet.
+func DecodeConfig(r io.Reader, policy_fn func(Policy) error, user_fn func(User) error) error {
+	br := bufio.NewReader(r)
+	if isDslConfig(br) {
+		return decodeDslConfig(br, policy_fn, user_fn)
+	}
+	schemas, err := getSchemas()
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(br)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if key != "policies" && key != "users" {
+			return fmt.Errorf("unexpected property %v in policy set", tok)
+		}
+		if found[key] {
+			return fmt.Errorf("%s given more than once in policy set", key)
+		}
+		found[key] = true
+		if err := expectDelim(dec, '['); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		for i := 0; dec.More(); i++ {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return fmt.Errorf("/%s/%d: %w", key, i, err)
+			}
+			inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+			if err != nil {
+				return fmt.Errorf("/%s/%d: %w", key, i, err)
+			}
+			if key == "users" {
+				if err := schemas.user.Validate(inst); err != nil {
+					return fmt.Errorf("/users/%d: %w", i, err)
+				}
+				var user User
+				if err := json.Unmarshal(raw, &user); err != nil {
+					return fmt.Errorf("/users/%d: %w", i, err)
+				}
+				if err := user_fn(user); err != nil {
+					return fmt.Errorf("/users/%d (user %s): %w", i, user.Name, err)
+				}
+				continue
+			}
+			if err := schemas.policy.Validate(inst); err != nil {
+				return fmt.Errorf("/policies/%d: %w", i, err)
+			}
+			var policy Policy
+			if err := json.Unmarshal(raw, &policy); err != nil {
+				return fmt.Errorf("/policies/%d: %w", i, err)
+			}
+			if err := policy_fn(policy); err != nil {
+				return fmt.Errorf("/policies/%d (role %s): %w", i, policy.Role, err)
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	if !found["policies"] {
+		return fmt.Errorf("missing policies in policy set")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after policy set")
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %v, found %v", want, tok)
+	}
+	return nil
+}
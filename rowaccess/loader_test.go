@@ -0,0 +1,167 @@
+package rowaccess
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadDbFromReaderWorks(t *testing.T) {
+	// Setup: The same config loaded in full and streamed
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	expected_db := getInitializedDbHandle(t)
+	defer expected_db.Close()
+	if err := LoadDbWithPolicies(t.Context(), expected_db, policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+
+	db := getDbHandle(t)
+	defer db.Close()
+	stats, err := LoadDbFromFile(t.Context(), db, "testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading db from file: %v\n", err)
+	}
+
+	// Test: Both databases hold the same policies
+	if got, want := dumpDb(t, db), dumpDb(t, expected_db); got != want {
+		t.Errorf("Database mismatch:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+	if stats.Roles != len(policy_set.Policies) {
+		t.Errorf("Role count mismatch: got %d, want %d\n", stats.Roles, len(policy_set.Policies))
+	}
+	if stats.Rows() == 0 || stats.Duration <= 0 || stats.RowsPerSecond() <= 0 {
+		t.Errorf("Stats not recorded: %+v\n", stats)
+	}
+	if !getDbInitialized(t, db) {
+		t.Error("Db falsely reported as uninitialized after streaming load")
+	}
+}
+
+func TestLoadDbFromReaderBatchesValues(t *testing.T) {
+	// A role with enough values to span several batches, after another role
+	// whose values are still buffered when it is loaded
+	var values []string
+	for i := 0; i < 2*insert_batch_size+17; i++ {
+		values = append(values, fmt.Sprintf("sku_%d", i))
+	}
+	final := Policy{Role: "buyer", Policy: []PolicyItem{
+		{Column: "item_code", Values: values},
+		{Column: "Region", Values: []string{"__all__"}},
+	}}
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "item_code", Values: values[:insert_batch_size-1]}}},
+		final,
+	}}
+	data, err := json.Marshal(policy_set)
+	if err != nil {
+		t.Fatalf("Error marshalling policy set: %v\n", err)
+	}
+
+	db := getDbHandle(t)
+	defer db.Close()
+	stats, err := LoadDbFromReader(t.Context(), db, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error loading db from reader: %v\n", err)
+	}
+	policy, err := GetPolicy(t.Context(), db, "buyer")
+	if err != nil {
+		t.Fatalf("Error getting policy: %v\n", err)
+	}
+	if !reflect.DeepEqual(policy, final) {
+		t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), final.ToJson())
+	}
+	if want := insert_batch_size - 1 + len(values); stats.Values != want {
+		t.Errorf("Value count mismatch: got %d, want %d\n", stats.Values, want)
+	}
+}
+
+func TestLoadDbFromReaderIsAtomic(t *testing.T) {
+	invalid_configs := map[string]string{
+		"Invalid role name":         `{"policies":[{"role":"admin","policy":[]},{"role":"-admin","policy":[]}]}`,
+		"Schema error mid-stream":   `{"policies":[{"role":"admin","policy":[]},{"role":"east_mgr","policy":[{"column":"Region"}]}]}`,
+		"Missing policies":          `{}`,
+		"Extra property":            `{"policies":[{"role":"admin","policy":[]}],"extra":"property"}`,
+		"Policies is not an array":  `{"policies":{"role":"admin","policy":[]}}`,
+		"Truncated":                 `{"policies":[{"role":"admin","policy":[]}`,
+		"Data after the policy set": `{"policies":[{"role":"admin","policy":[]}]} {}`,
+		"Policies given twice":      `{"policies":[],"policies":[{"role":"admin","policy":[]}]}`,
+		"Not a policy set":          `[{"role":"admin","policy":[]}]`,
+		"Values of the wrong type":  `{"policies":[{"role":"admin","policy":[{"column":"Region","values":[1]}]}]}`,
+		"Insert failure":            fmt.Sprintf(`{"policies":[{"role":"admin","policy":[{"column":"Region","values":["one","%s"]}]}]}`, getFailingValue()),
+	}
+	for name, config := range invalid_configs {
+		t.Run(name, func(t *testing.T) {
+			db := getInitializedDbHandle(t)
+			defer db.Close()
+			initial_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "two"}}}}}}
+			if err := LoadDbWithPolicies(t.Context(), db, &initial_set); err != nil {
+				t.Fatalf("Error loading db with policies: %v\n", err)
+			}
+			injectInsertFailure(t, db)
+			before := dumpDb(t, db)
+
+			if _, err := LoadDbFromReader(t.Context(), db, strings.NewReader(config)); err == nil {
+				t.Fatalf("Expected error loading db from reader, but got none")
+			}
+
+			if after := dumpDb(t, db); after != before {
+				t.Errorf("Database changed after failed load:\nbefore:\n%s\nafter:\n%s", before, after)
+			}
+		})
+	}
+}
+
+func TestFailedStreamingLoadLeavesDbEmpty(t *testing.T) {
+	db := getDbHandle(t)
+	defer db.Close()
+	if _, err := LoadDbFromReader(t.Context(), db, strings.NewReader(`{"policies":[{"role":"-admin","policy":[]}]}`)); err == nil {
+		t.Fatalf("Expected error loading db from reader, but got none")
+	}
+	if empty, err := dbIsEmpty(t.Context(), db); err != nil || !empty {
+		t.Errorf("Db not left empty after failed load (empty %v, error %v)\n", empty, err)
+	}
+}
+
+// Load a generated config of 10,000 roles with 50 values each, reporting
+// the rows written per second
+func BenchmarkLoadDbFromReader(b *testing.B) {
+	policy_set := PolicySet{}
+	for i := 0; i < 10000; i++ {
+		policy := Policy{Role: benchmarkRoleName(i), Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"__all__"}},
+			{Column: "item_code", Values: []string{}},
+		}}
+		for j := 0; j < 50; j++ {
+			policy.Policy[1].Values = append(policy.Policy[1].Values, fmt.Sprintf("sku_%d", (i*7+j)%5000))
+		}
+		policy_set.Policies = append(policy_set.Policies, policy)
+	}
+	data, err := json.Marshal(policy_set)
+	if err != nil {
+		b.Fatalf("Error marshalling policy set: %v\n", err)
+	}
+
+	b.ResetTimer()
+	var rows_per_second float64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, err := OpenDb(b.Context(), b.TempDir()+"/bench.db")
+		if err != nil {
+			b.Fatalf("Error opening db: %v\n", err)
+		}
+		b.StartTimer()
+		stats, err := LoadDbFromReader(b.Context(), db, bytes.NewReader(data))
+		if err != nil {
+			b.Fatalf("Error loading db from reader: %v\n", err)
+		}
+		rows_per_second += stats.RowsPerSecond()
+		db.Close()
+	}
+	b.ReportMetric(rows_per_second/float64(b.N), "rows/s")
+}
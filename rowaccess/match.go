@@ -0,0 +1,436 @@
+package rowaccess
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// How the values of a policy item are matched against a column
+type MatchKind string
+
+const (
+	// Values are compared as they are. This is the default, and a policy
+	// item that matches exactly leaves its match out.
+	MatchExact MatchKind = "exact"
+	// Values are prefixes, so SKU-12 matches SKU-1234
+	MatchPrefix MatchKind = "prefix"
+	// Values are globs as SQLite's GLOB reads them: * matches any run of
+	// characters, ? any one character, and [...] one of a set, or with [^...]
+	// one not in it. Globs are case sensitive and have no escape character;
+	// [*] matches a *.
+	MatchGlob MatchKind = "glob"
+	// Values are RE2 regular expressions, which must match the whole value
+	MatchRegex MatchKind = "regex"
+)
+
+// Every match kind, in the order they are documented
+var MatchKinds = []MatchKind{MatchExact, MatchPrefix, MatchGlob, MatchRegex}
+
+// The most states matchesEverything explores before it gives up and takes
+// the pattern to restrict the column
+const max_everything_states = 256
+
+// Regular expressions compiled by compilePattern, keyed by patternKey, so
+// that each pattern is compiled once however many values it is matched
+// against. Patterns come from policies, so there are few of them.
+var compiled_patterns sync.Map
+
+type patternKey struct {
+	kind    MatchKind
+	pattern string
+}
+
+type compiledPattern struct {
+	re  *regexp.Regexp
+	err error
+}
+
+// Return the match kind with the name, or an error if there is none
+func ParseMatchKind(name string) (MatchKind, error) {
+	for _, kind := range MatchKinds {
+		if string(kind) == name {
+			return kind, nil
+		}
+	}
+	return "", fmt.Errorf("unknown match %q, use exact, prefix, glob or regex", name)
+}
+
+// Return the item's match kind, which is MatchExact if it has none
+func (pi *PolicyItem) matchKind() MatchKind {
+	if pi.Match == "" {
+		return MatchExact
+	}
+	return pi.Match
+}
+
+// Return true if the item's values are patterns rather than exact values
+func (pi *PolicyItem) isPattern() bool {
+	return pi.matchKind() != MatchExact
+}
+
+// Return true if the item lets the value through: an exact item names it
+// or grants __all__ without excepting it, and a pattern item has a pattern
+// that matches it
+func (pi *PolicyItem) allows(value string) bool {
+	if !pi.isPattern() {
+		return allowsThroughAll(*pi, value) || slices.Contains(pi.Values, value)
+	}
+	for _, pattern := range pi.Values {
+		if re, err := compilePattern(pi.matchKind(), pattern); err == nil && re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the pattern as the body of a regular expression that matches the
+// same values when anchored at both ends
+func patternRegexp(kind MatchKind, pattern string) (string, error) {
+	switch kind {
+	case MatchExact:
+		return regexp.QuoteMeta(pattern), nil
+	case MatchPrefix:
+		return regexp.QuoteMeta(pattern) + `(?s:.*)`, nil
+	case MatchGlob:
+		return globRegexp(pattern)
+	case MatchRegex:
+		return "(?:" + pattern + ")", nil
+	}
+	return "", fmt.Errorf("unknown match %q", kind)
+}
+
+// Return a regular expression that matches the whole of the values the
+// pattern matches, compiling it only the first time
+func compilePattern(kind MatchKind, pattern string) (*regexp.Regexp, error) {
+	key := patternKey{kind, pattern}
+	if compiled, ok := compiled_patterns.Load(key); ok {
+		return compiled.(compiledPattern).re, compiled.(compiledPattern).err
+	}
+	var compiled compiledPattern
+	body, err := patternRegexp(kind, pattern)
+	if err != nil {
+		compiled.err = err
+	} else {
+		compiled.re, compiled.err = regexp.Compile("^(?:" + body + ")$")
+	}
+	compiled_patterns.Store(key, compiled)
+	return compiled.re, compiled.err
+}
+
+// Return the value, matched as kind, as a pattern that matches the same
+// values as target, which is a glob or a regular expression
+func convertPattern(kind, target MatchKind, value string) string {
+	if kind == target {
+		return value
+	}
+	if target == MatchRegex {
+		// Globs are checked before they are stored, so they convert
+		body, _ := patternRegexp(kind, value)
+		return body
+	}
+	var b strings.Builder
+	for _, c := range value {
+		if strings.ContainsRune("*?[", c) {
+			b.WriteString("[" + string(c) + "]")
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	if kind == MatchPrefix {
+		b.WriteString("*")
+	}
+	return b.String()
+}
+
+// Return the glob as the body of a regular expression
+func globRegexp(glob string) (string, error) {
+	var b strings.Builder
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			b.WriteString(`(?s:.*)`)
+		case '?':
+			b.WriteString(`(?s:.)`)
+		case '[':
+			j := i + 1
+			negate := j < len(runes) && runes[j] == '^'
+			if negate {
+				j++
+			}
+			start := j
+			// A ] first in the set is one of its characters
+			if j < len(runes) && runes[j] == ']' {
+				j++
+			}
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j == len(runes) {
+				return "", fmt.Errorf("unterminated [")
+			}
+			b.WriteString("[")
+			if negate {
+				b.WriteString("^")
+			}
+			set := runes[start:j]
+			for k, r := range set {
+				if r == '-' && k > 0 && k < len(set)-1 {
+					b.WriteString("-")
+				} else {
+					fmt.Fprintf(&b, `\x{%x}`, r)
+				}
+			}
+			b.WriteString("]")
+			i = j
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// Return an error if the pattern is invalid, can never match, or matches
+// every value
+//
+// A pattern matches every value if it matches every value that is neither
+// empty nor has a line break in it, as matchesEverything decides, so that
+// .* and (?s).+ are both refused. Exact values are always accepted.
+func checkPattern(kind MatchKind, pattern string) error {
+	if kind == MatchExact {
+		return nil
+	}
+	body, err := patternRegexp(kind, pattern)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", kind, pattern, err)
+	}
+	full := "^(?:" + body + ")$"
+	parsed, err := syntax.Parse(full, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", kind, pattern, err)
+	}
+	parsed = parsed.Simplify()
+	if !canMatch(parsed) {
+		return fmt.Errorf("%s %q can never match", kind, pattern)
+	}
+	if matchesEverything(parsed) {
+		return fmt.Errorf("%s %q matches every value; grant %s instead", kind, pattern, AllValues)
+	}
+	return nil
+}
+
+// Return true if the regular expression matches every value that is not
+// empty and has no line break
+//
+// The compiled program is run as a DFA over ranges of runes that each of
+// its instructions treats alike, from the start state, and every state
+// reached by reading at least one rune must accept. A DFA that grows past
+// max_everything_states states is taken not to match everything.
+func matchesEverything(re *syntax.Regexp) bool {
+	prog, err := syntax.Compile(re)
+	if err != nil {
+		return false
+	}
+	// A state is the instructions waiting for the next rune and the rune
+	// before them, reduced to what empty-width assertions look at
+	type state struct {
+		pcs  []uint32
+		prev rune
+	}
+	key := func(st state) string {
+		return fmt.Sprint(st.pcs, st.prev)
+	}
+	runes := runeRanges(prog)
+	start := state{pcs: []uint32{uint32(prog.Start)}, prev: -1}
+	seen := map[string]bool{key(start): true}
+	queue := []state{start}
+	for len(queue) > 0 {
+		st := queue[0]
+		queue = queue[1:]
+		for _, r := range runes {
+			var next state
+			next.prev = assertionRune(r)
+			for _, pc := range closure(prog, st.pcs, syntax.EmptyOpContext(st.prev, r)) {
+				inst := &prog.Inst[pc]
+				if inst.Op != syntax.InstMatch && matchesRune(inst, r) {
+					next.pcs = append(next.pcs, inst.Out)
+				}
+			}
+			slices.Sort(next.pcs)
+			next.pcs = slices.Compact(next.pcs)
+			if seen[key(next)] {
+				continue
+			}
+			accepts := slices.ContainsFunc(closure(prog, next.pcs, syntax.EmptyOpContext(next.prev, -1)), func(pc uint32) bool {
+				return prog.Inst[pc].Op == syntax.InstMatch
+			})
+			if !accepts || len(seen) == max_everything_states {
+				return false
+			}
+			seen[key(next)] = true
+			queue = append(queue, next)
+		}
+	}
+	return true
+}
+
+// Return the instructions that consume a rune or match, reached from pcs
+// without consuming one where the empty-width assertions in context hold
+func closure(prog *syntax.Prog, pcs []uint32, context syntax.EmptyOp) []uint32 {
+	var reached []uint32
+	visited := map[uint32]bool{}
+	stack := slices.Clone(pcs)
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[pc] {
+			continue
+		}
+		visited[pc] = true
+		switch inst := &prog.Inst[pc]; inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, inst.Out, inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			stack = append(stack, inst.Out)
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^context == 0 {
+				stack = append(stack, inst.Out)
+			}
+		case syntax.InstMatch, syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			reached = append(reached, pc)
+		}
+	}
+	return reached
+}
+
+// Return true if the instruction consumes the rune
+func matchesRune(inst *syntax.Inst, r rune) bool {
+	switch inst.Op {
+	case syntax.InstRune:
+		return inst.MatchRune(r)
+	case syntax.InstRune1:
+		return r == inst.Rune[0]
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return r != '\n'
+	}
+	return false
+}
+
+// Return the first rune of each range of runes that the program's
+// instructions and empty-width assertions all treat alike, leaving out the
+// line break
+func runeRanges(prog *syntax.Prog) []rune {
+	// Word characters and line breaks are where assertions change
+	bounds := []rune{0, '\n', '\n' + 1, '0', '9' + 1, 'A', 'Z' + 1, '_', '_' + 1, 'a', 'z' + 1}
+	for _, inst := range prog.Inst {
+		switch inst.Op {
+		case syntax.InstRune:
+			for i := 0; i+1 < len(inst.Rune); i += 2 {
+				bounds = append(bounds, inst.Rune[i], inst.Rune[i+1]+1)
+			}
+			// A single rune may match case insensitively
+			if len(inst.Rune) == 1 {
+				r := inst.Rune[0]
+				bounds = append(bounds, r, r+1)
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					bounds = append(bounds, f, f+1)
+				}
+			}
+		case syntax.InstRune1:
+			bounds = append(bounds, inst.Rune[0], inst.Rune[0]+1)
+		}
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	return slices.DeleteFunc(bounds, func(r rune) bool {
+		return r == '\n' || r > unicode.MaxRune
+	})
+}
+
+// Return a rune that empty-width assertions treat as they treat r
+func assertionRune(r rune) rune {
+	switch {
+	case r == '\n':
+		return '\n'
+	case syntax.IsWordChar(r):
+		return 'a'
+	}
+	return ' '
+}
+
+// Return false if no string can match the regular expression, because it
+// needs a character from an empty set or text before its start or after its
+// end
+func canMatch(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return false
+	case syntax.OpCharClass:
+		return len(re.Rune) > 0
+	case syntax.OpCapture, syntax.OpPlus:
+		return canMatch(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min == 0 || canMatch(re.Sub[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if canMatch(sub) {
+				return true
+			}
+		}
+		return false
+	case syntax.OpConcat:
+		consumed := 0
+		ended := false
+		for _, sub := range re.Sub {
+			if !canMatch(sub) {
+				return false
+			}
+			n := minLength(sub)
+			if (sub.Op == syntax.OpBeginText && consumed > 0) || (ended && n > 0) {
+				return false
+			}
+			consumed += n
+			if sub.Op == syntax.OpEndText {
+				ended = true
+			}
+		}
+	}
+	return true
+}
+
+// Return the length, in characters, of the shortest string the regular
+// expression matches
+func minLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return 1
+	case syntax.OpCapture, syntax.OpPlus:
+		return minLength(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min * minLength(re.Sub[0])
+	case syntax.OpConcat:
+		n := 0
+		for _, sub := range re.Sub {
+			n += minLength(sub)
+		}
+		return n
+	case syntax.OpAlternate:
+		n := -1
+		for _, sub := range re.Sub {
+			if m := minLength(sub); canMatch(sub) && (n < 0 || m < n) {
+				n = m
+			}
+		}
+		return max(n, 0)
+	}
+	return 0
+}
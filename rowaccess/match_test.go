@@ -0,0 +1,95 @@
+package rowaccess
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPattern(t *testing.T) {
+	tests := map[string]struct {
+		kind    MatchKind
+		pattern string
+		problem string
+	}{
+		"Prefix":                              {MatchPrefix, "SKU-12", ""},
+		"Empty prefix":                        {MatchPrefix, "", "matches every value"},
+		"Glob":                                {MatchGlob, "SKU-[0-9]?*", ""},
+		"Glob of stars":                       {MatchGlob, "**", "matches every value"},
+		"Unterminated glob set":               {MatchGlob, "SKU-[12", "invalid glob"},
+		"Reversed glob range":                 {MatchGlob, "[z-a]", "invalid glob"},
+		"Regex":                               {MatchRegex, `SKU-\d{4}`, ""},
+		"Regex of an optional value":          {MatchRegex, `(SKU-1)?`, ""},
+		"Invalid regex":                       {MatchRegex, `SKU-(\d`, "invalid regex"},
+		"Regex for any value":                 {MatchRegex, `.*`, "matches every value"},
+		"Regex for any character":             {MatchRegex, `[\s\S]*`, "matches every value"},
+		"Regex for any non-empty value":       {MatchRegex, `(?s).+`, "matches every value"},
+		"Regex of alternatives for any value": {MatchRegex, `[^x].*|x.*`, "matches every value"},
+		"Regex of lines":                      {MatchRegex, `(?m)^.+$`, "matches every value"},
+		"Regex of anything but one value":     {MatchRegex, `[^x]|..+`, ""},
+		"Regex needing a word boundary":       {MatchRegex, `\b.+`, ""},
+		"Regex of letters":                    {MatchRegex, `\p{L}+`, ""},
+		"Regex ignoring case":                 {MatchRegex, `(?i)[^k]|k|..+`, "matches every value"},
+		"Glob for any non-empty value":        {MatchGlob, "?*", "matches every value"},
+		"Regex with an empty set":             {MatchRegex, `SKU-[^\x00-\x{10FFFF}]`, "can never match"},
+		"Regex with text before start":        {MatchRegex, `SKU^1`, "can never match"},
+		"Regex with text after end":           {MatchRegex, `SKU$1|a$b`, "can never match"},
+		"Regex with one good branch":          {MatchRegex, `a$b|SKU`, ""},
+		"Exact values are not checked":        {MatchExact, "", ""},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkPattern(test.kind, test.pattern)
+			switch {
+			case test.problem == "" && err != nil:
+				t.Errorf("Unexpected error: %v\n", err)
+			case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+				t.Errorf("Error mismatch: got %v, want %s\n", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestPolicyItemAllows(t *testing.T) {
+	tests := map[string]struct {
+		item    PolicyItem
+		allowed []string
+		denied  []string
+	}{
+		"Exact":    {PolicyItem{Values: []string{"SKU-1"}}, []string{"SKU-1"}, []string{"SKU-12", "sku-1"}},
+		"__all__":  {PolicyItem{Values: []string{"__all__"}, Except: []string{"SKU-2"}}, []string{"SKU-1", ""}, []string{"SKU-2"}},
+		"Prefix":   {PolicyItem{Match: MatchPrefix, Values: []string{"SKU-1", "X."}}, []string{"SKU-1", "SKU-12", "X.y"}, []string{"SKU-2", "XY", "sku-1"}},
+		"Glob":     {PolicyItem{Match: MatchGlob, Values: []string{"SKU-[12]?", "[*]x", "[]]"}}, []string{"SKU-1a", "SKU-2\n", "*x", "]"}, []string{"SKU-3a", "SKU-1", "ax"}},
+		"Negation": {PolicyItem{Match: MatchGlob, Values: []string{"[^a-c]*"}}, []string{"d", "xyz"}, []string{"b", ""}},
+		"Regex":    {PolicyItem{Match: MatchRegex, Values: []string{`SKU-\d+|X`}}, []string{"SKU-12", "X"}, []string{"SKU-12a", "aX", "XX"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, value := range test.allowed {
+				if !test.item.allows(value) {
+					t.Errorf("Expected %q to be allowed\n", value)
+				}
+			}
+			for _, value := range test.denied {
+				if test.item.allows(value) {
+					t.Errorf("Expected %q not to be allowed\n", value)
+				}
+			}
+		})
+	}
+}
+
+func TestCompilePatternCaches(t *testing.T) {
+	first, err := compilePattern(MatchGlob, "SKU-[12]*")
+	if err != nil {
+		t.Fatalf("Error compiling pattern: %v\n", err)
+	}
+	if second, _ := compilePattern(MatchGlob, "SKU-[12]*"); second != first {
+		t.Errorf("Expected the same pattern to be compiled once\n")
+	}
+	if other, _ := compilePattern(MatchPrefix, "SKU-[12]*"); other == first {
+		t.Errorf("Expected patterns of another match to be compiled apart\n")
+	}
+	if _, err := compilePattern(MatchRegex, `SKU-(\d`); err == nil {
+		t.Errorf("Expected an error compiling an invalid regex\n")
+	}
+}
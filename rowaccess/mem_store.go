@@ -0,0 +1,361 @@
+package rowaccess
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PolicyStore held in memory, for embedding and for tests
+//
+// It is safe for concurrent use.
+type MemStore struct {
+	mu       sync.RWMutex
+	policies map[string]Policy
+	users    map[string][]string
+	mode     CombineMode
+}
+
+// Return an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{policies: map[string]Policy{}, users: map[string][]string{}}
+}
+
+// Replace the policy of every role in the set
+//
+// The set is checked with CheckPolicySet before anything is changed.
+func (s *MemStore) LoadPolicies(ctx context.Context, policy_set *PolicySet) (LoadStats, error) {
+	start := time.Now()
+	if err := CheckPolicySet(policy_set); err != nil {
+		return LoadStats{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkExtendsLocked(policy_set, false); err != nil {
+		return LoadStats{}, err
+	}
+	stats := s.loadLocked(policy_set)
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// Replace the policy of every role in the checked set, with s.mu held
+func (s *MemStore) loadLocked(policy_set *PolicySet) LoadStats {
+	var stats LoadStats
+	for _, role_policy := range policy_set.Policies {
+		s.policies[role_policy.Role] = normalizePolicy(role_policy)
+		stats.Roles++
+		for _, policy_item := range role_policy.Policy {
+			stats.Grants++
+			for _, value := range policy_item.Values {
+				if value != AllValues {
+					stats.Values++
+				}
+			}
+		}
+	}
+	for _, user := range policy_set.Users {
+		s.users[user.Name] = slices.Clone(user.Roles)
+		stats.Users++
+	}
+	return stats
+}
+
+// Return the roles each role extends, with s.mu held
+func (s *MemStore) extendsLocked() map[string][]string {
+	extends := map[string][]string{}
+	for role, policy := range s.policies {
+		extends[role] = policy.Extends
+	}
+	return extends
+}
+
+// Return ErrExtendsCycle if loading the policy set would leave roles that
+// extend each other in a cycle, with s.mu held
+//
+// With sync only the set's roles are considered, as the rest are deleted.
+func (s *MemStore) checkExtendsLocked(policy_set *PolicySet, sync bool) error {
+	extends := map[string][]string{}
+	if !sync {
+		extends = s.extendsLocked()
+	}
+	for _, role_policy := range policy_set.Policies {
+		extends[role_policy.Role] = role_policy.Extends
+	}
+	if cycle := findExtendsCycle(extends); cycle != nil {
+		return extendsCycle(cycle)
+	}
+	return nil
+}
+
+// Replace the whole store with the policy set
+//
+// The set is checked with CheckPolicySet before anything is changed.
+func (s *MemStore) SyncPolicies(ctx context.Context, policy_set *PolicySet) (SyncStats, error) {
+	start := time.Now()
+	if err := CheckPolicySet(policy_set); err != nil {
+		return SyncStats{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkExtendsLocked(policy_set, true); err != nil {
+		return SyncStats{}, err
+	}
+	roles := make([]string, 0, len(s.policies))
+	for role := range s.policies {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	stats := SyncStats{Deleted: rolesMissingFrom(roles, policy_set)}
+	for _, role := range stats.Deleted {
+		delete(s.policies, role)
+	}
+	stats.LoadStats = s.loadLocked(policy_set)
+	s.removeMembersLocked(func(role string) bool {
+		_, ok := s.policies[role]
+		return !ok
+	})
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+func (s *MemStore) GetPolicy(ctx context.Context, role string) (Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policy, ok := s.policies[role]
+	if !ok {
+		return Policy{}, roleNotFound(role)
+	}
+	return copyPolicy(policy), nil
+}
+
+func (s *MemStore) ListRoles(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	roles := make([]string, 0, len(s.policies))
+	for role := range s.policies {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	return roles, nil
+}
+
+func (s *MemStore) GetUser(ctx context.Context, user string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	roles, ok := s.users[user]
+	if !ok {
+		return User{}, userNotFound(user)
+	}
+	return User{Name: user, Roles: append([]string{}, roles...)}, nil
+}
+
+func (s *MemStore) ListUsers(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]string, 0, len(s.users))
+	for user := range s.users {
+		users = append(users, user)
+	}
+	slices.Sort(users)
+	return users, nil
+}
+
+func (s *MemStore) GetCombineMode(ctx context.Context) (CombineMode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mode, nil
+}
+
+func (s *MemStore) SetCombineMode(ctx context.Context, mode CombineMode) error {
+	if _, err := ParseCombineMode(string(mode)); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = mode
+	return nil
+}
+
+func (s *MemStore) ListColumns(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := map[string]bool{}
+	columns := []string{}
+	for _, policy := range s.policies {
+		for _, policy_item := range slices.Concat(policy.Policy, policy.Deny) {
+			if !seen[policy_item.Column] {
+				seen[policy_item.Column] = true
+				columns = append(columns, policy_item.Column)
+			}
+		}
+	}
+	slices.Sort(columns)
+	return columns, nil
+}
+
+// Call fn with a copy of every policy, in role order
+//
+// The policies are copied before fn is called, so fn may use the store.
+func (s *MemStore) GetAllPolicies(ctx context.Context, fn func(Policy) error) error {
+	s.mu.RLock()
+	policies := make([]Policy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, copyPolicy(policy))
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(policies, func(a, b Policy) int {
+		return strings.Compare(a.Role, b.Role)
+	})
+	for _, policy := range policies {
+		if err := fn(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteRole(ctx context.Context, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.policies[role]; !ok {
+		return roleNotFound(role)
+	}
+	if err := checkNotExtended(s.extendsLocked(), []string{role}); err != nil {
+		return err
+	}
+	delete(s.policies, role)
+	s.removeMembersLocked(func(member_of string) bool {
+		return member_of == role
+	})
+	return nil
+}
+
+// Remove users from the roles remove returns true for, with s.mu held
+func (s *MemStore) removeMembersLocked(remove func(role string) bool) {
+	for user, roles := range s.users {
+		if slices.ContainsFunc(roles, remove) {
+			s.users[user] = slices.DeleteFunc(slices.Clone(roles), remove)
+		}
+	}
+}
+
+func (s *MemStore) RenameRole(ctx context.Context, role, new_role string) error {
+	return s.copyRole(role, new_role, true)
+}
+
+func (s *MemStore) CloneRole(ctx context.Context, role, new_role string) error {
+	return s.copyRole(role, new_role, false)
+}
+
+// Copy the role's policy to new_role, removing the original and pointing
+// the roles that extend it and its members at new_role if move is true
+func (s *MemStore) copyRole(role, new_role string, move bool) error {
+	if err := checkNewRoleName(new_role); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy, ok := s.policies[role]
+	if !ok {
+		return roleNotFound(role)
+	}
+	if _, ok := s.policies[new_role]; ok {
+		return roleExists(new_role)
+	}
+	// A role may already extend the new name, closing a cycle
+	extends := s.extendsLocked()
+	extends[new_role] = policy.Extends
+	if move {
+		delete(extends, role)
+		for other, parents := range extends {
+			if i := slices.Index(parents, role); i >= 0 {
+				parents = slices.Clone(parents)
+				parents[i] = new_role
+				extends[other] = parents
+			}
+		}
+	}
+	if cycle := findExtendsCycle(extends); cycle != nil {
+		return extendsCycle(cycle)
+	}
+	copied := copyPolicy(policy)
+	copied.Role = new_role
+	s.policies[new_role] = copied
+	if move {
+		delete(s.policies, role)
+		for other, policy := range s.policies {
+			if i := slices.Index(policy.Extends, role); i >= 0 {
+				policy.Extends = slices.Clone(policy.Extends)
+				policy.Extends[i] = new_role
+				s.policies[other] = policy
+			}
+		}
+		for user, roles := range s.users {
+			if i := slices.Index(roles, role); i >= 0 {
+				roles = slices.Clone(roles)
+				roles[i] = new_role
+				s.users[user] = roles
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) ApplyChanges(ctx context.Context, changes []PolicyChange) (*Diff, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before, after, err := planChanges(changes, func(role string) (Policy, error) {
+		policy, ok := s.policies[role]
+		if !ok {
+			return Policy{}, roleNotFound(role)
+		}
+		return policy, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	diff := DiffPolicies(before, after)
+	removed := removedRoles(diff)
+	extends := s.extendsLocked()
+	for _, policy := range after {
+		extends[policy.Role] = policy.Extends
+	}
+	if err := checkNotExtended(extends, removed); err != nil {
+		return nil, err
+	}
+	diff.Users = removedMemberships(diff, s.users)
+	for _, role := range removed {
+		delete(s.policies, role)
+	}
+	s.removeMembersLocked(func(role string) bool {
+		return slices.Contains(removed, role)
+	})
+	for _, policy := range after {
+		s.policies[policy.Role] = normalizePolicy(policy)
+	}
+	return diff, nil
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
+
+// Return a copy of the policy that shares no slices with the original
+func copyPolicy(policy Policy) Policy {
+	return Policy{Role: policy.Role, Extends: slices.Clone(policy.Extends), Policy: copyItems(policy.Policy), Deny: copyItems(policy.Deny)}
+}
+
+// Return a deep copy of the policy items, which is nil if items is
+func copyItems(items []PolicyItem) []PolicyItem {
+	if items == nil {
+		return nil
+	}
+	copied := make([]PolicyItem, len(items))
+	for i, policy_item := range items {
+		copied[i] = PolicyItem{Column: policy_item.Column, Match: policy_item.Match, Values: slices.Clone(policy_item.Values), Except: slices.Clone(policy_item.Except)}
+	}
+	return copied
+}
@@ -0,0 +1,384 @@
+package rowaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned when a database was written by a newer version of this program
+var ErrSchemaTooNew = errors.New("database schema is newer than this program supports")
+
+// A single step in the schema history
+//
+// Migrations run in order of version, each at most once per database. Never
+// edit a migration that has been released; add a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create roles and policies tables",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// Databases created before versioning already have these tables,
+			// so they are adopted as they are
+			_, err := tx.ExecContext(ctx, `
+			create table if not exists policies(role varchar, control_column varchar, value varchar);
+			create table if not exists roles(role varchar unique);`)
+			return err
+		},
+	},
+	{
+		version:     2,
+		description: "normalize into roles, control_columns, grants and grant_values",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+			alter table roles rename to roles_v1;
+			alter table policies rename to policies_v1;
+
+			create table roles(
+				id integer primary key,
+				role text not null unique
+			);
+			create table control_columns(
+				id integer primary key,
+				name text not null unique
+			);
+			-- One row per role and control column. all_values records an
+			-- __all__ grant; a grant with no values and all_values = 0 grants
+			-- nothing on the column.
+			create table grants(
+				id integer primary key,
+				role_id integer not null references roles(id) on delete cascade,
+				column_id integer not null references control_columns(id) on delete cascade,
+				all_values integer not null default 0,
+				unique (role_id, column_id)
+			);
+			create table grant_values(
+				grant_id integer not null references grants(id) on delete cascade,
+				value text not null,
+				position integer not null,
+				primary key (grant_id, value)
+			);
+			create index grants_column_role on grants(column_id, role_id, all_values);
+			create index grant_values_position on grant_values(grant_id, position, value);
+
+			insert into roles (role)
+			select role from roles_v1 where role is not null order by rowid;
+
+			insert into control_columns (name)
+			select p.control_column from policies_v1 p join roles r on r.role = p.role
+			where p.control_column is not null
+			group by p.control_column order by min(p.rowid);
+
+			-- Rows for roles missing from the roles table are orphans, and
+			-- are dropped
+			insert into grants (role_id, column_id, all_values)
+			select r.id, c.id, max(coalesce(p.value = '__all__', 0))
+			from policies_v1 p
+			join roles r on r.role = p.role
+			join control_columns c on c.name = p.control_column
+			group by r.id, c.id order by min(p.rowid);
+
+			insert or ignore into grant_values (grant_id, value, position)
+			select g.id, p.value, p.rowid
+			from policies_v1 p
+			join roles r on r.role = p.role
+			join control_columns c on c.name = p.control_column
+			join grants g on g.role_id = r.id and g.column_id = c.id
+			where p.value is not null and p.value != '__all__'
+			order by p.rowid;
+
+			drop table policies_v1;
+			drop table roles_v1;
+
+			-- The flat view of the grants that the policies table used to hold
+			create view policies(role, control_column, value) as
+			select r.role, c.name, '__all__'
+			from grants g
+			join roles r on r.id = g.role_id
+			join control_columns c on c.id = g.column_id
+			where g.all_values
+			union all
+			select r.role, c.name, v.value
+			from grants g
+			join roles r on r.id = g.role_id
+			join control_columns c on c.id = g.column_id
+			left join grant_values v on v.grant_id = g.id
+			where v.value is not null or not g.all_values;`)
+			return err
+		},
+	},
+	{
+		version:     3,
+		description: "add change_log for grants and revokes",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+			-- One row per value granted or revoked by ApplyChanges. Loads are
+			-- not logged, as the config they load from is the record.
+			create table change_log(
+				id integer primary key,
+				changed_at text not null default (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+				role text not null,
+				control_column text not null,
+				op text not null check (op in ('grant', 'revoke')),
+				value text not null
+			);`)
+			return err
+		},
+	},
+	{
+		version:     4,
+		description: "log roles created and dropped in change_log",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+			-- SQLite cannot alter a check constraint, so the table is rebuilt.
+			-- Creating and dropping a role has no column or value.
+			create table change_log_v4(
+				id integer primary key,
+				changed_at text not null default (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+				role text not null,
+				control_column text,
+				op text not null check (op in ('grant', 'revoke', 'create', 'drop')),
+				value text,
+				check ((op in ('grant', 'revoke')) = (control_column is not null and value is not null))
+			);
+			insert into change_log_v4 select * from change_log;
+			drop table change_log;
+			alter table change_log_v4 rename to change_log;`)
+			return err
+		},
+	},
+	{
+		version:     5,
+		description: "add role_extends for role inheritance",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+			-- The roles a role extends, in order of precedence. Parents are
+			-- held by name, so a role may extend one that has been deleted;
+			-- that is reported when the role is resolved.
+			create table role_extends(
+				role_id integer not null references roles(id) on delete cascade,
+				parent text not null,
+				position integer not null,
+				primary key (role_id, parent)
+			);
+			create index role_extends_parent on role_extends(parent);`)
+			return err
+		},
+	},
+	{
+		version:     6,
+		description: "add users and user_roles",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+			create table users(
+				id integer primary key,
+				name text not null unique
+			);
+			-- The roles a user is a member of, in order. As with role_extends,
+			-- roles are held by name, so memberships can be loaded before
+			-- the roles are.
+			create table user_roles(
+				user_id integer not null references users(id) on delete cascade,
+				role text not null,
+				position integer not null,
+				primary key (user_id, role)
+			);
+			create index user_roles_role on user_roles(role);`)
+			return err
+		},
+	},
+	{
+		version:     7,
+		description: "add settings",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// Settings of the database as a whole, e.g. combine_mode, which
+			// loads and syncs leave alone
+			_, err := tx.ExecContext(ctx, `
+			create table settings(
+				name text primary key,
+				value text not null
+			);`)
+			return err
+		},
+	},
+	{
+		version:     8,
+		description: "add grant_exceptions and role_denials",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+			-- The values an __all__ grant leaves out
+			create table grant_exceptions(
+				grant_id integer not null references grants(id) on delete cascade,
+				value text not null,
+				position integer not null,
+				primary key (grant_id, value)
+			);
+			-- The values of a column a role may never see, one row per value,
+			-- in the order of the role's deny items and their values
+			create table role_denials(
+				role_id integer not null references roles(id) on delete cascade,
+				column_id integer not null references control_columns(id) on delete cascade,
+				value text not null,
+				position integer not null,
+				primary key (role_id, column_id, value)
+			);
+			create index role_denials_column on role_denials(column_id);`)
+			return err
+		},
+	},
+	{
+		version:     9,
+		description: "add match_kind to grants and role_denials",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// How a grant's values match, empty for exact. A role's denials
+			// of one column share the match of its deny item.
+			_, err := tx.ExecContext(ctx, `
+			alter table grants add column match_kind text not null default '';
+			alter table role_denials add column match_kind text not null default '';`)
+			return err
+		},
+	},
+}
+
+// Return the schema version this program writes and understands
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Return the schema version recorded in the database
+//
+// Databases with no recorded version, either empty or created before
+// versioning was introduced, are at version 0.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	return schemaVersion(ctx, db)
+}
+
+// Run any pending migrations in a single transaction
+//
+// Returns the schema version before and after migrating. Databases from a
+// newer version of this program are refused with ErrSchemaTooNew.
+func MigrateDb(ctx context.Context, db *sql.DB) (int, int, error) {
+	var from, to int
+	err := withTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		from, to, err = migrateTx(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+// Open a database file, migrating it to the latest schema version
+//
+// Empty databases are left empty, so that they can be initialized and loaded
+// in one transaction with InitDbWithPolicies.
+func OpenDb(ctx context.Context, fname string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", DbDsn(fname))
+	if err != nil {
+		return nil, err
+	}
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = upgradeDb(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Return the data source name for a database file, with the connection
+// settings the schema relies on
+//
+// Foreign keys are enforced per connection in SQLite, so every connection
+// must be opened with them turned on for deletes to cascade. The name is
+// escaped, so that a # or ? in it is not read as part of the URI.
+func DbDsn(fname string) string {
+	return "file:" + dsn_escaper.Replace(fname) + "?_pragma=foreign_keys(1)"
+}
+
+var dsn_escaper = strings.NewReplacer("%", "%25", "#", "%23", "?", "%3F")
+
+func upgradeDb(ctx context.Context, db *sql.DB) error {
+	empty, err := dbIsEmpty(ctx, db)
+	if err != nil {
+		return err
+	}
+	if empty {
+		return nil
+	}
+	_, _, err = MigrateDb(ctx, db)
+	return err
+}
+
+func migrateTx(ctx context.Context, tx *sql.Tx) (int, int, error) {
+	if _, err := tx.ExecContext(ctx, "create table if not exists schema_version(version integer not null)"); err != nil {
+		return 0, 0, err
+	}
+	from, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > LatestSchemaVersion() {
+		return 0, 0, fmt.Errorf("%w: database is at version %d, latest supported is %d", ErrSchemaTooNew, from, LatestSchemaVersion())
+	}
+	to := from
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		if err := m.up(ctx, tx); err != nil {
+			return 0, 0, fmt.Errorf("migrating to version %d (%s): %w", m.version, m.description, err)
+		}
+		to = m.version
+	}
+	if to == from {
+		return from, to, nil
+	}
+	if _, err := tx.ExecContext(ctx, "delete from schema_version"); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "insert into schema_version (version) values (?)", to); err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+// Satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func schemaVersion(ctx context.Context, q queryer) (int, error) {
+	var n int
+	if err := q.QueryRowContext(ctx, "select count(*) from sqlite_master where type = 'table' and name = 'schema_version'").Scan(&n); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	if err := q.QueryRowContext(ctx, "select max(version) from schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func dbIsEmpty(ctx context.Context, db *sql.DB) (bool, error) {
+	var n int
+	if err := db.QueryRowContext(ctx, "select count(*) from sqlite_master where type = 'table'").Scan(&n); err != nil {
+		return false, err
+	}
+	return n == 0, nil
+}
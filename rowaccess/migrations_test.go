@@ -0,0 +1,234 @@
+package rowaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Migration %d has version %d, want %d\n", i, m.version, i+1)
+		}
+		if m.description == "" {
+			t.Errorf("Migration %d has no description\n", m.version)
+		}
+	}
+}
+
+func TestSchemaVersionWorks(t *testing.T) {
+	t.Run("Empty db is at version 0", func(t *testing.T) {
+		db := getDbHandle(t)
+		defer db.Close()
+		assertSchemaVersion(t, db, 0)
+	})
+
+	t.Run("Initialized db is at latest version", func(t *testing.T) {
+		db := getInitializedDbHandle(t)
+		defer db.Close()
+		assertSchemaVersion(t, db, LatestSchemaVersion())
+		var tableName string
+		fetchOneRow(t, db, "select name from sqlite_master where type = 'table' and name = 'schema_version'", &tableName)
+	})
+}
+
+func TestMigrateDbWorks(t *testing.T) {
+	t.Run("Migrates empty db", func(t *testing.T) {
+		db := getDbHandle(t)
+		defer db.Close()
+		from, to, err := MigrateDb(t.Context(), db)
+		if err != nil {
+			t.Fatalf("Error migrating db: %v\n", err)
+		}
+		if from != 0 || to != LatestSchemaVersion() {
+			t.Errorf("Migration mismatch: got %d -> %d, want 0 -> %d\n", from, to, LatestSchemaVersion())
+		}
+		if !getDbInitialized(t, db) {
+			t.Error("Db falsely reported as uninitialized after migrating")
+		}
+	})
+
+	t.Run("Migrating twice is a no-op", func(t *testing.T) {
+		db := getInitializedDbHandle(t)
+		defer db.Close()
+		from, to, err := MigrateDb(t.Context(), db)
+		if err != nil {
+			t.Fatalf("Error migrating db: %v\n", err)
+		}
+		if from != LatestSchemaVersion() || to != LatestSchemaVersion() {
+			t.Errorf("Migration mismatch: got %d -> %d, want no change\n", from, to)
+		}
+	})
+
+	t.Run("Adopts unversioned db and keeps its data", func(t *testing.T) {
+		db := getDbHandle(t)
+		defer db.Close()
+		if _, err := db.Exec(`
+		create table policies(role varchar, control_column varchar, value varchar);
+		create table roles(role varchar unique);
+		insert into roles (role) values ('admin');
+		insert into policies (role, control_column, value) values ('admin', 'Region', 'one');`); err != nil {
+			t.Fatalf("Error creating unversioned db: %v\n", err)
+		}
+		if _, _, err := MigrateDb(t.Context(), db); err != nil {
+			t.Fatalf("Error migrating db: %v\n", err)
+		}
+		assertSchemaVersion(t, db, LatestSchemaVersion())
+		policy, err := GetPolicy(t.Context(), db, "admin")
+		if err != nil {
+			t.Fatalf("Error getting policy: %v\n", err)
+		}
+		expected_policy := `{"role":"admin","policy":[{"column":"Region","values":["one"]}]}`
+		if policy.ToJson() != expected_policy {
+			t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+		}
+	})
+
+	t.Run("Failed migration rolls back", func(t *testing.T) {
+		db := getInitializedDbHandle(t)
+		defer db.Close()
+		original := migrations
+		defer func() { migrations = original }()
+		migrations = append(append([]migration{}, original...),
+			migration{
+				version:     LatestSchemaVersion() + 1,
+				description: "create a table",
+				up: func(ctx context.Context, tx *sql.Tx) error {
+					_, err := tx.Exec("create table migration_test(id integer)")
+					return err
+				},
+			},
+			migration{
+				version:     LatestSchemaVersion() + 2,
+				description: "fail",
+				up: func(ctx context.Context, tx *sql.Tx) error {
+					_, err := tx.Exec("this is not sql")
+					return err
+				},
+			},
+		)
+		if _, _, err := MigrateDb(t.Context(), db); err == nil {
+			t.Fatalf("Expected error migrating db, but got none")
+		}
+		assertSchemaVersion(t, db, len(original))
+		var n int
+		fetchOneRow(t, db, "select count(*) from sqlite_master where name = 'migration_test'", &n)
+		if n != 0 {
+			t.Error("Table from failed migration was not rolled back")
+		}
+	})
+}
+
+func TestMigrationNormalizesPolicies(t *testing.T) {
+	// Setup: A database at schema version 1, with duplicate values, an
+	// __all__ grant, an empty column and an orphaned row
+	db := getDbHandle(t)
+	defer db.Close()
+	migrateDbTo(t, db, 1)
+	if _, err := db.Exec(`
+	insert into roles (role) values ('admin'), ('east_mgr');
+	insert into policies (role, control_column, value) values
+		('admin', 'Region', '__all__'),
+		('east_mgr', 'Region', 'Eastern'),
+		('east_mgr', 'State', 'Maine'),
+		('east_mgr', 'State', 'Ohio'),
+		('east_mgr', 'State', 'Maine'),
+		('east_mgr', 'Segment', null),
+		('deleted_mgr', 'Region', 'Western');`); err != nil {
+		t.Fatalf("Error loading version 1 db: %v\n", err)
+	}
+
+	if _, _, err := MigrateDb(t.Context(), db); err != nil {
+		t.Fatalf("Error migrating db: %v\n", err)
+	}
+
+	expected := map[string]string{
+		"admin":    `{"role":"admin","policy":[{"column":"Region","values":["__all__"]}]}`,
+		"east_mgr": `{"role":"east_mgr","policy":[{"column":"Region","values":["Eastern"]},{"column":"State","values":["Maine","Ohio"]},{"column":"Segment","values":[]}]}`,
+	}
+	for role, expected_policy := range expected {
+		policy, err := GetPolicy(t.Context(), db, role)
+		if err != nil {
+			t.Fatalf("Error getting policy: %v\n", err)
+		}
+		if policy.ToJson() != expected_policy {
+			t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+		}
+	}
+	var n int
+	fetchOneRow(t, db, "select count(*) from policies where role = 'deleted_mgr'", &n)
+	if n != 0 {
+		t.Errorf("Orphaned policy rows survived migration")
+	}
+}
+
+func TestNewerSchemaIsRefused(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "newer.db")
+	db, err := OpenDb(t.Context(), fname)
+	if err != nil {
+		t.Fatalf("Error opening db: %v\n", err)
+	}
+	if err := InitDb(t.Context(), db); err != nil {
+		t.Fatalf("Error initializing db: %v\n", err)
+	}
+	if _, err := db.Exec("update schema_version set version = ?", LatestSchemaVersion()+1); err != nil {
+		t.Fatalf("Error updating schema version: %v\n", err)
+	}
+
+	if _, _, err := MigrateDb(t.Context(), db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew migrating db, got %v\n", err)
+	}
+	if err := InitDb(t.Context(), db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew initializing db, got %v\n", err)
+	}
+	db.Close()
+
+	if _, err := OpenDb(t.Context(), fname); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew opening db, got %v\n", err)
+	}
+}
+
+func TestDbNamesAreEscaped(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "dev#1?.db")
+	db, err := OpenDb(t.Context(), fname)
+	if err != nil {
+		t.Fatalf("Error opening db: %v\n", err)
+	}
+	if err := InitDb(t.Context(), db); err != nil {
+		t.Fatalf("Error initializing db: %v\n", err)
+	}
+	db.Close()
+	if _, err := os.Stat(fname); err != nil {
+		t.Errorf("Database not written to %s: %v\n", fname, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dev")); err == nil {
+		t.Errorf("Database written to a truncated name\n")
+	}
+}
+
+// Migrate an empty database to an earlier schema version
+func migrateDbTo(t *testing.T, db *sql.DB, version int) {
+	t.Helper()
+	original := migrations
+	defer func() { migrations = original }()
+	migrations = original[:version]
+	if _, _, err := MigrateDb(t.Context(), db); err != nil {
+		t.Fatalf("Error migrating db to version %d: %v\n", version, err)
+	}
+}
+
+func assertSchemaVersion(t *testing.T, db *sql.DB, want int) {
+	t.Helper()
+	version, err := SchemaVersion(t.Context(), db)
+	if err != nil {
+		t.Fatalf("Error reading schema version: %v\n", err)
+	}
+	if version != want {
+		t.Errorf("Schema version mismatch: got %d, want %d\n", version, want)
+	}
+}
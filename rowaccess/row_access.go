@@ -0,0 +1,590 @@
+// Package rowaccess stores row access policies, which map roles to the values
+// of control columns they may see, and reads them back.
+//
+// Policies are kept in a PolicyStore, backed by SQLite or held in memory.
+package rowaccess
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+
+	_ "modernc.org/sqlite"
+)
+
+// The special value that grants access to every value of a control column
+const AllValues = "__all__"
+
+type PolicySet struct {
+	Policies []Policy `json:"policies"`
+	// The roles each user is a member of; see GetUserPolicy
+	Users []User `json:"users,omitempty"`
+}
+
+type Policy struct {
+	Role string `json:"role"`
+	// The roles this one builds on, in order of precedence; see
+	// EffectivePolicy
+	Extends []string     `json:"extends,omitempty"`
+	Policy  []PolicyItem `json:"policy"`
+	// Values of columns the role may never see, whatever it or any role it
+	// is combined with grants. Deny items have no except list.
+	Deny []PolicyItem `json:"deny,omitempty"`
+}
+
+type PolicyItem struct {
+	Column string `json:"column"`
+	// How the values match the column; empty means MatchExact
+	Match  MatchKind `json:"match,omitempty"`
+	Values []string  `json:"values"`
+	// Values an __all__ grant leaves out, so that every other value,
+	// including ones that appear later, is visible
+	Except []string `json:"except,omitempty"`
+}
+
+// Return a JSON string representation of the policy
+//
+// A role with no policy items is still printed, with an empty policy list, so
+// that it can be told apart from the zero Policy.
+func (p *Policy) ToJson() string {
+	if p.Role == "" && len(p.Policy) == 0 {
+		return "null"
+	}
+	out := *p
+	if out.Policy == nil {
+		out.Policy = []PolicyItem{}
+	}
+	json, err := json.Marshal(out)
+	if err != nil {
+		return "(error marshalling policy)"
+	}
+	return string(json)
+}
+
+// Return a JSON string representation of the policy item
+func (pi *PolicyItem) ToJson() string {
+	if len(pi.Values) == 0 {
+		return "null"
+	}
+	json, err := json.Marshal(pi)
+	if err != nil {
+		return "(error marshalling policy item)"
+	}
+	return string(json)
+}
+
+// Load the role policies from the config file, which is JSON or in the
+// policy language (see DecodePolicyDsl)
+//
+// A file ending in .csv holds only users, as ReadUsersCsv reads them. The
+// file is read once, so it may be a pipe.
+func LoadRolePolicies(fname string) (*PolicySet, error) {
+	if isCsvFile(fname) {
+		users, err := ReadUsersCsvFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		return &PolicySet{Policies: []Policy{}, Users: users}, nil
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if isDslData(data) {
+		policy_set := &PolicySet{Policies: []Policy{}}
+		err := DecodeConfig(bytes.NewReader(data), func(policy Policy) error {
+			policy_set.Policies = append(policy_set.Policies, policy)
+			return nil
+		}, func(user User) error {
+			policy_set.Users = append(policy_set.Users, user)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return policy_set, nil
+	}
+	if err := ValidateConfig(data); err != nil {
+		return nil, err
+	}
+	var policy_set PolicySet
+	if err := json.Unmarshal(data, &policy_set); err != nil {
+		return nil, err
+	}
+	return &policy_set, nil
+}
+
+// Validate the config file against the schema
+func ValidateConfigFile(fname string) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	return ValidateConfig(data)
+}
+
+// Validate a config against the embedded schema
+func ValidateConfig(data []byte) error {
+	var inst any
+	err := json.Unmarshal(data, &inst)
+	if err != nil {
+		return err
+	}
+	schemas, err := getSchemas()
+	if err != nil {
+		return err
+	}
+
+	if err := schemas.policy_set.Validate(inst); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Create the tables at the latest schema version, removing any existing
+// policies
+//
+// This runs in a single transaction, so a failure leaves the database as it
+// was.
+func InitDb(ctx context.Context, db *sql.DB) error {
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		return initDbTx(ctx, tx)
+	})
+}
+
+// Create the tables and load them with the policy set in a single transaction
+//
+// Either the database ends up initialized and fully loaded, or it is left
+// exactly as it was before the call.
+func InitDbWithPolicies(ctx context.Context, db *sql.DB, policy_set *PolicySet) error {
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		if err := initDbTx(ctx, tx); err != nil {
+			return err
+		}
+		_, err := loadPoliciesTx(ctx, tx, policy_set)
+		return err
+	})
+}
+
+func initDbTx(ctx context.Context, tx *sql.Tx) error {
+	if _, _, err := migrateTx(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+	delete from grant_exceptions;
+	delete from grant_values;
+	delete from grants;
+	delete from role_denials;
+	delete from role_extends;
+	delete from roles;
+	delete from user_roles;
+	delete from users;
+	delete from control_columns;`); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run fn inside a transaction, committing if it succeeds and rolling back if
+// it returns an error
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rb_err := tx.Rollback(); rb_err != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rb_err)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// Return true if the database has been initialized at the latest schema
+// version, or the error reading its version
+func DbAlreadyInitialized(ctx context.Context, db *sql.DB) (bool, error) {
+	version, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return false, fmt.Errorf("reading schema version: %w", err)
+	}
+	return version == LatestSchemaVersion(), nil
+}
+
+// Load the database with policies from the config
+//
+// The set is checked with CheckPolicySet before anything is written, and the
+// whole set is loaded in a single transaction: if any role fails to load,
+// none of the set is applied.
+func LoadDbWithPolicies(ctx context.Context, db *sql.DB, policy_set *PolicySet) error {
+	return withTx(ctx, db, func(tx *sql.Tx) error {
+		_, err := loadPoliciesTx(ctx, tx, policy_set)
+		return err
+	})
+}
+
+func loadPoliciesTx(ctx context.Context, tx *sql.Tx, policy_set *PolicySet) (LoadStats, error) {
+	if err := CheckPolicySet(policy_set); err != nil {
+		return LoadStats{}, err
+	}
+	l, err := newLoader(ctx, tx)
+	if err != nil {
+		return LoadStats{}, err
+	}
+	defer l.close()
+	for _, role_policy := range policy_set.Policies {
+		if err := l.loadPolicy(role_policy); err != nil {
+			return LoadStats{}, err
+		}
+	}
+	for _, user := range policy_set.Users {
+		if err := l.loadUser(user); err != nil {
+			return LoadStats{}, err
+		}
+	}
+	return l.finish()
+}
+
+func roleNotFound(role string) error {
+	return fmt.Errorf("%w: %s", ErrRoleNotFound, role)
+}
+
+// Return true if the role name is valid, false otherwise
+//
+// A valid role name must:
+// - Start and end with a letter or number
+// - Contain only letters, numbers, hyphens, and underscores
+// - Be between 1 and 255 characters long
+func IsValidRoleName(role string) bool {
+	return regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]+[a-zA-Z0-9]$`).MatchString(role) && len(role) > 0 && len(role) <= 255
+}
+
+// For a given role, return all policy items
+//
+// The policy's grants are read with a single query, however many control
+// columns and values the role has. The roles it extends, its deny items and
+// its exceptions are each read with one more.
+//
+// Returns an error if the role does not exist.
+func GetPolicy(ctx context.Context, db *sql.DB, role string) (Policy, error) {
+	return getPolicy(ctx, db, role)
+}
+
+// Implemented by both *sql.DB and *sql.Tx
+type rowsQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func getPolicy(ctx context.Context, q rowsQueryer, role string) (Policy, error) {
+	extras, err := getPolicyExtras(ctx, q, "where r.role = ?", role)
+	if err != nil {
+		return Policy{}, err
+	}
+	rows, err := q.QueryContext(ctx, policy_query+`
+		where r.role = ?
+		order by g.id, v.position`, role)
+	if err != nil {
+		return Policy{}, err
+	}
+	defer rows.Close()
+
+	found_role := false
+	var policy Policy
+	err = scanPolicies(rows, extras, func(p Policy) error {
+		found_role = true
+		policy = p
+		return nil
+	})
+	if err != nil {
+		return Policy{}, err
+	}
+	if !found_role {
+		return Policy{}, roleNotFound(role)
+	}
+	return policy, nil
+}
+
+// Call fn with the policy of every role, in order of role name
+//
+// Every policy's grants are read in one pass over a single query, and only
+// one policy is held in memory at a time, though every role's parents, deny
+// items and exceptions are read beforehand. Iteration stops at the first
+// error returned by fn, and that error is returned.
+func GetAllPolicies(ctx context.Context, db *sql.DB, fn func(Policy) error) error {
+	extras, err := getPolicyExtras(ctx, db, "")
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, policy_query+`
+		order by r.role, g.id, v.position`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scanPolicies(rows, extras, fn)
+}
+
+// The parts of policies that are not on the rows of policy_query, keyed by
+// role, or for exceptions by grant
+type policyExtras struct {
+	extends    map[string][]string
+	deny       map[string][]PolicyItem
+	exceptions map[int64][]string
+}
+
+// Return the extras of the roles matching the condition on roles r, which may
+// be empty
+//
+// Each is read with a query of its own, once per role or grant rather than
+// once per row of policy_query.
+func getPolicyExtras(ctx context.Context, q rowsQueryer, condition string, args ...any) (policyExtras, error) {
+	var extras policyExtras
+	var err error
+	if extras.extends, err = getExtends(ctx, q, condition, args...); err != nil {
+		return policyExtras{}, err
+	}
+	if extras.deny, err = getDenials(ctx, q, condition, args...); err != nil {
+		return policyExtras{}, err
+	}
+	if extras.exceptions, err = getGrantExceptions(ctx, q, condition, args...); err != nil {
+		return policyExtras{}, err
+	}
+	return extras, nil
+}
+
+// Return the roles that each role matching the condition extends, in order,
+// keyed by role
+func getExtends(ctx context.Context, q rowsQueryer, condition string, args ...any) (map[string][]string, error) {
+	rows, err := q.QueryContext(ctx, `
+		select r.role, e.parent
+		from roles r
+		join role_extends e on e.role_id = r.id
+		`+condition+`
+		order by e.role_id, e.position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	extends := map[string][]string{}
+	for rows.Next() {
+		var role, parent string
+		if err := rows.Scan(&role, &parent); err != nil {
+			return nil, err
+		}
+		extends[role] = append(extends[role], parent)
+	}
+	return extends, rows.Err()
+}
+
+// Return the deny items of each role matching the condition, in order, keyed
+// by role
+func getDenials(ctx context.Context, q rowsQueryer, condition string, args ...any) (map[string][]PolicyItem, error) {
+	rows, err := q.QueryContext(ctx, `
+		select r.role, c.name, d.value, d.match_kind
+		from roles r
+		join role_denials d on d.role_id = r.id
+		join control_columns c on c.id = d.column_id
+		`+condition+`
+		order by d.role_id, d.position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deny := map[string][]PolicyItem{}
+	for rows.Next() {
+		var role, column, value, match_kind string
+		if err := rows.Scan(&role, &column, &value, &match_kind); err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(deny[role], func(deny_item PolicyItem) bool {
+			return deny_item.Column == column
+		})
+		if i < 0 {
+			i = len(deny[role])
+			deny[role] = append(deny[role], PolicyItem{Column: column, Match: MatchKind(match_kind), Values: []string{}})
+		}
+		deny[role][i].Values = append(deny[role][i].Values, value)
+	}
+	return deny, rows.Err()
+}
+
+// Return the exceptions of each grant of the roles matching the condition, in
+// order, keyed by grant
+func getGrantExceptions(ctx context.Context, q rowsQueryer, condition string, args ...any) (map[int64][]string, error) {
+	rows, err := q.QueryContext(ctx, `
+		select x.grant_id, x.value
+		from roles r
+		join grants g on g.role_id = r.id
+		join grant_exceptions x on x.grant_id = g.id
+		`+condition+`
+		order by x.grant_id, x.position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	exceptions := map[int64][]string{}
+	for rows.Next() {
+		var grant_id int64
+		var value string
+		if err := rows.Scan(&grant_id, &value); err != nil {
+			return nil, err
+		}
+		exceptions[grant_id] = append(exceptions[grant_id], value)
+	}
+	return exceptions, rows.Err()
+}
+
+// Every role joined to its grants and their values, one row per value. Roles
+// with no grants, and grants with no values, still return one row.
+const policy_query = `
+	select r.role, g.id, c.name, g.all_values, g.match_kind, v.value
+	from roles r
+	left join grants g on g.role_id = r.id
+	left join control_columns c on c.id = g.column_id
+	left join grant_values v on v.grant_id = g.id`
+
+// Group the rows of policy_query into policies, calling fn as each one is
+// completed
+//
+// The rows must be ordered by role and then grant, so that each policy's rows
+// are contiguous. Each policy's parents, deny items and exceptions are taken
+// from extras.
+func scanPolicies(rows *sql.Rows, extras policyExtras, fn func(Policy) error) error {
+	var policy Policy
+	var item *PolicyItem
+	var last_grant int64
+	for rows.Next() {
+		var role string
+		var grant_id sql.NullInt64
+		var column sql.NullString
+		var all_values sql.NullBool
+		var match_kind, value sql.NullString
+		if err := rows.Scan(&role, &grant_id, &column, &all_values, &match_kind, &value); err != nil {
+			return err
+		}
+		if role != policy.Role {
+			if policy.Role != "" {
+				if err := fn(policy); err != nil {
+					return err
+				}
+			}
+			policy = Policy{Role: role, Extends: extras.extends[role], Deny: extras.deny[role], Policy: []PolicyItem{}}
+			item = nil
+		}
+		// A role with no grants
+		if !grant_id.Valid {
+			continue
+		}
+		if item == nil || grant_id.Int64 != last_grant {
+			policy.Policy = append(policy.Policy, PolicyItem{Column: column.String, Match: MatchKind(match_kind.String), Values: []string{}})
+			item = &policy.Policy[len(policy.Policy)-1]
+			last_grant = grant_id.Int64
+			if all_values.Bool {
+				item.Values = append(item.Values, AllValues)
+			}
+			item.Except = extras.exceptions[grant_id.Int64]
+		}
+		if value.Valid {
+			item.Values = append(item.Values, value.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if policy.Role != "" {
+		return fn(policy)
+	}
+	return nil
+}
+
+// Return the match to store for the item, which is empty for exact matches
+func storedMatch(policy_item PolicyItem) string {
+	if !policy_item.isPattern() {
+		return ""
+	}
+	return string(policy_item.Match)
+}
+
+// Return a PolicyItem for this role and control column
+//
+// Values are returned in the order they were loaded, after __all__ if the
+// column is granted in full. A column that was loaded with no values returns
+// an item with an empty (non-nil) list of values.
+func GetPolicyItem(ctx context.Context, db *sql.DB, role, column string) (PolicyItem, error) {
+	var column_values []string
+	var match_kind string
+	found_column := false
+	rows, err := db.QueryContext(ctx, `
+		select g.all_values, g.match_kind, v.value
+		from roles r
+		join grants g on g.role_id = r.id
+		join control_columns c on c.id = g.column_id
+		left join grant_values v on v.grant_id = g.id
+		where r.role = ? and c.name = ?
+		order by v.position`, role, column)
+	if err != nil {
+		return PolicyItem{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var all_values bool
+		var v sql.NullString
+		if err = rows.Scan(&all_values, &match_kind, &v); err != nil {
+			return PolicyItem{}, err
+		}
+		if !found_column && all_values {
+			column_values = append(column_values, AllValues)
+		}
+		found_column = true
+		if v.Valid {
+			column_values = append(column_values, v.String)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return PolicyItem{}, err
+	}
+	// If the column isn't in the policy, return an empty policy item
+	if !found_column {
+		return PolicyItem{}, nil
+	}
+	if column_values == nil {
+		column_values = []string{}
+	}
+	except, err := getExceptions(ctx, db, role, column)
+	if err != nil {
+		return PolicyItem{}, err
+	}
+	return PolicyItem{Column: column, Match: MatchKind(match_kind), Values: column_values, Except: except}, nil
+}
+
+// Return the values the role's grant on the column leaves out, in order, or
+// nil if there are none
+func getExceptions(ctx context.Context, db *sql.DB, role, column string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		select x.value
+		from roles r
+		join grants g on g.role_id = r.id
+		join control_columns c on c.id = g.column_id
+		join grant_exceptions x on x.grant_id = g.id
+		where r.role = ? and c.name = ?
+		order by x.position`, role, column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var except []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		except = append(except, value)
+	}
+	return except, rows.Err()
+}
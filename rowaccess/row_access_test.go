@@ -0,0 +1,877 @@
+package rowaccess
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPolicyItemConvertsToJson(t *testing.T) {
+
+	tests := map[string]struct {
+		input  PolicyItem
+		output string
+	}{
+		// NOTE: it might not be best practice to serialize different inputs to
+		// the same output, but it's convenient for the user
+		"Empty policy item":                 {PolicyItem{}, "null"},
+		"Column with no values":             {PolicyItem{Column: "charlie", Values: []string{}}, "null"},
+		"Column with values (typical case)": {PolicyItem{Column: "charlie", Values: []string{"one", "two", "three"}}, `{"column":"charlie","values":["one","two","three"]}`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := test.input.ToJson()
+			if got != test.output {
+				t.Errorf("Policy item mismatch: got %s, want %s\n", got, test.output)
+			}
+		})
+	}
+}
+
+func TestPolicyConvertsToJson(t *testing.T) {
+	// NOTE: __all__ values do not get treated specially in the ToJson() method,
+	// so they are not tested here.
+	tests := map[string]struct {
+		input  Policy
+		output string
+	}{
+		"Empty policy":            {Policy{}, "null"},
+		"Role with no items":      {Policy{Role: "admin"}, `{"role":"admin","policy":[]}`},
+		"Role with empty columns": {Policy{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{}}}}, `{"role":"admin","policy":[{"column":"Region","values":[]}]}`},
+		"Policy with one item (typical case)": {
+			Policy{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "two", "three"}}}},
+			`{"role":"admin","policy":[{"column":"Region","values":["one","two","three"]}]}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := test.input.ToJson()
+			if got != test.output {
+				t.Errorf("Policy mismatch: got %s, want %s\n", got, test.output)
+			}
+		})
+	}
+}
+
+func TestValidateConfigWorks(t *testing.T) {
+	t.Run("Valid config file", func(t *testing.T) {
+		err := ValidateConfigFile("testdata/valid_policy_set.json")
+		if err != nil {
+			t.Errorf("Error validating config file: %v\n", err)
+		}
+	})
+
+	valid_policy_set_tests := map[string]string{
+		"Empty policy set":                               `{"policies":[]}`,
+		"Policy set with one empty policy":               `{"policies":[{"role":"admin", "policy":[]}]}`,
+		"Policy set with one policy item with no values": `{"policies":[{"role":"admin", "policy":[{"column":"Region", "values":[]}]}]}`,
+		"Policy set with one policy item with values":    `{"policies":[{"role":"admin", "policy":[{"column":"Region", "values":["one","two"]}]}]}`,
+	}
+	for name, test := range valid_policy_set_tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateConfig([]byte(test))
+			if err != nil {
+				t.Errorf("Error validating policy set: %v\n", err)
+			}
+		})
+	}
+}
+
+func TestValidateConfigFails(t *testing.T) {
+	t.Run("Invalid config file", func(t *testing.T) {
+		err := ValidateConfigFile("testdata/invalid_policy_set.json")
+		if err == nil {
+			t.Errorf("Expected error validating config file, but got none")
+		}
+	})
+
+	invalid_policy_set_tests := map[string]string{
+		"Missing role key":               `{"policies":[{"oops":"admin", "policy":[{"column":"Region", "values":["one","two"]}]}]}`,
+		"Missing policy key":             `{"policies":[{"role":"admin", "policy_items":[{"column":"Region", "values":["one","two"]}]}]}`,
+		"Just a role (not a policy set)": `{"role":"admin", "policy":[{"column":"Region", "values":["Eastern"]}]}`,
+	}
+	for name, test := range invalid_policy_set_tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateConfig([]byte(test))
+			if err == nil {
+				t.Errorf("Expected error validating config, but got none")
+			}
+		})
+	}
+}
+
+func TestDbInitWorks(t *testing.T) {
+	t.Run("InitDb works", func(t *testing.T) {
+		db := getDbHandle(t)
+		if err := InitDb(t.Context(), db); err != nil {
+			t.Fatalf("Error initializing db: %v\n", err)
+		}
+	})
+
+	for _, table := range []string{"roles", "control_columns", "grants", "grant_values"} {
+		t.Run(fmt.Sprintf("%s table is created", table), func(t *testing.T) {
+			db := getInitializedDbHandle(t)
+			var tableName string
+			fetchOneRow(t, db, fmt.Sprintf("select name from sqlite_master where type = 'table' and name = '%s'", table), &tableName)
+			db.Close()
+		})
+	}
+
+	t.Run("policies view is created", func(t *testing.T) {
+		db := getInitializedDbHandle(t)
+		var tableName string
+		fetchOneRow(t, db, "select name from sqlite_master where type = 'view' and name = 'policies'", &tableName)
+		db.Close()
+	})
+}
+
+func TestDbLoadAddsToDatabase_ManuallyRetrieved(t *testing.T) {
+	// Setup: Load the policy into the database with LoadDbWithPolicies
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}}}}
+	if err := LoadDbWithPolicies(t.Context(), db, &policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+	// Verify the value "one" is in the policies table
+	var value string
+	fetchOneRow(t, db, "select value from policies where role = 'admin' and control_column = 'Region'", &value)
+	if value != "one" {
+		t.Errorf("Value mismatch: got %s, want %s\n", value, "one")
+	}
+	// Verify the role "admin" is in the roles table
+	var role string
+	fetchOneRow(t, db, "select role from roles where role = 'admin'", &role)
+	if role != "admin" {
+		t.Errorf("Role mismatch: got %s, want %s\n", role, "admin")
+	}
+}
+
+func TestGetPolicyWorks_ManuallyLoaded(t *testing.T) {
+	// Setup: Manually load the policy into the database
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	if _, err := db.Exec("insert into roles (id, role) values (1, 'admin')"); err != nil {
+		t.Fatalf("Error inserting role: %v\n", err)
+	}
+	if _, err := db.Exec(`
+	insert into control_columns (id, name) values (1, 'Region');
+	insert into grants (id, role_id, column_id) values (1, 1, 1);
+	insert into grant_values (grant_id, value, position) values (1, 'one', 1);`); err != nil {
+		t.Fatalf("Error inserting policy: %v\n", err)
+	}
+	// Test: Get the policy
+	policy, err := GetPolicy(t.Context(), db, "admin")
+	if err != nil {
+		t.Fatalf("Error getting policy: %v\n", err)
+	}
+	if policy.ToJson() != `{"role":"admin","policy":[{"column":"Region","values":["one"]}]}` {
+		t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), `{"role":"admin","policy":[{"column":"Region","values":["one"]}]}`)
+	}
+}
+
+func TestDbLoadWorks_RoundTrip(t *testing.T) {
+
+	policies := map[string]struct {
+		input  Policy
+		output string
+	}{
+		"Policy with one item": {
+			Policy{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "two", "three"}}}},
+			`{"role":"admin","policy":[{"column":"Region","values":["one","two","three"]}]}`,
+		},
+		"Policy with one __all__ item": {
+			Policy{Role: "east_mgr", Policy: []PolicyItem{{Column: "State", Values: []string{"__all__"}}}},
+			`{"role":"east_mgr","policy":[{"column":"State","values":["__all__"]}]}`,
+		},
+		"Policy with no items": {
+			Policy{Role: "nobody", Policy: []PolicyItem{}},
+			`{"role":"nobody","policy":[]}`,
+		},
+		"Policy with two items": {
+			Policy{Role: "north_mgr", Policy: []PolicyItem{
+				{Column: "Region", Values: []string{"Northern", "Eastern"}},
+				{Column: "State", Values: []string{"WA", "OR", "CA", "ID", "NV"}},
+			}},
+			`{"role":"north_mgr","policy":[{"column":"Region","values":["Northern","Eastern"]},{"column":"State","values":["WA","OR","CA","ID","NV"]}]}`,
+		},
+		"Policy with two items, one __all__ item": {
+			Policy{Role: "north_mgr", Policy: []PolicyItem{
+				{Column: "Region", Values: []string{"Northern", "Eastern"}},
+				{Column: "State", Values: []string{"__all__"}},
+			}},
+			`{"role":"north_mgr","policy":[{"column":"Region","values":["Northern","Eastern"]},{"column":"State","values":["__all__"]}]}`,
+		},
+	}
+
+	for name, test := range policies {
+		t.Run(name, func(t *testing.T) {
+			db := getInitializedDbHandle(t)
+			if err := LoadDbWithPolicies(t.Context(), db, &PolicySet{Policies: []Policy{test.input}}); err != nil {
+				t.Fatalf("Error loading db with policies: %v\n", err)
+			}
+			fetch, err := GetPolicy(t.Context(), db, test.input.Role)
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			if fetch.ToJson() != test.output {
+				t.Errorf("Policy mismatch: got %s, want %s\n", fetch.ToJson(), test.output)
+			}
+			db.Close()
+		})
+	}
+}
+
+func TestGetPolicyWorks(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	if err := LoadDbWithPolicies(t.Context(), db, policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+
+	policy, err := GetPolicy(t.Context(), db, "admin")
+	if err != nil {
+		t.Fatalf("Error getting policy: %v\n", err)
+	}
+	expected_policy := `{"role":"admin","policy":[{"column":"Region","values":["__all__"]},{"column":"State","values":["__all__"]}]}`
+	if policy.ToJson() != expected_policy {
+		t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+	}
+}
+
+func TestDbLoadWorks_RoundTripConfigFile(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	if err := LoadDbWithPolicies(t.Context(), db, policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+
+	exported := PolicySet{}
+	for _, original := range policy_set.Policies {
+		policy, err := GetPolicy(t.Context(), db, original.Role)
+		if err != nil {
+			t.Fatalf("Error getting policy: %v\n", err)
+		}
+		exported.Policies = append(exported.Policies, policy)
+	}
+	if !reflect.DeepEqual(&exported, policy_set) {
+		t.Errorf("Policy set mismatch after round trip:\ngot  %+v\nwant %+v\n", exported, *policy_set)
+	}
+}
+
+func TestGetAllPoliciesWorks(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}, {Column: "State", Values: []string{"__all__"}}}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "nobody", Policy: []PolicyItem{}},
+		{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}, {Column: "State", Values: []string{"Maine", "Ohio"}}}},
+	}}
+	if err := LoadDbWithPolicies(t.Context(), db, &policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+
+	t.Run("Returns every role in order", func(t *testing.T) {
+		var got []Policy
+		err := GetAllPolicies(t.Context(), db, func(p Policy) error {
+			got = append(got, p)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error getting all policies: %v\n", err)
+		}
+		want := []Policy{policy_set.Policies[1], policy_set.Policies[3], policy_set.Policies[2], policy_set.Policies[0]}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Policies mismatch:\ngot  %+v\nwant %+v\n", got, want)
+		}
+	})
+
+	t.Run("Matches GetPolicy", func(t *testing.T) {
+		var got []Policy
+		err := GetAllPolicies(t.Context(), db, func(p Policy) error {
+			got = append(got, p)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error getting all policies: %v\n", err)
+		}
+		for _, p := range got {
+			policy, err := GetPolicy(t.Context(), db, p.Role)
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			if !reflect.DeepEqual(p, policy) {
+				t.Errorf("Policy mismatch: got %s, want %s\n", p.ToJson(), policy.ToJson())
+			}
+		}
+	})
+
+	t.Run("Stops at the first error", func(t *testing.T) {
+		stop := fmt.Errorf("stop")
+		n := 0
+		err := GetAllPolicies(t.Context(), db, func(p Policy) error {
+			n++
+			return stop
+		})
+		if err != stop {
+			t.Errorf("Error mismatch: got %v, want %v\n", err, stop)
+		}
+		if n != 1 {
+			t.Errorf("Callback called %d times, want 1\n", n)
+		}
+	})
+
+	t.Run("Empty db returns nothing", func(t *testing.T) {
+		empty_db := getInitializedDbHandle(t)
+		defer empty_db.Close()
+		err := GetAllPolicies(t.Context(), empty_db, func(p Policy) error {
+			t.Errorf("Unexpected policy: %s\n", p.ToJson())
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error getting all policies: %v\n", err)
+		}
+	})
+}
+
+func TestGetPolicyFailsIfRoleDoesNotExist(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	if err := LoadDbWithPolicies(t.Context(), db, policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+
+	_, err = GetPolicy(t.Context(), db, "does_not_exist")
+	if err == nil {
+		t.Error("Expected error getting policy for role that does not exist, but got none")
+	}
+}
+
+func TestDbAlreadyInitializedWorks(t *testing.T) {
+	t.Run("Uninitialized db not initialized", func(t *testing.T) {
+		db := getDbHandle(t)
+		defer db.Close()
+		is_initialized := getDbInitialized(t, db)
+		if is_initialized {
+			t.Error("Db falsely reported as initialized")
+		}
+	})
+	t.Run("Initialized db initialized", func(t *testing.T) {
+		db := getInitializedDbHandle(t)
+		defer db.Close()
+		is_initialized := getDbInitialized(t, db)
+		if !is_initialized {
+			t.Error("Db falsely reported as uninitialized")
+		}
+	})
+
+	partials := map[string]string{
+		"policies": "create table if not exists policies(role varchar, control_column varchar, value varchar)",
+		"roles":    "create table if not exists roles(role varchar unique)",
+	}
+	for tbl, exec_statment := range partials {
+		t.Run(fmt.Sprintf("Uninitialized if only table is %s", tbl), func(t *testing.T) {
+			db := getDbHandle(t)
+			defer db.Close()
+			if _, err := db.Exec(exec_statment); err != nil {
+				t.Fatalf("Failed to create temporary table %v\n", err)
+			}
+			is_initialized := getDbInitialized(t, db)
+			if is_initialized {
+				t.Errorf("Db reported as initialized but only has %s\n", tbl)
+			}
+		})
+	}
+
+	t.Run("Closed db is an error", func(t *testing.T) {
+		db := getInitializedDbHandle(t)
+		db.Close()
+		if _, err := DbAlreadyInitialized(t.Context(), db); err == nil {
+			t.Error("Expected error checking closed db, but got none")
+		}
+	})
+}
+
+func TestOverwritePolicyWorks(t *testing.T) {
+	// Setup: Two overlapping policy sets
+	overlapping_policy_sets := []PolicySet{
+		{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "two"}}}}}},
+		{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"three", "four"}}}}}},
+	}
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	for _, policy_set := range overlapping_policy_sets {
+		if err := LoadDbWithPolicies(t.Context(), db, &policy_set); err != nil {
+			t.Fatalf("Error loading db with policies: %v\n", err)
+		}
+	}
+
+	// Test: Confirm only last policy set is in database
+	policy, err := GetPolicy(t.Context(), db, "admin")
+	if err != nil {
+		t.Fatalf("Error getting policy: %v\n", err)
+	}
+	expected_policy := `{"role":"admin","policy":[{"column":"Region","values":["three","four"]}]}`
+	if policy.ToJson() != expected_policy {
+		t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+	}
+}
+
+func TestPolicyUploadValidatesRoleNames(t *testing.T) {
+	valid_roles := []string{
+		"admin",
+		"east_mgr",
+		"north_mgr",
+		"pa_sales_manager",
+		"world-advisor",
+		"GLOBAL_EMPIRE_ADMIN",
+		"CaribouGone",
+		"admin1234567890",
+	}
+	invalid_roles := []string{
+		"admin admin",
+		"user@example.com",
+		"",
+		" ",
+		"   ",
+		"-admin",
+		"123admin",
+		"admin-",
+		"@@$$@3%",
+		"admin@@$$@3",
+		"world–advisor", // U+2013, not U+002D
+		strings.Repeat("a", 256),
+		`this_role_has
+a_newline`,
+	}
+	for _, role := range valid_roles {
+		t.Run(fmt.Sprintf("Valid role: %s", role), func(t *testing.T) {
+			if is_valid := IsValidRoleName(role); !is_valid {
+				t.Errorf("Valid role reported as invalid: %s\n", role)
+			}
+		})
+	}
+	for _, role := range invalid_roles {
+		t.Run(fmt.Sprintf("Invalid role: %s", role), func(t *testing.T) {
+			if is_valid := IsValidRoleName(role); is_valid {
+				t.Errorf("Invalid role reported as valid: %s\n", role)
+			}
+		})
+	}
+}
+
+func TestPolicyUploadFailsIfRoleNameIsInvalid(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set := PolicySet{Policies: []Policy{{Role: getInvalidRoleName(), Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "two"}}}}}}
+	if err := LoadDbWithPolicies(t.Context(), db, &policy_set); err == nil {
+		t.Errorf("Expected error loading db with policies, but got none")
+	}
+}
+
+func TestPolicyUploadIsAtomic(t *testing.T) {
+	// Setup: A database with one role already loaded
+	initial_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one", "two"}}}}}}
+
+	failing_sets := map[string]PolicySet{
+		"Invalid role name in the middle of the set": {Policies: []Policy{
+			{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"three"}}}},
+			{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+			{Role: getInvalidRoleName(), Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+			{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+		}},
+		"Insert failure in the middle of the set": {Policies: []Policy{
+			{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"three"}}}},
+			{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+			{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western", getFailingValue()}}}},
+		}},
+	}
+
+	for name, policy_set := range failing_sets {
+		t.Run(name, func(t *testing.T) {
+			db := getInitializedDbHandle(t)
+			defer db.Close()
+			if err := LoadDbWithPolicies(t.Context(), db, &initial_set); err != nil {
+				t.Fatalf("Error loading db with policies: %v\n", err)
+			}
+			injectInsertFailure(t, db)
+			before := dumpDb(t, db)
+
+			if err := LoadDbWithPolicies(t.Context(), db, &policy_set); err == nil {
+				t.Fatalf("Expected error loading db with policies, but got none")
+			}
+
+			after := dumpDb(t, db)
+			if after != before {
+				t.Errorf("Database changed after failed load:\nbefore:\n%s\nafter:\n%s", before, after)
+			}
+		})
+	}
+}
+
+func TestInitDbWithPoliciesIsAtomic(t *testing.T) {
+	t.Run("Successful load initializes db", func(t *testing.T) {
+		db := getDbHandle(t)
+		defer db.Close()
+		policy_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}}}}
+		if err := InitDbWithPolicies(t.Context(), db, &policy_set); err != nil {
+			t.Fatalf("Error initializing db with policies: %v\n", err)
+		}
+		if !getDbInitialized(t, db) {
+			t.Error("Db falsely reported as uninitialized")
+		}
+		policy, err := GetPolicy(t.Context(), db, "admin")
+		if err != nil {
+			t.Fatalf("Error getting policy: %v\n", err)
+		}
+		expected_policy := `{"role":"admin","policy":[{"column":"Region","values":["one"]}]}`
+		if policy.ToJson() != expected_policy {
+			t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+		}
+	})
+
+	t.Run("Failed load leaves db uninitialized", func(t *testing.T) {
+		db := getDbHandle(t)
+		defer db.Close()
+		policy_set := PolicySet{Policies: []Policy{
+			{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}},
+			{Role: getInvalidRoleName(), Policy: []PolicyItem{{Column: "Region", Values: []string{"two"}}}},
+		}}
+		if err := InitDbWithPolicies(t.Context(), db, &policy_set); err == nil {
+			t.Fatalf("Expected error initializing db with policies, but got none")
+		}
+		if getDbInitialized(t, db) {
+			t.Error("Db reported as initialized after failed load")
+		}
+	})
+}
+
+func TestDbLoadDeduplicatesValues(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{
+		{Column: "Region", Values: []string{"one", "two", "one", "three", "two"}},
+	}}}}
+	if err := LoadDbWithPolicies(t.Context(), db, &policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+	var n int
+	fetchOneRow(t, db, "select count(*) from policies where role = 'admin'", &n)
+	if n != 3 {
+		t.Errorf("Row count mismatch: got %d, want %d\n", n, 3)
+	}
+	policy, err := GetPolicy(t.Context(), db, "admin")
+	if err != nil {
+		t.Fatalf("Error getting policy: %v\n", err)
+	}
+	expected_policy := `{"role":"admin","policy":[{"column":"Region","values":["one","two","three"]}]}`
+	if policy.ToJson() != expected_policy {
+		t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+	}
+}
+
+func TestDeletingRoleCascades(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	policy_set, err := LoadRolePolicies("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error loading role policies: %v\n", err)
+	}
+	if err := LoadDbWithPolicies(t.Context(), db, policy_set); err != nil {
+		t.Fatalf("Error loading db with policies: %v\n", err)
+	}
+	if _, err := db.Exec("delete from roles"); err != nil {
+		t.Fatalf("Error deleting roles: %v\n", err)
+	}
+	for _, table := range []string{"grants", "grant_values"} {
+		var n int
+		fetchOneRow(t, db, fmt.Sprintf("select count(*) from %s", table), &n)
+		if n != 0 {
+			t.Errorf("Found %d orphaned rows in %s\n", n, table)
+		}
+	}
+}
+
+func TestPolicyLookupsUseIndexes(t *testing.T) {
+	db := getInitializedDbHandle(t)
+	defer db.Close()
+	queries := map[string]string{
+		"Role lookup": `
+			select c.name from grants g
+			join roles r on r.id = g.role_id
+			join control_columns c on c.id = g.column_id
+			where r.role = 'admin' order by g.id`,
+		"Role and column lookup": `
+			select g.all_values, v.value from roles r
+			join grants g on g.role_id = r.id
+			join control_columns c on c.id = g.column_id
+			left join grant_values v on v.grant_id = g.id
+			where r.role = 'admin' and c.name = 'Region' order by v.position`,
+	}
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			rows, err := db.Query("explain query plan " + query)
+			if err != nil {
+				t.Fatalf("Error explaining query: %v\n", err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id, parent, unused int
+				var detail string
+				if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+					t.Fatalf("Error scanning query plan: %v\n", err)
+				}
+				if strings.HasPrefix(detail, "SCAN") && !strings.Contains(detail, "INDEX") {
+					t.Errorf("Query plan scans a table: %s\n", detail)
+				}
+			}
+		})
+	}
+}
+
+// The number of roles in the generated benchmark database
+const benchmark_roles = 10000
+
+var benchmark_db struct {
+	once sync.Once
+	db   *sql.DB
+	err  error
+}
+
+// Return a database loaded with benchmark_roles generated roles, each with
+// three control columns and 32 values
+//
+// The database is generated once and shared by every benchmark.
+func getBenchmarkDbHandle(b *testing.B) *sql.DB {
+	b.Helper()
+	benchmark_db.once.Do(func() {
+		db, err := sql.Open("sqlite", DbDsn(":memory:"))
+		if err != nil {
+			benchmark_db.err = err
+			return
+		}
+		// Every connection to :memory: is a separate database
+		db.SetMaxOpenConns(1)
+		policy_set := PolicySet{}
+		for i := 0; i < benchmark_roles; i++ {
+			policy := Policy{Role: benchmarkRoleName(i), Policy: []PolicyItem{
+				{Column: "Region", Values: []string{fmt.Sprintf("region_%d", i%4), fmt.Sprintf("region_%d", (i+1)%4)}},
+				{Column: "State", Values: []string{}},
+				{Column: "item_code", Values: []string{}},
+			}}
+			for j := 0; j < 10; j++ {
+				policy.Policy[1].Values = append(policy.Policy[1].Values, fmt.Sprintf("state_%d", (i+j)%50))
+			}
+			for j := 0; j < 20; j++ {
+				policy.Policy[2].Values = append(policy.Policy[2].Values, fmt.Sprintf("sku_%d", (i*7+j)%5000))
+			}
+			policy_set.Policies = append(policy_set.Policies, policy)
+		}
+		benchmark_db.db = db
+		benchmark_db.err = InitDbWithPolicies(context.Background(), db, &policy_set)
+	})
+	if benchmark_db.err != nil {
+		b.Fatalf("Error generating benchmark db: %v\n", benchmark_db.err)
+	}
+	return benchmark_db.db
+}
+
+func benchmarkRoleName(i int) string {
+	return fmt.Sprintf("role_%05d", i)
+}
+
+func BenchmarkGetPolicy(b *testing.B) {
+	db := getBenchmarkDbHandle(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetPolicy(b.Context(), db, benchmarkRoleName(i%benchmark_roles)); err != nil {
+			b.Fatalf("Error getting policy: %v\n", err)
+		}
+	}
+}
+
+// The previous implementation of GetPolicy, which ran one query for the
+// role, one for its columns and one per column, kept as a baseline
+func BenchmarkGetPolicy_QueryPerColumn(b *testing.B) {
+	db := getBenchmarkDbHandle(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		role := benchmarkRoleName(i % benchmark_roles)
+		var exists string
+		if err := db.QueryRow("select role from roles where role = ?", role).Scan(&exists); err != nil {
+			b.Fatalf("Error getting role: %v\n", err)
+		}
+		rows, err := db.Query(`
+			select c.name from grants g
+			join roles r on r.id = g.role_id
+			join control_columns c on c.id = g.column_id
+			where r.role = ? order by g.id`, role)
+		if err != nil {
+			b.Fatalf("Error getting columns: %v\n", err)
+		}
+		var columns []string
+		for rows.Next() {
+			var column string
+			rows.Scan(&column)
+			columns = append(columns, column)
+		}
+		rows.Close()
+		for _, column := range columns {
+			if _, err := GetPolicyItem(b.Context(), db, role, column); err != nil {
+				b.Fatalf("Error getting policy item: %v\n", err)
+			}
+		}
+	}
+}
+
+func BenchmarkGetPolicy_EveryRole(b *testing.B) {
+	db := getBenchmarkDbHandle(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmark_roles; j++ {
+			if _, err := GetPolicy(b.Context(), db, benchmarkRoleName(j)); err != nil {
+				b.Fatalf("Error getting policy: %v\n", err)
+			}
+		}
+	}
+}
+
+func BenchmarkGetAllPolicies(b *testing.B) {
+	db := getBenchmarkDbHandle(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		err := GetAllPolicies(b.Context(), db, func(p Policy) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("Error getting all policies: %v\n", err)
+		}
+		if n != benchmark_roles {
+			b.Fatalf("Role count mismatch: got %d, want %d\n", n, benchmark_roles)
+		}
+	}
+}
+
+func getInvalidRoleName() string {
+	return "-admin"
+}
+
+// A value that makes the insert into `grant_values` fail once
+// injectInsertFailure has been called on the database
+func getFailingValue() string {
+	return "__fail__"
+}
+
+// Install a trigger that aborts any insert of getFailingValue() into
+// grant_values
+func injectInsertFailure(t *testing.T, db *sql.DB) {
+	t.Helper()
+	if _, err := db.Exec(fmt.Sprintf(`
+	create trigger fail_policy_insert before insert on grant_values
+	when new.value = '%s'
+	begin
+		select raise(abort, 'injected failure');
+	end`, getFailingValue())); err != nil {
+		t.Fatalf("Error creating trigger: %v\n", err)
+	}
+}
+
+// Return every row of the roles and policies tables as a string, for
+// comparing database state
+func dumpDb(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var sb strings.Builder
+	queries := []string{
+		"select role from roles order by role",
+		"select role || '|' || control_column || '|' || coalesce(value, '<null>') from policies order by role, control_column, value",
+	}
+	for _, query := range queries {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Fatalf("Error querying db: %v\n", err)
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				rows.Close()
+				t.Fatalf("Error scanning row: %v\n", err)
+			}
+			sb.WriteString(line)
+			sb.WriteString("\n")
+		}
+		rows.Close()
+	}
+	return sb.String()
+}
+
+func getInitializedDbHandle(t *testing.T) *sql.DB {
+	t.Helper()
+	db := getDbHandle(t)
+	if err := InitDb(t.Context(), db); err != nil {
+		db.Close()
+		t.Fatalf("Error initializing db: %v\n", err)
+	}
+	return db
+}
+
+func getDbInitialized(t *testing.T, db *sql.DB) bool {
+	t.Helper()
+	initialized, err := DbAlreadyInitialized(t.Context(), db)
+	if err != nil {
+		t.Fatalf("Error checking db is initialized: %v\n", err)
+	}
+	return initialized
+}
+
+func getDbHandle(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", DbDsn(":memory:"))
+	if err != nil {
+		t.Fatalf("Error opening db: %v\n", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Error pinging db: %v\n", err)
+	}
+
+	return db
+}
+
+func fetchOneRow(t *testing.T, db *sql.DB, query string, dest ...any) {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("Error querying db: %v\n", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		t.Fatalf("No rows found")
+	}
+
+	rows.Scan(dest...)
+	if rows.Next() {
+		t.Fatalf("Found too many rows (expected 1, got >1)")
+	}
+}
@@ -0,0 +1,53 @@
+package rowaccess
+
+import (
+	"bytes"
+	_ "embed"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+//go:embed config_schema.json
+var config_schema []byte
+
+// The URL the embedded schema is registered under. Nothing is fetched from
+// it.
+const config_schema_url = "https://github.com/charlie-gallagher/go-row-access-policies/config_schema.json"
+
+// Return the JSON schema configs are validated against, exactly as embedded
+// in the package
+func ConfigSchema() []byte {
+	return bytes.Clone(config_schema)
+}
+
+// The config schema, and the parts of it that describe a single policy and
+// a single user
+type compiledSchemas struct {
+	policy_set *jsonschema.Schema
+	policy     *jsonschema.Schema
+	user       *jsonschema.Schema
+}
+
+// Return the compiled config schema, which is compiled on first use
+var getSchemas = sync.OnceValues(func() (compiledSchemas, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(config_schema))
+	if err != nil {
+		return compiledSchemas{}, err
+	}
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(config_schema_url, doc); err != nil {
+		return compiledSchemas{}, err
+	}
+	var schemas compiledSchemas
+	if schemas.policy_set, err = c.Compile(config_schema_url); err != nil {
+		return compiledSchemas{}, err
+	}
+	if schemas.policy, err = c.Compile(config_schema_url + "#/properties/policies/items"); err != nil {
+		return compiledSchemas{}, err
+	}
+	if schemas.user, err = c.Compile(config_schema_url + "#/properties/users/items"); err != nil {
+		return compiledSchemas{}, err
+	}
+	return schemas, nil
+})
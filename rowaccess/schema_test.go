@@ -0,0 +1,55 @@
+package rowaccess
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidationDoesNotNeedSchemaFile(t *testing.T) {
+	config, err := filepath.Abs("testdata/valid_policy_set.json")
+	if err != nil {
+		t.Fatalf("Error getting config path: %v\n", err)
+	}
+	t.Chdir(t.TempDir())
+
+	if err := ValidateConfigFile(config); err != nil {
+		t.Errorf("Error validating config outside the repo: %v\n", err)
+	}
+	policy_set, err := LoadRolePolicies(config)
+	if err != nil {
+		t.Fatalf("Error loading config outside the repo: %v\n", err)
+	}
+	if len(policy_set.Policies) == 0 {
+		t.Errorf("Policy count mismatch: got 0, want more than 0\n")
+	}
+}
+
+func TestConfigSchemaWorks(t *testing.T) {
+	schema := ConfigSchema()
+	var doc map[string]any
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		t.Fatalf("Error parsing config schema: %v\n", err)
+	}
+	if doc["title"] != "Row Access Configuration Schema" {
+		t.Errorf("Schema title mismatch: got %v, want %s\n", doc["title"], "Row Access Configuration Schema")
+	}
+
+	t.Run("Schema is a copy", func(t *testing.T) {
+		schema[0] = 'x'
+		if ConfigSchema()[0] != '{' {
+			t.Errorf("Changing the returned schema changed the embedded schema\n")
+		}
+	})
+
+	t.Run("Schema is compiled once", func(t *testing.T) {
+		first, err := getSchemas()
+		if err != nil {
+			t.Fatalf("Error compiling schema: %v\n", err)
+		}
+		second, _ := getSchemas()
+		if first.policy_set != second.policy_set || first.policy != second.policy {
+			t.Errorf("Schema was compiled more than once\n")
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package rowaccess
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Return a SQL condition that is true for the rows the policy lets its role
+// see, for use in a WHERE clause
+//
+// Each control column is a column of the same name. A column granted
+// __all__ adds no condition, and a column with no values matches nothing.
+// A role with no policy items sees nothing, so its condition is FALSE.
+// Excepted and denied values are ruled out with NOT IN, which still lets
+// through rows where the column is NULL, as __all__ does.
+//
+// Prefixes are compared with substr, globs with GLOB and regular
+// expressions with REGEXP, anchored at both ends. SQLite has no REGEXP
+// function of its own, so one must be registered to run a condition with
+// regular expressions.
+func (p *Policy) ToSql() string {
+	if len(p.Policy) == 0 {
+		return "FALSE"
+	}
+	var conditions []string
+	for _, policy_item := range p.Policy {
+		if condition := policy_item.ToSql(); condition != "TRUE" {
+			conditions = append(conditions, condition)
+		}
+	}
+	conditions = append(conditions, denySql(p.Deny)...)
+	if len(conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// Return a SQL condition for each deny item that is true for the values it
+// does not deny
+func denySql(deny []PolicyItem) []string {
+	var conditions []string
+	for _, deny_item := range deny {
+		if deny_item.isPattern() {
+			column := quoteSqlIdentifier(deny_item.Column)
+			conditions = append(conditions, "("+column+" IS NULL OR NOT "+deny_item.patternSql()+")")
+		} else {
+			conditions = append(conditions, notInSql(deny_item.Column, deny_item.Values))
+		}
+	}
+	return conditions
+}
+
+// Return a SQL condition that is true for the values of the column the
+// policy item grants
+func (pi *PolicyItem) ToSql() string {
+	if pi.isPattern() {
+		return pi.patternSql()
+	}
+	values := []string{}
+	for _, value := range pi.Values {
+		if value == AllValues {
+			if len(pi.Except) > 0 {
+				return notInSql(pi.Column, pi.Except)
+			}
+			return "TRUE"
+		}
+		values = append(values, quoteSqlString(value))
+	}
+	if len(values) == 0 {
+		return "FALSE"
+	}
+	return quoteSqlIdentifier(pi.Column) + " IN (" + strings.Join(values, ", ") + ")"
+}
+
+// Return a SQL condition that is true for the values the item's patterns
+// match
+func (pi *PolicyItem) patternSql() string {
+	column := quoteSqlIdentifier(pi.Column)
+	var conditions []string
+	switch pi.matchKind() {
+	case MatchPrefix:
+		// Prefixes of the same length share one IN, in the order of the
+		// first of each length
+		var lengths []int
+		by_length := map[int][]string{}
+		for _, prefix := range pi.Values {
+			n := utf8.RuneCountInString(prefix)
+			if _, ok := by_length[n]; !ok {
+				lengths = append(lengths, n)
+			}
+			by_length[n] = append(by_length[n], quoteSqlString(prefix))
+		}
+		for _, n := range lengths {
+			conditions = append(conditions, fmt.Sprintf("substr(%s, 1, %d) IN (%s)", column, n, strings.Join(by_length[n], ", ")))
+		}
+	case MatchGlob:
+		for _, glob := range pi.Values {
+			conditions = append(conditions, column+" GLOB "+quoteSqlString(glob))
+		}
+	case MatchRegex:
+		for _, pattern := range pi.Values {
+			conditions = append(conditions, column+" REGEXP "+quoteSqlString("^(?:"+pattern+")$"))
+		}
+	}
+	switch len(conditions) {
+	case 0:
+		return "FALSE"
+	case 1:
+		return conditions[0]
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// Return a SQL condition that is true unless the column has one of the
+// values
+func notInSql(column string, values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quoteSqlString(value)
+	}
+	column = quoteSqlIdentifier(column)
+	return "(" + column + " IS NULL OR " + column + " NOT IN (" + strings.Join(quoted, ", ") + "))"
+}
+
+func quoteSqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteSqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,141 @@
+package rowaccess
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"modernc.org/sqlite"
+)
+
+// SQLite has no REGEXP function of its own; X REGEXP Y calls regexp(Y, X)
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, ok_pattern := args[0].(string)
+		value, ok_value := args[1].(string)
+		if !ok_pattern || !ok_value {
+			return nil, nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("regexp: %w", err)
+		}
+		return re.MatchString(value), nil
+	})
+}
+
+func TestPolicyConvertsToSql(t *testing.T) {
+	policies := map[string]struct {
+		input  Policy
+		output string
+	}{
+		"One column": {
+			Policy{Role: "pa_mgr", Policy: []PolicyItem{{Column: "State", Values: []string{"Pennsylvania"}}}},
+			`"State" IN ('Pennsylvania')`,
+		},
+		"Two columns": {
+			Policy{Role: "ne_mgr", Policy: []PolicyItem{
+				{Column: "Region", Values: []string{"Northern", "Eastern"}},
+				{Column: "State", Values: []string{"Maine", "Vermont"}},
+			}},
+			`"Region" IN ('Northern', 'Eastern') AND "State" IN ('Maine', 'Vermont')`,
+		},
+		"__all__ adds no condition": {
+			Policy{Role: "east_mgr", Policy: []PolicyItem{
+				{Column: "Region", Values: []string{"Eastern"}},
+				{Column: "State", Values: []string{"__all__"}},
+			}},
+			`"Region" IN ('Eastern')`,
+		},
+		"Only __all__": {
+			Policy{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+			`TRUE`,
+		},
+		"No policy items": {
+			Policy{Role: "nobody", Policy: []PolicyItem{}},
+			`FALSE`,
+		},
+		"Column with no values": {
+			Policy{Role: "nobody", Policy: []PolicyItem{{Column: "Region", Values: []string{}}}},
+			`FALSE`,
+		},
+		"__all__ with exceptions": {
+			Policy{Role: "not_ca", Policy: []PolicyItem{{Column: "State", Values: []string{"__all__"}, Except: []string{"California", "Texas"}}}},
+			`("State" IS NULL OR "State" NOT IN ('California', 'Texas'))`,
+		},
+		"Denied values": {
+			Policy{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}, Deny: []PolicyItem{{Column: "State", Values: []string{"Maine"}}}},
+			`"Region" IN ('Eastern') AND ("State" IS NULL OR "State" NOT IN ('Maine'))`,
+		},
+		"Denied values do not open up a role with no policy items": {
+			Policy{Role: "nobody", Policy: []PolicyItem{}, Deny: []PolicyItem{{Column: "State", Values: []string{"Maine"}}}},
+			`FALSE`,
+		},
+		"Prefixes": {
+			Policy{Role: "sku_reader", Policy: []PolicyItem{{Column: "item_code", Match: MatchPrefix, Values: []string{"SKU-12", "AB", "SKU-34"}}}},
+			`(substr("item_code", 1, 6) IN ('SKU-12', 'SKU-34') OR substr("item_code", 1, 2) IN ('AB'))`,
+		},
+		"One glob": {
+			Policy{Role: "sku_reader", Policy: []PolicyItem{{Column: "item_code", Match: MatchGlob, Values: []string{"SKU-1?"}}}},
+			`"item_code" GLOB 'SKU-1?'`,
+		},
+		"Regular expressions are anchored": {
+			Policy{Role: "sku_reader", Policy: []PolicyItem{{Column: "item_code", Match: MatchRegex, Values: []string{`SKU-\d+`, "O'Neil|AB"}}}},
+			`("item_code" REGEXP '^(?:SKU-\d+)$' OR "item_code" REGEXP '^(?:O''Neil|AB)$')`,
+		},
+		"Denied prefix": {
+			Policy{Role: "sku_reader", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}, Deny: []PolicyItem{{Column: "item_code", Match: MatchPrefix, Values: []string{"SKU-9"}}}},
+			`("item_code" IS NULL OR NOT substr("item_code", 1, 5) IN ('SKU-9'))`,
+		},
+		"Quotes are escaped": {
+			Policy{Role: "admin", Policy: []PolicyItem{{Column: `odd "column"`, Values: []string{"O'Brien"}}}},
+			`"odd ""column""" IN ('O''Brien')`,
+		},
+	}
+	for name, test := range policies {
+		t.Run(name, func(t *testing.T) {
+			if got := test.input.ToSql(); got != test.output {
+				t.Errorf("SQL mismatch: got %s, want %s\n", got, test.output)
+			}
+		})
+	}
+}
+
+func TestPolicySqlFiltersRows(t *testing.T) {
+	db := getDbHandle(t)
+	defer db.Close()
+	if _, err := db.Exec(`
+	create table sales(id integer, "Region" text, "State" text);
+	insert into sales values
+		(1, 'Eastern', 'Pennsylvania'),
+		(2, 'Eastern', 'Maine'),
+		(3, 'Western', 'Oregon'),
+		(4, 'Western', null);`); err != nil {
+		t.Fatalf("Error creating sales table: %v\n", err)
+	}
+	policies := map[string]struct {
+		input Policy
+		count int
+	}{
+		"pa_mgr":    {Policy{Role: "pa_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}, {Column: "State", Values: []string{"Pennsylvania"}}}}, 1},
+		"east_mgr":  {Policy{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}, {Column: "State", Values: []string{"__all__"}}}}, 2},
+		"admin":     {Policy{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}}, 4},
+		"nobody":    {Policy{Role: "nobody", Policy: []PolicyItem{}}, 0},
+		"not_maine": {Policy{Role: "not_maine", Policy: []PolicyItem{{Column: "State", Values: []string{"__all__"}, Except: []string{"Maine"}}}}, 3},
+		"no_oregon": {Policy{Role: "no_oregon", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}, Deny: []PolicyItem{{Column: "State", Values: []string{"Oregon"}}}}, 3},
+		"penn":      {Policy{Role: "penn", Policy: []PolicyItem{{Column: "State", Match: MatchPrefix, Values: []string{"Penn", "penn"}}}}, 1},
+		"m_states":  {Policy{Role: "m_states", Policy: []PolicyItem{{Column: "State", Match: MatchGlob, Values: []string{"M*", "[OP]regon"}}}}, 2},
+		"o_or_ma":   {Policy{Role: "o_or_ma", Policy: []PolicyItem{{Column: "State", Match: MatchRegex, Values: []string{`O.*|Ma\w+`}}}}, 2},
+		"no_ore":    {Policy{Role: "no_ore", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}, Deny: []PolicyItem{{Column: "State", Match: MatchPrefix, Values: []string{"Ore"}}}}, 3},
+	}
+	for name, test := range policies {
+		t.Run(name, func(t *testing.T) {
+			var n int
+			fetchOneRow(t, db, "select count(*) from sales where "+test.input.ToSql(), &n)
+			if n != test.count {
+				t.Errorf("Row count mismatch: got %d, want %d\n", n, test.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,696 @@
+package rowaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// A PolicyStore backed by a SQLite database
+//
+// An empty database is left empty until the first load, so that it is
+// initialized and loaded in one transaction. Until then it reads as a store
+// with no roles.
+type SQLiteStore struct {
+	db          *sql.DB
+	initialized atomic.Bool
+}
+
+// Return a store using the database, which should have been opened with
+// OpenDb
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// Return the underlying database
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+// Replace the policy of every role in the set in one transaction, migrating
+// or initializing the database first if needed
+func (s *SQLiteStore) LoadPolicies(ctx context.Context, policy_set *PolicySet) (LoadStats, error) {
+	start := time.Now()
+	var stats LoadStats
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, _, err := migrateTx(ctx, tx); err != nil {
+			return err
+		}
+		var err error
+		stats, err = loadPoliciesTx(ctx, tx, policy_set)
+		return err
+	})
+	if err != nil {
+		return LoadStats{}, err
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// Load the policy set and delete every other role in one transaction, so
+// that the database never holds a mix of old and new roles
+func (s *SQLiteStore) SyncPolicies(ctx context.Context, policy_set *PolicySet) (SyncStats, error) {
+	start := time.Now()
+	var stats SyncStats
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, _, err := migrateTx(ctx, tx); err != nil {
+			return err
+		}
+		// Roles are pruned first, so that the load checks what the roles
+		// extend against only the roles that are kept
+		var err error
+		if stats.Deleted, err = pruneRolesTx(ctx, tx, policy_set); err != nil {
+			return err
+		}
+		if stats.LoadStats, err = loadPoliciesTx(ctx, tx, policy_set); err != nil {
+			return err
+		}
+		// Memberships are held by name, so those in a pruned role, or in a
+		// role the set lists for a user but does not define, are left over
+		_, err = tx.ExecContext(ctx, "delete from user_roles where role not in (select role from roles)")
+		return err
+	})
+	if err != nil {
+		return SyncStats{}, err
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// Delete every role the policy set does not define, returning them in order
+func pruneRolesTx(ctx context.Context, tx *sql.Tx, policy_set *PolicySet) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "select role from roles order by role")
+	if err != nil {
+		return nil, err
+	}
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	deleted := rolesMissingFrom(roles, policy_set)
+	for _, role := range deleted {
+		// Grants and values cascade
+		if _, err := tx.ExecContext(ctx, "delete from roles where role = ?", role); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// Stream a JSON config into the database with LoadDbFromReader
+func (s *SQLiteStore) LoadFrom(ctx context.Context, r io.Reader) (LoadStats, error) {
+	return LoadDbFromReader(ctx, s.db, r)
+}
+
+func (s *SQLiteStore) GetPolicy(ctx context.Context, role string) (Policy, error) {
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return Policy{}, err
+	}
+	if !initialized {
+		return Policy{}, roleNotFound(role)
+	}
+	return GetPolicy(ctx, s.db, role)
+}
+
+func (s *SQLiteStore) ListRoles(ctx context.Context) ([]string, error) {
+	roles := []string{}
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		return roles, nil
+	}
+	rows, err := s.db.QueryContext(ctx, "select role from roles order by role")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *SQLiteStore) GetUser(ctx context.Context, user string) (User, error) {
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	if !initialized {
+		return User{}, userNotFound(user)
+	}
+	// A user with no roles still returns one row, with a null role
+	rows, err := s.db.QueryContext(ctx, `
+		select m.role
+		from users u
+		left join user_roles m on m.user_id = u.id
+		where u.name = ?
+		order by m.position`, user)
+	if err != nil {
+		return User{}, err
+	}
+	defer rows.Close()
+	var u *User
+	for rows.Next() {
+		var role sql.NullString
+		if err := rows.Scan(&role); err != nil {
+			return User{}, err
+		}
+		if u == nil {
+			u = &User{Name: user, Roles: []string{}}
+		}
+		if role.Valid {
+			u.Roles = append(u.Roles, role.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return User{}, err
+	}
+	if u == nil {
+		return User{}, userNotFound(user)
+	}
+	return *u, nil
+}
+
+func (s *SQLiteStore) ListUsers(ctx context.Context) ([]string, error) {
+	users := []string{}
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		return users, nil
+	}
+	rows, err := s.db.QueryContext(ctx, "select name from users order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteStore) GetCombineMode(ctx context.Context) (CombineMode, error) {
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !initialized {
+		return "", nil
+	}
+	var mode string
+	err = s.db.QueryRowContext(ctx, "select value from settings where name = 'combine_mode'").Scan(&mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return CombineMode(mode), err
+}
+
+// Set the combination mode, migrating or initializing the database first if
+// needed
+func (s *SQLiteStore) SetCombineMode(ctx context.Context, mode CombineMode) error {
+	if _, err := ParseCombineMode(string(mode)); err != nil {
+		return err
+	}
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, _, err := migrateTx(ctx, tx); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			insert into settings(name, value) values ('combine_mode', ?)
+			on conflict (name) do update set value = excluded.value`, string(mode))
+		return err
+	})
+}
+
+func (s *SQLiteStore) ListColumns(ctx context.Context) ([]string, error) {
+	columns := []string{}
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		return columns, nil
+	}
+	// Columns stay in control_columns after the last grant or denial on
+	// them is deleted, so only those still in use are listed
+	rows, err := s.db.QueryContext(ctx, `
+	select name from control_columns c
+	where exists (select 1 from grants g where g.column_id = c.id)
+		or exists (select 1 from role_denials d where d.column_id = c.id)
+	order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+func (s *SQLiteStore) GetAllPolicies(ctx context.Context, fn func(Policy) error) error {
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return nil
+	}
+	return GetAllPolicies(ctx, s.db, fn)
+}
+
+// Delete the role, whose grants and values cascade
+func (s *SQLiteStore) DeleteRole(ctx context.Context, role string) error {
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return roleNotFound(role)
+	}
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "delete from roles where role = ?", role)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return roleNotFound(role)
+		}
+		// Memberships are held by name, so they do not cascade
+		if _, err = tx.ExecContext(ctx, "delete from user_roles where role = ?", role); err != nil {
+			return err
+		}
+		return checkNotExtendedTx(ctx, tx, []string{role})
+	})
+}
+
+// Return ErrRoleExtended if a role left in the database extends one of the
+// deleted roles
+func checkNotExtendedTx(ctx context.Context, tx *sql.Tx, deleted []string) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	extends, err := getExtends(ctx, tx, "")
+	if err != nil {
+		return err
+	}
+	return checkNotExtended(extends, deleted)
+}
+
+// Rename the role in place, so its grants are untouched, and point the
+// roles that extend it and its members at the new name
+func (s *SQLiteStore) RenameRole(ctx context.Context, role, new_role string) error {
+	if err := checkNewRoleName(new_role); err != nil {
+		return err
+	}
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return roleNotFound(role)
+	}
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := roleId(ctx, tx, role); err != nil {
+			return err
+		}
+		if err := checkRoleIsFree(ctx, tx, new_role); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "update roles set role = ? where role = ?", new_role, role); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "update role_extends set parent = ? where parent = ?", new_role, role); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "update user_roles set role = ? where role = ?", new_role, role); err != nil {
+			return err
+		}
+		// A role may already extend the new name, closing a cycle
+		return checkExtendsTx(ctx, tx)
+	})
+}
+
+// Copy the role's grants, values, exceptions, denials and the roles it
+// extends to a new role in one transaction, keeping their order
+func (s *SQLiteStore) CloneRole(ctx context.Context, role, new_role string) error {
+	if err := checkNewRoleName(new_role); err != nil {
+		return err
+	}
+	initialized, err := s.isInitialized(ctx)
+	if err != nil {
+		return err
+	}
+	if !initialized {
+		return roleNotFound(role)
+	}
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		role_id, err := roleId(ctx, tx, role)
+		if err != nil {
+			return err
+		}
+		if err := checkRoleIsFree(ctx, tx, new_role); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "insert into roles(role) values (?)", new_role)
+		if err != nil {
+			return err
+		}
+		new_role_id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			insert into role_extends(role_id, parent, position)
+			select ?, parent, position from role_extends
+			where role_id = ?`, new_role_id, role_id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			insert into grants(role_id, column_id, all_values, match_kind)
+			select ?, column_id, all_values, match_kind from grants
+			where role_id = ?
+			order by id`, new_role_id, role_id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			insert into grant_values(grant_id, value, position)
+			select new_g.id, v.value, v.position
+			from grants g
+			join grants new_g on new_g.role_id = ? and new_g.column_id = g.column_id
+			join grant_values v on v.grant_id = g.id
+			where g.role_id = ?`, new_role_id, role_id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			insert into grant_exceptions(grant_id, value, position)
+			select new_g.id, x.value, x.position
+			from grants g
+			join grants new_g on new_g.role_id = ? and new_g.column_id = g.column_id
+			join grant_exceptions x on x.grant_id = g.id
+			where g.role_id = ?`, new_role_id, role_id); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, `
+			insert into role_denials(role_id, column_id, value, position, match_kind)
+			select ?, column_id, value, position, match_kind from role_denials
+			where role_id = ?`, new_role_id, role_id); err != nil {
+			return err
+		}
+		// A role may already extend the new name, closing a cycle
+		return checkExtendsTx(ctx, tx)
+	})
+}
+
+// Return the id of the role, or ErrRoleNotFound
+func roleId(ctx context.Context, tx *sql.Tx, role string) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "select id from roles where role = ?", role).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, roleNotFound(role)
+	}
+	return id, err
+}
+
+// Return ErrRoleExists if the role is in the database
+func checkRoleIsFree(ctx context.Context, tx *sql.Tx, role string) error {
+	_, err := roleId(ctx, tx, role)
+	if err == nil {
+		return roleExists(role)
+	}
+	if errors.Is(err, ErrRoleNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Return true once the database has been initialized, which is then
+// remembered for the life of the store
+func (s *SQLiteStore) isInitialized(ctx context.Context) (bool, error) {
+	if s.initialized.Load() {
+		return true, nil
+	}
+	initialized, err := DbAlreadyInitialized(ctx, s.db)
+	if err != nil {
+		return false, err
+	}
+	if initialized {
+		s.initialized.Store(true)
+	}
+	return initialized, nil
+}
+
+// Grant and revoke values and create and drop roles in one transaction,
+// writing only the grants and values that change, and logging each change
+// in change_log
+func (s *SQLiteStore) ApplyChanges(ctx context.Context, changes []PolicyChange) (*Diff, error) {
+	var diff *Diff
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, _, err := migrateTx(ctx, tx); err != nil {
+			return err
+		}
+		before, after, err := planChanges(changes, func(role string) (Policy, error) {
+			return getPolicy(ctx, tx, role)
+		})
+		if err != nil {
+			return err
+		}
+		diff = DiffPolicies(before, after)
+		if diff.Users, err = removedMembersTx(ctx, tx, diff); err != nil {
+			return err
+		}
+		if err := writeDiffTx(ctx, tx, diff, after); err != nil {
+			return err
+		}
+		return checkNotExtendedTx(ctx, tx, removedRoles(diff))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// Return how the members of the roles the diff removes lose them
+func removedMembersTx(ctx context.Context, tx *sql.Tx, diff *Diff) ([]UserDiff, error) {
+	members := map[string][]string{}
+	for _, role := range removedRoles(diff) {
+		rows, err := tx.QueryContext(ctx, `
+			select u.name
+			from user_roles m
+			join users u on u.id = m.user_id
+			where m.role = ?`, role)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var user string
+			if err := rows.Scan(&user); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			members[user] = append(members[user], role)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return removedMemberships(diff, members), nil
+}
+
+// Write the changes in the diff, whose roles have the policies in after,
+// and remove the members of the roles it removes
+func writeDiffTx(ctx context.Context, tx *sql.Tx, diff *Diff, after []Policy) error {
+	new_items := map[[2]string]PolicyItem{}
+	new_deny := map[string][]PolicyItem{}
+	for _, policy := range after {
+		for _, policy_item := range policy.Policy {
+			new_items[[2]string{policy.Role, policy_item.Column}] = policy_item
+		}
+		new_deny[policy.Role] = policy.Deny
+	}
+	for _, role_diff := range diff.Roles {
+		if role_diff.Change != Changed {
+			op := OpCreate
+			if role_diff.Change == Removed {
+				op = OpDrop
+			}
+			if _, err := tx.ExecContext(ctx, "insert into change_log (role, op) values (?, ?)", role_diff.Role, op); err != nil {
+				return err
+			}
+		}
+		if role_diff.Change == Removed {
+			// Grants and their values are deleted with the role, but
+			// memberships are held by name
+			if _, err := tx.ExecContext(ctx, "delete from roles where role = ?", role_diff.Role); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "delete from user_roles where role = ?", role_diff.Role); err != nil {
+				return err
+			}
+			continue
+		}
+		var role_id int64
+		err := tx.QueryRowContext(ctx, `
+			insert into roles (role) values (?)
+			on conflict (role) do update set role = excluded.role
+			returning id`, role_diff.Role).Scan(&role_id)
+		if err != nil {
+			return err
+		}
+		if role_diff.Deny != nil {
+			if err := writeDenialsTx(ctx, tx, role_id, new_deny[role_diff.Role]); err != nil {
+				return err
+			}
+		}
+		for _, column_diff := range role_diff.Columns {
+			policy_item := new_items[[2]string{role_diff.Role, column_diff.Column}]
+			if err := writeColumnDiffTx(ctx, tx, role_id, column_diff, policy_item); err != nil {
+				return err
+			}
+			for _, logged := range []struct {
+				op     GrantOp
+				values []string
+			}{
+				{OpRevoke, column_diff.Removed},
+				{OpGrant, column_diff.Added},
+				// Revoking from __all__ excepts the value, and granting it
+				// again stops excepting it
+				{OpRevoke, column_diff.ExceptAdded},
+				{OpGrant, column_diff.ExceptRemoved},
+			} {
+				for _, value := range logged.values {
+					if _, err := tx.ExecContext(ctx, `
+						insert into change_log (role, control_column, op, value) values (?, ?, ?, ?)`,
+						role_diff.Role, column_diff.Column, logged.op, value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Replace the role's deny items
+func writeDenialsTx(ctx context.Context, tx *sql.Tx, role_id int64, deny []PolicyItem) error {
+	if _, err := tx.ExecContext(ctx, "delete from role_denials where role_id = ?", role_id); err != nil {
+		return err
+	}
+	position := 0
+	for _, deny_item := range deny {
+		column_id, err := columnIdTx(ctx, tx, deny_item.Column)
+		if err != nil {
+			return err
+		}
+		for _, value := range deny_item.Values {
+			position++
+			if _, err := tx.ExecContext(ctx, `
+				insert into role_denials (role_id, column_id, value, position, match_kind) values (?, ?, ?, ?, ?)`,
+				role_id, column_id, value, position, storedMatch(deny_item)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the id of the control column, adding it if needed
+func columnIdTx(ctx context.Context, tx *sql.Tx, column string) (int64, error) {
+	var column_id int64
+	err := tx.QueryRowContext(ctx, `
+		insert into control_columns (name) values (?)
+		on conflict (name) do update set name = excluded.name
+		returning id`, column).Scan(&column_id)
+	return column_id, err
+}
+
+// Write the change to one column of a role, which is left as policy_item
+func writeColumnDiffTx(ctx context.Context, tx *sql.Tx, role_id int64, column_diff ColumnDiff, policy_item PolicyItem) error {
+	column_id, err := columnIdTx(ctx, tx, column_diff.Column)
+	if err != nil {
+		return err
+	}
+	if column_diff.Change == Removed {
+		_, err := tx.ExecContext(ctx, "delete from grants where role_id = ? and column_id = ?", role_id, column_id)
+		return err
+	}
+
+	all_values := slices.Contains(policy_item.Values, AllValues)
+	var grant_id int64
+	err = tx.QueryRowContext(ctx, `
+		insert into grants (role_id, column_id, all_values, match_kind) values (?, ?, ?, ?)
+		on conflict (role_id, column_id) do update set all_values = excluded.all_values, match_kind = excluded.match_kind
+		returning id`, role_id, column_id, all_values, storedMatch(policy_item)).Scan(&grant_id)
+	if err != nil {
+		return err
+	}
+	for _, value := range column_diff.Removed {
+		if _, err := tx.ExecContext(ctx, "delete from grant_values where grant_id = ? and value = ?", grant_id, value); err != nil {
+			return err
+		}
+	}
+	for _, value := range column_diff.Added {
+		if value == AllValues {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `
+			insert into grant_values (grant_id, value, position)
+			select ?, ?, coalesce(max(position), 0) + 1 from grant_values where grant_id = ?`,
+			grant_id, value, grant_id); err != nil {
+			return err
+		}
+	}
+	if len(column_diff.ExceptAdded) == 0 && len(column_diff.ExceptRemoved) == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "delete from grant_exceptions where grant_id = ?", grant_id); err != nil {
+		return err
+	}
+	for i, value := range policy_item.Except {
+		if _, err := tx.ExecContext(ctx, `
+			insert into grant_exceptions (grant_id, value, position) values (?, ?, ?)`,
+			grant_id, value, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
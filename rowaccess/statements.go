@@ -0,0 +1,343 @@
+package rowaccess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// A problem with a statement, at the line and column where it was found,
+// both counted from 1
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Every problem found in a list of statements, in the order they appear
+type SyntaxErrors []*SyntaxError
+
+func (e SyntaxErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, syntax_error := range e {
+		messages[i] = syntax_error.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Parse admin statements into the changes they make, in order
+//
+// There are four statements, each ending in a semicolon:
+//
+//	GRANT Region IN ('Eastern', 'Northern') TO ROLE ne_manager;
+//	REVOKE State IN ('Maine') FROM ROLE ne_manager;
+//	CREATE ROLE ne_manager;
+//	DROP ROLE ne_manager;
+//
+// Keywords are case insensitive. A column is a bare word or is double
+// quoted, as in "Sales Region". Values are single quoted, and a quote
+// within one is doubled. ALL stands for __all__:
+//
+//	GRANT City IN ('Coeur d''Alene') TO ROLE nw_manager; -- a comment
+//	GRANT State IN (ALL) TO ROLE admin;
+//
+// Comments start with -- and run to the end of the line.
+//
+// Parsing stops at the first syntax error. Otherwise the changes are
+// checked with CheckChanges, and every problem is reported at the statement
+// it is in. Either way the error is a SyntaxErrors.
+func ParseStatements(r io.Reader) ([]PolicyChange, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &statementParser{lexer: statementLexer{input: []rune(string(data)), line: 1, column: 1}}
+	var changes []PolicyChange
+	var positions []token
+	for {
+		p.next()
+		if p.err != nil {
+			return nil, SyntaxErrors{p.err}
+		}
+		if p.tok.kind == tokenEOF {
+			break
+		}
+		start := p.tok
+		change := p.statement()
+		if p.err != nil {
+			return nil, SyntaxErrors{p.err}
+		}
+		changes = append(changes, change)
+		positions = append(positions, start)
+	}
+
+	var config_errors ConfigErrors
+	if !errors.As(CheckChanges(changes), &config_errors) {
+		return changes, nil
+	}
+	var syntax_errors SyntaxErrors
+	for _, config_error := range config_errors {
+		var i int
+		fmt.Sscanf(config_error.Pointer, "/%d/", &i)
+		syntax_errors = append(syntax_errors, &SyntaxError{
+			Line:    positions[i].line,
+			Column:  positions[i].column,
+			Message: fmt.Sprintf("%s: %s", strings.ToUpper(string(changes[i].Op)), config_error.Message),
+		})
+	}
+	return nil, syntax_errors
+}
+
+// Parse statements from a file with ParseStatements
+func ParseStatementsFile(fname string) ([]PolicyChange, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseStatements(f)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	// A bare word, which may be a keyword
+	tokenWord
+	// A double quoted name, which is never a keyword
+	tokenName
+	// A single quoted string
+	tokenString
+	// One of ( ) , ;
+	tokenPunct
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	line   int
+	column int
+}
+
+// Describe the token for an error message
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of input"
+	case tokenName:
+		return fmt.Sprintf("%q", t.text)
+	case tokenString:
+		return "'" + strings.ReplaceAll(t.text, "'", "''") + "'"
+	}
+	return t.text
+}
+
+// Return true if the token is the keyword, in any case
+func (t token) is(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+type statementLexer struct {
+	input  []rune
+	pos    int
+	line   int
+	column int
+}
+
+func (l *statementLexer) peek(offset int) rune {
+	if l.pos+offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+offset]
+}
+
+func (l *statementLexer) advance() rune {
+	c := l.input[l.pos]
+	l.pos++
+	if c == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return c
+}
+
+func isWordStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+func isWordPart(c rune) bool {
+	return isWordStart(c) || unicode.IsDigit(c)
+}
+
+// Return the next token, skipping space and comments
+func (l *statementLexer) next() (token, *SyntaxError) {
+	for l.pos < len(l.input) {
+		if c := l.peek(0); unicode.IsSpace(c) {
+			l.advance()
+		} else if c == '-' && l.peek(1) == '-' {
+			for l.pos < len(l.input) && l.peek(0) != '\n' {
+				l.advance()
+			}
+		} else {
+			break
+		}
+	}
+	tok := token{line: l.line, column: l.column}
+	if l.pos >= len(l.input) {
+		return tok, nil
+	}
+
+	c := l.peek(0)
+	switch {
+	case strings.ContainsRune("(),;", c):
+		tok.kind = tokenPunct
+		tok.text = string(l.advance())
+	case isWordStart(c):
+		// Role names may contain single hyphens, e.g. ne-manager
+		var b strings.Builder
+		for isWordPart(l.peek(0)) || (l.peek(0) == '-' && isWordPart(l.peek(1))) {
+			b.WriteRune(l.advance())
+		}
+		tok.kind = tokenWord
+		tok.text = b.String()
+	case c == '\'' || c == '"':
+		text, err := l.quoted(c)
+		if err != nil {
+			return tok, err
+		}
+		tok.kind = tokenString
+		if c == '"' {
+			tok.kind = tokenName
+		}
+		tok.text = text
+	default:
+		return tok, &SyntaxError{tok.line, tok.column, fmt.Sprintf("unexpected character %q", c)}
+	}
+	return tok, nil
+}
+
+// Read text quoted with the quote, in which two quotes stand for one
+func (l *statementLexer) quoted(quote rune) (string, *SyntaxError) {
+	line, column := l.line, l.column
+	l.advance()
+	var b strings.Builder
+	for l.pos < len(l.input) {
+		c := l.advance()
+		if c != quote {
+			b.WriteRune(c)
+		} else if l.peek(0) == quote {
+			b.WriteRune(l.advance())
+		} else {
+			return b.String(), nil
+		}
+	}
+	return "", &SyntaxError{line, column, fmt.Sprintf("unterminated %c", quote)}
+}
+
+type statementParser struct {
+	lexer statementLexer
+	tok   token
+	err   *SyntaxError
+}
+
+// Move to the next token, unless there has been an error
+func (p *statementParser) next() {
+	if p.err == nil {
+		p.tok, p.err = p.lexer.next()
+	}
+}
+
+// Record an error at the current token, unless there already is one
+func (p *statementParser) fail(format string, args ...any) {
+	if p.err == nil {
+		p.err = &SyntaxError{p.tok.line, p.tok.column, fmt.Sprintf(format, args...)}
+	}
+}
+
+// Consume the keyword or punctuation, or fail
+func (p *statementParser) expect(text string) {
+	if p.tok.is(text) || (p.tok.kind == tokenPunct && p.tok.text == text) {
+		p.next()
+		return
+	}
+	p.fail("expected %s, found %s", text, p.tok)
+}
+
+// Consume a column or role name, or fail
+func (p *statementParser) name(what string) string {
+	if p.tok.kind != tokenWord && p.tok.kind != tokenName {
+		p.fail("expected %s, found %s", what, p.tok)
+		return ""
+	}
+	text := p.tok.text
+	p.next()
+	return text
+}
+
+// Parse the statement starting at the current token, stopping at its
+// semicolon
+func (p *statementParser) statement() PolicyChange {
+	var change PolicyChange
+	switch {
+	case p.tok.is("GRANT"), p.tok.is("REVOKE"):
+		change.Op, change.Column, change.Values, change.Role = p.grant()
+	case p.tok.is("CREATE"):
+		change.Op = OpCreate
+		p.next()
+		p.expect("ROLE")
+		change.Role = p.name("role name")
+	case p.tok.is("DROP"):
+		change.Op = OpDrop
+		p.next()
+		p.expect("ROLE")
+		change.Role = p.name("role name")
+	default:
+		p.fail("expected GRANT, REVOKE, CREATE or DROP, found %s", p.tok)
+	}
+	if p.err == nil && (p.tok.kind != tokenPunct || p.tok.text != ";") {
+		p.fail("expected ; at the end of the statement, found %s", p.tok)
+	}
+	return change
+}
+
+// Parse GRANT column IN (values) TO ROLE role, or REVOKE ... FROM ROLE role
+func (p *statementParser) grant() (GrantOp, string, []string, string) {
+	op, preposition := OpGrant, "TO"
+	if p.tok.is("REVOKE") {
+		op, preposition = OpRevoke, "FROM"
+	}
+	p.next()
+	column := p.name("column name")
+	p.expect("IN")
+	p.expect("(")
+	values := []string{}
+	for p.err == nil {
+		switch {
+		case p.tok.kind == tokenString:
+			values = append(values, p.tok.text)
+		case p.tok.is("ALL"):
+			values = append(values, AllValues)
+		default:
+			p.fail("expected a quoted value or ALL, found %s", p.tok)
+		}
+		p.next()
+		if p.tok.kind != tokenPunct || p.tok.text != "," {
+			break
+		}
+		p.next()
+	}
+	p.expect(")")
+	p.expect(preposition)
+	p.expect("ROLE")
+	role := p.name("role name")
+	return op, column, values, role
+}
@@ -0,0 +1,88 @@
+package rowaccess
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStatements(t *testing.T) {
+	input := `-- Give the north east manager the northern region
+GRANT Region IN ('Eastern', 'Northern') TO ROLE ne_manager;
+revoke "State" in ('Maine', 'O''Brien County') from role ne-manager;  -- trailing comment
+CREATE ROLE auditor; grant State in (all) to role auditor;
+DROP ROLE old_manager;
+`
+	expected := []PolicyChange{
+		{Op: OpGrant, Role: "ne_manager", Column: "Region", Values: []string{"Eastern", "Northern"}},
+		{Op: OpRevoke, Role: "ne-manager", Column: "State", Values: []string{"Maine", "O'Brien County"}},
+		{Op: OpCreate, Role: "auditor"},
+		{Op: OpGrant, Role: "auditor", Column: "State", Values: []string{"__all__"}},
+		{Op: OpDrop, Role: "old_manager"},
+	}
+	changes, err := ParseStatements(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error parsing statements: %v\n", err)
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Changes mismatch:\ngot  %+v\nwant %+v\n", changes, expected)
+	}
+	if changes, err := ParseStatements(strings.NewReader("  -- nothing to do\n")); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes from comments alone, got %v, %v\n", changes, err)
+	}
+}
+
+func TestParseStatementsReportsPositions(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected []string
+	}{
+		"Wrong preposition": {
+			"GRANT Region IN ('Eastern')\n  FROM ROLE ne_manager;",
+			[]string{"line 2, column 3: expected TO, found FROM"},
+		},
+		"Missing semicolon": {
+			"CREATE ROLE a_role\nDROP ROLE b_role;",
+			[]string{"line 2, column 1: expected ; at the end of the statement, found DROP"},
+		},
+		"Unknown statement": {
+			"CREATE ROLE a_role;\n\n  ALTER ROLE a_role;",
+			[]string{"line 3, column 3: expected GRANT, REVOKE, CREATE or DROP, found ALTER"},
+		},
+		"Unquoted value": {
+			"GRANT Region IN (Eastern) TO ROLE a_role;",
+			[]string{"line 1, column 18: expected a quoted value or ALL, found Eastern"},
+		},
+		"Unterminated string": {
+			"GRANT Region IN ('Eastern) TO ROLE a_role;",
+			[]string{"line 1, column 18: unterminated '"},
+		},
+		"Unexpected character": {
+			"DROP ROLE a_role;\nDROP ROLE *;",
+			[]string{"line 2, column 11: unexpected character '*'"},
+		},
+		"End of input": {
+			"REVOKE State IN ('Maine') FROM",
+			[]string{"line 1, column 31: expected ROLE, found end of input"},
+		},
+		"Every invalid change": {
+			"GRANT Region IN ('Eastern', ALL) TO ROLE a_role;\nDROP ROLE admin;\nCREATE ROLE \"a role\";",
+			[]string{
+				"line 1, column 1: GRANT: __all__ cannot be mixed with other values",
+				"line 3, column 1: CREATE: invalid role name \"a role\"",
+			},
+		},
+	}
+	for name, test := range tests {
+		_, err := ParseStatements(strings.NewReader(test.input))
+		var syntax_errors SyntaxErrors
+		if !errors.As(err, &syntax_errors) {
+			t.Errorf("%s: expected SyntaxErrors, got %v\n", name, err)
+			continue
+		}
+		if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: errors mismatch: got %q, want %q\n", name, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package rowaccess
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+)
+
+// Returned when a role is not in the store
+var ErrRoleNotFound = errors.New("role does not exist")
+
+// Returned when a role is renamed or cloned to a name already in the store
+var ErrRoleExists = errors.New("role already exists")
+
+// Returned when a role is renamed or cloned to a name IsValidRoleName
+// rejects
+var ErrInvalidRoleName = errors.New("invalid role name")
+
+// A place policies are kept
+//
+// Every implementation must behave the same way: loading a policy replaces
+// the role's existing policy and a user's existing roles, a set with
+// problems found by CheckPolicySet is refused, repeated values are stored
+// once, and a failed load changes nothing.
+type PolicyStore interface {
+	// Replace the policy of every role in the set, all or nothing
+	LoadPolicies(ctx context.Context, policy_set *PolicySet) (LoadStats, error)
+	// Make the store hold exactly the policy set, loading it and deleting
+	// every role it does not define, all or nothing. Users the set does not
+	// list are kept, but no user is left a member of a role the store no
+	// longer defines.
+	SyncPolicies(ctx context.Context, policy_set *PolicySet) (SyncStats, error)
+	// Return the policy of one role, or ErrRoleNotFound
+	GetPolicy(ctx context.Context, role string) (Policy, error)
+	// Return the name of every role, in order
+	ListRoles(ctx context.Context) ([]string, error)
+	// Return the name of every control column some role has a grant on, in
+	// order
+	ListColumns(ctx context.Context) ([]string, error)
+	// Call fn with the policy of every role, in role order, stopping at the
+	// first error
+	GetAllPolicies(ctx context.Context, fn func(Policy) error) error
+	// Remove a role, its policy and its members, or return ErrRoleNotFound.
+	// A role that other roles extend is not deleted: ErrRoleExtended is
+	// returned, naming them.
+	DeleteRole(ctx context.Context, role string) error
+	// Give a role a new name, keeping its policy and pointing the roles that
+	// extend it and the users who are members of it at the new name, or
+	// return ErrRoleNotFound, ErrRoleExists or ErrInvalidRoleName. A role
+	// that already extends the new name may close a cycle, which returns
+	// ErrExtendsCycle.
+	RenameRole(ctx context.Context, role, new_role string) error
+	// Create a new role with a copy of a role's policy, or return
+	// ErrRoleNotFound, ErrRoleExists, ErrInvalidRoleName or, as for
+	// RenameRole, ErrExtendsCycle
+	CloneRole(ctx context.Context, role, new_role string) error
+	// Grant and revoke values and create and drop roles, all or nothing,
+	// returning what changed. Dropping a role removes its members, and the
+	// diff lists them. Revoking from or dropping a role that does not exist
+	// returns ErrRoleNotFound, creating one that does ErrRoleExists, and
+	// dropping one that other roles extend ErrRoleExtended.
+	ApplyChanges(ctx context.Context, changes []PolicyChange) (*Diff, error)
+	// Return a user and the roles they are members of, or ErrUserNotFound
+	GetUser(ctx context.Context, user string) (User, error)
+	// Return the name of every user, in order
+	ListUsers(ctx context.Context) ([]string, error)
+	// Return how the store combines the policies of several roles, or ""
+	// if it has not been set; see StoreCombineMode
+	GetCombineMode(ctx context.Context) (CombineMode, error)
+	// Set how the store combines the policies of several roles
+	SetCombineMode(ctx context.Context, mode CombineMode) error
+	Close() error
+}
+
+// Implemented by stores that can load a JSON config as a stream, without
+// holding the whole policy set in memory
+type StreamLoader interface {
+	LoadFrom(ctx context.Context, r io.Reader) (LoadStats, error)
+}
+
+// Open a store from a specification of the form BACKEND:LOCATION
+//
+// The backends are:
+//   - sqlite:FILE, a SQLite database file, migrated to the latest schema
+//   - mem:, an empty in-memory store that lasts as long as the process
+//
+// A specification with no backend is taken to be a SQLite file.
+func OpenStore(ctx context.Context, spec string) (PolicyStore, error) {
+	backend, location := ParseStoreSpec(spec)
+	switch backend {
+	case "sqlite":
+		if location == "" {
+			return nil, fmt.Errorf("sqlite store needs a file name, e.g. sqlite:policies.db")
+		}
+		db, err := OpenDb(ctx, location)
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLiteStore(db), nil
+	case "mem":
+		if location != "" {
+			return nil, fmt.Errorf("mem store takes no location, use mem:")
+		}
+		return NewMemStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store backend %q", backend)
+}
+
+// Return an error if new_role cannot be given to a role, whether or not it
+// is taken
+func checkNewRoleName(new_role string) error {
+	if !IsValidRoleName(new_role) {
+		return fmt.Errorf("%w: %q", ErrInvalidRoleName, new_role)
+	}
+	return nil
+}
+
+func roleExists(role string) error {
+	return fmt.Errorf("%w: %s", ErrRoleExists, role)
+}
+
+// Split a store specification into its backend and location
+func ParseStoreSpec(spec string) (string, string) {
+	if m := store_spec_regexp.FindStringSubmatch(spec); m != nil {
+		return m[1], m[2]
+	}
+	return "sqlite", spec
+}
+
+var store_spec_regexp = regexp.MustCompile(`^([a-z]+):(.*)$`)
+
+// Load a JSON config file into the store, streaming it if the store supports
+// that
+//
+// A CSV file of users is never streamed.
+func LoadStoreFromFile(ctx context.Context, store PolicyStore, fname string) (LoadStats, error) {
+	if stream_loader, ok := store.(StreamLoader); ok && !isCsvFile(fname) {
+		f, err := os.Open(fname)
+		if err != nil {
+			return LoadStats{}, err
+		}
+		defer f.Close()
+		return stream_loader.LoadFrom(ctx, f)
+	}
+	policy_set, err := LoadRolePolicies(fname)
+	if err != nil {
+		return LoadStats{}, err
+	}
+	return store.LoadPolicies(ctx, policy_set)
+}
+
+// Return the policy as every store holds it: repeated columns merged in the
+// order they first appear, repeated values dropped, __all__ before any other
+// values, repeated parents dropped, and no nil slices but Extends, Deny and
+// Except, which are nil when empty
+func normalizePolicy(policy Policy) Policy {
+	normalized := Policy{Role: policy.Role, Policy: []PolicyItem{}}
+	for _, parent := range policy.Extends {
+		if !slices.Contains(normalized.Extends, parent) {
+			normalized.Extends = append(normalized.Extends, parent)
+		}
+	}
+	normalized.Policy = normalizeItems(policy.Policy)
+	if len(policy.Deny) > 0 {
+		normalized.Deny = normalizeItems(policy.Deny)
+	}
+	return normalized
+}
+
+// Return the policy items normalized as normalizePolicy does, with except
+// lists merged and deduplicated the same way and nil if empty. Items of a
+// column are only merged if they match the same way, and exact matches are
+// left out.
+func normalizeItems(items []PolicyItem) []PolicyItem {
+	normalized := []PolicyItem{}
+	column_index := map[[2]string]int{}
+	seen_values := map[[2]string]map[string]bool{}
+	for _, policy_item := range items {
+		key := [2]string{policy_item.Column, string(policy_item.matchKind())}
+		i, ok := column_index[key]
+		if !ok {
+			i = len(normalized)
+			column_index[key] = i
+			seen_values[key] = map[string]bool{}
+			normalized = append(normalized, PolicyItem{Column: policy_item.Column, Values: []string{}})
+			if policy_item.isPattern() {
+				normalized[i].Match = policy_item.Match
+			}
+		}
+		item := &normalized[i]
+		seen := seen_values[key]
+		for _, value := range policy_item.Values {
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			if value == AllValues {
+				item.Values = append([]string{AllValues}, item.Values...)
+			} else {
+				item.Values = append(item.Values, value)
+			}
+		}
+		for _, value := range policy_item.Except {
+			if !slices.Contains(item.Except, value) {
+				item.Except = append(item.Except, value)
+			}
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,531 @@
+package rowaccess
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Every PolicyStore implementation, opened empty
+func getStoreFactories() map[string]func(t *testing.T) PolicyStore {
+	return map[string]func(t *testing.T) PolicyStore{
+		"sqlite": func(t *testing.T) PolicyStore {
+			t.Helper()
+			store, err := OpenStore(t.Context(), "sqlite:"+filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatalf("Error opening store: %v\n", err)
+			}
+			return store
+		},
+		"mem": func(t *testing.T) PolicyStore {
+			t.Helper()
+			store, err := OpenStore(t.Context(), "mem:")
+			if err != nil {
+				t.Fatalf("Error opening store: %v\n", err)
+			}
+			return store
+		},
+	}
+}
+
+func TestStoresLoadAndGetPolicies(t *testing.T) {
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}, {Column: "State", Values: []string{"__all__"}}}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "nobody", Policy: []PolicyItem{}},
+		{Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"Maine", "Ohio", "Maine", "Vermont"}},
+		}},
+	}}
+	expected := map[string]Policy{
+		"west_mgr": policy_set.Policies[0],
+		"admin":    policy_set.Policies[1],
+		"nobody":   policy_set.Policies[2],
+		"east_mgr": {Role: "east_mgr", Policy: []PolicyItem{
+			{Column: "Region", Values: []string{"Eastern"}},
+			{Column: "State", Values: []string{"Maine", "Ohio", "Vermont"}},
+		}},
+	}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			stats, err := store.LoadPolicies(t.Context(), &policy_set)
+			if err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			if stats.Roles != 4 || stats.Grants != 5 {
+				t.Errorf("Stats mismatch: got %+v\n", stats)
+			}
+			for role, want := range expected {
+				got, err := store.GetPolicy(t.Context(), role)
+				if err != nil {
+					t.Fatalf("Error getting policy: %v\n", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Policy mismatch: got %s, want %s\n", got.ToJson(), want.ToJson())
+				}
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if want := []string{"admin", "east_mgr", "nobody", "west_mgr"}; !reflect.DeepEqual(roles, want) {
+				t.Errorf("Roles mismatch: got %v, want %v\n", roles, want)
+			}
+		})
+	}
+}
+
+func TestStoresReplacePolicies(t *testing.T) {
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			for _, values := range [][]string{{"one", "two"}, {"three"}} {
+				policy_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: values}}}}}
+				if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+					t.Fatalf("Error loading policies: %v\n", err)
+				}
+			}
+			policy, err := store.GetPolicy(t.Context(), "admin")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			expected_policy := `{"role":"admin","policy":[{"column":"Region","values":["three"]}]}`
+			if policy.ToJson() != expected_policy {
+				t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), expected_policy)
+			}
+		})
+	}
+}
+
+func TestStoresLoadAtomically(t *testing.T) {
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			initial_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}}}}
+			if _, err := store.LoadPolicies(t.Context(), &initial_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			failing_set := PolicySet{Policies: []Policy{
+				{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"two"}}}},
+				{Role: "east_mgr", Policy: []PolicyItem{}},
+				{Role: getInvalidRoleName(), Policy: []PolicyItem{}},
+			}}
+			if _, err := store.LoadPolicies(t.Context(), &failing_set); err == nil {
+				t.Fatalf("Expected error loading policies, but got none")
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if want := []string{"admin"}; !reflect.DeepEqual(roles, want) {
+				t.Errorf("Roles mismatch: got %v, want %v\n", roles, want)
+			}
+			policy, err := store.GetPolicy(t.Context(), "admin")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			if !reflect.DeepEqual(policy, initial_set.Policies[0]) {
+				t.Errorf("Policy mismatch: got %s, want %s\n", policy.ToJson(), initial_set.Policies[0].ToJson())
+			}
+		})
+	}
+}
+
+func TestStoresDeleteRoles(t *testing.T) {
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := LoadStoreFromFile(t.Context(), store, "testdata/valid_policy_set.json"); err != nil {
+				t.Fatalf("Error loading store from file: %v\n", err)
+			}
+			if err := store.DeleteRole(t.Context(), "admin"); err != nil {
+				t.Fatalf("Error deleting role: %v\n", err)
+			}
+			if _, err := store.GetPolicy(t.Context(), "admin"); !errors.Is(err, ErrRoleNotFound) {
+				t.Errorf("Expected ErrRoleNotFound getting deleted role, got %v\n", err)
+			}
+			if err := store.DeleteRole(t.Context(), "admin"); !errors.Is(err, ErrRoleNotFound) {
+				t.Errorf("Expected ErrRoleNotFound deleting deleted role, got %v\n", err)
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			for _, role := range roles {
+				if role == "admin" {
+					t.Errorf("Deleted role still listed")
+				}
+			}
+		})
+	}
+}
+
+func TestStoresRenameAndCloneRoles(t *testing.T) {
+	east_mgr := Policy{Role: "east_mgr", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"Maine", "Ohio"}},
+		{Column: "Region", Values: []string{"__all__"}},
+	}}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if err := store.RenameRole(t.Context(), "east_mgr", "east_manager"); !errors.Is(err, ErrRoleNotFound) {
+				t.Errorf("Expected ErrRoleNotFound renaming role in empty store, got %v\n", err)
+			}
+			policy_set := PolicySet{Policies: []Policy{east_mgr, {Role: "admin", Policy: []PolicyItem{}}}}
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+
+			if err := store.CloneRole(t.Context(), "east_mgr", "east_deputy"); err != nil {
+				t.Fatalf("Error cloning role: %v\n", err)
+			}
+			if err := store.RenameRole(t.Context(), "east_mgr", "east_manager"); err != nil {
+				t.Fatalf("Error renaming role: %v\n", err)
+			}
+			for _, role := range []string{"east_deputy", "east_manager"} {
+				got, err := store.GetPolicy(t.Context(), role)
+				if err != nil {
+					t.Fatalf("Error getting policy: %v\n", err)
+				}
+				want := Policy{Role: role, Policy: east_mgr.Policy}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Policy mismatch: got %s, want %s\n", got.ToJson(), want.ToJson())
+				}
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if want := []string{"admin", "east_deputy", "east_manager"}; !reflect.DeepEqual(roles, want) {
+				t.Errorf("Roles mismatch: got %v, want %v\n", roles, want)
+			}
+
+			// The clone shares nothing with the original
+			if err := store.DeleteRole(t.Context(), "east_manager"); err != nil {
+				t.Fatalf("Error deleting role: %v\n", err)
+			}
+			if _, err := store.GetPolicy(t.Context(), "east_deputy"); err != nil {
+				t.Errorf("Error getting clone after deleting original: %v\n", err)
+			}
+
+			failures := map[string]struct {
+				fn       func(ctx context.Context, role, new_role string) error
+				role     string
+				new_role string
+				err      error
+			}{
+				"Rename missing role":     {store.RenameRole, "east_mgr", "west_mgr", ErrRoleNotFound},
+				"Rename to existing role": {store.RenameRole, "east_deputy", "admin", ErrRoleExists},
+				"Rename to itself":        {store.RenameRole, "admin", "admin", ErrRoleExists},
+				"Rename to invalid name":  {store.RenameRole, "admin", "-admin", ErrInvalidRoleName},
+				"Clone missing role":      {store.CloneRole, "east_mgr", "west_mgr", ErrRoleNotFound},
+				"Clone to existing role":  {store.CloneRole, "east_deputy", "admin", ErrRoleExists},
+				"Clone to invalid name":   {store.CloneRole, "admin", "admin role", ErrInvalidRoleName},
+			}
+			for name, test := range failures {
+				if err := test.fn(t.Context(), test.role, test.new_role); !errors.Is(err, test.err) {
+					t.Errorf("%s: expected %v, got %v\n", name, test.err, err)
+				}
+			}
+			roles, err = store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if want := []string{"admin", "east_deputy"}; !reflect.DeepEqual(roles, want) {
+				t.Errorf("Roles mismatch after failed changes: got %v, want %v\n", roles, want)
+			}
+		})
+	}
+}
+
+func TestStoresListColumns(t *testing.T) {
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			columns, err := store.ListColumns(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing columns of empty store: %v\n", err)
+			}
+			if len(columns) != 0 {
+				t.Errorf("Columns mismatch: got %v, want none\n", columns)
+			}
+			policy_set := PolicySet{Policies: []Policy{
+				{Role: "east_mgr", Policy: []PolicyItem{{Column: "State", Values: []string{"Maine"}}, {Column: "Region", Values: []string{"Eastern"}}}},
+				{Role: "buyer", Policy: []PolicyItem{{Column: "item_code", Values: []string{"__all__"}}}},
+			}}
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			if err := store.DeleteRole(t.Context(), "buyer"); err != nil {
+				t.Fatalf("Error deleting role: %v\n", err)
+			}
+			columns, err = store.ListColumns(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing columns: %v\n", err)
+			}
+			if want := []string{"Region", "State"}; !reflect.DeepEqual(columns, want) {
+				t.Errorf("Columns mismatch: got %v, want %v\n", columns, want)
+			}
+		})
+	}
+}
+
+func TestStoresKeepExceptionsAndDenials(t *testing.T) {
+	config_file := filepath.Join(t.TempDir(), "config.json")
+	config := `{"policies":[
+		{"role":"not_west","policy":[
+			{"column":"State","values":["__all__"],"except":["California","Texas"]},
+			{"column":"Region","values":["Eastern","Northern"]}
+		],"deny":[{"column":"Store","values":["12","7"]}]},
+		{"role":"not_west_ohio","extends":["not_west"],"policy":[],"deny":[{"column":"State","values":["Ohio"]}]}
+	]}`
+	if err := os.WriteFile(config_file, []byte(config), 0o644); err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	not_west := Policy{Role: "not_west", Policy: []PolicyItem{
+		{Column: "State", Values: []string{"__all__"}, Except: []string{"California", "Texas"}},
+		{Column: "Region", Values: []string{"Eastern", "Northern"}},
+	}, Deny: []PolicyItem{{Column: "Store", Values: []string{"12", "7"}}}}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := LoadStoreFromFile(t.Context(), store, config_file); err != nil {
+				t.Fatalf("Error loading config: %v\n", err)
+			}
+			if got, err := store.GetPolicy(t.Context(), "not_west"); err != nil || !reflect.DeepEqual(got, not_west) {
+				t.Errorf("Policy mismatch:\ngot  %+v, %v\nwant %+v\n", got, err, not_west)
+			}
+			if columns, _ := store.ListColumns(t.Context()); !reflect.DeepEqual(columns, []string{"Region", "State", "Store"}) {
+				t.Errorf("Columns mismatch: got %v\n", columns)
+			}
+
+			// Denials accumulate through extends
+			effective, err := EffectivePolicy(t.Context(), store, "not_west_ohio")
+			if err != nil {
+				t.Fatalf("Error getting effective policy: %v\n", err)
+			}
+			want_sql := `("State" IS NULL OR "State" NOT IN ('California', 'Texas')) AND "Region" IN ('Eastern', 'Northern')` +
+				` AND ("State" IS NULL OR "State" NOT IN ('Ohio')) AND ("Store" IS NULL OR "Store" NOT IN ('12', '7'))`
+			if got := effective.ToSql(); got != want_sql {
+				t.Errorf("SQL mismatch: got %s, want %s\n", got, want_sql)
+			}
+
+			if err := store.CloneRole(t.Context(), "not_west", "not_west_copy"); err != nil {
+				t.Fatalf("Error cloning role: %v\n", err)
+			}
+			want_clone := not_west
+			want_clone.Role = "not_west_copy"
+			if got, _ := store.GetPolicy(t.Context(), "not_west_copy"); !reflect.DeepEqual(got, want_clone) {
+				t.Errorf("Clone mismatch:\ngot  %+v\nwant %+v\n", got, want_clone)
+			}
+
+			// Granting an excepted value takes it out of the except list
+			diff, err := store.ApplyChanges(t.Context(), []PolicyChange{{Op: OpGrant, Role: "not_west", Column: "State", Values: []string{"Texas"}}})
+			if err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			if got := diff.Roles[0].Columns[0].ExceptRemoved; !reflect.DeepEqual(got, []string{"Texas"}) {
+				t.Errorf("Diff mismatch: got %v, want [Texas]\n", got)
+			}
+			got, _ := store.GetPolicy(t.Context(), "not_west")
+			if except := got.Policy[0].Except; !reflect.DeepEqual(except, []string{"California"}) {
+				t.Errorf("Except mismatch: got %v, want [California]\n", except)
+			}
+
+			// Syncing a role without its denials removes them
+			synced := not_west
+			synced.Deny = nil
+			if _, err := store.SyncPolicies(t.Context(), &PolicySet{Policies: []Policy{synced}}); err != nil {
+				t.Fatalf("Error syncing policies: %v\n", err)
+			}
+			if got, _ := store.GetPolicy(t.Context(), "not_west"); !reflect.DeepEqual(got, synced) {
+				t.Errorf("Synced policy mismatch:\ngot  %+v\nwant %+v\n", got, synced)
+			}
+		})
+	}
+}
+
+func TestStoresKeepMatches(t *testing.T) {
+	config_file := filepath.Join(t.TempDir(), "config.json")
+	config := `{"policies":[
+		{"role":"sku_reader","policy":[
+			{"column":"Sku","match":"prefix","values":["SKU-12","SKU-34"]},
+			{"column":"Store","match":"glob","values":["1?"]},
+			{"column":"State","match":"exact","values":["Ohio"]}
+		],"deny":[{"column":"Sku","match":"regex","values":["SKU-12\\d*9"]}]}
+	]}`
+	if err := os.WriteFile(config_file, []byte(config), 0o644); err != nil {
+		t.Fatalf("Error writing config: %v\n", err)
+	}
+	// Exact matches are left out
+	sku_reader := Policy{Role: "sku_reader", Policy: []PolicyItem{
+		{Column: "Sku", Match: MatchPrefix, Values: []string{"SKU-12", "SKU-34"}},
+		{Column: "Store", Match: MatchGlob, Values: []string{"1?"}},
+		{Column: "State", Values: []string{"Ohio"}},
+	}, Deny: []PolicyItem{{Column: "Sku", Match: MatchRegex, Values: []string{`SKU-12\d*9`}}}}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := LoadStoreFromFile(t.Context(), store, config_file); err != nil {
+				t.Fatalf("Error loading config: %v\n", err)
+			}
+			if got, err := store.GetPolicy(t.Context(), "sku_reader"); err != nil || !reflect.DeepEqual(got, sku_reader) {
+				t.Errorf("Policy mismatch:\ngot  %+v, %v\nwant %+v\n", got, err, sku_reader)
+			}
+			if err := store.CloneRole(t.Context(), "sku_reader", "sku_copy"); err != nil {
+				t.Fatalf("Error cloning role: %v\n", err)
+			}
+			want_clone := sku_reader
+			want_clone.Role = "sku_copy"
+			if got, _ := store.GetPolicy(t.Context(), "sku_copy"); !reflect.DeepEqual(got, want_clone) {
+				t.Errorf("Clone mismatch:\ngot  %+v\nwant %+v\n", got, want_clone)
+			}
+
+			// A value means something else under another match, so changing
+			// the match replaces every value
+			if _, err := store.ApplyChanges(t.Context(), []PolicyChange{
+				{Op: OpGrant, Role: "sku_reader", Column: "State", Match: MatchGlob, Values: []string{"O*"}},
+			}); err == nil {
+				t.Errorf("Expected an error granting a glob to a column of exact values\n")
+			}
+			diff, err := store.ApplyChanges(t.Context(), []PolicyChange{
+				{Op: OpRevoke, Role: "sku_reader", Column: "State", Values: []string{"__all__"}},
+				{Op: OpGrant, Role: "sku_reader", Column: "State", Match: MatchPrefix, Values: []string{"Ohio", "Ma"}},
+			})
+			if err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			want_diff := ColumnDiff{Column: "State", Change: Changed, Match: &MatchDiff{Old: "", New: MatchPrefix}, Added: []string{"Ohio", "Ma"}, Removed: []string{"Ohio"}}
+			if got := diff.Roles[0].Columns[0]; !reflect.DeepEqual(got, want_diff) {
+				t.Errorf("Diff mismatch:\ngot  %+v\nwant %+v\n", got, want_diff)
+			}
+			synced := copyPolicy(sku_reader)
+			synced.Policy[2] = PolicyItem{Column: "State", Match: MatchPrefix, Values: []string{"Ohio", "Ma"}}
+			if got, _ := store.GetPolicy(t.Context(), "sku_reader"); !reflect.DeepEqual(got, synced) {
+				t.Errorf("Policy mismatch:\ngot  %+v\nwant %+v\n", got, synced)
+			}
+
+			// Syncing back to exact values and without the denial
+			synced = copyPolicy(sku_reader)
+			synced.Deny = nil
+			if _, err := store.SyncPolicies(t.Context(), &PolicySet{Policies: []Policy{synced}}); err != nil {
+				t.Fatalf("Error syncing policies: %v\n", err)
+			}
+			if got, _ := store.GetPolicy(t.Context(), "sku_reader"); !reflect.DeepEqual(got, synced) {
+				t.Errorf("Synced policy mismatch:\ngot  %+v\nwant %+v\n", got, synced)
+			}
+		})
+	}
+}
+
+func TestStoresGetAllPolicies(t *testing.T) {
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if err := store.GetAllPolicies(t.Context(), func(p Policy) error {
+				t.Errorf("Empty store returned a policy: %s\n", p.ToJson())
+				return nil
+			}); err != nil {
+				t.Fatalf("Error getting all policies of empty store: %v\n", err)
+			}
+			if _, err := LoadStoreFromFile(t.Context(), store, "testdata/valid_policy_set.json"); err != nil {
+				t.Fatalf("Error loading store from file: %v\n", err)
+			}
+			var got []Policy
+			if err := store.GetAllPolicies(t.Context(), func(p Policy) error {
+				got = append(got, p)
+				return nil
+			}); err != nil {
+				t.Fatalf("Error getting all policies: %v\n", err)
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if len(got) != len(roles) {
+				t.Fatalf("Policy count mismatch: got %d, want %d\n", len(got), len(roles))
+			}
+			for i, role := range roles {
+				want, err := store.GetPolicy(t.Context(), role)
+				if err != nil {
+					t.Fatalf("Error getting policy: %v\n", err)
+				}
+				if !reflect.DeepEqual(got[i], want) {
+					t.Errorf("Policy mismatch: got %s, want %s\n", got[i].ToJson(), want.ToJson())
+				}
+			}
+		})
+	}
+}
+
+func TestStoresReturnCopies(t *testing.T) {
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			policy_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"one"}}}}}}
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			policy_set.Policies[0].Policy[0].Values[0] = "changed"
+			policy, err := store.GetPolicy(t.Context(), "admin")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			policy.Policy[0].Values[0] = "changed again"
+			policy, err = store.GetPolicy(t.Context(), "admin")
+			if err != nil {
+				t.Fatalf("Error getting policy: %v\n", err)
+			}
+			if policy.Policy[0].Values[0] != "one" {
+				t.Errorf("Store shares memory with its callers: got %s\n", policy.Policy[0].Values[0])
+			}
+		})
+	}
+}
+
+func TestParseStoreSpecWorks(t *testing.T) {
+	tests := map[string]struct {
+		backend  string
+		location string
+	}{
+		"sqlite:policies.db": {"sqlite", "policies.db"},
+		"sqlite:":            {"sqlite", ""},
+		"mem:":               {"mem", ""},
+		"policies.db":        {"sqlite", "policies.db"},
+		"dir/policies.db":    {"sqlite", "dir/policies.db"},
+	}
+	for spec, test := range tests {
+		t.Run(spec, func(t *testing.T) {
+			backend, location := ParseStoreSpec(spec)
+			if backend != test.backend || location != test.location {
+				t.Errorf("Spec mismatch: got %s %s, want %s %s\n", backend, location, test.backend, test.location)
+			}
+		})
+	}
+
+	for _, spec := range []string{"sqlite:", "mem:extra", "bogus:policies.db"} {
+		t.Run("Invalid "+spec, func(t *testing.T) {
+			if _, err := OpenStore(t.Context(), spec); err == nil {
+				t.Errorf("Expected error opening store %s, but got none\n", spec)
+			}
+		})
+	}
+}
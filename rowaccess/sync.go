@@ -0,0 +1,84 @@
+package rowaccess
+
+import (
+	"context"
+	"fmt"
+)
+
+// What a sync wrote to the store, and the roles it deleted
+type SyncStats struct {
+	LoadStats
+	// The roles that were in the store but not in the policy set, in order
+	Deleted []string
+}
+
+// Return the roles a sync with the policy set would delete from the store:
+// every role in the store that the set does not define, in order
+func RolesToPrune(ctx context.Context, store PolicyStore, policy_set *PolicySet) ([]string, error) {
+	roles, err := store.ListRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rolesMissingFrom(roles, policy_set), nil
+}
+
+// Return the roles that the policy set does not define, keeping their order
+func rolesMissingFrom(roles []string, policy_set *PolicySet) []string {
+	defined := map[string]bool{}
+	for _, role_policy := range policy_set.Policies {
+		defined[role_policy.Role] = true
+	}
+	missing := []string{}
+	for _, role := range roles {
+		if !defined[role] {
+			missing = append(missing, role)
+		}
+	}
+	return missing
+}
+
+// Return the policy sets as one set, or an error naming the two sets that
+// define the same role or list the same user
+//
+// The names identify each set in errors, e.g. the files they were read from.
+func MergePolicySets(names []string, policy_sets []*PolicySet) (*PolicySet, error) {
+	merged := &PolicySet{Policies: []Policy{}}
+	defined_in := map[string]int{}
+	for i, policy_set := range policy_sets {
+		for _, role_policy := range policy_set.Policies {
+			if first, ok := defined_in[role_policy.Role]; ok && first != i {
+				return nil, fmt.Errorf("role %q is defined in both %s and %s", role_policy.Role, names[first], names[i])
+			}
+			defined_in[role_policy.Role] = i
+			merged.Policies = append(merged.Policies, role_policy)
+		}
+	}
+	listed_in := map[string]int{}
+	for i, policy_set := range policy_sets {
+		for _, user := range policy_set.Users {
+			if first, ok := listed_in[user.Name]; ok && first != i {
+				return nil, fmt.Errorf("user %q is listed in both %s and %s", user.Name, names[first], names[i])
+			}
+			listed_in[user.Name] = i
+			merged.Users = append(merged.Users, user)
+		}
+	}
+	return merged, nil
+}
+
+// Read and check each config file, returning them merged into one policy
+// set, as a sync with all of them needs
+func LoadPolicySetFiles(fnames []string) (*PolicySet, error) {
+	policy_sets := make([]*PolicySet, len(fnames))
+	for i, fname := range fnames {
+		policy_set, err := LoadRolePolicies(fname)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+		if err := CheckPolicySet(policy_set); err != nil {
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+		policy_sets[i] = policy_set
+	}
+	return MergePolicySets(fnames, policy_sets)
+}
@@ -0,0 +1,123 @@
+package rowaccess
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStoresSyncPolicies(t *testing.T) {
+	initial_set := PolicySet{Policies: []Policy{
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+		{Role: "east_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western"}}}},
+	}}
+	sync_set := PolicySet{Policies: []Policy{
+		{Role: "west_mgr", Policy: []PolicyItem{{Column: "Region", Values: []string{"Western", "Central"}}}},
+		{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{"__all__"}}}},
+	}}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &initial_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			to_prune, err := RolesToPrune(t.Context(), store, &sync_set)
+			if err != nil {
+				t.Fatalf("Error finding roles to prune: %v\n", err)
+			}
+			if want := []string{"east_mgr"}; !reflect.DeepEqual(to_prune, want) {
+				t.Errorf("Roles to prune mismatch: got %v, want %v\n", to_prune, want)
+			}
+
+			stats, err := store.SyncPolicies(t.Context(), &sync_set)
+			if err != nil {
+				t.Fatalf("Error syncing policies: %v\n", err)
+			}
+			if !reflect.DeepEqual(stats.Deleted, to_prune) || stats.Roles != 2 {
+				t.Errorf("Stats mismatch: got %+v\n", stats)
+			}
+			exported, err := ExportPolicySet(t.Context(), store, SortLoaded)
+			if err != nil {
+				t.Fatalf("Error exporting policies: %v\n", err)
+			}
+			want := []Policy{sync_set.Policies[1], sync_set.Policies[0]}
+			if !reflect.DeepEqual(exported.Policies, want) {
+				t.Errorf("Policies mismatch after sync: got %+v, want %+v\n", exported.Policies, want)
+			}
+
+			// A set with problems changes nothing
+			failing_set := PolicySet{Policies: []Policy{{Role: "admin", Policy: []PolicyItem{{Column: "Region", Values: []string{}}}}}}
+			var config_errors ConfigErrors
+			if _, err := store.SyncPolicies(t.Context(), &failing_set); !errors.As(err, &config_errors) {
+				t.Errorf("Expected ConfigErrors syncing invalid set, got %v\n", err)
+			}
+			roles, err := store.ListRoles(t.Context())
+			if err != nil {
+				t.Fatalf("Error listing roles: %v\n", err)
+			}
+			if want := []string{"admin", "west_mgr"}; !reflect.DeepEqual(roles, want) {
+				t.Errorf("Roles mismatch after failed sync: got %v, want %v\n", roles, want)
+			}
+
+			// Syncing an empty set empties the store
+			stats, err = store.SyncPolicies(t.Context(), &PolicySet{})
+			if err != nil {
+				t.Fatalf("Error syncing empty set: %v\n", err)
+			}
+			if want := []string{"admin", "west_mgr"}; !reflect.DeepEqual(stats.Deleted, want) {
+				t.Errorf("Deleted mismatch: got %v, want %v\n", stats.Deleted, want)
+			}
+		})
+	}
+}
+
+func TestLoadPolicySetFilesMergesFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(fname, config string) string {
+		t.Helper()
+		fname = filepath.Join(dir, fname)
+		if err := os.WriteFile(fname, []byte(config), 0o644); err != nil {
+			t.Fatalf("Error writing config: %v\n", err)
+		}
+		return fname
+	}
+	east := write("east.json", `{"policies":[{"role":"east_mgr","policy":[{"column":"Region","values":["Eastern"]}]}]}`)
+	west := write("west.json", `{"policies":[{"role":"west_mgr","policy":[{"column":"Region","values":["Western"]}]}]}`)
+	east_again := write("east_again.json", `{"policies":[{"role":"east_mgr","policy":[]}]}`)
+	invalid := write("invalid.json", `{"policies":[{"role":"admin","policy":[{"column":"Region","values":[]}]}]}`)
+	users := write("users.csv", "user,role\nalice,east_mgr\n")
+	users_again := write("users_again.csv", "user,role\nalice,west_mgr\n")
+
+	policy_set, err := LoadPolicySetFiles([]string{east, west, users})
+	if err != nil {
+		t.Fatalf("Error loading config files: %v\n", err)
+	}
+	if len(policy_set.Policies) != 2 || policy_set.Policies[0].Role != "east_mgr" || policy_set.Policies[1].Role != "west_mgr" {
+		t.Errorf("Policies mismatch: got %+v\n", policy_set.Policies)
+	}
+	if want := []User{{Name: "alice", Roles: []string{"east_mgr"}}}; !reflect.DeepEqual(policy_set.Users, want) {
+		t.Errorf("Users mismatch: got %+v, want %+v\n", policy_set.Users, want)
+	}
+
+	failures := map[string]struct {
+		fnames []string
+		err    string
+	}{
+		"Role in two files": {[]string{east, west, east_again}, `role "east_mgr" is defined in both ` + east + " and " + east_again},
+		"User in two files": {[]string{users, users_again}, `user "alice" is listed in both ` + users + " and " + users_again},
+		"Problem in a file": {[]string{east, invalid}, invalid + ": /policies/0/policy/0/values"},
+	}
+	for name, test := range failures {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadPolicySetFiles(test.fnames)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Error mismatch: got %v, want %s\n", err, test.err)
+			}
+		})
+	}
+}
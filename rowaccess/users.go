@@ -0,0 +1,111 @@
+package rowaccess
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Returned when a user is not in the store
+var ErrUserNotFound = errors.New("user does not exist")
+
+// A user and the roles they are members of, in order
+type User struct {
+	Name  string   `json:"user"`
+	Roles []string `json:"roles"`
+}
+
+func userNotFound(user string) error {
+	return fmt.Errorf("%w: %s", ErrUserNotFound, user)
+}
+
+// Return true if the user name is valid, false otherwise
+//
+// User names are freer than role names, so that they can be logins or email
+// addresses, but must be 1 to 255 characters long with no leading or
+// trailing space and no control characters.
+func IsValidUserName(user string) bool {
+	return user != "" && len(user) <= 255 && strings.TrimSpace(user) == user && !strings.ContainsFunc(user, unicode.IsControl)
+}
+
+// Return true if the file is a CSV file of users, by its extension
+func isCsvFile(fname string) bool {
+	return strings.EqualFold(filepath.Ext(fname), ".csv")
+}
+
+// Read users from CSV with a user,role header and one row per membership
+//
+// A user's rows need not be together; their roles are kept in the order of
+// the rows. A row with an empty role lists a user with no roles.
+func ReadUsersCsv(r io.Reader) ([]User, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing user,role header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(header[0], "user") || !strings.EqualFold(header[1], "role") {
+		return nil, fmt.Errorf("line 1: expected a user,role header, found %s", strings.Join(header, ","))
+	}
+
+	users := []User{}
+	index := map[string]int{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[record[0]]
+		if !ok {
+			i = len(users)
+			index[record[0]] = i
+			users = append(users, User{Name: record[0], Roles: []string{}})
+		}
+		if record[1] != "" {
+			users[i].Roles = append(users[i].Roles, record[1])
+		}
+	}
+}
+
+// Read users from a CSV file with ReadUsersCsv
+func ReadUsersCsvFile(fname string) ([]User, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadUsersCsv(f)
+}
+
+// Return the policy the user has through all of their roles, combined in
+// the mode as CombineRoles does
+//
+// A user with no roles has no columns. It is an error if the user or one of
+// their roles does not exist.
+func GetUserPolicy(ctx context.Context, store PolicyStore, user string, mode CombineMode) (CombinedPolicy, error) {
+	u, err := store.GetUser(ctx, user)
+	if err != nil {
+		return CombinedPolicy{}, err
+	}
+	combined, err := combineRoles(ctx, store, u.Roles, mode, func(role string, err error) error {
+		return fmt.Errorf("user %s is a member of %s: %w", user, role, err)
+	})
+	if err != nil {
+		return CombinedPolicy{}, err
+	}
+	combined.User = u.Name
+	return combined, nil
+}
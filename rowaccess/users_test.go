@@ -0,0 +1,224 @@
+package rowaccess
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadUsersCsv(t *testing.T) {
+	users, err := ReadUsersCsv(strings.NewReader("user,role\nalice,east_mgr\nbob,\nalice, ohio_reader\ncarol,east_mgr\n"))
+	if err != nil {
+		t.Fatalf("Error reading users: %v\n", err)
+	}
+	want := []User{
+		{Name: "alice", Roles: []string{"east_mgr", "ohio_reader"}},
+		{Name: "bob", Roles: []string{}},
+		{Name: "carol", Roles: []string{"east_mgr"}},
+	}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("Users mismatch:\ngot  %+v\nwant %+v\n", users, want)
+	}
+
+	bad := map[string]string{
+		"Empty":        "",
+		"No header":    "alice,east_mgr\n",
+		"Extra fields": "user,role\nalice,east_mgr,admin\n",
+	}
+	for name, input := range bad {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadUsersCsv(strings.NewReader(input)); err == nil {
+				t.Errorf("Expected an error reading %q\n", input)
+			}
+		})
+	}
+}
+
+func TestStoresLoadUsers(t *testing.T) {
+	dir := t.TempDir()
+	config_file := filepath.Join(dir, "config.json")
+	config := `{"policies":[
+		{"role":"east","policy":[{"column":"Region","values":["Eastern"]},{"column":"State","values":["__all__"]}]},
+		{"role":"ohio","policy":[{"column":"State","values":["Ohio","Maine"]}]}
+	],"users":[
+		{"user":"alice","roles":["east","ohio"]},
+		{"user":"bob","roles":[]}
+	]}`
+	users_file := filepath.Join(dir, "users.csv")
+	users_csv := "user,role\nbob,ohio\ncarol,retired\n"
+	for fname, data := range map[string]string{config_file: config, users_file: users_csv} {
+		if err := os.WriteFile(fname, []byte(data), 0o644); err != nil {
+			t.Fatalf("Error writing %s: %v\n", fname, err)
+		}
+	}
+
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			stats, err := LoadStoreFromFile(t.Context(), store, config_file)
+			if err != nil {
+				t.Fatalf("Error loading config: %v\n", err)
+			}
+			if stats.Users != 2 {
+				t.Errorf("Users mismatch: got %d, want 2\n", stats.Users)
+			}
+			if _, err := LoadStoreFromFile(t.Context(), store, users_file); err != nil {
+				t.Fatalf("Error loading users: %v\n", err)
+			}
+			if users, _ := store.ListUsers(t.Context()); !reflect.DeepEqual(users, []string{"alice", "bob", "carol"}) {
+				t.Errorf("Users mismatch: got %v\n", users)
+			}
+			// The CSV replaced bob's memberships
+			if user, _ := store.GetUser(t.Context(), "bob"); !reflect.DeepEqual(user, User{Name: "bob", Roles: []string{"ohio"}}) {
+				t.Errorf("User mismatch: got %+v\n", user)
+			}
+			if _, err := store.GetUser(t.Context(), "dave"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("Expected ErrUserNotFound, got %v\n", err)
+			}
+
+			user_policy, err := GetUserPolicy(t.Context(), store, "alice", "")
+			if err != nil {
+				t.Fatalf("Error getting user policy: %v\n", err)
+			}
+			want := CombinedPolicy{User: "alice", Roles: []string{"east", "ohio"}, Mode: CombineIntersection, Policy: []SourcedItem{
+				{Column: "Region", Values: []SourcedValue{{"Eastern", []string{"east"}}}},
+				{Column: "State", Values: []SourcedValue{{"Ohio", []string{"ohio"}}, {"Maine", []string{"ohio"}}}},
+			}}
+			if !reflect.DeepEqual(user_policy, want) {
+				t.Errorf("User policy mismatch:\ngot  %+v\nwant %+v\n", user_policy, want)
+			}
+			if _, err := GetUserPolicy(t.Context(), store, "carol", ""); !errors.Is(err, ErrRoleNotFound) {
+				t.Errorf("Expected ErrRoleNotFound for a missing role, got %v\n", err)
+			}
+
+			// Renaming a role keeps its members, and syncing keeps users but
+			// not their memberships in the pruned east
+			if err := store.RenameRole(t.Context(), "ohio", "ohio_reader"); err != nil {
+				t.Fatalf("Error renaming role: %v\n", err)
+			}
+			if _, err := store.SyncPolicies(t.Context(), &PolicySet{Policies: []Policy{
+				{Role: "ohio_reader", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio"}}}},
+			}}); err != nil {
+				t.Fatalf("Error syncing policies: %v\n", err)
+			}
+			if user, _ := store.GetUser(t.Context(), "alice"); !reflect.DeepEqual(user.Roles, []string{"ohio_reader"}) {
+				t.Errorf("Roles mismatch: got %v\n", user.Roles)
+			}
+		})
+	}
+}
+
+func TestStoresRemoveMembersOfDeletedRoles(t *testing.T) {
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "east", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+		{Role: "ohio", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio"}}}},
+		{Role: "maine", Policy: []PolicyItem{{Column: "State", Values: []string{"Maine"}}}},
+	}, Users: []User{
+		{Name: "alice", Roles: []string{"east", "ohio", "maine"}},
+		{Name: "carol", Roles: []string{"ohio"}},
+		{Name: "dave", Roles: []string{"retired"}},
+	}}
+	sync_set := PolicySet{Policies: []Policy{
+		{Role: "east", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+	}, Users: []User{
+		{Name: "erin", Roles: []string{"east", "western"}},
+	}}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			if err := store.DeleteRole(t.Context(), "ohio"); err != nil {
+				t.Fatalf("Error deleting role: %v\n", err)
+			}
+			// A membership in a role not yet loaded is kept
+			want := []User{
+				{Name: "alice", Roles: []string{"east", "maine"}},
+				{Name: "carol", Roles: []string{}},
+				{Name: "dave", Roles: []string{"retired"}},
+			}
+			if users, err := ExportUsers(t.Context(), store, SortLoaded); err != nil || !reflect.DeepEqual(users, want) {
+				t.Errorf("Users mismatch after delete: got %+v, want %+v (%v)\n", users, want, err)
+			}
+			if _, err := GetUserPolicy(t.Context(), store, "carol", CombineIntersection); err != nil {
+				t.Errorf("Error getting policy of a member of a deleted role: %v\n", err)
+			}
+
+			if _, err := store.SyncPolicies(t.Context(), &sync_set); err != nil {
+				t.Fatalf("Error syncing policies: %v\n", err)
+			}
+			want = []User{
+				{Name: "alice", Roles: []string{"east"}},
+				{Name: "carol", Roles: []string{}},
+				{Name: "dave", Roles: []string{}},
+				{Name: "erin", Roles: []string{"east"}},
+			}
+			if users, err := ExportUsers(t.Context(), store, SortLoaded); err != nil || !reflect.DeepEqual(users, want) {
+				t.Errorf("Users mismatch after sync: got %+v, want %+v (%v)\n", users, want, err)
+			}
+		})
+	}
+}
+
+func TestStoresRemoveMembersOfDroppedRoles(t *testing.T) {
+	policy_set := PolicySet{Policies: []Policy{
+		{Role: "role_a", Policy: []PolicyItem{{Column: "Region", Values: []string{"Eastern"}}}},
+		{Role: "role_b", Policy: []PolicyItem{{Column: "State", Values: []string{"Ohio"}}}},
+		{Role: "role_c", Policy: []PolicyItem{{Column: "State", Values: []string{"Maine"}}}},
+	}, Users: []User{
+		{Name: "user_u", Roles: []string{"role_a", "role_b"}},
+		{Name: "user_v", Roles: []string{"role_c", "role_a"}},
+		{Name: "user_w", Roles: []string{"role_b"}},
+	}}
+	for name, open := range getStoreFactories() {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			if _, err := store.LoadPolicies(t.Context(), &policy_set); err != nil {
+				t.Fatalf("Error loading policies: %v\n", err)
+			}
+			// role_b is dropped and created again, so it keeps its members
+			changes := []PolicyChange{
+				{Op: OpDrop, Role: "role_a"},
+				{Op: OpDrop, Role: "role_c"},
+				{Op: OpDrop, Role: "role_b"},
+				{Op: OpCreate, Role: "role_b"},
+			}
+			plan, err := PlanChanges(t.Context(), store, changes)
+			if err != nil {
+				t.Fatalf("Error planning changes: %v\n", err)
+			}
+			diff, err := store.ApplyChanges(t.Context(), changes)
+			if err != nil {
+				t.Fatalf("Error applying changes: %v\n", err)
+			}
+			if !reflect.DeepEqual(plan, diff) {
+				t.Errorf("Plan mismatch:\ngot  %+v\nwant %+v\n", plan, diff)
+			}
+			want_diff := []UserDiff{
+				{User: "user_u", Change: Changed, Added: []string{}, Removed: []string{"role_a"}},
+				{User: "user_v", Change: Changed, Added: []string{}, Removed: []string{"role_a", "role_c"}},
+			}
+			if !reflect.DeepEqual(diff.Users, want_diff) {
+				t.Errorf("User diff mismatch:\ngot  %+v\nwant %+v\n", diff.Users, want_diff)
+			}
+			want := []User{
+				{Name: "user_u", Roles: []string{"role_b"}},
+				{Name: "user_v", Roles: []string{}},
+				{Name: "user_w", Roles: []string{"role_b"}},
+			}
+			if users, err := ExportUsers(t.Context(), store, SortLoaded); err != nil || !reflect.DeepEqual(users, want) {
+				t.Errorf("Users mismatch: got %+v, want %+v (%v)\n", users, want, err)
+			}
+			if _, err := GetUserPolicy(t.Context(), store, "user_u", CombineIntersection); err != nil {
+				t.Errorf("Error getting policy of a member of a dropped role: %v\n", err)
+			}
+		})
+	}
+}